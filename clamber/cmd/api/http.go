@@ -3,16 +3,29 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+	"github.com/stevenayers/clamber/pkg/cache"
 	"github.com/stevenayers/clamber/pkg/config"
+	"github.com/stevenayers/clamber/pkg/crawl"
 	"github.com/stevenayers/clamber/pkg/database/relationship"
 	"github.com/stevenayers/clamber/pkg/logging"
 	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stevenayers/clamber/pkg/progress"
 	"github.com/stevenayers/clamber/pkg/query"
 	"github.com/stevenayers/clamber/pkg/queue"
 	"github.com/stevenayers/clamber/pkg/route"
+	"golang.org/x/net/websocket"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Routes contains defined routes data
@@ -27,68 +40,955 @@ var Routes = []route.Route{
 			"depth", "{depth}",
 		},
 	},
+	{
+		Name:        "InitiateSeeds",
+		Method:      "POST",
+		Pattern:     "/search",
+		HandlerFunc: SearchHandler,
+	},
+	{
+		Name:        "Delete",
+		Method:      "DELETE",
+		Pattern:     "/crawl",
+		HandlerFunc: DeleteHandler,
+		Params: []string{
+			"url", "{url}",
+			"depth", "{depth}",
+		},
+		AuthenticatedIfEnabled: true,
+	},
+	{
+		Name:        "Node",
+		Method:      "GET",
+		Pattern:     "/node",
+		HandlerFunc: NodeHandler,
+		Params: []string{
+			"url", "{url}",
+			"depth", "{depth}",
+		},
+	},
+	{
+		Name:        "Children",
+		Method:      "GET",
+		Pattern:     "/children",
+		HandlerFunc: ChildrenHandler,
+		Params: []string{
+			"url", "{url}",
+		},
+	},
+	{
+		Name:        "Export",
+		Method:      "GET",
+		Pattern:     "/export",
+		HandlerFunc: ExportHandler,
+		Params: []string{
+			"url", "{url}",
+			"depth", "{depth}",
+		},
+	},
+	{
+		Name:        "Edges",
+		Method:      "GET",
+		Pattern:     "/edges",
+		HandlerFunc: EdgesHandler,
+		Params: []string{
+			"from", "{from}",
+			"to", "{to}",
+		},
+	},
+	{
+		Name:        "Diff",
+		Method:      "GET",
+		Pattern:     "/diff",
+		HandlerFunc: DiffHandler,
+		Params: []string{
+			"url", "{url}",
+			"depth", "{depth}",
+			"since", "{since}",
+		},
+	},
+	{
+		Name:        "Roots",
+		Method:      "GET",
+		Pattern:     "/roots",
+		HandlerFunc: RootsHandler,
+	},
+	{
+		Name:        "Stats",
+		Method:      "GET",
+		Pattern:     "/stats",
+		HandlerFunc: StatsHandler,
+	},
+	{
+		Name:        "Health",
+		Method:      "GET",
+		Pattern:     "/healthz",
+		HandlerFunc: HealthHandler,
+	},
+	{
+		Name:        "Ready",
+		Method:      "GET",
+		Pattern:     "/ready",
+		HandlerFunc: ReadyHandler,
+	},
+	{
+		Name:        "Progress",
+		Method:      "GET",
+		Pattern:     "/progress/{id}",
+		HandlerFunc: ProgressHandler,
+	},
+	{
+		Name:        "CrawlSocket",
+		Method:      "GET",
+		Pattern:     "/ws/crawl",
+		HandlerFunc: CrawlSocketHandler,
+	},
+	{
+		Name:          "AdminSchema",
+		Method:        "POST",
+		Pattern:       "/admin/schema",
+		HandlerFunc:   AdminSchemaHandler,
+		Authenticated: true,
+	},
+	{
+		Name:          "AdminReset",
+		Method:        "POST",
+		Pattern:       "/admin/reset",
+		HandlerFunc:   AdminResetHandler,
+		Authenticated: true,
+	},
 }
 
+const (
+	// ExportGraphML exports a graph from /export as GraphML
+	ExportGraphML = "graphml"
+	// ExportDot exports a graph from /export as Graphviz DOT
+	ExportDot = "dot"
+)
+
+// ResetConfirmation must be sent as confirm in the body of /admin/reset, so every page isn't deleted by mistake
+const ResetConfirmation = "delete all pages"
+
+// DefaultRootsLimit is the number of pages /roots returns when no limit is given
+const DefaultRootsLimit = 100
+
+// QueueDepthInterval is the minimum time between checks of the queue depth reported in progress events
+var QueueDepthInterval = time.Second
+
+type (
+	// DeleteResult contains the deleted URL, depth and number of pages removed
+	DeleteResult struct {
+		Url     string `json:"url"`
+		Depth   int    `json:"depth"`
+		Deleted int    `json:"deleted"`
+	}
+
+	// StartMessage is the first message a client sends on /ws/crawl, naming the crawl to stream
+	StartMessage struct {
+		Url   string `json:"url"`
+		Depth int    `json:"depth"`
+	}
+
+	// SocketMessage is sent on /ws/crawl for each page ("node") and link ("edge") found by a crawl, with the stats of
+	// the crawl once it has been streamed ("stats"), or with the reason the crawl could not be streamed ("error")
+	SocketMessage struct {
+		Type string `json:"type"`
+		*page.Page
+		*page.Edge
+		Stats   *crawl.Stats `json:"stats,omitempty"`
+		Message string       `json:"message,omitempty"`
+	}
+
+	// graphStream sends the pages and links of a crawl's results which haven't been sent on the connection yet
+	graphStream struct {
+		ws        *websocket.Conn
+		sentNodes map[string]struct{}
+		sentEdges map[page.Edge]struct{}
+		cancel    context.CancelFunc
+	}
+
+	// ResetRequest is the body of /admin/reset
+	ResetRequest struct {
+		Confirm string `json:"confirm"`
+	}
+
+	// AdminResult reports that an admin action succeeded
+	AdminResult struct {
+		Action string `json:"action"`
+		Status string `json:"status"`
+	}
+
+	// HealthResult reports the status of the api from /healthz and /ready
+	HealthResult struct {
+		Status string `json:"status"`
+	}
+
+	// Readiness records whether the api is ready to serve requests. It is safe for concurrent use.
+	Readiness struct {
+		ready int32
+	}
+
+	// EdgeResult reports whether the page at From links to the page at To
+	EdgeResult struct {
+		From   string `json:"from"`
+		To     string `json:"to"`
+		Exists bool   `json:"exists"`
+	}
+
+	// DiffResult contains the pages and links added to and removed from the subtree beneath Url down to Depth since the
+	// unix time Since
+	DiffResult struct {
+		Url   string `json:"url"`
+		Depth int    `json:"depth"`
+		Since int64  `json:"since"`
+		*page.GraphDiff
+	}
+
+	// ChildrenResult contains the pages the page stored for Url links to directly, without their own links
+	ChildrenResult struct {
+		Url      string       `json:"url"`
+		Children []*page.Page `json:"children"`
+	}
+
+	// RootsResult contains up to Limit of the stored pages which no stored page links to
+	RootsResult struct {
+		Limit int          `json:"limit"`
+		Roots []*page.Page `json:"roots"`
+	}
+
+	// StatsResult contains the number of pages and links stored in the graph, and the dgraph server version
+	StatsResult struct {
+		Nodes   int    `json:"nodes"`
+		Edges   int    `json:"edges"`
+		Version string `json:"version"`
+	}
+)
+
 // SearchHandler function handles /search endpoint. Initiates a database connection, tries to find the url in the database with the
-// required depth, and if it doesn't exist, initiate a crawl.
+// required depth, and if it doesn't exist, initiate a crawl. When url is given more than once, one crawl is seeded from
+// every url and the response is always 202 Accepted with the seeds, as the results of each seed are found with their
+// own /search. When sink is given, a crawl is always started with its pages written to that result sink, and the
+// response is 202 Accepted. Found results include the stats of the latest crawl from url, which crawlers store in the
+// graph as they count them. Found results can be requested as XML or a CSV edge list with the Accept header, and carry
+// cache headers so a client which already has them gets 304 Not Modified. A search of depth 0 crawls and returns only
+// the page at url, without its links. With crawlId, only the pages stored by the crawl of that id are found, bypassing
+// the cache, and a crawl started by the search is given that id, so several crawls can share one graph.
 func SearchHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "cloudformation/json; charset=UTF-8")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	requestUid := r.Header.Get("Clamber-Request-ID")
 	statusCode := http.StatusOK
 	q, err := query.New(r)
 	if err != nil {
-		statusCode = http.StatusBadRequest
-		w.WriteHeader(statusCode)
+		var invalid *query.ValidationError
+		if errors.As(err, &invalid) {
+			route.WriteFieldErrors(w, http.StatusBadRequest, "invalid request body", invalid.Fields)
+		} else {
+			route.WriteError(w, http.StatusBadRequest, err.Error())
+		}
 		_ = level.Error(logging.Logger).Log("context", "requestUid", requestUid, "msg", err.Error())
 		return
 	}
-	store := relationship.Store{}
+	store := relationship.NewStore()
 	store.Connect()
 	var result *page.Page
-	if q.Depth >= 0 {
+	var cached bool
+	if q.Depth >= 0 && len(q.Seeds) == 0 && q.Sink == "" && q.CrawlId == "" && !q.NoCache {
+		result = cache.DefaultCache.Get(q.Url, q.Depth)
+		cached = result != nil
+	}
+	if result == nil && q.Depth >= 0 && len(q.Seeds) == 0 && q.Sink == "" {
 		ctx := context.Background()
-		result, err = store.FindNode(&ctx, q.Url, q.Depth)
-		if err != nil {
-			if !strings.Contains(err.Error(), "Depth does not match dgraph result.") {
-				statusCode = http.StatusServiceUnavailable
-				w.WriteHeader(statusCode)
-				_ = level.Error(logging.Logger).Log("context", "requestUid", requestUid, "msg", err.Error())
-				return
-			}
+		result, err = store.FindNode(&ctx, q.Url, q.Depth, q.CrawlId)
+		if err != nil && !errors.Is(err, relationship.ErrDepthMismatch) {
+			route.WriteError(w, databaseStatus(err), "failed to query database")
+			_ = level.Error(logging.Logger).Log("context", "requestUid", requestUid, "msg", err.Error())
+			return
 		}
 	}
 	if result == nil {
 		qu := queue.NewQueue()
-		startPage := &page.Page{
-			Url:      q.Url,
+		seeds := q.Seeds
+		if len(seeds) == 0 {
+			seeds = []string{q.Url}
+		}
+		crawler := crawl.Crawler{Frontier: qu}
+		var startPages []*page.Page
+		startPages, err = crawler.Seed(r.Context(), seeds, crawl.SeedOptions{
 			Depth:    q.DisplayDepth,
-			StartUrl: q.Url,
+			Deadline: q.Deadline(),
+			Login:    q.Login,
+			Sink:     q.Sink,
+			CrawlId:  q.CrawlId,
+		})
+		if err != nil {
+			route.WriteError(w, http.StatusBadRequest, err.Error())
+			_ = level.Error(logging.Logger).Log("context", "seeding crawl", "requestUid", requestUid, "msg", err.Error())
+			return
+		}
+		if len(q.Seeds) > 0 || q.Sink != "" {
+			if len(q.Seeds) > 0 {
+				q.Seeds = nil
+				for _, startPage := range startPages {
+					q.Seeds = append(q.Seeds, startPage.Url)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+			q.StatusCode = http.StatusAccepted
+			json.NewEncoder(w).Encode(q)
+			return
 		}
-		qu.Publish(startPage)
-		if config.AppConfig.Api.WaitCrawl {
-			result, err = q.PollForFinishedCrawl(store)
+		q.Id = requestUid
+		progress.DefaultTracker.Start(q.Id)
+		report := progressReporter(q.Id, qu)
+		if config.Get().Api.WaitCrawl {
+			result, err = q.PollForFinishedCrawl(r.Context(), store, report)
+			progress.DefaultTracker.Finish(q.Id)
 			if err != nil {
-				statusCode = http.StatusServiceUnavailable
-				w.WriteHeader(statusCode)
+				route.WriteError(w, databaseStatus(err), "failed to query database")
 				_ = level.Error(logging.Logger).Log("context", "polling for finished crawl", "requestUid", requestUid, "msg", err.Error())
 				return
 			}
 		} else {
 			go func() {
-				result, err = q.PollForFinishedCrawl(store)
+				defer progress.DefaultTracker.Finish(q.Id)
+				_, err := q.PollForFinishedCrawl(context.Background(), store, report)
 				if err != nil {
 					_ = level.Error(logging.Logger).Log("context", "polling for finished crawl", "requestUid", requestUid, "msg", err.Error())
 					return
 				}
 			}()
+			w.WriteHeader(http.StatusAccepted)
+			q.StatusCode = http.StatusAccepted
+			json.NewEncoder(w).Encode(q)
+			return
 		}
 	}
-	q.Results = result
-	if q.Results.Links == nil {
-		q.Results = nil
-		statusCode = http.StatusNotFound
-		w.WriteHeader(statusCode)
+	if result != nil && result.StatusCode >= http.StatusBadRequest {
+		route.WriteError(w, http.StatusBadGateway, fmt.Sprintf("fetching %s returned status %d", q.Url, result.StatusCode))
+		return
+	}
+	if result == nil || (result.Links == nil && q.Depth != 0) {
+		route.WriteError(w, http.StatusNotFound, fmt.Sprintf("no pages found for %s", q.Url))
+		return
+	}
+	if !cached && q.Depth >= 0 && q.CrawlId == "" {
+		cache.DefaultCache.Set(q.Url, q.Depth, result, time.Duration(config.Get().Api.CacheTtl)*time.Second)
 	}
+	q.Results = result
+	q.CollectErrors(config.Get().Api.MaxReportedErrors)
+	q.Stats = findStats(store, q.Url)
+	q.FormatResults()
 	q.StatusCode = statusCode
-	json.NewEncoder(w).Encode(q)
+	writeTree(w, r, result, q)
+}
+
+// findStats function returns the stats stored for the latest crawl from Url, or nil if there are none or they couldn't
+// be found, as they only add to the results they are returned with
+func findStats(store relationship.Graph, Url string) *crawl.Stats {
+	ctx := context.Background()
+	stats, err := store.FindCrawlStats(&ctx, page.CanonicalUrl(Url))
+	if err != nil {
+		_ = level.Warn(logging.Logger).Log("context", "finding crawl stats", "url", Url, "msg", err.Error())
+		return nil
+	}
+	return stats
+}
+
+// writeTree function writes a found page tree in the media type negotiated from the request's Accept header: the tree
+// as XML, the links between its pages as a from,to CSV edge list, or otherwise v as JSON. The tree's ETag and
+// Last-Modified are taken from the newest timestamp among its pages, and a request which already has it gets 304 Not
+// Modified. Responses may be cached for the api's cache_max_age.
+func writeTree(w http.ResponseWriter, r *http.Request, result *page.Page, v interface{}) {
+	mediaType := route.Negotiate(r, route.MediaJson, route.MediaXml, route.MediaCsv)
+	newest := result.NewestTimestamp()
+	var lastModified time.Time
+	if newest > 0 {
+		lastModified = time.Unix(newest, 0)
+	}
+	etag := fmt.Sprintf(`W/"%d-%d-%s"`, newest, len(result.Urls()), mediaType[strings.Index(mediaType, "/")+1:])
+	w.Header().Set("Vary", "Accept")
+	if route.NotModified(w, r, etag, lastModified, config.Get().Api.CacheMaxAge) {
+		return
+	}
+	switch mediaType {
+	case route.MediaXml:
+		w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+		_, _ = io.WriteString(w, xml.Header)
+		_ = xml.NewEncoder(w).Encode(page.ConvertPageToJsonTree(result))
+	case route.MediaCsv:
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+		_ = result.WriteEdgeCsv(w)
+	default:
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// progressReporter function returns a callback which passes the results found while polling a crawl on to the
+// progress tracker, checking the queue depth at most once every QueueDepthInterval.
+func progressReporter(id string, qu *queue.Queue) func(result *page.Page) {
+	var queueDepth int64
+	var checked time.Time
+	return func(result *page.Page) {
+		if time.Since(checked) >= QueueDepthInterval {
+			checked = time.Now()
+			if depth, err := qu.ApproximateDepth(); err == nil {
+				queueDepth = depth
+			}
+		}
+		event := progress.NewEvent(id, result)
+		event.QueueDepth = queueDepth
+		progress.DefaultTracker.Update(event)
+	}
+}
+
+// ProgressHandler function handles /progress/{id} endpoint. Streams the progress of the in-flight crawl with the id
+// returned by /search as Server-Sent Events, ending with a "done" event when the crawl finishes.
+func ProgressHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	events, unsubscribe, ok := progress.DefaultTracker.Subscribe(id)
+	if !ok {
+		route.WriteError(w, http.StatusNotFound, fmt.Sprintf("no crawl in progress with id %s", id))
+		return
+	}
+	defer unsubscribe()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		route.WriteError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			name := "progress"
+			if event.Done {
+				name = "done"
+			}
+			data, _ := json.Marshal(event)
+			_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+			flusher.Flush()
+			if event.Done {
+				return
+			}
+		}
+	}
+}
+
+// crawlSocket accepts connections from any origin, as a visualization frontend is usually served from elsewhere and the
+// rest of the api is open to any caller anyway.
+var crawlSocket = websocket.Server{Handler: streamCrawl}
+
+// CrawlSocketHandler function handles /ws/crawl endpoint. Upgrades the connection to a WebSocket, waits for a
+// StartMessage, then streams the crawl's pages and links as they are stored, closing the connection when the crawl
+// finishes.
+func CrawlSocketHandler(w http.ResponseWriter, r *http.Request) {
+	crawlSocket.ServeHTTP(w, r)
+}
+
+// streamCrawl function starts the crawl requested on the connection, if it isn't already stored, and sends what is
+// found until the crawl's results stop changing. Polling stops as soon as the client disconnects; pages already queued
+// are still crawled by the service, up to the crawl's max_duration.
+func streamCrawl(ws *websocket.Conn) {
+	defer ws.Close()
+	requestUid := ws.Request().Header.Get("Clamber-Request-ID")
+	var start StartMessage
+	err := websocket.JSON.Receive(ws, &start)
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "streaming crawl", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	q, err := query.Parse(url.Values{"url": {start.Url}, "depth": {strconv.Itoa(start.Depth)}})
+	if err != nil {
+		_ = websocket.JSON.Send(ws, SocketMessage{Type: "error", Message: err.Error()})
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		var discarded []byte
+		for websocket.Message.Receive(ws, &discarded) == nil {
+		}
+	}()
+	stream := &graphStream{
+		ws:        ws,
+		sentNodes: make(map[string]struct{}),
+		sentEdges: make(map[page.Edge]struct{}),
+		cancel:    cancel,
+	}
+	store := relationship.NewStore()
+	store.Connect()
+	var result *page.Page
+	if q.Depth >= 0 {
+		result, err = store.FindNode(&ctx, q.Url, q.Depth, "")
+		if err != nil && !errors.Is(err, relationship.ErrDepthMismatch) {
+			_ = websocket.JSON.Send(ws, SocketMessage{Type: "error", Message: "failed to query database"})
+			_ = level.Error(logging.Logger).Log("context", "streaming crawl", "requestUid", requestUid, "msg", err.Error())
+			return
+		}
+	}
+	if result != nil {
+		stream.send(result)
+		stream.sendStats(store, q.Url)
+		return
+	}
+	queue.NewQueue().Publish(&page.Page{
+		Url:      q.Url,
+		Depth:    q.DisplayDepth,
+		StartUrl: q.Url,
+		Deadline: q.Deadline(),
+	})
+	_, err = q.PollForFinishedCrawl(ctx, store, stream.send)
+	if err != nil && ctx.Err() == nil {
+		_ = websocket.JSON.Send(ws, SocketMessage{Type: "error", Message: "failed to query database"})
+		_ = level.Error(logging.Logger).Log("context", "streaming crawl", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	if ctx.Err() == nil {
+		stream.sendStats(store, q.Url)
+	}
+}
+
+// sendStats function sends the stats stored for the latest crawl from Url, if there are any
+func (stream *graphStream) sendStats(store relationship.Graph, Url string) {
+	if stats := findStats(store, Url); stats != nil {
+		_ = websocket.JSON.Send(stream.ws, SocketMessage{Type: "stats", Stats: stats})
+	}
+}
+
+// send function sends the pages and links in result which haven't been sent yet, cancelling the stream if the
+// connection fails
+func (stream *graphStream) send(result *page.Page) {
+	adjacencyList := result.AdjacencyList()
+	for _, node := range adjacencyList.Nodes {
+		if _, isPresent := stream.sentNodes[node.Url]; isPresent {
+			continue
+		}
+		stream.sentNodes[node.Url] = struct{}{}
+		if err := websocket.JSON.Send(stream.ws, SocketMessage{Type: "node", Page: node}); err != nil {
+			stream.cancel()
+			return
+		}
+	}
+	for _, edge := range adjacencyList.Edges {
+		if _, isPresent := stream.sentEdges[*edge]; isPresent {
+			continue
+		}
+		stream.sentEdges[*edge] = struct{}{}
+		if err := websocket.JSON.Send(stream.ws, SocketMessage{Type: "edge", Edge: edge}); err != nil {
+			stream.cancel()
+			return
+		}
+	}
+}
+
+// DeleteHandler function handles DELETE /crawl endpoint. Removes the page with the given url and everything linked
+// beneath it down to the given depth, and drops the api's cached search results. Once the api's admin_token is set, it
+// needs the token like the admin routes.
+func DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	q, err := query.New(r)
+	if err == nil && q.Depth < 0 {
+		err = errors.New("depth must not be negative")
+	}
+	if err != nil {
+		route.WriteError(w, http.StatusBadRequest, err.Error())
+		_ = level.Error(logging.Logger).Log("context", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	store := relationship.NewStore()
+	store.Connect()
+	ctx := context.Background()
+	deleted, err := store.DeleteSubtree(&ctx, q.Url, q.Depth)
+	if errors.Is(err, relationship.ErrNotFound) {
+		route.WriteError(w, http.StatusNotFound, fmt.Sprintf("no pages found for %s", q.Url))
+		return
+	}
+	if err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to delete from database")
+		_ = level.Error(logging.Logger).Log("context", "deleting crawl", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	// results of searches from beneath url hold deleted pages too, not just those which include url
+	cache.DefaultCache.Clear()
+	json.NewEncoder(w).Encode(DeleteResult{Url: q.Url, Depth: q.Depth, Deleted: deleted})
+}
+
+// NodeHandler function handles /node endpoint. Returns the page stored for url and the pages linked beneath it down to
+// depth, or as deep as is stored if that is less. Nothing is crawled, so a url which isn't stored is not found. Like
+// /search, the page can be requested as XML or a CSV edge list with the Accept header, and carries cache headers.
+func NodeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	q, err := query.New(r)
+	if err == nil && q.Depth < 0 {
+		err = errors.New("depth must not be negative")
+	}
+	if err != nil {
+		route.WriteError(w, http.StatusBadRequest, err.Error())
+		_ = level.Error(logging.Logger).Log("context", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	result, err := findStored(q.Url, q.Depth)
+	if err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to query database")
+		_ = level.Error(logging.Logger).Log("context", "finding node", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	if result == nil {
+		route.WriteError(w, http.StatusNotFound, fmt.Sprintf("no page stored for %s", q.Url))
+		return
+	}
+	writeTree(w, r, result, result)
+}
+
+// ChildrenHandler function handles /children endpoint. Returns the pages the page stored for url links to directly,
+// each with its timestamp and childCount but none of its own links, so a client can expand the graph one level at a
+// time. Nothing is crawled, so a url which isn't stored is not found.
+func ChildrenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	Url := r.URL.Query().Get("url")
+	parsedUrl, err := url.Parse(Url)
+	if err != nil || parsedUrl.Host == "" {
+		route.WriteError(w, http.StatusBadRequest, fmt.Sprintf("%q is not an absolute URL", Url))
+		return
+	}
+	Url = page.CanonicalUrl(Url)
+	store := relationship.NewStore()
+	store.Connect()
+	ctx := context.Background()
+	children, err := store.FindChildren(&ctx, Url)
+	if errors.Is(err, relationship.ErrNotFound) {
+		route.WriteError(w, http.StatusNotFound, fmt.Sprintf("no page stored for %s", Url))
+		return
+	}
+	if err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to query database")
+		_ = level.Error(logging.Logger).Log("context", "finding children", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	if children == nil {
+		children = []*page.Page{}
+	}
+	json.NewEncoder(w).Encode(ChildrenResult{Url: Url, Children: children})
+}
+
+// ExportHandler function handles /export endpoint. Returns the pages stored beneath url down to depth, as /node finds
+// them, as a GraphML or DOT graph for tools such as Gephi and Graphviz. Each page appears once, however many pages link
+// to it.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	err := r.ParseForm()
+	var q query.Query
+	exportFormat := r.Form.Get("format")
+	if err == nil {
+		r.Form.Del("format")
+		q, err = query.Parse(r.Form)
+	}
+	switch {
+	case err != nil:
+	case q.Depth < 0:
+		err = errors.New("depth must not be negative")
+	case exportFormat != ExportGraphML && exportFormat != ExportDot:
+		err = fmt.Errorf("format must be %s or %s", ExportGraphML, ExportDot)
+	}
+	if err != nil {
+		route.WriteError(w, http.StatusBadRequest, err.Error())
+		_ = level.Error(logging.Logger).Log("context", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	result, err := findStored(q.Url, q.Depth)
+	if err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to query database")
+		_ = level.Error(logging.Logger).Log("context", "exporting graph", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	if result == nil {
+		route.WriteError(w, http.StatusNotFound, fmt.Sprintf("no page stored for %s", q.Url))
+		return
+	}
+	if exportFormat == ExportGraphML {
+		w.Header().Set("Content-Type", "application/graphml+xml; charset=UTF-8")
+		err = result.WriteGraphML(w)
+	} else {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=UTF-8")
+		err = result.WriteDot(w)
+	}
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "exporting graph", "requestUid", requestUid, "msg", err.Error())
+	}
+}
+
+// EdgesHandler function handles /edges endpoint. Reports whether the page stored for from links to the page stored for
+// to. Both urls are normalized like /search's url, and if either isn't stored the response is 404.
+func EdgesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	urls := []string{r.URL.Query().Get("from"), r.URL.Query().Get("to")}
+	for i, Url := range urls {
+		parsedUrl, err := url.Parse(Url)
+		if err != nil || parsedUrl.Host == "" {
+			route.WriteError(w, http.StatusBadRequest, fmt.Sprintf("%q is not an absolute URL", Url))
+			return
+		}
+		urls[i] = page.CanonicalUrl(Url)
+	}
+	store := relationship.NewStore()
+	store.Connect()
+	ctx := context.Background()
+	var uids []string
+	for _, Url := range urls {
+		stored, err := findShallow(&ctx, store, Url)
+		if err != nil {
+			route.WriteError(w, databaseStatus(err), "failed to query database")
+			_ = level.Error(logging.Logger).Log("context", "finding edge", "requestUid", requestUid, "msg", err.Error())
+			return
+		}
+		if stored == nil || stored.Uid == "" {
+			route.WriteError(w, http.StatusNotFound, fmt.Sprintf("no page stored for %s", Url))
+			return
+		}
+		uids = append(uids, stored.Uid)
+	}
+	exists, err := store.CheckPredicate(&ctx, uids[0], uids[1])
+	if err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to query database")
+		_ = level.Error(logging.Logger).Log("context", "finding edge", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(EdgeResult{From: urls[0], To: urls[1], Exists: exists})
+}
+
+// DiffHandler function handles /diff endpoint. Compares the subtree stored beneath url down to depth with the subtree
+// as it was at since, a unix time, from when each link was stored and pruned, without crawling anything. Returns the
+// pages and links added and removed since then. Links stored before their times were recorded are taken to have always
+// been stored. Returns 404 if the url isn't stored.
+func DiffHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	err := r.ParseForm()
+	var q query.Query
+	var since int64
+	if err == nil {
+		since, err = strconv.ParseInt(r.Form.Get("since"), 10, 64)
+		if err != nil {
+			err = fmt.Errorf("since must be a unix timestamp, got %q", r.Form.Get("since"))
+		}
+	}
+	if err == nil {
+		r.Form.Del("since")
+		q, err = query.Parse(r.Form)
+	}
+	if err == nil && q.Depth < 0 {
+		err = errors.New("depth must not be negative")
+	}
+	if err != nil {
+		route.WriteError(w, http.StatusBadRequest, err.Error())
+		_ = level.Error(logging.Logger).Log("context", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	store := relationship.NewStore()
+	store.Connect()
+	ctx := context.Background()
+	stored, err := store.FindNode(&ctx, q.Url, 0, "")
+	var history []page.LinkHistory
+	if err == nil && stored != nil {
+		history, err = store.FindLinkHistory(&ctx, stored.Url, q.Depth)
+	}
+	if err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to query database")
+		_ = level.Error(logging.Logger).Log("context", "diffing graph", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	if stored == nil {
+		route.WriteError(w, http.StatusNotFound, fmt.Sprintf("no page stored for %s", q.Url))
+		return
+	}
+	diff := page.DiffLinks(stored.Url, q.Depth, history, since)
+	json.NewEncoder(w).Encode(DiffResult{Url: stored.Url, Depth: q.Depth, Since: since, GraphDiff: diff})
+}
+
+// databaseStatus function returns the HTTP status for a failed database call: 404 when the page isn't stored, 503 when
+// the database can't be reached or the transaction should be retried, and 500 otherwise.
+func databaseStatus(err error) int {
+	switch {
+	case errors.Is(err, relationship.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, relationship.ErrConnUnavailable), errors.Is(err, relationship.ErrTxnAborted):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// findShallow function finds the page stored for Url without its links, for handlers which only need its uid. The
+// Dgraph Store, wrapped or not, finds it with FindNodeShallow, which doesn't count its links as FindNode does; as
+// LimitedGraph doesn't limit reads, unwrapping it changes nothing. Other graphs find it with FindNode at depth 0.
+func findShallow(ctx *context.Context, store relationship.Graph, Url string) (*page.Page, error) {
+	if limited, ok := store.(*relationship.LimitedGraph); ok {
+		store = limited.Graph
+	}
+	if dgraphStore, ok := store.(*relationship.Store); ok {
+		return dgraphStore.FindNodeShallow(ctx, nil, Url)
+	}
+	return store.FindNode(ctx, Url, 0, "")
+}
+
+// findStored function finds the page stored for Url and the pages linked beneath it down to depth, or as deep as is
+// stored if that is less. It returns a nil page if Url isn't stored.
+func findStored(Url string, depth int) (result *page.Page, err error) {
+	store := relationship.NewStore()
+	store.Connect()
+	defer store.Close()
+	ctx := context.Background()
+	return store.FindNodeUpTo(&ctx, Url, depth, "")
+}
+
+// RootsHandler function handles /roots endpoint. Returns the stored pages which no stored page links to, the entry
+// points of the graph, without their links. Up to limit pages are returned, DefaultRootsLimit if it isn't given.
+func RootsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	limit := DefaultRootsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			err = fmt.Errorf("limit must be a positive integer, got %q", value)
+			route.WriteError(w, http.StatusBadRequest, err.Error())
+			_ = level.Error(logging.Logger).Log("context", "roots", "requestUid", requestUid, "msg", err.Error())
+			return
+		}
+	}
+	store := relationship.NewStore()
+	store.Connect()
+	ctx := context.Background()
+	roots, err := store.FindRoots(&ctx, limit)
+	if err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to query database")
+		_ = level.Error(logging.Logger).Log("context", "roots", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	if roots == nil {
+		roots = []*page.Page{}
+	}
+	json.NewEncoder(w).Encode(RootsResult{Limit: limit, Roots: roots})
+}
+
+// StatsHandler function handles /stats endpoint. Returns the number of pages and links in the graph, and the dgraph
+// server version.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	store := relationship.NewStore()
+	store.Connect()
+	ctx := context.Background()
+	version, err := store.Version(&ctx)
+	if err != nil {
+		route.WriteError(w, http.StatusServiceUnavailable, err.Error())
+		_ = level.Error(logging.Logger).Log("context", "stats", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	nodes, edges, err := store.Stats(&ctx)
+	if err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to query database")
+		_ = level.Error(logging.Logger).Log("context", "stats", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(StatsResult{Nodes: nodes, Edges: edges, Version: version})
+}
+
+// AdminSchemaHandler function handles /admin/schema endpoint. Applies the database schema with InitSchema, which is
+// safe to repeat.
+func AdminSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	if err := InitSchema(); err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to apply schema")
+		_ = level.Error(logging.Logger).Log("context", "applying schema", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	_ = level.Info(logging.Logger).Log("context", "applying schema", "requestUid", requestUid, "msg", "schema applied")
+	json.NewEncoder(w).Encode(AdminResult{Action: "schema", Status: "applied"})
+}
+
+// AdminResetHandler function handles /admin/reset endpoint. Deletes every page and link in the database, but only when
+// the JSON body confirms it with ResetConfirmation. Cached search results are dropped too.
+func AdminResetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	requestUid := r.Header.Get("Clamber-Request-ID")
+	var reset ResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&reset); err != nil || reset.Confirm != ResetConfirmation {
+		route.WriteError(w, http.StatusBadRequest, fmt.Sprintf("confirm must be %q to delete every page", ResetConfirmation))
+		return
+	}
+	store := relationship.NewStore()
+	store.Connect()
+	if err := store.DeleteAll(); err != nil {
+		route.WriteError(w, databaseStatus(err), "failed to delete from database")
+		_ = level.Error(logging.Logger).Log("context", "resetting database", "requestUid", requestUid, "msg", err.Error())
+		return
+	}
+	cache.DefaultCache.Clear()
+	_ = level.Warn(logging.Logger).Log("context", "resetting database", "requestUid", requestUid, "msg", "every page deleted")
+	json.NewEncoder(w).Encode(AdminResult{Action: "reset", Status: "deleted"})
+}
+
+// DefaultReadiness is the Readiness /ready reports, set once the database schema has been applied
+var DefaultReadiness = &Readiness{}
+
+// Set function records whether the api is ready
+func (readiness *Readiness) Set(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&readiness.ready, value)
+}
+
+// IsReady function checks whether the api is ready
+func (readiness *Readiness) IsReady() bool {
+	return atomic.LoadInt32(&readiness.ready) == 1
+}
+
+// InitSchema function connects to the database and applies its schema, after which DefaultReadiness is set so /ready
+// reports the api as ready
+func InitSchema() (err error) {
+	store := relationship.NewStore()
+	store.Connect()
+	if err = store.SetSchema(); err != nil {
+		return
+	}
+	DefaultReadiness.Set(true)
+	return
+}
+
+// HealthHandler function handles /healthz endpoint. Reports the api is alive whenever it can answer, whatever the
+// state of the database, so it is only restarted when it stops answering.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(HealthResult{Status: "ok"})
+}
+
+// ReadyHandler function handles /ready endpoint. Reports the api is ready to serve requests once the database schema
+// has been applied, at startup or through /admin/schema, and answers 503 Service Unavailable until then.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if !DefaultReadiness.IsReady() {
+		route.WriteError(w, http.StatusServiceUnavailable, "database schema not yet applied")
+		return
+	}
+	json.NewEncoder(w).Encode(HealthResult{Status: "ready"})
 }
@@ -1,22 +1,38 @@
 package main_test
 
 import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
 	"github.com/stevenayers/clamber/clamber/cmd/api"
+	"github.com/stevenayers/clamber/pkg/cache"
 	"github.com/stevenayers/clamber/pkg/config"
 	"github.com/stevenayers/clamber/pkg/crawl"
 	"github.com/stevenayers/clamber/pkg/database/relationship"
 	"github.com/stevenayers/clamber/pkg/logging"
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stevenayers/clamber/pkg/progress"
+	"github.com/stevenayers/clamber/pkg/query"
 	"github.com/stevenayers/clamber/pkg/route"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/websocket"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var QueryParamsTests = []QueryParamsTest{
@@ -110,7 +126,7 @@ func (s *StoreSuite) TestSearchHandlerConfigError() {
 		response := httptest.NewRecorder()
 		router := route.NewRouter(main.Routes)
 		router.ServeHTTP(response, req)
-		assert.Equal(s.T(), 503, response.Code, "Service Unavailable response is expected")
+		assert.Equal(s.T(), 500, response.Code, "Internal Server Error response is expected")
 	}
 }
 
@@ -124,6 +140,7 @@ func (s *StoreSuite) TestSearchHandlerBadUrl() {
 	router := route.NewRouter(main.Routes)
 	router.ServeHTTP(response, req)
 	assert.Equal(s.T(), 400, response.Code, "BadRequest response is expected")
+	assertErrorEnvelope(s.T(), response, 400)
 	//app.ApiCrawler.DbWaitGroup.Wait()
 }
 
@@ -137,9 +154,80 @@ func (s *StoreSuite) TestSearchHandlerBadDepth() {
 	router := route.NewRouter(main.Routes)
 	router.ServeHTTP(response, req)
 	assert.Equal(s.T(), 400, response.Code, "BadRequest response is expected")
+	assertErrorEnvelope(s.T(), response, 400)
 	//app.ApiCrawler.DbWaitGroup.Wait()
 }
 
+func (s *StoreSuite) TestSearchHandlerBadOverride() {
+	req, _ := http.NewRequest("GET", "/search", nil)
+	q := req.URL.Query()
+	q.Add("url", "https://golang.org")
+	q.Add("depth", strconv.Itoa(1))
+	q.Add("max_duration", "-10")
+	req.URL.RawQuery = q.Encode()
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 400, response.Code, "BadRequest response is expected")
+	assertErrorEnvelope(s.T(), response, 400)
+}
+
+func (s *StoreSuite) TestSearchHandlerInvalidBody() {
+	for _, test := range []struct {
+		body   string
+		fields []route.FieldError
+	}{
+		{
+			`{"url": "https://golang.org", "depth": 1, "allow_external": true}`,
+			[]route.FieldError{{Field: "allow_external", Message: "is not a known field"}},
+		},
+		{
+			`{"url": "https://golang.org", "depth": "1"}`,
+			[]route.FieldError{{Field: "depth", Message: "must be an integer, got string"}},
+		},
+		{
+			`{"url": ["https://golang.org"], "depth": 1}`,
+			[]route.FieldError{{Field: "url", Message: "must be a string, got array"}},
+		},
+		{
+			`{"format": "tree"}`,
+			[]route.FieldError{
+				{Field: "url", Message: "is required"},
+				{Field: "depth", Message: "is required"},
+				{Field: "format", Message: "must be nested or adjacency"},
+			},
+		},
+		{
+			`{"url": "/relative", "seeds": ["ftp://golang.org"], "depth": -2}`,
+			[]route.FieldError{
+				{Field: "url", Message: "must be an absolute http or https URL"},
+				{Field: "seeds[0]", Message: "must be an absolute http or https URL"},
+				{Field: "depth", Message: "must be -1 (infinite) or more"},
+			},
+		},
+	} {
+		req, _ := http.NewRequest("POST", "/search", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		assert.Equal(s.T(), 400, response.Code, test.body)
+		var envelope route.ErrorResponse
+		if err := json.Unmarshal(response.Body.Bytes(), &envelope); err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), "invalid request body", envelope.Error.Message, test.body)
+		assert.Equal(s.T(), test.fields, envelope.Error.Fields, test.body)
+	}
+
+	req, _ := http.NewRequest("POST", "/search", strings.NewReader(`{"url": `))
+	req.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	route.NewRouter(main.Routes).ServeHTTP(response, req)
+	assert.Equal(s.T(), 400, response.Code, "a body which isn't JSON should be rejected")
+	assertErrorEnvelope(s.T(), response, 400)
+}
+
 func (s *StoreSuite) TestSearchHandlerNotFound() {
 	req, _ := http.NewRequest("GET", "/search", nil)
 	q := req.URL.Query()
@@ -150,9 +238,835 @@ func (s *StoreSuite) TestSearchHandlerNotFound() {
 	router := route.NewRouter(main.Routes)
 	router.ServeHTTP(response, req)
 	assert.Equal(s.T(), 404, response.Code, "BadRequest response is expected")
+	assertErrorEnvelope(s.T(), response, 404)
 	//app.ApiCrawler.DbWaitGroup.Wait()
 }
 
+func (s *StoreSuite) TestSearchHandlerDatabaseError() {
+	config.AppConfig.Database = config.DatabaseConfig{
+		Connections: []*config.Connection{
+			{Host: "fakehost.local",
+				Port: 999999},
+		},
+	}
+	req, _ := http.NewRequest("GET", "/search", nil)
+	q := req.URL.Query()
+	q.Add("url", "https://golang.org")
+	q.Add("depth", strconv.Itoa(1))
+	req.URL.RawQuery = q.Encode()
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 500, response.Code, "Internal Server Error response is expected")
+	assertErrorEnvelope(s.T(), response, 500)
+}
+
+func (s *StoreSuite) TestSearchHandlerUpstreamError() {
+	ctx := context.Background()
+	p := page.Page{Url: "https://golang.org/missing", Timestamp: time.Now().Unix(), StatusCode: http.StatusNotFound}
+	_, err := s.store.FindOrCreateNode(&ctx, &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "/search", nil)
+	q := req.URL.Query()
+	q.Add("url", p.Url)
+	q.Add("depth", strconv.Itoa(0))
+	req.URL.RawQuery = q.Encode()
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 502, response.Code, "Bad Gateway response is expected")
+	assertErrorEnvelope(s.T(), response, 502)
+}
+
+func (s *StoreSuite) TestDeleteHandler() {
+	ctx := context.Background()
+	p := page.Page{Url: "https://golang.org", Timestamp: time.Now().Unix()}
+	_, err := s.store.FindOrCreateNode(&ctx, &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	config.Update(func(c *config.Config) {
+		c.Api.AdminToken = "secret"
+	})
+	req, _ := http.NewRequest("DELETE", "/crawl", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	q := req.URL.Query()
+	q.Add("url", p.Url)
+	q.Add("depth", strconv.Itoa(0))
+	req.URL.RawQuery = q.Encode()
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	var result main.DeleteResult
+	err = json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 1, result.Deleted)
+}
+
+func (s *StoreSuite) TestDeleteHandlerUnauthorized() {
+	ctx := context.Background()
+	p := page.Page{Url: "https://golang.org", Timestamp: time.Now().Unix()}
+	_, err := s.store.FindOrCreateNode(&ctx, &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	remove := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("DELETE", "/crawl?url=https://golang.org&depth=0", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	config.Update(func(c *config.Config) {
+		c.Api.AdminToken = "secret"
+	})
+	response := remove("")
+	assert.Equal(s.T(), 401, response.Code, "Unauthorized response is expected")
+	assertErrorEnvelope(s.T(), response, 401)
+	response = remove("wrong")
+	assert.Equal(s.T(), 401, response.Code, "Unauthorized response is expected")
+	stored, _ := s.store.FindNode(&ctx, p.Url, 0, "")
+	assert.NotNil(s.T(), stored, "nothing should be deleted without a valid admin token")
+
+	config.Update(func(c *config.Config) {
+		c.Api.AdminToken = ""
+	})
+	response = remove("")
+	assert.Equal(s.T(), 200, response.Code, "deleting should be open while no admin token is set")
+}
+
+func (s *StoreSuite) TestDeleteHandlerClearsCache() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc")
+	defer store.DeleteAll()
+	config.Update(func(c *config.Config) {
+		c.Api.AdminToken = "secret"
+		c.Api.CacheTtl = 60
+	})
+	defer cache.DefaultCache.Clear()
+	router := route.NewRouter(main.Routes)
+	response := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=1", nil)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	assert.Equal(s.T(), 1, cache.DefaultCache.Len(), "the result should be cached")
+
+	response = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/crawl?url=https://golang.org/doc&depth=0", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	assert.Equal(s.T(), 0, cache.DefaultCache.Len(), "deleting pages should drop cached results")
+}
+
+func (s *StoreSuite) TestDeleteHandlerNotFound() {
+	config.Update(func(c *config.Config) {
+		c.Api.AdminToken = "secret"
+	})
+	req, _ := http.NewRequest("DELETE", "/crawl", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	q := req.URL.Query()
+	q.Add("url", "http://blsdadadadadsa.uk")
+	q.Add("depth", strconv.Itoa(1))
+	req.URL.RawQuery = q.Encode()
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 404, response.Code, "NotFound response is expected")
+	assertErrorEnvelope(s.T(), response, 404)
+}
+
+func (s *StoreSuite) TestNodeHandler() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc")
+	defer store.DeleteAll()
+	req, _ := http.NewRequest("GET", "/node", nil)
+	q := req.URL.Query()
+	q.Add("url", "https://golang.org")
+	q.Add("depth", strconv.Itoa(3))
+	req.URL.RawQuery = q.Encode()
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	var result page.Page
+	err := json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "https://golang.org", result.Url)
+	if assert.Equal(s.T(), 1, len(result.Links), "the stored links should be returned when fewer levels are stored") {
+		assert.Equal(s.T(), "https://golang.org/doc", result.Links[0].Url)
+	}
+}
+
+func (s *StoreSuite) TestSearchHandlerDepthZero() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc")
+	defer store.DeleteAll()
+	req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=0&nocache=true", nil)
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code, "a stored page should be found at depth 0 without its links")
+	var result query.Query
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		s.T().Fatal(err)
+	}
+	if assert.Equal(s.T(), true, result.Results != nil) {
+		assert.Equal(s.T(), "https://golang.org", result.Results.Url)
+		assert.Equal(s.T(), 0, len(result.Results.Links))
+		assert.Equal(s.T(), 1, result.Results.ChildCount)
+	}
+}
+
+func (s *StoreSuite) TestSearchHandlerCrawlId() {
+	store := storeMemoryTree(s.T(), "https://golang.org")
+	defer store.DeleteAll()
+	ctx := context.Background()
+	root := &page.Page{Url: "https://golang.org", CrawlId: "docs"}
+	if _, err := store.FindOrCreateNode(&ctx, root); err != nil {
+		s.T().Fatal(err)
+	}
+	for Url, crawlId := range map[string]string{"https://golang.org/doc": "docs", "https://golang.org/blog": "blog"} {
+		child := &page.Page{Url: Url, Timestamp: time.Now().Unix(), CrawlId: crawlId}
+		if _, err := store.FindOrCreateNode(&ctx, child); err != nil {
+			s.T().Fatal(err)
+		}
+		if _, err := store.CheckOrCreatePredicate(&ctx, root.Uid, child.Uid, crawlId); err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=1&crawlId=docs", nil)
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code)
+	var result query.Query
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "docs", result.CrawlId)
+	if assert.Equal(s.T(), true, result.Results != nil) && assert.Equal(s.T(), 1, len(result.Results.Links)) {
+		assert.Equal(s.T(), "https://golang.org/doc", result.Results.Links[0].Url, "only the crawl's own pages should be found")
+	}
+
+	req, _ = http.NewRequest("GET", "/search?url=https://golang.org&depth=1&crawlId=../docs", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), http.StatusBadRequest, response.Code)
+	assertErrorEnvelope(s.T(), response, http.StatusBadRequest)
+}
+
+func (s *StoreSuite) TestConditionalRequests() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc")
+	defer store.DeleteAll()
+	config.Update(func(c *config.Config) {
+		c.Api.CacheMaxAge = 60
+	})
+	for _, path := range []string{"/node", "/search"} {
+		get := func(header string, value string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", path, nil)
+			q := req.URL.Query()
+			q.Add("url", "https://golang.org")
+			q.Add("depth", "1")
+			if path == "/search" {
+				q.Add("nocache", "true")
+			}
+			req.URL.RawQuery = q.Encode()
+			if header != "" {
+				req.Header.Set(header, value)
+			}
+			response := httptest.NewRecorder()
+			router := route.NewRouter(main.Routes)
+			router.ServeHTTP(response, req)
+			return response
+		}
+		response := get("", "")
+		assert.Equal(s.T(), 200, response.Code, path)
+		etag := response.Header().Get("ETag")
+		assert.NotEmpty(s.T(), etag, path)
+		assert.Equal(s.T(), "public, max-age=60", response.Header().Get("Cache-Control"), path)
+		lastModified, err := http.ParseTime(response.Header().Get("Last-Modified"))
+		assert.Equal(s.T(), nil, err, path)
+
+		response = get("If-None-Match", etag)
+		assert.Equal(s.T(), http.StatusNotModified, response.Code, "%s: a matching If-None-Match should get 304", path)
+		assert.Equal(s.T(), 0, response.Body.Len(), path)
+		assert.Equal(s.T(), etag, response.Header().Get("ETag"), path)
+
+		response = get("If-None-Match", `W/"1-1-json"`)
+		assert.Equal(s.T(), 200, response.Code, "%s: a stale If-None-Match should get the body", path)
+		assert.NotEqual(s.T(), 0, response.Body.Len(), path)
+
+		response = get("If-Modified-Since", lastModified.Format(http.TimeFormat))
+		assert.Equal(s.T(), http.StatusNotModified, response.Code, "%s: an unchanged tree should get 304", path)
+		response = get("If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat))
+		assert.Equal(s.T(), 200, response.Code, "%s: a tree changed since If-Modified-Since should get the body", path)
+
+		response = get("Accept", "text/csv")
+		assert.NotEqual(s.T(), etag, response.Header().Get("ETag"), "%s: each format should have its own ETag", path)
+	}
+}
+
+func (s *StoreSuite) TestEdgesHandler() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc", "https://golang.org/pkg")
+	defer store.DeleteAll()
+	for _, test := range []struct {
+		from, to string
+		code     int
+		exists   bool
+	}{
+		{"https://golang.org", "https://golang.org/doc", http.StatusOK, true},
+		{"https://golang.org/", "https://golang.org/pkg/", http.StatusOK, true},
+		{"https://golang.org/doc", "https://golang.org", http.StatusOK, false},
+		{"https://golang.org/doc", "https://golang.org/pkg", http.StatusOK, false},
+		{"https://golang.org", "https://golang.org/blog", http.StatusNotFound, false},
+		{"https://go.dev", "https://golang.org", http.StatusNotFound, false},
+		{"golang.org", "https://golang.org", http.StatusBadRequest, false},
+	} {
+		req, _ := http.NewRequest("GET", "/edges", nil)
+		q := req.URL.Query()
+		q.Add("from", test.from)
+		q.Add("to", test.to)
+		req.URL.RawQuery = q.Encode()
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		assert.Equal(s.T(), test.code, response.Code, "%s -> %s", test.from, test.to)
+		if test.code != http.StatusOK {
+			assertErrorEnvelope(s.T(), response, test.code)
+			continue
+		}
+		var result main.EdgeResult
+		err := json.Unmarshal(response.Body.Bytes(), &result)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), test.exists, result.Exists, "%s -> %s", test.from, test.to)
+	}
+}
+
+func (s *StoreSuite) TestResultFormats() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc", "https://golang.org/pkg")
+	defer store.DeleteAll()
+	for _, path := range []string{"/search", "/node"} {
+		for accept, expected := range map[string]string{
+			"application/xml": `<page><url>https://golang.org</url>`,
+			"text/csv":        "from,to\n",
+			"":                `"url":"https://golang.org"`,
+		} {
+			req, _ := http.NewRequest("GET", path, nil)
+			q := req.URL.Query()
+			q.Add("url", "https://golang.org")
+			q.Add("depth", strconv.Itoa(1))
+			req.URL.RawQuery = q.Encode()
+			req.Header.Set("Accept", accept)
+			response := httptest.NewRecorder()
+			router := route.NewRouter(main.Routes)
+			router.ServeHTTP(response, req)
+			assert.Equal(s.T(), 200, response.Code, path+" "+accept)
+			body := response.Body.String()
+			assert.Contains(s.T(), body, expected, path+" "+accept)
+			switch accept {
+			case "application/xml":
+				assert.Equal(s.T(), "application/xml; charset=UTF-8", response.Header().Get("Content-Type"))
+				var tree page.JsonPage
+				if assert.Equal(s.T(), nil, xml.Unmarshal(response.Body.Bytes(), &tree), path) {
+					assert.Equal(s.T(), 2, len(tree.Children))
+					assert.Equal(s.T(), 2, tree.ChildCount)
+				}
+			case "text/csv":
+				assert.Equal(s.T(), "text/csv; charset=UTF-8", response.Header().Get("Content-Type"))
+				records, err := csv.NewReader(response.Body).ReadAll()
+				if assert.Equal(s.T(), nil, err, path) {
+					assert.ElementsMatch(s.T(), [][]string{
+						{"from", "to"},
+						{"https://golang.org", "https://golang.org/doc"},
+						{"https://golang.org", "https://golang.org/pkg"},
+					}, records)
+				}
+			default:
+				assert.Equal(s.T(), "application/json; charset=UTF-8", response.Header().Get("Content-Type"))
+			}
+		}
+	}
+}
+
+func (s *StoreSuite) TestExportHandler() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc", "https://golang.org/pkg")
+	defer store.DeleteAll()
+	export := func(format string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/export", nil)
+		q := req.URL.Query()
+		q.Add("url", "https://golang.org")
+		q.Add("depth", strconv.Itoa(1))
+		q.Add("format", format)
+		req.URL.RawQuery = q.Encode()
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := export(main.ExportGraphML)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	var graphml page.GraphML
+	err := xml.Unmarshal(response.Body.Bytes(), &graphml)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "directed", graphml.Graph.EdgeDefault)
+	ids := make(map[string]string)
+	for _, node := range graphml.Graph.Nodes {
+		if assert.Equal(s.T(), 1, len(node.Data)) {
+			ids[node.Id] = node.Data[0].Value
+		}
+	}
+	assert.Equal(s.T(), 3, len(ids))
+	var edges []page.Edge
+	for _, edge := range graphml.Graph.Edges {
+		edges = append(edges, page.Edge{From: ids[edge.Source], To: ids[edge.Target]})
+	}
+	assert.ElementsMatch(s.T(), []page.Edge{
+		{From: "https://golang.org", To: "https://golang.org/doc"},
+		{From: "https://golang.org", To: "https://golang.org/pkg"},
+	}, edges)
+
+	response = export(main.ExportDot)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	assert.Equal(s.T(), "digraph clamber {", lines[0])
+	assert.Equal(s.T(), "}", lines[len(lines)-1])
+	labels := regexp.MustCompile(`^  (n\d+) \[label="([^"]*)"\];$`)
+	arrows := regexp.MustCompile(`^  (n\d+) -> (n\d+);$`)
+	ids = make(map[string]string)
+	edges = nil
+	for _, line := range lines[1 : len(lines)-1] {
+		if match := labels.FindStringSubmatch(line); match != nil {
+			ids[match[1]] = match[2]
+		} else if match := arrows.FindStringSubmatch(line); match != nil {
+			edges = append(edges, page.Edge{From: ids[match[1]], To: ids[match[2]]})
+		} else {
+			s.T().Errorf("unexpected DOT statement %q", line)
+		}
+	}
+	assert.Equal(s.T(), 3, len(ids))
+	assert.ElementsMatch(s.T(), []page.Edge{
+		{From: "https://golang.org", To: "https://golang.org/doc"},
+		{From: "https://golang.org", To: "https://golang.org/pkg"},
+	}, edges)
+
+	response = export("svg")
+	assert.Equal(s.T(), 400, response.Code, "BadRequest response is expected")
+	assertErrorEnvelope(s.T(), response, 400)
+}
+
+func (s *StoreSuite) TestSearchHandlerCache() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc")
+	defer store.DeleteAll()
+	config.Update(func(c *config.Config) {
+		c.Api.CacheTtl = 60
+	})
+	defer cache.DefaultCache.Clear()
+	search := func(noCache bool) *page.Page {
+		req, _ := http.NewRequest("GET", "/search", nil)
+		q := req.URL.Query()
+		q.Add("url", "https://golang.org")
+		q.Add("depth", strconv.Itoa(1))
+		if noCache {
+			q.Add("nocache", "true")
+		}
+		req.URL.RawQuery = q.Encode()
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+		var result query.Query
+		err := json.Unmarshal(response.Body.Bytes(), &result)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		return result.Results
+	}
+
+	assert.Equal(s.T(), 1, len(search(false).Links))
+	assert.Equal(s.T(), 1, cache.DefaultCache.Len(), "the result should be cached")
+	ctx := context.Background()
+	root, _ := store.FindNode(&ctx, "https://golang.org", 0, "")
+	uid, err := store.FindOrCreateNode(&ctx, &page.Page{Url: "https://golang.org/pkg", Timestamp: time.Now().Unix(), StatusCode: http.StatusOK})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	if _, err = store.CheckOrCreatePredicate(&ctx, root.Uid, uid, ""); err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 1, len(search(false).Links), "a repeated search should be served from the cache")
+	assert.Equal(s.T(), 2, len(search(true).Links), "nocache should query the database")
+
+	cache.DefaultCache.Invalidate("https://golang.org")
+	assert.Equal(s.T(), 0, cache.DefaultCache.Len(), "invalidating a page should drop results which include it")
+	assert.Equal(s.T(), 2, len(search(false).Links))
+}
+
+func (s *StoreSuite) TestSearchHandlerStats() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc")
+	defer store.DeleteAll()
+	ctx := context.Background()
+	stored := page.CrawlStats{PagesFetched: 2, PagesSkipped: 1, EdgesCreated: 1, Bytes: 512, ElapsedMs: 40}
+	if err := store.AddCrawlStats(&ctx, "https://golang.org", stored, true); err != nil {
+		s.T().Fatal(err)
+	}
+	_, isPresent := crawl.DefaultStats.Get("https://golang.org")
+	assert.Equal(s.T(), false, isPresent, "no crawler in this process should have counted the crawl")
+
+	req, _ := http.NewRequest("GET", "/search", nil)
+	q := req.URL.Query()
+	q.Add("url", "https://golang.org")
+	q.Add("depth", "1")
+	q.Add("nocache", "true")
+	req.URL.RawQuery = q.Encode()
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	var result query.Query
+	err := json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	if assert.NotNil(s.T(), result.Stats, "the stats stored for the crawl should be returned") {
+		assert.Equal(s.T(), stored, *result.Stats)
+	}
+}
+
+func (s *StoreSuite) TestDiffHandler() {
+	var mutex sync.Mutex
+	links := map[string][]string{"/": {"/a", "/b"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		body := "<html><body>"
+		for _, link := range links[r.URL.Path] {
+			body += fmt.Sprintf(`<a href="%s">%s</a>`, link, link)
+		}
+		_, _ = w.Write([]byte(body + "</body></html>"))
+	}))
+	defer server.Close()
+	store := storeMemoryTree(s.T(), server.URL)
+	defer store.DeleteAll()
+	ctx := context.Background()
+	crawlSite := func(expected ...page.Edge) {
+		crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, Recrawl: true, PruneStaleLinks: true}
+		crawler.Frontier = &crawlingFrontier{crawler: &crawler}
+		crawler.Crawl(&page.Page{Url: server.URL, StartUrl: server.URL, Depth: 2})
+		expectedLinks := make(map[page.Edge]struct{})
+		for _, edge := range expected {
+			expectedLinks[edge] = struct{}{}
+		}
+		var storedLinks map[page.Edge]struct{}
+		for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+			history, err := store.FindLinkHistory(&ctx, server.URL, 2)
+			if err != nil {
+				s.T().Fatal(err)
+			}
+			storedLinks = make(map[page.Edge]struct{})
+			for _, link := range history {
+				if link.UnlinkedAt == 0 {
+					storedLinks[link.Edge] = struct{}{}
+				}
+			}
+			if assert.ObjectsAreEqual(expectedLinks, storedLinks) {
+				return
+			}
+		}
+		s.T().Fatalf("crawl stored links %v, expected %v", storedLinks, expectedLinks)
+	}
+	diff := func(since string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/diff", nil)
+		q := req.URL.Query()
+		q.Add("url", server.URL)
+		q.Add("depth", "2")
+		q.Add("since", since)
+		req.URL.RawQuery = q.Encode()
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	crawlSite(page.Edge{From: server.URL, To: server.URL + "/a"}, page.Edge{From: server.URL, To: server.URL + "/b"})
+	since := time.Now().Unix()
+	for time.Now().Unix() <= since {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	links = map[string][]string{"/": {"/a", "/c"}, "/a": {"/b"}}
+	mutex.Unlock()
+	crawlSite(
+		page.Edge{From: server.URL, To: server.URL + "/a"},
+		page.Edge{From: server.URL, To: server.URL + "/c"},
+		page.Edge{From: server.URL + "/a", To: server.URL + "/b"},
+	)
+
+	response := diff(strconv.FormatInt(since, 10))
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	var result main.DiffResult
+	err := json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), server.URL, result.Url)
+	assert.Equal(s.T(), since, result.Since)
+	assert.Equal(s.T(), []string{server.URL + "/c"}, result.AddedNodes)
+	assert.Equal(s.T(), []string{}, result.RemovedNodes, "/b is still reachable through /a")
+	assert.Equal(s.T(), []*page.Edge{
+		{From: server.URL, To: server.URL + "/c"},
+		{From: server.URL + "/a", To: server.URL + "/b"},
+	}, result.AddedEdges)
+	assert.Equal(s.T(), []*page.Edge{{From: server.URL, To: server.URL + "/b"}}, result.RemovedEdges)
+
+	response = diff(strconv.FormatInt(time.Now().Unix(), 10))
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	result = main.DiffResult{}
+	err = json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 0, len(result.AddedNodes)+len(result.RemovedNodes)+len(result.AddedEdges)+len(result.RemovedEdges),
+		"nothing should have changed since the latest crawl")
+
+	response = diff("yesterday")
+	assert.Equal(s.T(), http.StatusBadRequest, response.Code)
+	assertErrorEnvelope(s.T(), response, http.StatusBadRequest)
+	store.DeleteAll()
+	response = diff(strconv.FormatInt(since, 10))
+	assert.Equal(s.T(), http.StatusNotFound, response.Code)
+	assertErrorEnvelope(s.T(), response, http.StatusNotFound)
+}
+
+func (s *StoreSuite) TestRootsHandler() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc", "https://golang.org/pkg")
+	defer store.DeleteAll()
+	ctx := context.Background()
+	doc, err := store.FindNode(&ctx, "https://golang.org/doc", 0, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	pkg, err := store.FindNode(&ctx, "https://golang.org/pkg", 0, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	if _, err := store.CheckOrCreatePredicate(&ctx, doc.Uid, pkg.Uid, ""); err != nil {
+		s.T().Fatal(err)
+	}
+	router := route.NewRouter(main.Routes)
+	req, _ := http.NewRequest("GET", "/roots", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	var result main.RootsResult
+	err = json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), main.DefaultRootsLimit, result.Limit)
+	if assert.Equal(s.T(), 1, len(result.Roots), "only the page nothing links to should be returned") {
+		assert.Equal(s.T(), "https://golang.org", result.Roots[0].Url)
+		assert.Equal(s.T(), 2, result.Roots[0].ChildCount)
+	}
+
+	for _, limit := range []string{"0", "-1", "many"} {
+		req, _ = http.NewRequest("GET", "/roots?limit="+limit, nil)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		assertErrorEnvelope(s.T(), response, http.StatusBadRequest)
+	}
+}
+
+func (s *StoreSuite) TestChildrenHandler() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc", "https://golang.org/pkg")
+	defer store.DeleteAll()
+	ctx := context.Background()
+	doc, err := store.FindNode(&ctx, "https://golang.org/doc", 0, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	faq := &page.Page{Url: "https://golang.org/doc/faq", Timestamp: time.Now().Unix()}
+	if _, err := store.FindOrCreateNode(&ctx, faq); err != nil {
+		s.T().Fatal(err)
+	}
+	if _, err := store.CheckOrCreatePredicate(&ctx, doc.Uid, faq.Uid, ""); err != nil {
+		s.T().Fatal(err)
+	}
+	router := route.NewRouter(main.Routes)
+	req, _ := http.NewRequest("GET", "/children?url="+url.QueryEscape("https://golang.org/"), nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	var result main.ChildrenResult
+	err = json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "https://golang.org", result.Url)
+	childCounts := make(map[string]int)
+	for _, child := range result.Children {
+		childCounts[child.Url] = child.ChildCount
+		assert.Equal(s.T(), true, child.Timestamp > 0, "%s should have its timestamp", child.Url)
+		assert.Equal(s.T(), 0, len(child.Links), "%s should be returned without its links", child.Url)
+	}
+	assert.Equal(s.T(), map[string]int{"https://golang.org/doc": 1, "https://golang.org/pkg": 0}, childCounts,
+		"only the direct links should be returned")
+
+	req, _ = http.NewRequest("GET", "/children?url="+url.QueryEscape("https://golang.org/doc/faq"), nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 200, response.Code)
+	assert.Equal(s.T(), true, strings.Contains(response.Body.String(), `"children":[]`), "a page without links should have no children")
+
+	req, _ = http.NewRequest("GET", "/children?url="+url.QueryEscape("https://golang.org/missing"), nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assertErrorEnvelope(s.T(), response, http.StatusNotFound)
+
+	req, _ = http.NewRequest("GET", "/children?url=golang.org", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assertErrorEnvelope(s.T(), response, http.StatusBadRequest)
+}
+
+func (s *StoreSuite) TestReadyHandler() {
+	config.Update(func(c *config.Config) {
+		c.Database.Driver = relationship.DriverMemory
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		return response
+	}
+	main.DefaultReadiness.Set(false)
+	response := get("/ready")
+	assert.Equal(s.T(), http.StatusServiceUnavailable, response.Code, "the api should not be ready before the schema is applied")
+	assertErrorEnvelope(s.T(), response, http.StatusServiceUnavailable)
+	response = get("/healthz")
+	assert.Equal(s.T(), 200, response.Code, "the api should be alive before the schema is applied")
+
+	if err := main.InitSchema(); err != nil {
+		s.T().Fatal(err)
+	}
+	response = get("/ready")
+	assert.Equal(s.T(), 200, response.Code, "the api should be ready once the schema is applied")
+	var result main.HealthResult
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), main.HealthResult{Status: "ready"}, result)
+	response = get("/healthz")
+	assert.Equal(s.T(), 200, response.Code)
+}
+
+func (s *StoreSuite) TestAdminSchemaHandler() {
+	config.Update(func(c *config.Config) {
+		c.Database.Driver = relationship.DriverMemory
+	})
+	schema := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/admin/schema", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := schema("secret")
+	assert.Equal(s.T(), 403, response.Code, "admin routes should be disabled without an admin token")
+	assertErrorEnvelope(s.T(), response, 403)
+
+	config.Update(func(c *config.Config) {
+		c.Api.AdminToken = "secret"
+	})
+	response = schema("")
+	assert.Equal(s.T(), 401, response.Code, "Unauthorized response is expected")
+	assertErrorEnvelope(s.T(), response, 401)
+	response = schema("wrong")
+	assert.Equal(s.T(), 401, response.Code, "Unauthorized response is expected")
+
+	main.DefaultReadiness.Set(false)
+	response = schema("secret")
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	assert.Equal(s.T(), true, main.DefaultReadiness.IsReady(), "applying the schema should make the api ready")
+	var result main.AdminResult
+	err := json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), main.AdminResult{Action: "schema", Status: "applied"}, result)
+}
+
+func (s *StoreSuite) TestAdminResetHandler() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc")
+	defer store.DeleteAll()
+	config.Update(func(c *config.Config) {
+		c.Api.AdminToken = "secret"
+	})
+	reset := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/admin/reset", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+		router := route.NewRouter(main.Routes)
+		router.ServeHTTP(response, req)
+		return response
+	}
+	ctx := context.Background()
+
+	for _, body := range []string{"", "{}", `{"confirm": "yes"}`} {
+		response := reset(body)
+		assert.Equal(s.T(), 400, response.Code, "reset should require confirmation: "+body)
+		assertErrorEnvelope(s.T(), response, 400)
+		stored, _ := store.FindNode(&ctx, "https://golang.org", 0, "")
+		assert.NotNil(s.T(), stored, "nothing should be deleted without confirmation")
+	}
+
+	response := reset(fmt.Sprintf(`{"confirm": %q}`, main.ResetConfirmation))
+	assert.Equal(s.T(), 200, response.Code, "StatusOK response is expected")
+	var result main.AdminResult
+	err := json.Unmarshal(response.Body.Bytes(), &result)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), main.AdminResult{Action: "reset", Status: "deleted"}, result)
+	stored, _ := store.FindNode(&ctx, "https://golang.org", 0, "")
+	assert.Nil(s.T(), stored, "every page should be deleted")
+}
+
+func (s *StoreSuite) TestNodeHandlerNotFound() {
+	config.Update(func(c *config.Config) {
+		c.Database.Driver = relationship.DriverMemory
+	})
+	req, _ := http.NewRequest("GET", "/node", nil)
+	q := req.URL.Query()
+	q.Add("url", "http://blsdadadadadsa.uk")
+	q.Add("depth", strconv.Itoa(1))
+	req.URL.RawQuery = q.Encode()
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), 404, response.Code, "NotFound response is expected")
+	assertErrorEnvelope(s.T(), response, 404)
+}
+
 func (s *StoreSuite) TestWriteHeader() {
 	router := mux.NewRouter().StrictSlash(true)
 	router.
@@ -167,14 +1081,186 @@ func (s *StoreSuite) TestWriteHeader() {
 	assert.Equal(s.T(), http.StatusCreated, result.StatusCode)
 }
 
+func (s *StoreSuite) TestProgressHandler() {
+	id := "test-crawl"
+	progress.DefaultTracker.Start(id)
+	server := httptest.NewServer(route.NewRouter(main.Routes))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/progress/" + id)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	assert.Equal(s.T(), "text/event-stream", resp.Header.Get("Content-Type"))
+
+	go func() {
+		root := &page.Page{Url: "https://golang.org", StatusCode: http.StatusOK}
+		for _, child := range []*page.Page{
+			{Url: "https://golang.org/doc", StatusCode: http.StatusOK},
+			{Url: "https://golang.org/missing", StatusCode: http.StatusNotFound},
+		} {
+			root.Links = append(root.Links, child)
+			progress.DefaultTracker.Update(progress.NewEvent(id, root))
+			time.Sleep(20 * time.Millisecond)
+		}
+		progress.DefaultTracker.Finish(id)
+	}()
+
+	var names []string
+	var last progress.Event
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			names = append(names, strings.TrimPrefix(line, "event: "))
+		case strings.HasPrefix(line, "data: "):
+			err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &last)
+			if err != nil {
+				s.T().Fatal(err)
+			}
+		}
+	}
+	if assert.Equal(s.T(), true, len(names) >= 2, names) {
+		assert.Equal(s.T(), "progress", names[0])
+		assert.Equal(s.T(), "done", names[len(names)-1])
+	}
+	assert.Equal(s.T(), true, last.Done)
+	assert.Equal(s.T(), 3, last.PagesFetched)
+	assert.Equal(s.T(), 1, last.Errors)
+}
+
+func (s *StoreSuite) TestProgressHandlerNotFound() {
+	req, _ := http.NewRequest("GET", "/progress/unknown", nil)
+	response := httptest.NewRecorder()
+	router := route.NewRouter(main.Routes)
+	router.ServeHTTP(response, req)
+	assert.Equal(s.T(), http.StatusNotFound, response.Code)
+	assertErrorEnvelope(s.T(), response, http.StatusNotFound)
+}
+
+func (s *StoreSuite) TestCrawlSocketHandler() {
+	store := storeMemoryTree(s.T(), "https://golang.org", "https://golang.org/doc", "https://golang.org/pkg")
+	defer store.DeleteAll()
+	ctx := context.Background()
+	stored := page.CrawlStats{PagesFetched: 3, EdgesCreated: 2, Bytes: 2048, ElapsedMs: 90}
+	if err := store.AddCrawlStats(&ctx, "https://golang.org", stored, true); err != nil {
+		s.T().Fatal(err)
+	}
+	server := httptest.NewServer(route.NewRouter(main.Routes))
+	defer server.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/crawl", "", server.URL)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer ws.Close()
+	err = websocket.JSON.Send(ws, main.StartMessage{Url: "https://golang.org", Depth: 1})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+
+	var nodes []string
+	var edges []page.Edge
+	var stats *page.CrawlStats
+	for {
+		var message main.SocketMessage
+		if err := websocket.JSON.Receive(ws, &message); err != nil {
+			break
+		}
+		switch message.Type {
+		case "node":
+			nodes = append(nodes, message.Url)
+		case "edge":
+			edges = append(edges, *message.Edge)
+		case "stats":
+			stats = message.Stats
+		default:
+			s.T().Fatalf("unexpected %s message: %s", message.Type, message.Message)
+		}
+	}
+	sort.Strings(nodes)
+	assert.Equal(s.T(), []string{"https://golang.org", "https://golang.org/doc", "https://golang.org/pkg"}, nodes)
+	assert.ElementsMatch(s.T(), []page.Edge{
+		{From: "https://golang.org", To: "https://golang.org/doc"},
+		{From: "https://golang.org", To: "https://golang.org/pkg"},
+	}, edges)
+	if assert.NotNil(s.T(), stats, "the stats stored for the crawl should be sent") {
+		assert.Equal(s.T(), stored, *stats)
+	}
+}
+
+func (s *StoreSuite) TestCrawlSocketHandlerBadStart() {
+	server := httptest.NewServer(route.NewRouter(main.Routes))
+	defer server.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/crawl", "", server.URL)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer ws.Close()
+	err = websocket.JSON.Send(ws, main.StartMessage{Url: "https://golang.org", Depth: -5})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var message main.SocketMessage
+	err = websocket.JSON.Receive(ws, &message)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "error", message.Type)
+	assert.NotEmpty(s.T(), message.Message)
+}
+
 func testHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 
 }
 
+// crawlingFrontier crawls each published page in its own goroutine in place of the SQS queue
+type crawlingFrontier struct {
+	crawler *crawl.Crawler
+}
+
+func (frontier *crawlingFrontier) Publish(p *page.Page) {
+	go frontier.crawler.Crawl(p)
+}
+
 func testHandlerFunc(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rw := logging.NewRichResponseWriter(w)
 		handler.ServeHTTP(rw, r)
 	})
 }
+
+func assertErrorEnvelope(t *testing.T, response *httptest.ResponseRecorder, code int) {
+	var envelope route.ErrorResponse
+	err := json.Unmarshal(response.Body.Bytes(), &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, code, envelope.Error.Code)
+	assert.NotEmpty(t, envelope.Error.Message)
+}
+
+// storeMemoryTree switches the config to the memory driver and stores a page at root linking to each of children
+func storeMemoryTree(t *testing.T, root string, children ...string) relationship.Graph {
+	config.Update(func(c *config.Config) {
+		c.Database.Driver = relationship.DriverMemory
+	})
+	store := relationship.NewStore()
+	ctx := context.Background()
+	uids := make(map[string]string)
+	for _, Url := range append([]string{root}, children...) {
+		uid, err := store.FindOrCreateNode(&ctx, &page.Page{Url: Url, Timestamp: time.Now().Unix(), StatusCode: http.StatusOK})
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids[Url] = uid
+	}
+	for _, child := range children {
+		if _, err := store.CheckOrCreatePredicate(&ctx, uids[root], uids[child], ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
@@ -10,22 +10,30 @@ import (
 	stdlog "log"
 	"net/http"
 	"os"
+	"time"
 )
 
+// SchemaRetryInterval is how long the api waits to apply the database schema again when it fails at startup
+var SchemaRetryInterval = 5 * time.Second
+
 func main() {
 	InitFlags(&AppFlags)
 	err := config.InitConfig(*AppFlags.ConfigFile)
-	if *AppFlags.Port != 0 {
-		config.AppConfig.Api.Port = *AppFlags.Port
-	}
-	if *AppFlags.Verbose {
-		config.AppConfig.Api.LogLevel = "debug"
-	}
+	applyFlags()
 	logging.InitJsonLogger(log.NewSyncWriter(os.Stdout), config.AppConfig.Api.LogLevel, "api")
 	if err != nil {
 		stdlog.Fatal(err.Error())
 		return
 	}
+	if err = config.AppConfig.Validate(); err != nil {
+		stdlog.Fatal(err.Error())
+		return
+	}
+	config.WatchReload(func() {
+		applyFlags()
+		_ = level.Info(logging.Logger).Log("msg", "config reloaded")
+	})
+	go applySchema()
 	router := route.NewRouter(Routes)
 	_ = level.Info(logging.Logger).Log(
 		"port", config.AppConfig.Api.Port,
@@ -36,3 +44,29 @@ func main() {
 		_ = level.Error(logging.Logger).Log("msg", err.Error())
 	}
 }
+
+// applyFlags function overrides config values with those passed on the command line
+func applyFlags() {
+	config.Update(func(c *config.Config) {
+		if *AppFlags.Port != 0 {
+			c.Api.Port = *AppFlags.Port
+		}
+		if *AppFlags.Verbose {
+			c.Api.LogLevel = "debug"
+		}
+	})
+}
+
+// applySchema function applies the database schema with InitSchema, trying again every SchemaRetryInterval until it
+// succeeds, so the api becomes ready as soon as the database can be reached
+func applySchema() {
+	for {
+		err := InitSchema()
+		if err == nil {
+			_ = level.Info(logging.Logger).Log("context", "applying schema", "msg", "schema applied")
+			return
+		}
+		_ = level.Error(logging.Logger).Log("context", "applying schema", "msg", err.Error())
+		time.Sleep(SchemaRetryInterval)
+	}
+}
@@ -16,18 +16,22 @@ import (
 func main() {
 	InitFlags(&AppFlags)
 	err := config.InitConfig(*AppFlags.ConfigFile)
-	if *AppFlags.Port != 0 {
-		config.AppConfig.Service.Port = *AppFlags.Port
-	}
-	if *AppFlags.Verbose {
-		config.AppConfig.Service.LogLevel = "debug"
-	}
+	applyFlags()
 	logging.InitJsonLogger(log.NewSyncWriter(os.Stdout), config.AppConfig.Service.LogLevel, "service")
 	if err != nil {
 		stdlog.Fatal(err.Error())
 		return
 	}
+	if err = config.AppConfig.Validate(); err != nil {
+		stdlog.Fatal(err.Error())
+		return
+	}
 	crawler := crawl.New()
+	config.WatchReload(func() {
+		applyFlags()
+		crawler.Reconfigure(config.Get().Service)
+		_ = level.Info(logging.Logger).Log("msg", "config reloaded")
+	})
 	go crawler.Start()
 	router := route.NewRouter(Routes)
 	_ = level.Info(logging.Logger).Log(
@@ -40,3 +44,15 @@ func main() {
 	}
 
 }
+
+// applyFlags function overrides config values with those passed on the command line
+func applyFlags() {
+	config.Update(func(c *config.Config) {
+		if *AppFlags.Port != 0 {
+			c.Service.Port = *AppFlags.Port
+		}
+		if *AppFlags.Verbose {
+			c.Service.LogLevel = "debug"
+		}
+	})
+}
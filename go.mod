@@ -12,6 +12,8 @@ require (
 	github.com/gorilla/mux v1.7.3
 	github.com/nsf/jsondiff v0.0.0-20190712045011-8443391ee9b6
 	github.com/prometheus/client_golang v1.2.1
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 	google.golang.org/grpc v1.25.1
 )
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"github.com/stevenayers/clamber/pkg/page"
+	"sync"
+	"time"
+)
+
+type (
+	// ResultCache holds the results of recent searches until they expire, so a repeated search doesn't query the
+	// database. An entry is dropped early when any page in its result is invalidated.
+	ResultCache struct {
+		sync.Mutex
+		entries map[resultKey]*resultEntry
+	}
+
+	// resultKey identifies a search by its normalized URL and depth
+	resultKey struct {
+		url   string
+		depth int
+	}
+
+	// resultEntry holds a cached result, the URLs of the pages in it and when it expires
+	resultEntry struct {
+		result  *page.Page
+		urls    map[string]struct{}
+		expires time.Time
+	}
+)
+
+// DefaultCache is the cache shared by the api handlers. It is invalidated by a crawler running in the same process, and
+// cleared when the api deletes pages. When the crawler runs in a separate service process, as it does with SQS, its
+// writes never reach the api's cache, so results are only refreshed once cache_ttl has passed.
+var DefaultCache = New()
+
+// New function creates an empty ResultCache
+func New() *ResultCache {
+	return &ResultCache{entries: make(map[resultKey]*resultEntry)}
+}
+
+// Get function returns the cached result of the search for Url down to depth, or nil if there isn't one which has yet
+// to expire. The result is shared, so it must not be changed.
+func (cache *ResultCache) Get(Url string, depth int) *page.Page {
+	cache.Lock()
+	defer cache.Unlock()
+	key := resultKey{url: cacheUrl(Url), depth: depth}
+	entry, isPresent := cache.entries[key]
+	if !isPresent {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return nil
+	}
+	return entry.result
+}
+
+// Set function caches the result of the search for Url down to depth for ttl, dropping any expired entries. Nothing is
+// cached if ttl is 0 or less.
+func (cache *ResultCache) Set(Url string, depth int, result *page.Page, ttl time.Duration) {
+	if ttl <= 0 || result == nil {
+		return
+	}
+	urls := make(map[string]struct{})
+	for _, Url := range result.Urls() {
+		urls[cacheUrl(Url)] = struct{}{}
+	}
+	now := time.Now()
+	cache.Lock()
+	defer cache.Unlock()
+	for key, entry := range cache.entries {
+		if now.After(entry.expires) {
+			delete(cache.entries, key)
+		}
+	}
+	cache.entries[resultKey{url: cacheUrl(Url), depth: depth}] = &resultEntry{result: result, urls: urls, expires: now.Add(ttl)}
+}
+
+// Invalidate function drops every cached result which includes the page at Url, as the page or its links have changed
+func (cache *ResultCache) Invalidate(Url string) {
+	Url = cacheUrl(Url)
+	cache.Lock()
+	defer cache.Unlock()
+	for key, entry := range cache.entries {
+		if _, isPresent := entry.urls[Url]; isPresent {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+// Clear function drops every cached result
+func (cache *ResultCache) Clear() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.entries = make(map[resultKey]*resultEntry)
+}
+
+// Len function returns the number of cached results, including any which have expired but not yet been dropped
+func (cache *ResultCache) Len() int {
+	cache.Lock()
+	defer cache.Unlock()
+	return len(cache.entries)
+}
+
+// cacheUrl function returns Url in the canonical form the crawler stores URLs in
+func cacheUrl(Url string) string {
+	return page.CanonicalUrl(Url)
+}
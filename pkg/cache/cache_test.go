@@ -0,0 +1,39 @@
+package cache_test
+
+import (
+	"github.com/stevenayers/clamber/pkg/cache"
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type StoreSuite struct {
+	suite.Suite
+}
+
+func TestSuite(t *testing.T) {
+	s := new(StoreSuite)
+	suite.Run(t, s)
+}
+
+func (s *StoreSuite) TestResultCache() {
+	resultCache := cache.New()
+	root := &page.Page{Url: "https://golang.org", Links: []*page.Page{{Url: "https://golang.org/doc"}}}
+	resultCache.Set("https://golang.org/", 1, root, time.Minute)
+	assert.Equal(s.T(), root, resultCache.Get("https://golang.org", 1), "a trailing slash should not change the key")
+	assert.Nil(s.T(), resultCache.Get("https://golang.org", 2), "results are cached per depth")
+
+	resultCache.Invalidate("https://golang.org/pkg")
+	assert.Equal(s.T(), root, resultCache.Get("https://golang.org", 1), "invalidating a page outside the result should keep it")
+	resultCache.Invalidate("https://golang.org/doc/")
+	assert.Nil(s.T(), resultCache.Get("https://golang.org", 1), "invalidating a page in the result should drop it")
+
+	resultCache.Set("https://golang.org", 1, root, 0)
+	assert.Equal(s.T(), 0, resultCache.Len(), "nothing should be cached without a ttl")
+	resultCache.Set("https://golang.org", 1, root, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(s.T(), resultCache.Get("https://golang.org", 1), "expired results should not be returned")
+	assert.Equal(s.T(), 0, resultCache.Len())
+}
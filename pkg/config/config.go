@@ -1,9 +1,20 @@
 package config
 
 import (
+	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/stevenayers/clamber/pkg/schedule"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 )
 
 type (
@@ -14,29 +25,114 @@ type (
 		Service  ServiceConfig
 		Database DatabaseConfig
 		Queue    QueueConfig
+		Url      UrlConfig
 	}
 
 	// GeneralConfig holds general section of toml config
 	ApiConfig struct {
-		MaxGoroutines int `toml:"max_goroutines"`
-		Port          int
-		LogLevel      string `toml:"log_level"`
-		WaitCrawl     bool   `toml:"wait_crawl"`
+		MaxGoroutines     int `toml:"max_goroutines"`
+		Port              int
+		LogLevel          string `toml:"log_level"`
+		WaitCrawl         bool   `toml:"wait_crawl"`
+		MaxReportedErrors int    `toml:"max_reported_errors"`
+		MaxDepth          int    `toml:"max_depth"`
+		MaxCrawlDuration  int    `toml:"max_crawl_duration"`
+		CacheTtl          int    `toml:"cache_ttl"`
+		CacheMaxAge       int    `toml:"cache_max_age"`
+		AdminToken        string `toml:"admin_token"`
 	}
 
 	// GeneralConfig holds general section of toml config
 	ServiceConfig struct {
-		MaxGoroutines       int `toml:"max_goroutines"`
-		Port                int
-		LogLevel            string `toml:"log_level"`
-		HttpRetryAttempts   int    `toml:"http_retry_attempts"`
-		HttpBackOffDuration int    `toml:"http_back_off_duration"`
-		NumConsumers        int    `toml:"sqs_consumers_per_node"`
+		MaxGoroutines         int `toml:"max_goroutines"`
+		Port                  int
+		LogLevel              string            `toml:"log_level"`
+		HttpRetryAttempts     int               `toml:"http_retry_attempts"`
+		HttpBackOffDuration   int               `toml:"http_back_off_duration"`
+		NumConsumers          int               `toml:"sqs_consumers_per_node"`
+		InsecureSkipVerify    bool              `toml:"insecure_skip_verify"`
+		MaxCrawlDuration      int               `toml:"max_crawl_duration"`
+		RecordRedirects       bool              `toml:"record_redirects"`
+		MaxIdleConnsPerHost   int               `toml:"max_idle_conns_per_host"`
+		IdleConnTimeout       int               `toml:"idle_conn_timeout"`
+		ForceAttemptHTTP2     bool              `toml:"force_attempt_http2"`
+		ForceHTTP1            bool              `toml:"force_http1"`
+		Recrawl               bool              `toml:"recrawl"`
+		PruneStaleLinks       bool              `toml:"prune_stale_links"`
+		MaxLinksPerPage       int               `toml:"max_links_per_page"`
+		MaxURLLength          int               `toml:"max_url_length"`
+		AcceptLanguage        string            `toml:"accept_language"`
+		Headers               map[string]string `toml:"headers"`
+		DbTimeout             int               `toml:"db_timeout"`
+		MaxBytesPerHost       int64             `toml:"max_bytes_per_host"`
+		ExcludePatterns       []string          `toml:"exclude_patterns"`
+		IncludePatterns       []string          `toml:"include_patterns"`
+		Soft404TitlePatterns  []string          `toml:"soft_404_title_patterns"`
+		Soft404BodyPatterns   []string          `toml:"soft_404_body_patterns"`
+		FollowSelfLinks       bool              `toml:"follow_self_links"`
+		HonorRobotsNoFollow   bool              `toml:"honor_robots_nofollow"`
+		HonorRobotsNoIndex    bool              `toml:"honor_robots_noindex"`
+		DepthRules            []DepthRule       `toml:"depth_rules"`
+		RecordErrors          bool              `toml:"record_errors"`
+		JsonLdLinks           bool              `toml:"json_ld_links"`
+		TimestampSource       string            `toml:"timestamp_source"`
+		ParseMode             string            `toml:"parse_mode"`
+		StreamLinks           bool              `toml:"stream_links"`
+		FrontierWorkers       int               `toml:"frontier_workers"`
+		MaxFrontierSize       int               `toml:"max_frontier_size"`
+		MaxParseTime          int               `toml:"max_parse_time"`
+		MaxReadTime           int               `toml:"max_read_time"`
+		SkipRecentlyCrawled   bool              `toml:"skip_recently_crawled"`
+		RecentlyCrawled       int               `toml:"recently_crawled_window"`
+		RecordAlternates      bool              `toml:"record_alternates"`
+		FollowPagination      bool              `toml:"follow_pagination"`
+		PreferHTTPS           bool              `toml:"prefer_https"`
+		MaxWarmHosts          int               `toml:"max_warm_hosts"`
+		MaxConcurrencyPerHost int               `toml:"max_concurrency_per_host"`
+		CrawlDelay            int               `toml:"crawl_delay_ms"`
+		DelayJitter           int               `toml:"delay_jitter_ms"`
+		MaxTotalRetries       int               `toml:"max_total_retries"`
+		VisitedFilter         string            `toml:"visited_filter"`
+		BloomExpectedItems    int               `toml:"bloom_expected_items"`
+		BloomFalsePositive    float64           `toml:"bloom_false_positive_rate"`
+		SeedFile              string            `toml:"seed_file"`
+		SeedDepth             int               `toml:"seed_depth"`
+		Schedules             []Schedule        `toml:"schedules"`
+		RouteHints            []RouteHint       `toml:"route_hints"`
+		MaxRouteHintUrls      int               `toml:"max_route_hint_urls"`
+		SinkDir               string            `toml:"sink_dir"`
+		SinkFormat            string            `toml:"sink_format"`
+	}
+
+	// DepthRule changes the depth left beneath the links whose URL matches Pattern, a regular expression, by DepthDelta
+	DepthRule struct {
+		Pattern    string `toml:"pattern"`
+		DepthDelta int    `toml:"depth_delta"`
+	}
+
+	// Schedule is a crawl of Url to Depth which the service runs each time Cron, a cron expression parsed by
+	// schedule.Parse, is due
+	Schedule struct {
+		Url   string `toml:"url"`
+		Depth int    `toml:"depth"`
+		Cron  string `toml:"cron"`
+	}
+
+	// RouteHint lists the pages of a single-page app on Host which aren't linked to in its HTML. Each of Ids replaces
+	// {id} in Template, a path such as /item/{id}, to give the URL of one page.
+	RouteHint struct {
+		Host     string   `toml:"host"`
+		Template string   `toml:"template"`
+		Ids      []string `toml:"ids"`
 	}
 
 	// DatabaseConfig holds database section of toml config
 	DatabaseConfig struct {
-		Connections []*Connection
+		Driver            string
+		Connections       []*Connection
+		MaxConcurrentTxns int  `toml:"max_concurrent_txns"`
+		AlterTimeout      int  `toml:"alter_timeout"`
+		BestEffortReads   bool `toml:"best_effort_reads"`
 	}
 
 	QueueConfig struct {
@@ -47,25 +143,415 @@ type (
 		SQSWaitTimeSeconds            int64  `toml:"sqs_wait_time_seconds"`
 	}
 
+	// UrlConfig holds the URL normalization rules shared by the api and service
+	UrlConfig struct {
+		TrackingParams       []string `toml:"tracking_params"`
+		KeepDuplicateSlashes bool     `toml:"keep_duplicate_slashes"`
+		TrailingSlash        string   `toml:"trailing_slash"`
+	}
+
 	// Connection holds the database connection data
 	Connection struct {
 		Host string
 		Port int
 	}
+
+	// ValidationError lists every problem found in a config
+	ValidationError struct {
+		Problems []string
+	}
 )
 
-var AppConfig Config
+// acceptLanguagePattern matches an Accept-Language header value such as "en-US,en;q=0.9,*;q=0.5"
+var acceptLanguagePattern = regexp.MustCompile(`^\s*(\*|[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*)(\s*;\s*q=[01](\.[0-9]{0,3})?)?(\s*,\s*(\*|[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*)(\s*;\s*q=[01](\.[0-9]{0,3})?)?)*\s*$`)
+
+// headerNamePattern matches a valid HTTP header name
+var headerNamePattern = regexp.MustCompile(`^[!#$%&'*+\-.^_|~0-9A-Za-z]+$`)
+
+// reservedHeaders are the request headers the crawler or the HTTP client manage themselves, which the service's
+// headers can't override
+var reservedHeaders = map[string]struct{}{
+	"Host":              {},
+	"Cookie":            {},
+	"Connection":        {},
+	"Content-Length":    {},
+	"Transfer-Encoding": {},
+	"If-None-Match":     {},
+	"If-Modified-Since": {},
+}
+
+// IsReservedHeader function checks whether name, in any case, is a request header the crawler or the HTTP client
+// manage themselves
+func IsReservedHeader(name string) bool {
+	_, isPresent := reservedHeaders[http.CanonicalHeaderKey(name)]
+	return isPresent
+}
 
-// InitConfig loads config in from specified TOML file.
+var (
+	AppConfig   Config
+	configPath  string
+	configMutex sync.RWMutex
+)
+
+// InitConfig loads config in from specified TOML file, then applies any environment variable overrides (see EnvPrefix).
 func InitConfig(path string) (err error) {
 	tomlData, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Printf("Could not read config file: %s - %s", path, err.Error())
 		return
 	}
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	configPath = path
 	_, err = toml.Decode(string(tomlData), &AppConfig)
 	if err != nil {
 		log.Printf("Could not parse TOML config: %s - %s", path, err.Error())
+		return
+	}
+	err = applyEnv(&AppConfig, os.Environ())
+	if err != nil {
+		log.Printf("Could not apply environment overrides: %s", err.Error())
+	}
+	return
+}
+
+// Error function joins every problem into one message
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+// Validate checks the config for values which would otherwise only surface as failures at runtime, returning a
+// *ValidationError listing all of them.
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	validPort := func(port int) bool {
+		return port > 0 && port <= 65535
+	}
+
+	if !validPort(c.Api.Port) {
+		invalid("api.port must be between 1 and 65535, got %d", c.Api.Port)
+	}
+	if c.Api.MaxGoroutines < 0 {
+		invalid("api.max_goroutines must not be negative, got %d", c.Api.MaxGoroutines)
+	}
+	if c.Api.MaxDepth < 0 {
+		invalid("api.max_depth must not be negative, got %d", c.Api.MaxDepth)
+	}
+	if c.Api.MaxCrawlDuration < 0 {
+		invalid("api.max_crawl_duration must not be negative, got %d", c.Api.MaxCrawlDuration)
+	}
+	if c.Api.MaxReportedErrors < 0 {
+		invalid("api.max_reported_errors must not be negative, got %d", c.Api.MaxReportedErrors)
+	}
+	if c.Api.CacheTtl < 0 {
+		invalid("api.cache_ttl must not be negative, got %d", c.Api.CacheTtl)
+	}
+	if c.Api.CacheMaxAge < 0 {
+		invalid("api.cache_max_age must not be negative, got %d", c.Api.CacheMaxAge)
+	}
+
+	if !validPort(c.Service.Port) {
+		invalid("service.port must be between 1 and 65535, got %d", c.Service.Port)
+	}
+	if c.Service.MaxGoroutines < 0 {
+		invalid("service.max_goroutines must not be negative, got %d", c.Service.MaxGoroutines)
+	}
+	if c.Service.HttpRetryAttempts < 0 {
+		invalid("service.http_retry_attempts must not be negative, got %d", c.Service.HttpRetryAttempts)
+	}
+	if c.Service.HttpBackOffDuration < 0 {
+		invalid("service.http_back_off_duration must not be negative, got %d", c.Service.HttpBackOffDuration)
+	}
+	if c.Service.NumConsumers < 1 {
+		invalid("service.sqs_consumers_per_node must be at least 1, got %d", c.Service.NumConsumers)
+	}
+	if c.Service.MaxCrawlDuration < 0 {
+		invalid("service.max_crawl_duration must not be negative, got %d", c.Service.MaxCrawlDuration)
+	}
+	if c.Service.MaxIdleConnsPerHost < 0 {
+		invalid("service.max_idle_conns_per_host must not be negative, got %d", c.Service.MaxIdleConnsPerHost)
+	}
+	if c.Service.MaxLinksPerPage < 0 {
+		invalid("service.max_links_per_page must not be negative, got %d", c.Service.MaxLinksPerPage)
+	}
+	if c.Service.MaxURLLength < 0 {
+		invalid("service.max_url_length must not be negative, got %d", c.Service.MaxURLLength)
+	}
+	if c.Service.AcceptLanguage != "" && !acceptLanguagePattern.MatchString(c.Service.AcceptLanguage) {
+		invalid("service.accept_language must be a list of language tags with optional q values, got %q", c.Service.AcceptLanguage)
+	}
+	headerNames := make([]string, 0, len(c.Service.Headers))
+	for name := range c.Service.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	for _, name := range headerNames {
+		switch {
+		case !headerNamePattern.MatchString(name):
+			invalid("service.headers[%q] is not a valid header name", name)
+		case IsReservedHeader(name):
+			invalid("service.headers[%q] is set by the crawler and can't be overridden", name)
+		case strings.ContainsAny(c.Service.Headers[name], "\r\n"):
+			invalid("service.headers[%q] must not contain a line break", name)
+		}
+	}
+	if c.Service.DbTimeout < 0 {
+		invalid("service.db_timeout must not be negative, got %d", c.Service.DbTimeout)
+	}
+	if c.Service.MaxBytesPerHost < 0 {
+		invalid("service.max_bytes_per_host must not be negative, got %d", c.Service.MaxBytesPerHost)
+	}
+	if _, err := CompilePatterns(c.Service.ExcludePatterns); err != nil {
+		invalid("service.exclude_patterns %s", err.Error())
+	}
+	if _, err := CompilePatterns(c.Service.IncludePatterns); err != nil {
+		invalid("service.include_patterns %s", err.Error())
+	}
+	if _, err := CompilePatterns(c.Service.Soft404TitlePatterns); err != nil {
+		invalid("service.soft_404_title_patterns %s", err.Error())
+	}
+	if _, err := CompilePatterns(c.Service.Soft404BodyPatterns); err != nil {
+		invalid("service.soft_404_body_patterns %s", err.Error())
+	}
+	for i, rule := range c.Service.DepthRules {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			invalid("service.depth_rules[%d].pattern is not a valid regular expression: %v", i, err)
+		}
+	}
+	if c.Service.FrontierWorkers < 0 {
+		invalid("service.frontier_workers must not be negative, got %d", c.Service.FrontierWorkers)
+	}
+	if c.Service.MaxFrontierSize < 0 {
+		invalid("service.max_frontier_size must not be negative, got %d", c.Service.MaxFrontierSize)
+	}
+	if c.Service.SeedDepth < 0 {
+		invalid("service.seed_depth must not be negative, got %d", c.Service.SeedDepth)
+	}
+	for i, s := range c.Service.Schedules {
+		if u, err := url.Parse(s.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("service.schedules[%d].url must be an absolute http or https URL, got %q", i, s.Url)
+		}
+		if s.Depth < 0 {
+			invalid("service.schedules[%d].depth must not be negative, got %d", i, s.Depth)
+		}
+		if _, err := schedule.Parse(s.Cron); err != nil {
+			invalid("service.schedules[%d].cron is not a valid cron expression: %v", i, err)
+		}
+	}
+	for i, hint := range c.Service.RouteHints {
+		if hint.Host == "" {
+			invalid("service.route_hints[%d].host must be set", i)
+		}
+		if !strings.HasPrefix(hint.Template, "/") || !strings.Contains(hint.Template, "{id}") {
+			invalid("service.route_hints[%d].template must be a path starting with / containing {id}, got %q", i, hint.Template)
+		}
+	}
+	if c.Service.MaxRouteHintUrls < 0 {
+		invalid("service.max_route_hint_urls must not be negative, got %d", c.Service.MaxRouteHintUrls)
+	}
+	if c.Service.MaxParseTime < 0 {
+		invalid("service.max_parse_time must not be negative, got %d", c.Service.MaxParseTime)
+	}
+	if c.Service.MaxReadTime < 0 {
+		invalid("service.max_read_time must not be negative, got %d", c.Service.MaxReadTime)
+	}
+	if c.Service.RecentlyCrawled < 0 {
+		invalid("service.recently_crawled_window must not be negative, got %d", c.Service.RecentlyCrawled)
+	}
+	switch c.Service.VisitedFilter {
+	case "", "map":
+	case "bloom":
+		if c.Service.BloomExpectedItems < 1 {
+			invalid("service.bloom_expected_items must be at least 1, got %d", c.Service.BloomExpectedItems)
+		}
+		if c.Service.BloomFalsePositive <= 0 || c.Service.BloomFalsePositive >= 1 {
+			invalid("service.bloom_false_positive_rate must be between 0 and 1, got %g", c.Service.BloomFalsePositive)
+		}
+	default:
+		invalid("service.visited_filter must be map or bloom, got %q", c.Service.VisitedFilter)
+	}
+	switch c.Service.TimestampSource {
+	case "", "fetch", "last_modified":
+	default:
+		invalid("service.timestamp_source must be fetch or last_modified, got %q", c.Service.TimestampSource)
+	}
+	switch c.Service.SinkFormat {
+	case "", "json", "gob":
+	default:
+		invalid("service.sink_format must be json or gob, got %q", c.Service.SinkFormat)
+	}
+	switch c.Service.ParseMode {
+	case "", "lenient", "strict":
+	default:
+		invalid("service.parse_mode must be lenient or strict, got %q", c.Service.ParseMode)
+	}
+	if c.Service.StreamLinks {
+		var needsDocument []string
+		for setting, isSet := range map[string]bool{
+			"parse_mode strict":       c.Service.ParseMode == "strict",
+			"json_ld_links":           c.Service.JsonLdLinks,
+			"soft_404_title_patterns": len(c.Service.Soft404TitlePatterns) > 0,
+			"soft_404_body_patterns":  len(c.Service.Soft404BodyPatterns) > 0,
+			"record_alternates":       c.Service.RecordAlternates,
+			"follow_pagination":       c.Service.FollowPagination,
+			"max_warm_hosts":          c.Service.MaxWarmHosts > 0,
+		} {
+			if isSet {
+				needsDocument = append(needsDocument, setting)
+			}
+		}
+		sort.Strings(needsDocument)
+		if len(needsDocument) > 0 {
+			invalid("service.stream_links only finds a page's <a> links, title and robots meta tags, so can't be used with %s", strings.Join(needsDocument, ", "))
+		}
+	}
+	if c.Service.MaxConcurrencyPerHost < 0 {
+		invalid("service.max_concurrency_per_host must not be negative, got %d", c.Service.MaxConcurrencyPerHost)
+	}
+	if c.Service.CrawlDelay < 0 {
+		invalid("service.crawl_delay_ms must not be negative, got %d", c.Service.CrawlDelay)
+	}
+	if c.Service.DelayJitter < 0 || c.Service.DelayJitter > c.Service.CrawlDelay {
+		invalid("service.delay_jitter_ms must be between 0 and crawl_delay_ms (%d), got %d", c.Service.CrawlDelay, c.Service.DelayJitter)
+	}
+	if c.Service.MaxTotalRetries < 0 {
+		invalid("service.max_total_retries must not be negative, got %d", c.Service.MaxTotalRetries)
+	}
+	if c.Service.MaxWarmHosts < 0 {
+		invalid("service.max_warm_hosts must not be negative, got %d", c.Service.MaxWarmHosts)
+	}
+	if c.Service.IdleConnTimeout < 0 {
+		invalid("service.idle_conn_timeout must not be negative, got %d", c.Service.IdleConnTimeout)
+	}
+
+	switch c.Database.Driver {
+	case "", "dgraph":
+		if len(c.Database.Connections) == 0 {
+			invalid("database.connections must contain at least one connection")
+		}
+	case "memory":
+	default:
+		invalid("database.driver must be dgraph or memory, got %q", c.Database.Driver)
+	}
+	if c.Database.MaxConcurrentTxns < 0 {
+		invalid("database.max_concurrent_txns must not be negative, got %d", c.Database.MaxConcurrentTxns)
+	}
+	if c.Database.AlterTimeout < 0 {
+		invalid("database.alter_timeout must not be negative, got %d", c.Database.AlterTimeout)
+	}
+	switch c.Url.TrailingSlash {
+	case "", "strip", "keep", "keep_root":
+	default:
+		invalid("url.trailing_slash must be strip, keep or keep_root, got %q", c.Url.TrailingSlash)
+	}
+	for i, connection := range c.Database.Connections {
+		if connection.Host == "" {
+			invalid("database.connections[%d].host must be set", i)
+		}
+		if !validPort(connection.Port) {
+			invalid("database.connections[%d].port must be between 1 and 65535, got %d", i, connection.Port)
+		}
+	}
+
+	if c.Queue.MaxConcurrentReceivedMessages < 0 {
+		invalid("queue.max_concurrent_received_messages must not be negative, got %d", c.Queue.MaxConcurrentReceivedMessages)
+	}
+	if c.Queue.SQSWaitTimeSeconds < 0 {
+		invalid("queue.sqs_wait_time_seconds must not be negative, got %d", c.Queue.SQSWaitTimeSeconds)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// CompilePatterns compiles a list of regular expressions from the config, returning an error naming the first which
+// doesn't compile
+func CompilePatterns(patterns []string) (compiled []*regexp.Regexp, err error) {
+	for i, pattern := range patterns {
+		var re *regexp.Regexp
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("[%d] is not a valid regular expression: %v", i, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return
+}
+
+// Get returns a copy of the current config. Use it instead of AppConfig anywhere that can run while the config is
+// being reloaded.
+func Get() Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return AppConfig
+}
+
+// Update applies changes to the current config, such as command line overrides, without racing a reload.
+func Update(apply func(*Config)) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	apply(&AppConfig)
+}
+
+// Reload re-reads the TOML file passed to InitConfig. The current config is only replaced once the whole file has
+// parsed and validated, so a bad edit leaves the running config alone.
+func Reload() (err error) {
+	configMutex.RLock()
+	path := configPath
+	configMutex.RUnlock()
+	tomlData, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Could not read config file: %s - %s", path, err.Error())
+		return
+	}
+	var reloaded Config
+	_, err = toml.Decode(string(tomlData), &reloaded)
+	if err != nil {
+		log.Printf("Could not parse TOML config: %s - %s", path, err.Error())
+		return
+	}
+	err = applyEnv(&reloaded, os.Environ())
+	if err != nil {
+		log.Printf("Could not apply environment overrides: %s", err.Error())
+		return
+	}
+	err = reloaded.Validate()
+	if err != nil {
+		log.Printf("Could not reload config: %s - %s", path, err.Error())
+		return
 	}
+	configMutex.Lock()
+	AppConfig = reloaded
+	configMutex.Unlock()
 	return
 }
+
+// WatchReload reloads the config every time the process receives SIGHUP, calling onReload after each successful
+// reload so callers can apply the new values. Settings only read at startup, such as ports and database connections,
+// still need a restart. The returned function stops watching.
+func WatchReload(onReload func()) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if err := Reload(); err == nil && onReload != nil {
+					onReload()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -9,11 +9,273 @@ import (
 	"github.com/stevenayers/clamber/pkg/logging"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
+type (
+	ValidateTest struct {
+		Name             string
+		Mutate           func(c *config.Config)
+		ExpectedProblems []string
+	}
+)
+
+var ValidateTests = []ValidateTest{
+	{
+		"no database connections",
+		func(c *config.Config) { c.Database.Connections = nil },
+		[]string{"database.connections must contain at least one connection"},
+	},
+	{
+		"unknown database driver",
+		func(c *config.Config) { c.Database.Driver = "postgres" },
+		[]string{`database.driver must be dgraph or memory, got "postgres"`},
+	},
+	{
+		"memory driver without connections",
+		func(c *config.Config) { c.Database.Driver = "memory"; c.Database.Connections = nil },
+		nil,
+	},
+	{
+		"incomplete database connection",
+		func(c *config.Config) { c.Database.Connections = []*config.Connection{{Host: "", Port: 0}} },
+		[]string{
+			"database.connections[0].host must be set",
+			"database.connections[0].port must be between 1 and 65535, got 0",
+		},
+	},
+	{
+		"invalid exclude pattern",
+		func(c *config.Config) { c.Service.ExcludePatterns = []string{`/logout`, `\.pdf(`} },
+		[]string{"service.exclude_patterns [1] is not a valid regular expression: error parsing regexp: missing closing ): `\\.pdf(`"},
+	},
+	{
+		"invalid soft 404 pattern",
+		func(c *config.Config) { c.Service.Soft404BodyPatterns = []string{`(?i)page not found[`} },
+		[]string{"service.soft_404_body_patterns [0] is not a valid regular expression: error parsing regexp: missing closing ]: `[`"},
+	},
+	{
+		"unknown visited filter",
+		func(c *config.Config) { c.Service.VisitedFilter = "trie" },
+		[]string{`service.visited_filter must be map or bloom, got "trie"`},
+	},
+	{
+		"bloom filter without a size",
+		func(c *config.Config) {
+			c.Service.VisitedFilter = "bloom"
+			c.Service.BloomExpectedItems = 0
+			c.Service.BloomFalsePositive = 1
+		},
+		[]string{
+			"service.bloom_expected_items must be at least 1, got 0",
+			"service.bloom_false_positive_rate must be between 0 and 1, got 1",
+		},
+	},
+	{
+		"negative max url length",
+		func(c *config.Config) { c.Service.MaxURLLength = -1 },
+		[]string{"service.max_url_length must not be negative, got -1"},
+	},
+	{
+		"negative max frontier size",
+		func(c *config.Config) { c.Service.MaxFrontierSize = -1 },
+		[]string{"service.max_frontier_size must not be negative, got -1"},
+	},
+	{
+		"negative seed depth",
+		func(c *config.Config) { c.Service.SeedDepth = -1 },
+		[]string{"service.seed_depth must not be negative, got -1"},
+	},
+	{
+		"negative max parse time",
+		func(c *config.Config) { c.Service.MaxParseTime = -1 },
+		[]string{"service.max_parse_time must not be negative, got -1"},
+	},
+	{
+		"negative max read time",
+		func(c *config.Config) { c.Service.MaxReadTime = -1 },
+		[]string{"service.max_read_time must not be negative, got -1"},
+	},
+	{
+		"negative recently crawled window",
+		func(c *config.Config) { c.Service.RecentlyCrawled = -1 },
+		[]string{"service.recently_crawled_window must not be negative, got -1"},
+	},
+	{
+		"invalid headers",
+		func(c *config.Config) {
+			c.Service.Headers = map[string]string{
+				"X-Api-Key":  "secret",
+				"Bad Header": "x",
+				"host":       "evil.example.com",
+				"X-Injected": "a\r\nCookie: b",
+			}
+		},
+		[]string{
+			`service.headers["Bad Header"] is not a valid header name`,
+			`service.headers["X-Injected"] must not contain a line break`,
+			`service.headers["host"] is set by the crawler and can't be overridden`,
+		},
+	},
+	{
+		"invalid depth rule pattern",
+		func(c *config.Config) {
+			c.Service.DepthRules = []config.DepthRule{{Pattern: `/blog/`, DepthDelta: 2}, {Pattern: `/tag/(`, DepthDelta: -1}}
+		},
+		[]string{"service.depth_rules[1].pattern is not a valid regular expression: error parsing regexp: missing closing ): `/tag/(`"},
+	},
+	{
+		"invalid schedules",
+		func(c *config.Config) {
+			c.Service.Schedules = []config.Schedule{
+				{Url: "https://golang.org", Depth: 2, Cron: "0 3 * * *"},
+				{Url: "golang.org", Depth: -1, Cron: "0 3 * *"},
+			}
+		},
+		[]string{
+			`service.schedules[1].url must be an absolute http or https URL, got "golang.org"`,
+			"service.schedules[1].depth must not be negative, got -1",
+			`service.schedules[1].cron is not a valid cron expression: expected 5 fields, got 4 in "0 3 * *"`,
+		},
+	},
+	{
+		"invalid route hints",
+		func(c *config.Config) {
+			c.Service.RouteHints = []config.RouteHint{
+				{Host: "app.example.com", Template: "/item/{id}", Ids: []string{"1"}},
+				{Template: "item/{id}"},
+				{Host: "app.example.com", Template: "/item"},
+			}
+			c.Service.MaxRouteHintUrls = -1
+		},
+		[]string{
+			"service.route_hints[1].host must be set",
+			`service.route_hints[1].template must be a path starting with / containing {id}, got "item/{id}"`,
+			`service.route_hints[2].template must be a path starting with / containing {id}, got "/item"`,
+			"service.max_route_hint_urls must not be negative, got -1",
+		},
+	},
+	{
+		"negative frontier workers",
+		func(c *config.Config) { c.Service.FrontierWorkers = -1 },
+		[]string{"service.frontier_workers must not be negative, got -1"},
+	},
+	{
+		"unknown timestamp source",
+		func(c *config.Config) { c.Service.TimestampSource = "date" },
+		[]string{`service.timestamp_source must be fetch or last_modified, got "date"`},
+	},
+	{
+		"unknown sink format",
+		func(c *config.Config) { c.Service.SinkFormat = "msgpack" },
+		[]string{`service.sink_format must be json or gob, got "msgpack"`},
+	},
+	{
+		"unknown parse mode",
+		func(c *config.Config) { c.Service.ParseMode = "pedantic" },
+		[]string{`service.parse_mode must be lenient or strict, got "pedantic"`},
+	},
+	{
+		"stream links with a parsed document",
+		func(c *config.Config) {
+			c.Service.StreamLinks = true
+			c.Service.ParseMode = "strict"
+			c.Service.FollowPagination = true
+		},
+		[]string{"service.stream_links only finds a page's <a> links, title and robots meta tags, so can't be used with follow_pagination, parse_mode strict"},
+	},
+	{
+		"unknown trailing slash policy",
+		func(c *config.Config) { c.Url.TrailingSlash = "trim" },
+		[]string{`url.trailing_slash must be strip, keep or keep_root, got "trim"`},
+	},
+	{
+		"negative max concurrency per host",
+		func(c *config.Config) { c.Service.MaxConcurrencyPerHost = -1 },
+		[]string{"service.max_concurrency_per_host must not be negative, got -1"},
+	},
+	{
+		"negative crawl delay",
+		func(c *config.Config) { c.Service.CrawlDelay = -1 },
+		[]string{"service.crawl_delay_ms must not be negative, got -1", "service.delay_jitter_ms must be between 0 and crawl_delay_ms (-1), got 0"},
+	},
+	{
+		"delay jitter above crawl delay",
+		func(c *config.Config) {
+			c.Service.CrawlDelay = 100
+			c.Service.DelayJitter = 150
+		},
+		[]string{"service.delay_jitter_ms must be between 0 and crawl_delay_ms (100), got 150"},
+	},
+	{
+		"negative max total retries",
+		func(c *config.Config) { c.Service.MaxTotalRetries = -1 },
+		[]string{"service.max_total_retries must not be negative, got -1"},
+	},
+	{
+		"negative max warm hosts",
+		func(c *config.Config) { c.Service.MaxWarmHosts = -1 },
+		[]string{"service.max_warm_hosts must not be negative, got -1"},
+	},
+	{
+		"negative max concurrent txns",
+		func(c *config.Config) { c.Database.MaxConcurrentTxns = -1 },
+		[]string{"database.max_concurrent_txns must not be negative, got -1"},
+	},
+	{
+		"negative alter timeout",
+		func(c *config.Config) { c.Database.AlterTimeout = -1 },
+		[]string{"database.alter_timeout must not be negative, got -1"},
+	},
+	{
+		"zero ports",
+		func(c *config.Config) { c.Api.Port = 0; c.Service.Port = 0 },
+		[]string{
+			"api.port must be between 1 and 65535, got 0",
+			"service.port must be between 1 and 65535, got 0",
+		},
+	},
+	{
+		"negative depth and timeouts",
+		func(c *config.Config) {
+			c.Api.MaxDepth = -1
+			c.Service.HttpBackOffDuration = -2
+			c.Service.MaxCrawlDuration = -3
+		},
+		[]string{
+			"api.max_depth must not be negative, got -1",
+			"service.http_back_off_duration must not be negative, got -2",
+			"service.max_crawl_duration must not be negative, got -3",
+		},
+	},
+	{
+		"negative cache ttl",
+		func(c *config.Config) { c.Api.CacheTtl = -1 },
+		[]string{"api.cache_ttl must not be negative, got -1"},
+	},
+	{
+		"negative cache max age",
+		func(c *config.Config) { c.Api.CacheMaxAge = -1 },
+		[]string{"api.cache_max_age must not be negative, got -1"},
+	},
+	{
+		"malformed accept language",
+		func(c *config.Config) { c.Service.AcceptLanguage = "en-US;q=high" },
+		[]string{`service.accept_language must be a list of language tags with optional q values, got "en-US;q=high"`},
+	},
+	{
+		"no consumers",
+		func(c *config.Config) { c.Service.NumConsumers = 0 },
+		[]string{"service.sqs_consumers_per_node must be at least 1, got 0"},
+	},
+}
+
 type StoreSuite struct {
 	suite.Suite
 	store   relationship.Store
@@ -86,3 +348,152 @@ func (s *StoreSuite) TestConfigParse() {
 			err.Error(), "cannot load TOML value of type string into a Go integer"))
 	}
 }
+
+func (s *StoreSuite) TestReloadOnSighup() {
+	tomlData, err := ioutil.ReadFile("/Users/steven/git/clamber/configs/config.toml")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "clamber")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.toml")
+	if err = ioutil.WriteFile(configFile, tomlData, 0644); err != nil {
+		s.T().Fatal(err)
+	}
+	if err = config.InitConfig(configFile); err != nil {
+		s.T().Fatal(err)
+	}
+
+	reloaded := make(chan struct{}, 1)
+	stop := config.WatchReload(func() { reloaded <- struct{}{} })
+	defer stop()
+	tomlData = []byte(strings.Replace(string(tomlData), "record_redirects = false", "record_redirects = true", 1))
+	if err = ioutil.WriteFile(configFile, tomlData, 0644); err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), false, config.Get().Service.RecordRedirects, "config should not change before the signal")
+	if err = syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		s.T().Fatal(err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("config was not reloaded")
+	}
+	assert.Equal(s.T(), true, config.Get().Service.RecordRedirects)
+}
+
+func (s *StoreSuite) TestReloadKeepsConfigOnParseError() {
+	err := config.Reload()
+	assert.Equal(s.T(), nil, err)
+	retries := config.Get().Service.HttpRetryAttempts
+	err = config.InitConfig("/Users/steven/git/clamber/test/invaild_config.toml")
+	assert.Equal(s.T(), true, err != nil)
+	err = config.Reload()
+	assert.Equal(s.T(), true, err != nil)
+	assert.Equal(s.T(), retries, config.Get().Service.HttpRetryAttempts)
+}
+
+func (s *StoreSuite) TestReloadKeepsConfigOnValidationError() {
+	tomlData, err := ioutil.ReadFile("/Users/steven/git/clamber/configs/config.toml")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "clamber")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.toml")
+	if err = ioutil.WriteFile(configFile, tomlData, 0644); err != nil {
+		s.T().Fatal(err)
+	}
+	if err = config.InitConfig(configFile); err != nil {
+		s.T().Fatal(err)
+	}
+
+	tomlData = []byte(strings.Replace(string(tomlData), "exclude_patterns = []", `exclude_patterns = ["[invalid"]`, 1))
+	if err = ioutil.WriteFile(configFile, tomlData, 0644); err != nil {
+		s.T().Fatal(err)
+	}
+	err = config.Reload()
+	_, ok := err.(*config.ValidationError)
+	assert.Equal(s.T(), true, ok, "an invalid config should not be reloaded")
+	assert.Equal(s.T(), 0, len(config.Get().Service.ExcludePatterns), "the running config should be kept")
+}
+
+func (s *StoreSuite) TestValidate() {
+	c := config.Get()
+	assert.Equal(s.T(), nil, c.Validate(), "the default config should be valid")
+	c.Service.AcceptLanguage = "en-US,en;q=0.9,*;q=0.5"
+	assert.Equal(s.T(), nil, c.Validate(), "a quality weighted accept language should be valid")
+	for _, test := range ValidateTests {
+		c := config.Get()
+		c.Database.Connections = []*config.Connection{{Host: "localhost", Port: 9080}}
+		test.Mutate(&c)
+		err := c.Validate()
+		if test.ExpectedProblems == nil {
+			assert.Equal(s.T(), nil, err, test.Name)
+			continue
+		}
+		validationError, ok := err.(*config.ValidationError)
+		if !assert.Equal(s.T(), true, ok, test.Name) {
+			continue
+		}
+		assert.Equal(s.T(), test.ExpectedProblems, validationError.Problems, test.Name)
+	}
+}
+
+func (s *StoreSuite) TestEnvOverrides() {
+	env := map[string]string{
+		"CLAMBER_DATABASE_CONNECTIONS_0_HOST":       "dgraph-alpha",
+		"CLAMBER_DATABASE_CONNECTIONS_1_HOST":       "dgraph-beta",
+		"CLAMBER_DATABASE_CONNECTIONS_1_PORT":       "9081",
+		"CLAMBER_SERVICE_SQS_CONSUMERS_PER_NODE":    "4",
+		"CLAMBER_SERVICE_RECORD_REDIRECTS":          "true",
+		"CLAMBER_URL_TRACKING_PARAMS":               "utm_*, ref",
+		"CLAMBER_SERVICE_BLOOM_FALSE_POSITIVE_RATE": "0.001",
+		"CLAMBER_SERVICE_HEADERS":                   "X-Crawler=clamber, X-Team=search",
+	}
+	for name, value := range env {
+		_ = os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	err := config.InitConfig("/Users/steven/git/clamber/configs/config.toml")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	c := config.Get()
+	assert.Equal(s.T(), 2, len(c.Database.Connections))
+	assert.Equal(s.T(), "dgraph-alpha", c.Database.Connections[0].Host)
+	assert.Equal(s.T(), 9080, c.Database.Connections[0].Port, "values without an override should come from the file")
+	assert.Equal(s.T(), "dgraph-beta", c.Database.Connections[1].Host)
+	assert.Equal(s.T(), 9081, c.Database.Connections[1].Port)
+	assert.Equal(s.T(), 4, c.Service.NumConsumers)
+	assert.Equal(s.T(), true, c.Service.RecordRedirects)
+	assert.Equal(s.T(), []string{"utm_*", "ref"}, c.Url.TrackingParams)
+	assert.Equal(s.T(), 0.001, c.Service.BloomFalsePositive)
+	assert.Equal(s.T(), map[string]string{"X-Crawler": "clamber", "X-Team": "search"}, c.Service.Headers)
+}
+
+func (s *StoreSuite) TestEnvOverridesInvalid() {
+	for name, value := range map[string]string{
+		"CLAMBER_SERVICE_PORTT":                     "80",
+		"CLAMBER_SERVICE_PORT":                      "eighty",
+		"CLAMBER_DATABASE_CONNECTIONS_HOST":         "dgraph",
+		"CLAMBER_SERVICE_INSECURE_SKIP_VERIFY":      "maybe",
+		"CLAMBER_SERVICE_BLOOM_FALSE_POSITIVE_RATE": "rare",
+		"CLAMBER_SERVICE_HEADERS":                   "X-Crawler",
+	} {
+		_ = os.Setenv(name, value)
+		err := config.InitConfig("/Users/steven/git/clamber/configs/config.toml")
+		_ = os.Unsetenv(name)
+		assert.Equal(s.T(), true, err != nil, name)
+		if err != nil {
+			assert.Equal(s.T(), true, strings.Contains(err.Error(), name), err.Error())
+		}
+	}
+}
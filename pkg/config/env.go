@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the name of every environment variable which overrides a config value.
+//
+// The rest of the name is the TOML section and key in upper case, joined with underscores, e.g.
+// CLAMBER_SERVICE_HTTP_RETRY_ATTEMPTS overrides http_retry_attempts in the [service] section. Entries in a list of
+// tables are addressed by their index, e.g. CLAMBER_DATABASE_CONNECTIONS_0_HOST, and an index past the end of the list
+// adds an entry. Lists of strings, such as CLAMBER_URL_TRACKING_PARAMS, are comma separated, and maps of strings, such
+// as CLAMBER_SERVICE_HEADERS, are comma separated name=value pairs which replace the whole map, so their values can't
+// contain commas.
+const EnvPrefix = "CLAMBER_"
+
+// applyEnv overrides values in the config with any CLAMBER_ environment variables, so they take precedence over the
+// TOML file.
+func applyEnv(c *Config, environ []string) (err error) {
+	for _, variable := range environ {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], EnvPrefix) {
+			continue
+		}
+		err = setEnvValue(reflect.ValueOf(c).Elem(), strings.TrimPrefix(parts[0], EnvPrefix), parts[1])
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %w", parts[0], err)
+		}
+	}
+	return
+}
+
+// setEnvValue walks the remaining name down through the config, matching the longest key at each level as keys
+// contain underscores themselves, then parses the value into the field it ends at.
+func setEnvValue(v reflect.Value, name string, value string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setEnvValue(v.Elem(), name, value)
+	case reflect.Struct:
+		matchKey := ""
+		var match reflect.Value
+		for i := 0; i < v.NumField(); i++ {
+			key := strings.ToUpper(tomlKey(v.Type().Field(i)))
+			if (name == key || strings.HasPrefix(name, key+"_")) && len(key) > len(matchKey) {
+				matchKey = key
+				match = v.Field(i)
+			}
+		}
+		if matchKey == "" {
+			return fmt.Errorf("unknown config key %s", name)
+		}
+		return setEnvValue(match, strings.TrimPrefix(strings.TrimPrefix(name, matchKey), "_"), value)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && name == "" {
+			values := reflect.MakeSlice(v.Type(), 0, 0)
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = reflect.Append(values, reflect.ValueOf(item))
+				}
+			}
+			v.Set(values)
+			return nil
+		}
+		parts := strings.SplitN(name, "_", 2)
+		index, err := strconv.Atoi(parts[0])
+		if err != nil || index < 0 || len(parts) != 2 {
+			return fmt.Errorf("expected an index and key, got %s", name)
+		}
+		if index >= v.Len() {
+			grown := reflect.MakeSlice(v.Type(), index+1, index+1)
+			reflect.Copy(grown, v)
+			v.Set(grown)
+		}
+		return setEnvValue(v.Index(index), parts[1], value)
+	}
+	if name != "" {
+		return fmt.Errorf("unknown config key %s", name)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(parsed)
+	case reflect.Map:
+		if v.Type() != reflect.TypeOf(map[string]string{}) {
+			return fmt.Errorf("unsupported config type %s", v.Type())
+		}
+		values := make(map[string]string)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			pair := strings.SplitN(item, "=", 2)
+			if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+				return fmt.Errorf("expected name=value, got %s", item)
+			}
+			values[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+		v.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
+
+// tomlKey returns the key a struct field is decoded from
+func tomlKey(field reflect.StructField) string {
+	if tag := field.Tag.Get("toml"); tag != "" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(field.Name)
+}
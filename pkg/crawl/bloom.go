@@ -0,0 +1,72 @@
+package crawl
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+type (
+	// VisitedSet records the URLs a crawler has already crawled, in place of the exact AlreadyCrawled map
+	VisitedSet interface {
+		// CheckAndAdd reports whether Url has been added before, adding it if not
+		CheckAndAdd(Url string) bool
+	}
+
+	// BloomFilter is a VisitedSet which uses a fixed amount of memory however many URLs are added, at the cost of
+	// sometimes reporting a URL which hasn't been added as already crawled, so the page is skipped. It never reports a
+	// URL which has been added as new. It is safe for concurrent use.
+	BloomFilter struct {
+		sync.Mutex
+		bits   []uint64
+		size   uint64
+		hashes uint64
+	}
+)
+
+// NewBloomFilter function creates an empty BloomFilter sized so that once expectedItems URLs have been added, a new URL
+// is wrongly reported as already crawled with a probability of about falsePositiveRate. Adding more URLs than expected
+// raises that probability.
+func NewBloomFilter(expectedItems int, falsePositiveRate float64) *BloomFilter {
+	if expectedItems < 1 {
+		expectedItems = 1
+	}
+	size := uint64(math.Ceil(-float64(expectedItems) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if size < 64 {
+		size = 64
+	}
+	hashes := uint64(math.Round(float64(size) / float64(expectedItems) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &BloomFilter{bits: make([]uint64, (size+63)/64), size: size, hashes: hashes}
+}
+
+// CheckAndAdd function reports whether Url may have been added before, adding it if not
+func (filter *BloomFilter) CheckAndAdd(Url string) (isPresent bool) {
+	first, second := bloomHashes(Url)
+	filter.Lock()
+	defer filter.Unlock()
+	isPresent = true
+	for i := uint64(0); i < filter.hashes; i++ {
+		bit := (first + i*second) % filter.size
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if filter.bits[word]&mask == 0 {
+			isPresent = false
+			filter.bits[word] |= mask
+		}
+	}
+	return
+}
+
+// bloomHashes function returns two hashes of Url, the halves of its 128 bit FNV-1a hash, which BloomFilter combines to
+// make each of its hashes. The second is odd so every hash differs.
+func bloomHashes(Url string) (first uint64, second uint64) {
+	h := fnv.New128a()
+	_, _ = h.Write([]byte(Url))
+	sum := h.Sum(nil)
+	first = binary.BigEndian.Uint64(sum[:8])
+	second = binary.BigEndian.Uint64(sum[8:]) | 1
+	return
+}
@@ -0,0 +1,31 @@
+package crawl_test
+
+import (
+	"fmt"
+	"github.com/stevenayers/clamber/pkg/crawl"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *StoreSuite) TestBloomFilter() {
+	const expectedItems, falsePositiveRate = 10000, 0.01
+	filter := crawl.NewBloomFilter(expectedItems, falsePositiveRate)
+	for i := 0; i < expectedItems; i++ {
+		filter.CheckAndAdd(fmt.Sprintf("https://golang.org/pkg/%d", i))
+	}
+	for i := 0; i < expectedItems; i++ {
+		Url := fmt.Sprintf("https://golang.org/pkg/%d", i)
+		if !assert.Equal(s.T(), true, filter.CheckAndAdd(Url), "added URLs should always be seen") {
+			break
+		}
+	}
+	// checking an unseen URL adds it too, so only check a few to keep the filter near the size it was made for
+	const unseenItems = expectedItems / 10
+	falsePositives := 0
+	for i := 0; i < unseenItems; i++ {
+		if filter.CheckAndAdd(fmt.Sprintf("https://golang.org/doc/%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Equal(s.T(), true, float64(falsePositives) <= 2*falsePositiveRate*unseenItems,
+		fmt.Sprintf("%d of %d unseen URLs were reported as seen", falsePositives, unseenItems))
+}
@@ -1,19 +1,31 @@
 package crawl
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/go-kit/kit/log/level"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stevenayers/clamber/pkg/cache"
 	"github.com/stevenayers/clamber/pkg/config"
 	"github.com/stevenayers/clamber/pkg/database/relationship"
 	"github.com/stevenayers/clamber/pkg/logging"
 	"github.com/stevenayers/clamber/pkg/page"
 	"github.com/stevenayers/clamber/pkg/queue"
+	"io"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,35 +33,473 @@ import (
 type (
 	Crawler struct {
 		AlreadyCrawled map[string]struct{}
+		VisitedFilter  VisitedSet
 		sync.Mutex
-		DbWaitGroup          sync.WaitGroup
-		BgWaitGroup          sync.WaitGroup
-		BgNotified           bool
-		BgWaitNotified       bool
-		Store                *relationship.Store
-		BackgroundCrawlDepth int
-		CrawlUid             uuid.UUID
-		Queue                *queue.Queue
+		DbWaitGroup           sync.WaitGroup
+		BgWaitGroup           sync.WaitGroup
+		BgNotified            bool
+		BgWaitNotified        bool
+		Store                 relationship.Graph
+		BackgroundCrawlDepth  int
+		CrawlUid              uuid.UUID
+		Queue                 *queue.Queue
+		Frontier              Frontier
+		Fetcher               Fetcher
+		OpenSink              func(name string) (ResultSink, error)
+		SinkDir               string
+		SinkFormat            string
+		StatsRecorder         *StatsRecorder
+		InsecureSkipVerify    bool
+		MaxDuration           time.Duration
+		RecordRedirects       bool
+		MaxIdleConnsPerHost   int
+		IdleConnTimeout       time.Duration
+		ForceAttemptHTTP2     bool
+		ForceHTTP1            bool
+		Recrawl               bool
+		PruneStaleLinks       bool
+		MaxLinksPerPage       int
+		MaxURLLength          int
+		AcceptLanguage        string
+		Headers               map[string]string
+		DbTimeout             time.Duration
+		MaxBytesPerHost       int64
+		ExcludePatterns       []*regexp.Regexp
+		IncludePatterns       []*regexp.Regexp
+		Soft404TitlePatterns  []*regexp.Regexp
+		Soft404BodyPatterns   []*regexp.Regexp
+		FollowSelfLinks       bool
+		HonorRobotsNoFollow   bool
+		HonorRobotsNoIndex    bool
+		DepthRules            []DepthRule
+		LinkExtractor         page.LinkExtractor
+		RecordErrors          bool
+		JsonLdLinks           bool
+		TimestampSource       string
+		ParseMode             string
+		StreamLinks           bool
+		MaxParseTime          time.Duration
+		MaxReadTime           time.Duration
+		SkipRecentlyCrawled   bool
+		RecentlyCrawled       time.Duration
+		RecordAlternates      bool
+		FollowPagination      bool
+		PreferHTTPS           bool
+		MaxWarmHosts          int
+		MaxConcurrencyPerHost int
+		CrawlDelay            time.Duration
+		DelayJitter           time.Duration
+		MaxTotalRetries       int
+		FrontierWorkers       int
+		MaxFrontierSize       int
+		SeedFile              string
+		SeedDepth             int
+		Schedules             []config.Schedule
+		RouteHints            []config.RouteHint
+		MaxRouteHintUrls      int
+		Score                 ScoreFunc
+		Client                *http.Client
+		settingsMutex         sync.RWMutex
+		hostBytes             map[hostBudget]int64
+		warmedHosts           map[hostBudget]struct{}
+		hostSlots             map[string]chan struct{}
+		hostNextRequest       map[string]time.Time
+		retriesSpent          map[string]int
+		paginated             map[crawlUrl]struct{}
+		sinks                 map[string]ResultSink
+		sunk                  map[string]struct{}
+		sessions              map[string]*crawlSession
 	}
+
+	// Frontier holds the pages waiting to be crawled. queue.Queue is the frontier shared by every service through SQS,
+	// and is used when a Crawler has no Frontier set.
+	Frontier interface {
+		Publish(p *page.Page)
+	}
+
+	// Fetcher sends the request for a page's URL. An HttpFetcher with the crawler's client is used when a Crawler has
+	// no Fetcher set, and another can be set to fetch pages some other way, such as through a headless browser.
+	Fetcher interface {
+		Fetch(ctx context.Context, Url string) (*http.Response, error)
+	}
+
+	// HttpFetcher fetches pages with a GET request sent by Client, with Header added to each request
+	HttpFetcher struct {
+		Client *http.Client
+		Header http.Header
+	}
+
+	// DepthRule changes the depth left beneath the links whose URL matches Pattern by DepthDelta
+	DepthRule struct {
+		Pattern    *regexp.Regexp
+		DepthDelta int
+	}
+
+	// SeedOptions holds the settings shared by every seed page of a crawl started with Seed. Sink names the ResultSink
+	// the crawl's pages are written to, if any, and CrawlId the crawl its pages and links are attributed to in the
+	// graph, if any.
+	SeedOptions struct {
+		Depth    int
+		Deadline int64
+		Login    *page.Login
+		Sink     string
+		CrawlId  string
+	}
+
+	// crawlSession holds the cookies of a crawl, shared by every page of the crawl fetched by this crawler, and whether
+	// it has logged in
+	crawlSession struct {
+		sync.Mutex
+		jar      http.CookieJar
+		loggedIn bool
+		expires  int64
+	}
+
+	// hostBudget identifies a host within a crawl, as MaxBytesPerHost is spent, and hosts are warmed, separately by each
+	// crawl
+	hostBudget struct {
+		startUrl string
+		host     string
+	}
+
+	// crawlUrl identifies a page within a crawl, as pagination links are followed once by each crawl
+	crawlUrl struct {
+		startUrl string
+		url      string
+	}
+
+	// crawlKey is the context key crawlContext stores the StartUrl of a page's crawl under, so the retries made for
+	// the page are charged to its crawl's retry budget
+	crawlKey struct{}
+
+	// releasingBody frees the host slot a request took once its response body is closed
+	releasingBody struct {
+		io.ReadCloser
+		release func()
+		once    sync.Once
+	}
+
+	// countingBody counts the bytes read from a response body. The count is updated atomically, as a read abandoned
+	// by page.ReadBody may still be running when it is checked.
+	countingBody struct {
+		io.ReadCloser
+		bytes int64
+	}
+)
+
+const (
+	// TimestampFetch stamps pages with the time they were fetched, and is used when no timestamp source is configured
+	TimestampFetch = "fetch"
+	// TimestampLastModified stamps pages with their Last-Modified header, falling back to the fetch time without one
+	TimestampLastModified = "last_modified"
 )
 
+// ErrRetryBudgetExhausted is returned by fetches and database writes which would retry once their crawl has made
+// MaxTotalRetries retries
+var ErrRetryBudgetExhausted = errors.New("crawl retry budget exhausted")
+
+// ErrSoft404 is the error stored, with RecordErrors, for a page served with a success status which matched the soft
+// 404 patterns
+var ErrSoft404 = errors.New("soft 404: page looks like an error page")
+
+// DbRetries records how many times each database write was retried before it finished, by operation ("create page",
+// "record error" or "create link") and outcome ("success", "exhausted" or "error")
+var DbRetries = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "clamber_db_retries",
+	Help:    "Number of times a database write was retried before it finished.",
+	Buckets: []float64{0, 1, 2, 3, 5, 10, 20},
+}, []string{"operation", "outcome"})
+
+func init() {
+	prometheus.MustRegister(DbRetries)
+}
+
 func New() (c Crawler) {
 	c = Crawler{
-		DbWaitGroup:    sync.WaitGroup{},
-		Store:          &relationship.Store{},
-		CrawlUid:       uuid.New(),
-		AlreadyCrawled: make(map[string]struct{}),
+		DbWaitGroup:           sync.WaitGroup{},
+		Store:                 relationship.NewStore(),
+		CrawlUid:              uuid.New(),
+		AlreadyCrawled:        make(map[string]struct{}),
+		InsecureSkipVerify:    config.AppConfig.Service.InsecureSkipVerify,
+		MaxDuration:           time.Duration(config.AppConfig.Service.MaxCrawlDuration) * time.Second,
+		SinkDir:               config.AppConfig.Service.SinkDir,
+		SinkFormat:            config.AppConfig.Service.SinkFormat,
+		RecordRedirects:       config.AppConfig.Service.RecordRedirects,
+		MaxIdleConnsPerHost:   config.AppConfig.Service.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(config.AppConfig.Service.IdleConnTimeout) * time.Second,
+		ForceAttemptHTTP2:     config.AppConfig.Service.ForceAttemptHTTP2,
+		ForceHTTP1:            config.AppConfig.Service.ForceHTTP1,
+		Recrawl:               config.AppConfig.Service.Recrawl,
+		PruneStaleLinks:       config.AppConfig.Service.PruneStaleLinks,
+		MaxLinksPerPage:       config.AppConfig.Service.MaxLinksPerPage,
+		MaxURLLength:          config.AppConfig.Service.MaxURLLength,
+		AcceptLanguage:        config.AppConfig.Service.AcceptLanguage,
+		Headers:               config.AppConfig.Service.Headers,
+		DbTimeout:             time.Duration(config.AppConfig.Service.DbTimeout) * time.Second,
+		MaxBytesPerHost:       config.AppConfig.Service.MaxBytesPerHost,
+		RecordErrors:          config.AppConfig.Service.RecordErrors,
+		JsonLdLinks:           config.AppConfig.Service.JsonLdLinks,
+		TimestampSource:       config.AppConfig.Service.TimestampSource,
+		ParseMode:             config.AppConfig.Service.ParseMode,
+		StreamLinks:           config.AppConfig.Service.StreamLinks,
+		FrontierWorkers:       config.AppConfig.Service.FrontierWorkers,
+		MaxParseTime:          time.Duration(config.AppConfig.Service.MaxParseTime) * time.Second,
+		MaxReadTime:           time.Duration(config.AppConfig.Service.MaxReadTime) * time.Second,
+		SkipRecentlyCrawled:   config.AppConfig.Service.SkipRecentlyCrawled,
+		RecentlyCrawled:       time.Duration(config.AppConfig.Service.RecentlyCrawled) * time.Second,
+		RecordAlternates:      config.AppConfig.Service.RecordAlternates,
+		FollowPagination:      config.AppConfig.Service.FollowPagination,
+		PreferHTTPS:           config.AppConfig.Service.PreferHTTPS,
+		FollowSelfLinks:       config.AppConfig.Service.FollowSelfLinks,
+		HonorRobotsNoFollow:   config.AppConfig.Service.HonorRobotsNoFollow,
+		HonorRobotsNoIndex:    config.AppConfig.Service.HonorRobotsNoIndex,
+		MaxWarmHosts:          config.AppConfig.Service.MaxWarmHosts,
+		MaxConcurrencyPerHost: config.AppConfig.Service.MaxConcurrencyPerHost,
+		CrawlDelay:            time.Duration(config.AppConfig.Service.CrawlDelay) * time.Millisecond,
+		DelayJitter:           time.Duration(config.AppConfig.Service.DelayJitter) * time.Millisecond,
+		MaxTotalRetries:       config.AppConfig.Service.MaxTotalRetries,
+		MaxFrontierSize:       config.AppConfig.Service.MaxFrontierSize,
+		SeedFile:              config.AppConfig.Service.SeedFile,
+		SeedDepth:             config.AppConfig.Service.SeedDepth,
+		Schedules:             config.AppConfig.Service.Schedules,
+		RouteHints:            config.AppConfig.Service.RouteHints,
+		MaxRouteHintUrls:      config.AppConfig.Service.MaxRouteHintUrls,
 	}
+	if config.AppConfig.Service.VisitedFilter == "bloom" {
+		c.VisitedFilter = NewBloomFilter(config.AppConfig.Service.BloomExpectedItems, config.AppConfig.Service.BloomFalsePositive)
+	}
+	c.compilePatterns(config.AppConfig.Service)
 	c.Queue = queue.NewQueue()
 	c.Store.Connect()
 	return
 }
 
+// Reconfigure function applies reloaded service config to the crawler. Pages already being crawled keep the settings
+// they started with; the new ones are picked up by the next page crawled.
+func (crawler *Crawler) Reconfigure(serviceConfig config.ServiceConfig) {
+	crawler.settingsMutex.Lock()
+	defer crawler.settingsMutex.Unlock()
+	idleConnTimeout := time.Duration(serviceConfig.IdleConnTimeout) * time.Second
+	if crawler.InsecureSkipVerify != serviceConfig.InsecureSkipVerify ||
+		crawler.MaxIdleConnsPerHost != serviceConfig.MaxIdleConnsPerHost ||
+		crawler.IdleConnTimeout != idleConnTimeout ||
+		crawler.ForceAttemptHTTP2 != serviceConfig.ForceAttemptHTTP2 ||
+		crawler.ForceHTTP1 != serviceConfig.ForceHTTP1 {
+		crawler.Client = nil
+	}
+	crawler.InsecureSkipVerify = serviceConfig.InsecureSkipVerify
+	crawler.MaxIdleConnsPerHost = serviceConfig.MaxIdleConnsPerHost
+	crawler.IdleConnTimeout = idleConnTimeout
+	crawler.ForceAttemptHTTP2 = serviceConfig.ForceAttemptHTTP2
+	crawler.ForceHTTP1 = serviceConfig.ForceHTTP1
+	crawler.MaxDuration = time.Duration(serviceConfig.MaxCrawlDuration) * time.Second
+	crawler.RecordRedirects = serviceConfig.RecordRedirects
+	crawler.SinkDir = serviceConfig.SinkDir
+	crawler.SinkFormat = serviceConfig.SinkFormat
+	crawler.Recrawl = serviceConfig.Recrawl
+	crawler.PruneStaleLinks = serviceConfig.PruneStaleLinks
+	crawler.MaxLinksPerPage = serviceConfig.MaxLinksPerPage
+	crawler.MaxURLLength = serviceConfig.MaxURLLength
+	crawler.AcceptLanguage = serviceConfig.AcceptLanguage
+	crawler.Headers = serviceConfig.Headers
+	crawler.DbTimeout = time.Duration(serviceConfig.DbTimeout) * time.Second
+	crawler.MaxBytesPerHost = serviceConfig.MaxBytesPerHost
+	crawler.RecordErrors = serviceConfig.RecordErrors
+	crawler.JsonLdLinks = serviceConfig.JsonLdLinks
+	crawler.TimestampSource = serviceConfig.TimestampSource
+	crawler.ParseMode = serviceConfig.ParseMode
+	crawler.StreamLinks = serviceConfig.StreamLinks
+	crawler.MaxParseTime = time.Duration(serviceConfig.MaxParseTime) * time.Second
+	crawler.MaxReadTime = time.Duration(serviceConfig.MaxReadTime) * time.Second
+	crawler.SkipRecentlyCrawled = serviceConfig.SkipRecentlyCrawled
+	crawler.RecentlyCrawled = time.Duration(serviceConfig.RecentlyCrawled) * time.Second
+	crawler.RecordAlternates = serviceConfig.RecordAlternates
+	crawler.FollowPagination = serviceConfig.FollowPagination
+	crawler.PreferHTTPS = serviceConfig.PreferHTTPS
+	crawler.FollowSelfLinks = serviceConfig.FollowSelfLinks
+	crawler.HonorRobotsNoFollow = serviceConfig.HonorRobotsNoFollow
+	crawler.HonorRobotsNoIndex = serviceConfig.HonorRobotsNoIndex
+	crawler.MaxWarmHosts = serviceConfig.MaxWarmHosts
+	crawler.MaxConcurrencyPerHost = serviceConfig.MaxConcurrencyPerHost
+	crawler.CrawlDelay = time.Duration(serviceConfig.CrawlDelay) * time.Millisecond
+	crawler.DelayJitter = time.Duration(serviceConfig.DelayJitter) * time.Millisecond
+	crawler.MaxTotalRetries = serviceConfig.MaxTotalRetries
+	crawler.RouteHints = serviceConfig.RouteHints
+	crawler.MaxRouteHintUrls = serviceConfig.MaxRouteHintUrls
+	crawler.compilePatterns(serviceConfig)
+}
+
+// compilePatterns function compiles the crawler's patterns and depth rules from serviceConfig. A setting which doesn't
+// compile is logged and its previous value kept, so a bad reload can't silently lift the crawler's exclusions.
+func (crawler *Crawler) compilePatterns(serviceConfig config.ServiceConfig) {
+	for _, patterns := range []struct {
+		setting  string
+		source   []string
+		compiled *[]*regexp.Regexp
+	}{
+		{"exclude_patterns", serviceConfig.ExcludePatterns, &crawler.ExcludePatterns},
+		{"include_patterns", serviceConfig.IncludePatterns, &crawler.IncludePatterns},
+		{"soft_404_title_patterns", serviceConfig.Soft404TitlePatterns, &crawler.Soft404TitlePatterns},
+		{"soft_404_body_patterns", serviceConfig.Soft404BodyPatterns, &crawler.Soft404BodyPatterns},
+	} {
+		compiled, err := config.CompilePatterns(patterns.source)
+		if err != nil {
+			_ = level.Error(logging.Logger).Log("context", "compiling patterns", "setting", patterns.setting, "msg", err.Error())
+			continue
+		}
+		*patterns.compiled = compiled
+	}
+	depthRules, err := CompileDepthRules(serviceConfig.DepthRules)
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "compiling patterns", "setting", "depth_rules", "msg", err.Error())
+		return
+	}
+	crawler.DepthRules = depthRules
+}
+
+// Seed function starts one crawl from several URLs, publishing a page for each to the frontier. Seeds must be absolute
+// http or https URLs; they are normalized and duplicates are dropped, and the first seed becomes the StartUrl of the
+// whole crawl so its pages share one deadline, login session and byte budgets. Nothing is published if any seed is
+// invalid, and seeds not yet published when ctx is done are dropped.
+func (crawler *Crawler) Seed(ctx context.Context, seeds []string, opts SeedOptions) (startPages []*page.Page, err error) {
+	seeds, err = NormalizeSeeds(seeds)
+	if err != nil {
+		return
+	}
+	for _, seed := range seeds {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		startPage := &page.Page{
+			Url:      seed,
+			Depth:    opts.Depth,
+			StartUrl: seeds[0],
+			Deadline: opts.Deadline,
+			Login:    opts.Login,
+			Sink:     opts.Sink,
+			CrawlId:  opts.CrawlId,
+		}
+		crawler.frontier().Publish(startPage)
+		startPages = append(startPages, startPage)
+	}
+	return
+}
+
+// NormalizeSeeds function checks that each seed is an absolute http or https URL, normalizes it, and drops duplicates,
+// keeping the seeds in the order given
+func NormalizeSeeds(seeds []string) (normalized []string, err error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("at least one seed URL is required")
+	}
+	seen := make(map[string]struct{})
+	for _, seed := range seeds {
+		seedUrl, err := url.Parse(seed)
+		if err != nil {
+			return nil, err
+		}
+		if (seedUrl.Scheme != "http" && seedUrl.Scheme != "https") || seedUrl.Host == "" {
+			return nil, fmt.Errorf("seed %q must be an absolute http or https URL", seed)
+		}
+		if err = page.NormalizeUrl(seedUrl); err != nil {
+			return nil, fmt.Errorf("seed %q has an invalid host: %v", seed, err)
+		}
+		seedUrl.Fragment = ""
+		if _, isPresent := seen[seedUrl.String()]; isPresent {
+			continue
+		}
+		seen[seedUrl.String()] = struct{}{}
+		normalized = append(normalized, seedUrl.String())
+	}
+	return
+}
+
+// ReadSeeds function reads newline delimited seed URLs, skipping blank lines and comments starting with #. Seeds are
+// normalized and duplicates are dropped as by NormalizeSeeds. A line which isn't an absolute http or https URL doesn't
+// stop the read; it is returned in malformed with its line number.
+func ReadSeeds(r io.Reader) (seeds []string, malformed []error, err error) {
+	scanner := bufio.NewScanner(r)
+	seen := make(map[string]struct{})
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		normalized, err := NormalizeSeeds([]string{line})
+		if err != nil {
+			malformed = append(malformed, fmt.Errorf("line %d: %v", lineNumber, err))
+			continue
+		}
+		if _, isPresent := seen[normalized[0]]; isPresent {
+			continue
+		}
+		seen[normalized[0]] = struct{}{}
+		seeds = append(seeds, normalized[0])
+	}
+	err = scanner.Err()
+	return
+}
+
+// SeedFromFile function starts one crawl, as Seed does, from the seed URLs read from the file at path by ReadSeeds, down
+// to SeedDepth. Malformed lines are logged and skipped; an error is returned if the file can't be read or has no valid
+// seeds.
+func (crawler *Crawler) SeedFromFile(ctx context.Context, path string) (startPages []*page.Page, err error) {
+	seedFile, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer seedFile.Close()
+	seeds, malformed, err := ReadSeeds(seedFile)
+	if err != nil {
+		return
+	}
+	for _, lineErr := range malformed {
+		_ = level.Warn(logging.Logger).Log("context", "reading seed file", "file", path, "msg", lineErr.Error())
+	}
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("seed file %s has no valid seeds", path)
+	}
+	return crawler.Seed(ctx, seeds, SeedOptions{Depth: crawler.SeedDepth})
+}
+
+// frontier function returns the Frontier pages are published to
+func (crawler *Crawler) frontier() Frontier {
+	if crawler.Frontier != nil {
+		return crawler.Frontier
+	}
+	return crawler.Queue
+}
+
+// Start function crawls the pages received from the queue. Each page is crawled in its own goroutine, unless
+// FrontierWorkers is set, when received pages wait in a PriorityFrontier ordered by Score and that many workers crawl
+// them, highest scored first. With MaxFrontierSize, no more pages are received while that many are waiting.
+// FrontierWorkers and MaxFrontierSize are only read when the crawler starts. If SeedFile is set, a crawl is
+// started from its seeds before any pages are received. Each of the Schedules is run by a schedule.Scheduler from
+// when the crawler starts; they aren't reloaded with the config.
 func (crawler *Crawler) Start() (err error) {
+	if crawler.SeedFile != "" {
+		if _, err := crawler.SeedFromFile(context.Background(), crawler.SeedFile); err != nil {
+			_ = level.Error(logging.Logger).Log("context", "reading seed file", "file", crawler.SeedFile, "msg", err.Error())
+		}
+	}
+	if len(crawler.Schedules) > 0 {
+		crawler.Scheduler(crawler.Schedules).Start(context.Background())
+	}
 	for i := 1; i <= config.AppConfig.Service.NumConsumers; i++ {
 		go crawler.Queue.Poll()
 	}
+	var prioritized *PriorityFrontier
+	if crawler.FrontierWorkers > 0 {
+		prioritized = NewPriorityFrontier(crawler.Score, crawler.MaxFrontierSize)
+		go crawler.Work(context.Background(), prioritized, crawler.FrontierWorkers)
+	}
 	for msg := range crawler.Queue.ReceiveChan {
+		if prioritized != nil {
+			currentPage, err := page.DeserializeSQSPage(msg)
+			if err == nil {
+				_ = prioritized.PublishWait(context.Background(), currentPage)
+			}
+			continue
+		}
 		go func(msg *sqs.Message) {
 			var currentPage *page.Page
 			currentPage, err = page.DeserializeSQSPage(msg)
@@ -62,52 +512,397 @@ func (crawler *Crawler) Start() (err error) {
 	return
 }
 
-// Get function manages HTTP request for page
-func (crawler *Crawler) Get(currentPage *page.Page) (resp *http.Response, err error) {
-	var req *http.Request
-	maxAttempts := config.AppConfig.Service.HttpRetryAttempts + 1
-	backOffDuration := time.Duration(config.AppConfig.Service.HttpBackOffDuration) * time.Second
-	client := http.Client{}
-	req, err = http.NewRequest("GET", currentPage.Url, nil)
+// Get function manages HTTP request for page, retrying failures within the retry budget of the crawl ctx belongs to.
+// The response body holds a slot for the page's host until it is closed, so callers must close it.
+func (crawler *Crawler) Get(ctx context.Context, currentPage *page.Page) (resp *http.Response, err error) {
+	serviceConfig := config.Get().Service
+	maxAttempts := serviceConfig.HttpRetryAttempts + 1
+	backOffDuration := time.Duration(serviceConfig.HttpBackOffDuration) * time.Second
+	client, err := crawler.crawlClient(ctx, currentPage)
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "login failure", "url", currentPage.Url, "start_url", currentPage.StartUrl, "msg", err.Error())
+		return
+	}
+	pageUrl, err := url.Parse(currentPage.Url)
 	if err != nil {
 		_ = level.Error(logging.Logger).Log("context", "HTTP failure", "url", currentPage.Url, "msg", err.Error())
 		return
 	}
-	req.Header.Set("User-Agent", "stevenayers/clamber")
+	header := http.Header{}
+	header.Set("User-Agent", "stevenayers/clamber")
+	crawler.settingsMutex.RLock()
+	acceptLanguage, maxConcurrencyPerHost := crawler.AcceptLanguage, crawler.MaxConcurrencyPerHost
+	headers := crawler.Headers
+	crawlDelay, delayJitter := crawler.CrawlDelay, crawler.DelayJitter
+	fetcher := crawler.Fetcher
+	crawler.settingsMutex.RUnlock()
+	if acceptLanguage != "" {
+		header.Set("Accept-Language", acceptLanguage)
+	}
+	for name, value := range headers {
+		if config.IsReservedHeader(name) {
+			_ = level.Warn(logging.Logger).Log("context", "HTTP request", "url", currentPage.Url, "header", name, "msg", "reserved header not overridden")
+			continue
+		}
+		header.Set(name, value)
+	}
+	if currentPage.ETag != "" {
+		header.Set("If-None-Match", currentPage.ETag)
+	}
+	if currentPage.LastModified != "" {
+		header.Set("If-Modified-Since", currentPage.LastModified)
+	}
+	if fetcher == nil {
+		fetcher = &HttpFetcher{Client: client, Header: header}
+	}
 	count := 0
 	for maxAttempts > count {
 		count++
-		resp, err = client.Do(req)
+		if err = crawler.waitForHost(ctx, pageUrl.Host, crawlDelay, delayJitter); err != nil {
+			_ = level.Debug(logging.Logger).Log("context", "HTTP failure", "url", currentPage.Url, "msg", err.Error())
+			return
+		}
+		var release func()
+		release, err = crawler.acquireHost(ctx, pageUrl.Host, maxConcurrencyPerHost)
+		if err != nil {
+			_ = level.Debug(logging.Logger).Log("context", "HTTP failure", "url", currentPage.Url, "msg", err.Error())
+			return
+		}
+		resp, err = fetcher.Fetch(ctx, currentPage.Url)
 		if err != nil {
+			release()
 			_ = level.Error(logging.Logger).Log("context", "HTTP failure", "url", currentPage.Url, "msg", err.Error())
 			return
 		}
+		if resp.Request == nil {
+			resp.Request = (&http.Request{Method: "GET", URL: pageUrl, Header: header}).WithContext(ctx)
+		}
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
 		switch {
-		case resp.StatusCode == http.StatusOK:
-			break
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified:
+			return
 		case resp.StatusCode < 500:
 			err = errors.New("received bad HTTP status code")
 			_ = level.Debug(logging.Logger).Log("context", "HTTP failure", "url", currentPage.Url, "statusCode", resp.StatusCode, "msg", err.Error())
-			break
+			return
 		default:
 			if maxAttempts == count {
 				err = errors.New("received bad HTTP status code")
 				_ = level.Debug(logging.Logger).Log("context", "HTTP failure", "url", currentPage.Url, "statusCode", resp.StatusCode, "msg", err.Error())
+				return
+			}
+			if err = crawler.spendRetry(ctx); err != nil {
+				_ = level.Debug(logging.Logger).Log("context", "HTTP failure", "url", currentPage.Url, "statusCode", resp.StatusCode, "msg", err.Error())
+				return
+			}
+			_ = resp.Body.Close()
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case <-time.After(backOffDuration):
 			}
-			time.Sleep(backOffDuration)
 		}
 	}
 	return
 }
 
+// getPreferringHTTPS function fetches a page found through an http link over https instead, leaving the page with its
+// https URL if that succeeds, so the secure version of a site is crawled and stored rather than both. If the https
+// request fails, the page is fetched over http as it would have been. Start pages, and URLs with an explicit port, are
+// always fetched as they are.
+func (crawler *Crawler) getPreferringHTTPS(ctx context.Context, currentPage *page.Page) (resp *http.Response, err error) {
+	pageUrl, err := url.Parse(currentPage.Url)
+	if err != nil || currentPage.Parent == nil || pageUrl.Scheme != "http" || pageUrl.Port() != "" {
+		return crawler.Get(ctx, currentPage)
+	}
+	httpUrl, eTag, lastModified := currentPage.Url, currentPage.ETag, currentPage.LastModified
+	pageUrl.Scheme = "https"
+	currentPage.Url = pageUrl.String()
+	currentPage.ETag, currentPage.LastModified = "", ""
+	resp, err = crawler.Get(ctx, currentPage)
+	if err == nil {
+		return
+	}
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	currentPage.Url, currentPage.ETag, currentPage.LastModified = httpUrl, eTag, lastModified
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	_ = level.Debug(logging.Logger).Log("context", "https upgrade failed", "url", httpUrl, "msg", err.Error())
+	return crawler.Get(ctx, currentPage)
+}
+
+// Fetch function sends a GET request for Url with the fetcher's Header
+func (fetcher *HttpFetcher) Fetch(ctx context.Context, Url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range fetcher.Header {
+		req.Header[name] = values
+	}
+	return fetcher.Client.Do(req)
+}
+
+// acquireHost function waits for a free slot for requests to host, returning the function which frees it, or the
+// context's error if it is done first. Each host has maxConcurrencyPerHost slots, and there is no limit without it.
+func (crawler *Crawler) acquireHost(ctx context.Context, host string, maxConcurrencyPerHost int) (release func(), err error) {
+	if maxConcurrencyPerHost <= 0 {
+		return func() {}, nil
+	}
+	crawler.Lock()
+	if crawler.hostSlots == nil {
+		crawler.hostSlots = make(map[string]chan struct{})
+	}
+	slots, isPresent := crawler.hostSlots[host]
+	if !isPresent || cap(slots) != maxConcurrencyPerHost {
+		slots = make(chan struct{}, maxConcurrencyPerHost)
+		crawler.hostSlots[host] = slots
+	}
+	crawler.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// crawlClient function returns the client the page's crawl fetches with: the crawler's shared client, so connections
+// are still reused across crawls, with the crawl's own cookie jar, so the cookies set while one crawl is fetched are
+// sent with its later requests but never with another crawl's. A crawl with a Login logs in first.
+func (crawler *Crawler) crawlClient(ctx context.Context, currentPage *page.Page) (*http.Client, error) {
+	jar, err := crawler.Login(ctx, currentPage)
+	if err != nil {
+		return nil, err
+	}
+	client := *crawler.httpClient()
+	client.Jar = jar
+	return &client, nil
+}
+
+// Login function returns the cookie jar holding the session of the page's crawl, sending the page's Login request the
+// first time a page of a crawl with a Login is fetched. The session lasts until the crawl's deadline, or until the
+// crawl's start page is crawled again. If the login fails the page isn't fetched, so a crawl which can't log in stops
+// at its seed page.
+func (crawler *Crawler) Login(ctx context.Context, currentPage *page.Page) (jar http.CookieJar, err error) {
+	session := crawler.session(currentPage, false)
+	session.Lock()
+	defer session.Unlock()
+	if session.jar == nil {
+		session.jar, _ = cookiejar.New(nil)
+	}
+	if currentPage.Login != nil && !session.loggedIn {
+		err = crawler.login(ctx, currentPage.Login, session.jar)
+		if err != nil {
+			return nil, err
+		}
+		session.loggedIn = true
+	}
+	return session.jar, nil
+}
+
+// session function returns the session of the page's crawl, replacing it if the crawl it was made for has passed its
+// deadline, or if renew is set. Crawls are told apart by their start URL and login, so a login retried with other
+// fields gets a new session.
+func (crawler *Crawler) session(currentPage *page.Page, renew bool) *crawlSession {
+	loginKey, _ := json.Marshal(currentPage.Login)
+	key := currentPage.StartUrl + " " + string(loginKey)
+	defer crawler.Unlock()
+	crawler.Lock()
+	if crawler.sessions == nil {
+		crawler.sessions = make(map[string]*crawlSession)
+	}
+	session, isPresent := crawler.sessions[key]
+	if renew || !isPresent || (session.expires != 0 && time.Now().UnixNano() > session.expires) {
+		session = &crawlSession{expires: currentPage.Deadline}
+		crawler.sessions[key] = session
+	}
+	return session
+}
+
+// login function sends a login request, keeping the cookies set along the way in jar. Error status codes count as a
+// failed login.
+func (crawler *Crawler) login(ctx context.Context, login *page.Login, jar http.CookieJar) (err error) {
+	form := url.Values{}
+	for name, value := range login.Fields {
+		form.Set(name, value)
+	}
+	method := strings.ToUpper(login.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	var req *http.Request
+	if method == http.MethodGet {
+		var loginUrl *url.URL
+		loginUrl, err = url.Parse(login.Url)
+		if err != nil {
+			return fmt.Errorf("login to %s failed: %v", login.Url, err)
+		}
+		loginUrl.RawQuery = form.Encode()
+		req, err = http.NewRequestWithContext(ctx, method, loginUrl.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, login.Url, strings.NewReader(form.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("login to %s failed: %v", login.Url, err)
+	}
+	req.Header.Set("User-Agent", "stevenayers/clamber")
+	client := &http.Client{Transport: crawler.httpClient().Transport, Jar: jar}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("login to %s failed: %v", login.Url, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("login to %s failed: received HTTP status %d", login.Url, resp.StatusCode)
+	}
+	return
+}
+
+// httpClient function lazily builds the HTTP client shared by every request the crawler makes, so connections to a
+// host are kept alive and reused across pages. Zero values leave the net/http defaults in place. ForceHTTP1 overrides
+// ForceAttemptHTTP2, disabling HTTP/2 for servers which misbehave with it.
+func (crawler *Crawler) httpClient() *http.Client {
+	crawler.settingsMutex.Lock()
+	defer crawler.settingsMutex.Unlock()
+	if crawler.Client != nil {
+		return crawler.Client
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = crawler.ForceAttemptHTTP2
+	if crawler.ForceHTTP1 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if crawler.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = crawler.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < crawler.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = crawler.MaxIdleConnsPerHost
+		}
+	}
+	if crawler.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = crawler.IdleConnTimeout
+	}
+	if crawler.InsecureSkipVerify {
+		_ = level.Warn(logging.Logger).Log("msg", "TLS certificate verification is disabled")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	crawler.Client = &http.Client{Transport: transport}
+	return crawler.Client
+}
+
+// crawlContext function returns a context bound by the deadline of the crawl the page belongs to, if it has one.
+func (crawler *Crawler) crawlContext(currentPage *page.Page) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), crawlKey{}, currentPage.StartUrl)
+	if currentPage.Deadline == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, time.Unix(0, currentPage.Deadline))
+}
+
 // Crawl function adds page to db (in a goroutine so it doesn't stop initiating other crawls), gets the child pages then
-// initiates crawls for each one.
+// initiates crawls for each one. A page with a Depth of 0 or less is stored without crawling its links.
 func (crawler *Crawler) Crawl(currentPage *page.Page) {
-	resp, err := crawler.Get(currentPage)
+	crawler.settingsMutex.RLock()
+	maxDuration, recordRedirects := crawler.MaxDuration, crawler.RecordRedirects
+	recrawl, pruneStaleLinks := crawler.Recrawl, crawler.PruneStaleLinks
+	maxLinksPerPage, maxBytesPerHost := crawler.MaxLinksPerPage, crawler.MaxBytesPerHost
+	scope := &page.LinkScope{
+		Include:      crawler.IncludePatterns,
+		Exclude:      crawler.ExcludePatterns,
+		Soft404Title: crawler.Soft404TitlePatterns,
+		Soft404Body:  crawler.Soft404BodyPatterns,
+		FollowSelf:   crawler.FollowSelfLinks,
+	}
+	depthRules := crawler.DepthRules
+	linkExtractor, recordErrors := crawler.LinkExtractor, crawler.RecordErrors
+	timestampSource, maxParseTime := crawler.TimestampSource, crawler.MaxParseTime
+	maxReadTime, parseMode, streamLinks := crawler.MaxReadTime, crawler.ParseMode, crawler.StreamLinks
+	skipRecentlyCrawled, recentlyCrawled := crawler.SkipRecentlyCrawled, crawler.RecentlyCrawled
+	recordAlternates, maxWarmHosts := crawler.RecordAlternates, crawler.MaxWarmHosts
+	maxTotalRetries, followPagination := crawler.MaxTotalRetries, crawler.FollowPagination
+	preferHTTPS, maxURLLength := crawler.PreferHTTPS, crawler.MaxURLLength
+	honorNoFollow, honorNoIndex := crawler.HonorRobotsNoFollow, crawler.HonorRobotsNoIndex
+	routeHints, maxRouteHintUrls := crawler.RouteHints, crawler.MaxRouteHintUrls
+	if crawler.JsonLdLinks {
+		if linkExtractor == nil {
+			linkExtractor = page.AnchorLinkExtractor{}
+		}
+		linkExtractor = page.LinkExtractors{linkExtractor, page.JsonLdLinkExtractor{}}
+	}
+	crawler.settingsMutex.RUnlock()
+	if currentPage.Parent == nil && currentPage.Deadline == 0 && maxDuration > 0 {
+		currentPage.Deadline = time.Now().Add(maxDuration).UnixNano()
+	}
+	if currentPage.Parent == nil && currentPage.Url == currentPage.StartUrl {
+		crawler.statsRecorder().start(currentPage.StartUrl)
+		crawler.session(currentPage, true)
+	}
+	ctx, cancel := crawler.crawlContext(currentPage)
+	defer cancel()
+	if ctx.Err() != nil {
+		_ = level.Debug(logging.Logger).Log("context", "crawl deadline exceeded", "url", currentPage.Url, "start_url", currentPage.StartUrl)
+		crawler.count(currentPage, skipped)
+		return
+	}
+	if crawler.overHostBudget(currentPage, currentPage.Url, maxBytesPerHost) {
+		_ = level.Debug(logging.Logger).Log("context", "host byte budget exceeded", "url", currentPage.Url, "start_url", currentPage.StartUrl)
+		crawler.count(currentPage, skipped)
+		return
+	}
+	if crawler.overRetryBudget(currentPage, maxTotalRetries) {
+		_ = level.Debug(logging.Logger).Log("context", "crawl retry budget exhausted", "url", currentPage.Url, "start_url", currentPage.StartUrl)
+		crawler.count(currentPage, skipped)
+		return
+	}
+	if crawler.Store != nil {
+		storedPage := crawler.loadValidators(ctx, currentPage)
+		if skipRecentlyCrawled && storedPage != nil && storedPage.Error == "" &&
+			storedPage.Timestamp > time.Now().Add(-recentlyCrawled).Unix() {
+			_ = level.Debug(logging.Logger).Log("context", "skipping recently crawled page", "url", currentPage.Url, "start_url", currentPage.StartUrl)
+			crawler.count(currentPage, skipped)
+			crawler.hasAlreadyCrawled(currentPage)
+			currentPage.Timestamp = storedPage.Timestamp
+			currentPage.StatusCode = storedPage.StatusCode
+			if currentPage.Parent != nil {
+				go func(currentPage *page.Page) {
+					_ = crawler.Create(currentPage)
+				}(currentPage)
+			}
+			return
+		}
+	}
+	var resp *http.Response
+	var err error
+	if preferHTTPS {
+		resp, err = crawler.getPreferringHTTPS(ctx, currentPage)
+	} else {
+		resp, err = crawler.Get(ctx, currentPage)
+	}
+	defer func() {
+		if (resp != nil || currentPage.Error != "") && !(honorNoIndex && currentPage.NoIndex) {
+			crawler.writeSink(currentPage)
+		}
+	}()
+	if resp != nil {
+		crawler.count(currentPage, func(stats *Stats) { stats.PagesFetched++ })
+	}
 	currentPage.StatusCode = http.StatusOK
-	currentPage.Timestamp = time.Now().Unix()
-	if resp != nil && resp.StatusCode == http.StatusNotFound {
-		currentPage.StatusCode = http.StatusNotFound
+	currentPage.Timestamp = PageTimestamp(currentPage, resp, timestampSource, time.Now())
+	if resp != nil && resp.StatusCode >= http.StatusBadRequest {
+		_ = resp.Body.Close()
+		currentPage.StatusCode = resp.StatusCode
+		if recordErrors {
+			currentPage.Error = FetchError(resp, err)
+		}
+		crawler.count(currentPage, failed)
 		go func(currentPage *page.Page) {
 			err = crawler.Create(currentPage)
 			if err != nil {
@@ -117,99 +912,772 @@ func (crawler *Crawler) Crawl(currentPage *page.Page) {
 		return
 	}
 	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		if resp == nil && ctx.Err() == nil {
+			crawler.count(currentPage, failed)
+		}
+		if recordErrors && resp == nil && ctx.Err() == nil {
+			currentPage.StatusCode = 0
+			currentPage.Error = FetchError(resp, err)
+			go func(currentPage *page.Page) {
+				_ = crawler.Create(currentPage)
+			}(currentPage)
+		}
 		return
 	}
+	if recordRedirects {
+		if redirects := RedirectChain(currentPage, resp); len(redirects) > 0 {
+			go func(currentPage *page.Page) {
+				_ = crawler.CreateRedirects(currentPage, redirects)
+			}(currentPage)
+		}
+	}
 
-	if !crawler.hasAlreadyCrawled(currentPage.Url) {
+	if resp.StatusCode == http.StatusNotModified {
+		_ = resp.Body.Close()
+		alreadyCrawled := crawler.hasAlreadyCrawled(currentPage)
 		go func(currentPage *page.Page) {
-			err = crawler.Create(currentPage)
-			if err != nil {
-				return
+			if !alreadyCrawled {
+				if err := crawler.Create(currentPage); err != nil {
+					return
+				}
+			}
+			_ = crawler.UpdateTimestamp(currentPage)
+		}(currentPage)
+		if currentPage.Depth > 0 && crawler.Store != nil {
+			childPages := crawler.storedChildren(ctx, currentPage, maxLinksPerPage, scope)
+			crawler.publishChildren(currentPage, childPages, depthRules, maxURLLength, maxBytesPerHost)
+		}
+		return
+	}
+	currentPage.ETag = resp.Header.Get("ETag")
+	currentPage.LastModified = resp.Header.Get("Last-Modified")
+
+	var childPages []*page.Page
+	body := &countingBody{ReadCloser: resp.Body}
+	resp.Body = body
+	linksFetched := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html")
+	if linksFetched {
+		if streamLinks {
+			childPages, err = currentPage.StreamChildPages(resp, maxReadTime, maxLinksPerPage, scope)
+		} else {
+			childPages, err = currentPage.FetchChildPagesWithin(resp, maxReadTime, maxParseTime, maxLinksPerPage, scope, linkExtractor, parseMode)
+		}
+		linksFetched = err == nil
+		if len(currentPage.ParseWarnings) > 0 {
+			_ = level.Warn(logging.Logger).Log("context", "parsing HTML", "url", currentPage.Url, "warnings", len(currentPage.ParseWarnings), "msg", currentPage.ParseWarnings[0])
+		}
+		if linksFetched && honorNoFollow && currentPage.NoFollow {
+			_ = level.Debug(logging.Logger).Log("context", "robots nofollow", "url", currentPage.Url, "start_url", currentPage.StartUrl)
+			childPages, currentPage.Pagination, linksFetched = nil, nil, false
+		}
+		expand := linksFetched && currentPage.Depth > 0
+		if expand && recordAlternates && len(currentPage.Alternates) > 0 {
+			go func(currentPage *page.Page) {
+				_ = crawler.CreateAlternates(currentPage)
+			}(currentPage)
+		}
+		if expand && maxWarmHosts > 0 && len(currentPage.Preconnects) > 0 {
+			go crawler.WarmConnections(currentPage, maxWarmHosts)
+		}
+		if expand && followPagination {
+			childPages = crawler.Paginate(currentPage, childPages, scope)
+		}
+		if expand && len(routeHints) > 0 && currentPage.Parent == nil && currentPage.Url == currentPage.StartUrl {
+			childPages = RouteHintLinks(currentPage, childPages, routeHints, maxRouteHintUrls, scope)
+		}
+	} else {
+		currentPage.ParseRobotsHeader(resp.Header)
+		_ = resp.Body.Close()
+	}
+	bytesRead := atomic.LoadInt64(&body.bytes)
+	crawler.count(currentPage, func(stats *Stats) { stats.Bytes += bytesRead })
+	if maxBytesPerHost > 0 {
+		crawler.addHostBytes(currentPage, resp.Request.URL.Host, bytesRead)
+	}
+	if currentPage.Soft404 {
+		crawler.count(currentPage, failed)
+		currentPage.StatusCode = http.StatusNotFound
+		if recordErrors {
+			currentPage.Error = ErrSoft404.Error()
+		}
+		go func(currentPage *page.Page) {
+			_ = crawler.Create(currentPage)
+		}(currentPage)
+		return
+	}
+	if honorNoIndex && currentPage.NoIndex {
+		_ = level.Debug(logging.Logger).Log("context", "robots noindex", "url", currentPage.Url, "start_url", currentPage.StartUrl)
+		crawler.count(currentPage, skipped)
+		return
+	}
+
+	create := !crawler.hasAlreadyCrawled(currentPage) || recrawl
+	if !create {
+		crawler.count(currentPage, skipped)
+	}
+	prune := pruneStaleLinks && linksFetched
+	if create || prune {
+		stored := currentPage.Uid != ""
+		go func(currentPage *page.Page) {
+			if create {
+				err := crawler.Create(currentPage)
+				if err != nil {
+					return
+				}
+				if recrawl && stored {
+					_ = crawler.UpdateTimestamp(currentPage)
+				}
+			}
+			if prune {
+				_ = crawler.PruneLinks(currentPage, childPages)
 			}
 		}(currentPage)
 	}
 
-	if currentPage.Depth <= 0 ||
-		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+	if currentPage.Depth <= 0 {
 		return
 	}
+	crawler.publishChildren(currentPage, childPages, depthRules, maxURLLength, maxBytesPerHost)
+}
 
-	childPages, _ := currentPage.FetchChildPages(resp)
+// publishChildren function publishes the child pages of a page to the frontier, each with the depth left beneath it,
+// skipping those whose URL is longer than maxURLLength or whose host's byte budget is spent
+func (crawler *Crawler) publishChildren(currentPage *page.Page, childPages []*page.Page, depthRules []DepthRule, maxURLLength int, maxBytesPerHost int64) {
+	frontier := crawler.frontier()
+	bounded, isBounded := frontier.(*PriorityFrontier)
 	for _, childPage := range childPages {
-		go func(childPage *page.Page) {
-			childPage.Depth = currentPage.Depth - 1
-			crawler.Queue.Publish(childPage)
-		}(childPage)
+		if maxURLLength > 0 && len(childPage.Url) > maxURLLength {
+			_ = level.Debug(logging.Logger).Log("context", "url too long", "url", childPage.Url[:maxURLLength], "length", len(childPage.Url), "start_url", currentPage.StartUrl)
+			crawler.count(childPage, skipped)
+			continue
+		}
+		if crawler.overHostBudget(childPage, childPage.Url, maxBytesPerHost) {
+			crawler.count(childPage, skipped)
+			continue
+		}
+		childPage.Depth = ChildDepth(currentPage.Depth, childPage.Url, depthRules)
+		if childPage.Paginated {
+			childPage.Depth = currentPage.Depth
+		}
+		childPage.Deadline = currentPage.Deadline
+		if isBounded && bounded.Bounded() {
+			if !bounded.Offer(childPage) {
+				crawler.Crawl(childPage)
+			}
+			continue
+		}
+		go frontier.Publish(childPage)
 	}
 }
 
+// PageTimestamp function returns the Unix timestamp to store for a page fetched at fetched. With
+// TimestampLastModified it is the response's Last-Modified header, or for a 304 the Last-Modified stored for the page,
+// when that parses; otherwise it is the fetch time.
+func PageTimestamp(currentPage *page.Page, resp *http.Response, source string, fetched time.Time) int64 {
+	if source == TimestampLastModified && resp != nil {
+		lastModified := resp.Header.Get("Last-Modified")
+		if lastModified == "" && resp.StatusCode == http.StatusNotModified {
+			lastModified = currentPage.LastModified
+		}
+		if modified, err := http.ParseTime(lastModified); err == nil {
+			return modified.Unix()
+		}
+	}
+	return fetched.Unix()
+}
+
 // Create function checks for current page, creates if doesn't exist. Checks for parent page, creates if doesn't exist. Checks for edge
-// between them, creates if doesn't exist.
+// between them, creates if doesn't exist. A current page with an Error is written with UpsertErrorPage, so the error is
+// recorded on it even if it was stored before. Pages without a Timestamp are stamped with the current time, so no node
+// is stored without one. The current page and the link to it are attributed to the page's CrawlId, if it has one.
 func (crawler *Crawler) Create(currentPage *page.Page) (err error) {
-	ctx := context.Background()
-	currentUid, err := crawler.FindOrCreatePage(&ctx, currentPage)
+	ctx, cancel := crawler.crawlContext(currentPage)
+	defer cancel()
+	if currentPage.Timestamp == 0 {
+		currentPage.Timestamp = time.Now().Unix()
+	}
+	createPage := crawler.FindOrCreatePage
+	if currentPage.Error != "" {
+		createPage = crawler.UpsertErrorPage
+	}
+	currentUid, err := createPage(&ctx, currentPage)
 	if err != nil {
 		return
 	}
+	cache.DefaultCache.Invalidate(currentPage.Url)
 	if currentPage.Parent != nil {
+		parentPage := *currentPage.Parent
+		if parentPage.Timestamp == 0 {
+			parentPage.Timestamp = currentPage.Timestamp
+		}
+		// the parent is attributed to its crawl when it is stored itself, so it isn't tagged again for every link
+		parentPage.CrawlId = ""
 		var parentUid string
-		parentUid, err = crawler.FindOrCreatePage(&ctx, currentPage.Parent)
+		parentUid, err = crawler.FindOrCreatePage(&ctx, &parentPage)
+		if err != nil {
+			return
+		}
+		err = crawler.FindOrCreateLink(&ctx, parentUid, currentUid, currentPage.CrawlId)
+		if err != nil {
+			return
+		}
+		crawler.count(currentPage, func(stats *Stats) { stats.EdgesCreated++ })
+		cache.DefaultCache.Invalidate(parentPage.Url)
+	}
+	return
+}
+
+// Paginate function marks the child pages which the page's Pagination links point to as Paginated, adding those which
+// aren't among them yet, so they are crawled at the page's own depth. Each page is only paginated once in a crawl, and
+// the page itself counts as paginated, so a next link back to an earlier page isn't followed again. Pagination links
+// outside scope are skipped, and they are added even once the page's links were truncated.
+func (crawler *Crawler) Paginate(currentPage *page.Page, childPages []*page.Page, scope *page.LinkScope) []*page.Page {
+	children := make(map[string]*page.Page)
+	for _, childPage := range childPages {
+		children[childPage.Url] = childPage
+	}
+	defer crawler.Unlock()
+	crawler.Lock()
+	if crawler.paginated == nil {
+		crawler.paginated = make(map[crawlUrl]struct{})
+	}
+	crawler.paginated[crawlUrl{startUrl: currentPage.StartUrl, url: page.CanonicalUrl(currentPage.Url)}] = struct{}{}
+	for _, Url := range currentPage.Pagination {
+		key := crawlUrl{startUrl: currentPage.StartUrl, url: Url}
+		if _, isPresent := crawler.paginated[key]; isPresent || !scope.Allows(Url) {
+			continue
+		}
+		crawler.paginated[key] = struct{}{}
+		childPage, isPresent := children[Url]
+		if !isPresent {
+			childPage = &page.Page{
+				Url:       Url,
+				Parent:    currentPage,
+				StartUrl:  currentPage.StartUrl,
+				Timestamp: time.Now().Unix(),
+				Login:     currentPage.Login,
+				Sink:      currentPage.Sink,
+				CrawlId:   currentPage.CrawlId,
+			}
+			childPages = append(childPages, childPage)
+		}
+		childPage.Paginated = true
+	}
+	return childPages
+}
+
+// DefaultMaxRouteHintUrls is the number of pages a crawl's start page adds from route hints when the config doesn't
+// set one
+const DefaultMaxRouteHintUrls = 1000
+
+// RouteHintLinks function adds the pages of a single-page app which its HTML doesn't link to, expanding the template of
+// each hint for the start page's host with each of the hint's ids. Ids are escaped for the part of the URL {id} is in.
+// Pages already among the child pages and those outside scope are skipped, and at most maxUrls are added, or
+// DefaultMaxRouteHintUrls if it is 0, even once the page's links were truncated.
+func RouteHintLinks(currentPage *page.Page, childPages []*page.Page, hints []config.RouteHint, maxUrls int, scope *page.LinkScope) []*page.Page {
+	if maxUrls <= 0 {
+		maxUrls = DefaultMaxRouteHintUrls
+	}
+	u, err := url.Parse(currentPage.Url)
+	if err != nil {
+		return childPages
+	}
+	children := make(map[string]struct{})
+	for _, childPage := range childPages {
+		children[childPage.Url] = struct{}{}
+	}
+	added := 0
+	for _, hint := range hints {
+		if host, err := page.NormalizeHost(hint.Host); err != nil || host != u.Hostname() {
+			continue
+		}
+		for _, id := range hint.Ids {
+			if added >= maxUrls {
+				_ = level.Warn(logging.Logger).Log("context", "route hints truncated", "url", currentPage.Url, "max_route_hint_urls", maxUrls)
+				return childPages
+			}
+			absoluteUrl, err := currentPage.ParseRelativeUrl(expandRoute(hint.Template, id))
+			if err != nil {
+				continue
+			}
+			Url := absoluteUrl.String()
+			if _, isPresent := children[Url]; isPresent || !scope.Allows(Url) {
+				continue
+			}
+			children[Url] = struct{}{}
+			childPages = append(childPages, &page.Page{
+				Url:       Url,
+				Parent:    currentPage,
+				StartUrl:  currentPage.StartUrl,
+				Timestamp: time.Now().Unix(),
+				Login:     currentPage.Login,
+				Sink:      currentPage.Sink,
+				CrawlId:   currentPage.CrawlId,
+			})
+			added++
+		}
+	}
+	return childPages
+}
+
+// expandRoute function replaces each {id} in template with id, escaped as a query value after the template's '?' and
+// as a path segment before it
+func expandRoute(template string, id string) string {
+	path, query := template, ""
+	if i := strings.Index(template, "?"); i >= 0 {
+		path, query = template[:i], template[i:]
+	}
+	return strings.Replace(path, "{id}", url.PathEscape(id), -1) + strings.Replace(query, "{id}", url.QueryEscape(id), -1)
+}
+
+// CompileDepthRules function compiles the depth rules from the config, returning an error naming the first whose
+// pattern doesn't compile
+func CompileDepthRules(rules []config.DepthRule) (compiled []DepthRule, err error) {
+	for i, rule := range rules {
+		var re *regexp.Regexp
+		re, err = regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("[%d] is not a valid regular expression: %v", i, err)
+		}
+		compiled = append(compiled, DepthRule{Pattern: re, DepthDelta: rule.DepthDelta})
+	}
+	return
+}
+
+// ChildDepth function returns the depth left beneath a link with the given URL found on a page with the given depth:
+// one less than the page's, changed by the DepthDelta of the first rule the URL matches. It is never below 0.
+func ChildDepth(depth int, Url string, rules []DepthRule) int {
+	depth--
+	for _, rule := range rules {
+		if rule.Pattern.MatchString(Url) {
+			depth += rule.DepthDelta
+			break
+		}
+	}
+	if depth < 0 {
+		return 0
+	}
+	return depth
+}
+
+// RedirectChain function returns each [source, target] URL pair the client was redirected through to get the response,
+// in the order they happened.
+func RedirectChain(currentPage *page.Page, resp *http.Response) (redirects [][2]string) {
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		source := req.Response.Request
+		sourceUrl := redirectUrl(source.URL)
+		if source.Response == nil {
+			sourceUrl = currentPage.Url
+		}
+		redirects = append([][2]string{{sourceUrl, redirectUrl(req.URL)}}, redirects...)
+	}
+	return
+}
+
+// redirectUrl function formats a redirect URL the same way discovered links are stored
+func redirectUrl(u *url.URL) string {
+	normalized := *u
+	normalized.Fragment = ""
+	_ = page.NormalizeUrl(&normalized)
+	return normalized.String()
+}
+
+// CreateRedirects function stores the pages either side of each redirect and the redirects_to edge between them.
+func (crawler *Crawler) CreateRedirects(currentPage *page.Page, redirects [][2]string) (err error) {
+	ctx, cancel := crawler.crawlContext(currentPage)
+	defer cancel()
+	for _, redirect := range redirects {
+		var sourceUid, targetUid string
+		sourceUid, err = crawler.FindOrCreatePage(&ctx, &page.Page{Url: redirect[0], Timestamp: currentPage.Timestamp, CrawlId: currentPage.CrawlId})
 		if err != nil {
 			return
 		}
-		err = crawler.FindOrCreateLink(&ctx, parentUid, currentUid)
+		targetUid, err = crawler.FindOrCreatePage(&ctx, &page.Page{Url: redirect[1], Timestamp: currentPage.Timestamp, CrawlId: currentPage.CrawlId})
 		if err != nil {
 			return
 		}
+		err = crawler.Store.CreateRedirect(&ctx, sourceUid, targetUid)
+		if err != nil {
+			_ = level.Error(logging.Logger).Log(
+				"context", "create redirect",
+				"msg", err.Error(),
+				"source", redirect[0],
+				"target", redirect[1],
+			)
+			return
+		}
 	}
 	return
 }
 
-func (crawler *Crawler) FindOrCreateLink(ctx *context.Context, parentUid string, currentUid string) (err error) {
-	attempts := 10
-	for attempts > 0 {
-		attempts--
-		success, err := crawler.Store.CheckOrCreatePredicate(ctx, parentUid, currentUid)
+// CreateAlternates function stores the page and each of its alternates, and the alternate edge from the page to each
+// of them.
+func (crawler *Crawler) CreateAlternates(currentPage *page.Page) (err error) {
+	ctx, cancel := crawler.crawlContext(currentPage)
+	defer cancel()
+	sourceUid, err := crawler.FindOrCreatePage(&ctx, &page.Page{Url: currentPage.Url, Timestamp: currentPage.Timestamp, CrawlId: currentPage.CrawlId})
+	if err != nil {
+		return
+	}
+	for _, alternate := range currentPage.Alternates {
+		var targetUid string
+		targetUid, err = crawler.FindOrCreatePage(&ctx, &page.Page{Url: alternate.Url, Timestamp: currentPage.Timestamp, CrawlId: currentPage.CrawlId})
 		if err != nil {
-			if !strings.Contains(err.Error(), "Transaction has been aborted. Please retry") &&
-				!strings.Contains(err.Error(), "Transaction is too old") {
-				_ = level.Error(logging.Logger).Log(
-					"context", "create predicate",
-					"msg", err.Error(),
-					"parentUid", parentUid,
-					"childUid", currentUid,
-				)
+			return
+		}
+		err = crawler.Store.CreateAlternate(&ctx, sourceUid, targetUid, alternate.Rel, alternate.Hreflang)
+		if err != nil {
+			_ = level.Error(logging.Logger).Log(
+				"context", "create alternate",
+				"msg", err.Error(),
+				"source", currentPage.Url,
+				"target", alternate.Url,
+			)
+			return
+		}
+	}
+	return
+}
+
+// PruneLinks function removes the stored links from a page to any page which isn't among its current child pages. It
+// is only called for pages whose links were fetched, so links outside the crawled scope are left alone.
+func (crawler *Crawler) PruneLinks(currentPage *page.Page, childPages []*page.Page) (err error) {
+	ctx, cancel := crawler.crawlContext(currentPage)
+	defer cancel()
+	uid, err := crawler.FindOrCreatePage(&ctx, currentPage)
+	if err != nil {
+		return
+	}
+	var childUrls []string
+	for _, childPage := range childPages {
+		childUrls = append(childUrls, childPage.Url)
+	}
+	pruned, err := crawler.Store.PruneLinks(&ctx, uid, childUrls)
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "prune links", "url", currentPage.Url, "msg", err.Error())
+		return
+	}
+	if pruned > 0 {
+		cache.DefaultCache.Invalidate(currentPage.Url)
+		_ = level.Debug(logging.Logger).Log("context", "prune links", "url", currentPage.Url, "pruned", pruned)
+	}
+	return
+}
+
+// UpdateTimestamp function bumps the timestamp of a page which the server reported as unchanged.
+func (crawler *Crawler) UpdateTimestamp(currentPage *page.Page) (err error) {
+	ctx, cancel := crawler.crawlContext(currentPage)
+	defer cancel()
+	err = crawler.Store.UpdateTimestamp(&ctx, currentPage.Uid, currentPage.Timestamp)
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "update timestamp", "url", currentPage.Url, "msg", err.Error())
+		return
+	}
+	cache.DefaultCache.Invalidate(currentPage.Url)
+	return
+}
+
+// storedChildren function returns child pages for the links stored for a page which answered 304 Not Modified, so the
+// levels beneath it are still crawled when fewer are stored than the crawl asks for. Links the scope no longer allows
+// are left out, and no more than maxLinksPerPage are returned when it is set.
+func (crawler *Crawler) storedChildren(ctx context.Context, currentPage *page.Page, maxLinksPerPage int, scope *page.LinkScope) (childPages []*page.Page) {
+	stored, err := crawler.Store.FindChildren(&ctx, currentPage.Url)
+	if err != nil {
+		_ = level.Warn(logging.Logger).Log("context", "finding stored links", "url", currentPage.Url, "msg", err.Error())
+		return
+	}
+	for _, child := range stored {
+		if maxLinksPerPage > 0 && len(childPages) >= maxLinksPerPage {
+			break
+		}
+		if !scope.Allows(child.Url) {
+			continue
+		}
+		childPages = append(childPages, &page.Page{
+			Url:       child.Url,
+			Parent:    currentPage,
+			StartUrl:  currentPage.StartUrl,
+			Timestamp: time.Now().Unix(),
+			Login:     currentPage.Login,
+			Sink:      currentPage.Sink,
+			CrawlId:   currentPage.CrawlId,
+		})
+	}
+	return
+}
+
+// loadValidators function copies the stored uid, ETag and Last-Modified values of a page so it can be fetched
+// conditionally, returning the stored page without its links, or nil if it isn't stored.
+func (crawler *Crawler) loadValidators(ctx context.Context, currentPage *page.Page) (storedPage *page.Page) {
+	storedPage, err := crawler.Store.FindNode(&ctx, currentPage.Url, 0, "")
+	if err != nil || storedPage == nil {
+		return nil
+	}
+	currentPage.Uid = storedPage.Uid
+	currentPage.ETag = storedPage.ETag
+	currentPage.LastModified = storedPage.LastModified
+	return
+}
+
+// FindOrCreateLink function creates the link between the parent and current pages, attributed to the crawl with the
+// given id, retrying transactions aborted by conflicting writes. It gives up after 10 attempts, once DbTimeout has
+// passed or once the crawl's retry budget is spent, returning the last error.
+func (crawler *Crawler) FindOrCreateLink(ctx *context.Context, parentUid string, currentUid string, crawlId string) (err error) {
+	linkCtx, cancel := crawler.dbContext(*ctx)
+	defer cancel()
+	attempts := 0
+	for attempts < 10 {
+		if attempts > 0 {
+			if err = crawler.spendRetry(linkCtx); err != nil {
 				break
 			}
 		}
-		if success {
+		attempts++
+		var success bool
+		success, err = crawler.Store.CheckOrCreatePredicate(&linkCtx, parentUid, currentUid, crawlId)
+		if err != nil && (!relationship.IsRetryable(err) || linkCtx.Err() != nil) {
 			break
 		}
+		if err == nil && success {
+			recordRetries("create link", retryOutcome(linkCtx, nil), attempts-1, "parentUid", parentUid, "childUid", currentUid)
+			return
+		}
+	}
+	outcome := retryOutcome(linkCtx, err)
+	if err == nil {
+		outcome = "exhausted"
+		err = errors.New("link was not confirmed after 10 attempts")
 	}
+	recordRetries("create link", outcome, attempts-1, "parentUid", parentUid, "childUid", currentUid)
+	_ = level.Error(logging.Logger).Log(
+		"context", "create predicate",
+		"msg", err.Error(),
+		"parentUid", parentUid,
+		"childUid", currentUid,
+	)
 	return
 }
 
+// FindOrCreatePage function finds or creates the page, retrying transactions aborted by conflicting writes until it
+// has a uid or DbTimeout has passed.
 func (crawler *Crawler) FindOrCreatePage(ctx *context.Context, p *page.Page) (uid string, err error) {
+	return crawler.storePage(ctx, p, "create page", crawler.Store.FindOrCreateNode)
+}
+
+// UpsertErrorPage function finds or creates the page and records its Error and status code, retrying like
+// FindOrCreatePage
+func (crawler *Crawler) UpsertErrorPage(ctx *context.Context, p *page.Page) (uid string, err error) {
+	return crawler.storePage(ctx, p, "record error", crawler.Store.UpsertErrorNode)
+}
+
+// storePage function retries write until it returns a uid, an error which can't be retried, or DbTimeout has passed
+// or the crawl's retry budget is spent
+func (crawler *Crawler) storePage(ctx *context.Context, p *page.Page, operation string, write func(*context.Context, *page.Page) (string, error)) (uid string, err error) {
+	pageCtx, cancel := crawler.dbContext(*ctx)
+	defer cancel()
+	retries := -1
 	for uid == "" {
-		uid, err = crawler.Store.FindOrCreateNode(ctx, p)
-		if err != nil {
-			if !strings.Contains(err.Error(), "Transaction has been aborted. Please retry") &&
-				!strings.Contains(err.Error(), "Transaction is too old") {
-				_ = level.Error(logging.Logger).Log(
-					"msg", err.Error(),
-					"context", "create page",
-					"url", p.Url,
-				)
-				return
+		if retries >= 0 {
+			err = crawler.spendRetry(pageCtx)
+		}
+		if err == nil {
+			retries++
+			uid, err = write(&pageCtx, p)
+			if err == nil && uid == "" && pageCtx.Err() != nil {
+				err = pageCtx.Err()
 			}
 		}
+		if err != nil && (!relationship.IsRetryable(err) || pageCtx.Err() != nil) {
+			recordRetries(operation, retryOutcome(pageCtx, err), retries, "url", p.Url)
+			_ = level.Error(logging.Logger).Log(
+				"msg", err.Error(),
+				"context", operation,
+				"url", p.Url,
+			)
+			return "", err
+		}
 	}
+	recordRetries(operation, retryOutcome(pageCtx, nil), retries, "url", p.Url)
 	return
 }
 
-// Locks crawl, then returns true/false dependent on Url being in map. If false, we store the Url.
-func (crawler *Crawler) hasAlreadyCrawled(Url string) (isPresent bool) {
-	cleanUrl := strings.TrimRight(Url, "/")
+// FetchError function describes why a page couldn't be fetched. Errors are prefixed with "http" when the server
+// returned an error status code, or "network" when no response was received.
+func FetchError(resp *http.Response, err error) string {
+	if resp != nil {
+		return fmt.Sprintf("http: received HTTP status %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return "network: " + err.Error()
+}
+
+// retryOutcome function describes how a run of database retries ended: "success", "exhausted" if it ran out of time
+// or attempts, or "error" if it failed with an error which can't be retried
+func retryOutcome(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case ctx.Err() != nil || relationship.IsRetryable(err) || errors.Is(err, ErrRetryBudgetExhausted):
+		return "exhausted"
+	default:
+		return "error"
+	}
+}
+
+// recordRetries function records how many times a database write was retried, and logs writes which needed retrying
+// so contention on the graph shows up
+func recordRetries(operation string, outcome string, retries int, keyvals ...interface{}) {
+	DbRetries.WithLabelValues(operation, outcome).Observe(float64(retries))
+	if retries > 0 {
+		_ = level.Debug(logging.Logger).Log(append([]interface{}{"context", operation, "outcome", outcome, "retries", retries}, keyvals...)...)
+	}
+}
+
+// spendRetry function charges a retry to the budget of the crawl ctx belongs to, returning ErrRetryBudgetExhausted
+// instead once the crawl has retried MaxTotalRetries times. There is no budget without MaxTotalRetries, or for a
+// context which doesn't belong to a crawl.
+func (crawler *Crawler) spendRetry(ctx context.Context) error {
+	startUrl, isCrawl := ctx.Value(crawlKey{}).(string)
+	crawler.settingsMutex.RLock()
+	maxTotalRetries := crawler.MaxTotalRetries
+	crawler.settingsMutex.RUnlock()
+	if !isCrawl || maxTotalRetries <= 0 {
+		return nil
+	}
+	defer crawler.Unlock()
+	crawler.Lock()
+	if crawler.retriesSpent == nil {
+		crawler.retriesSpent = make(map[string]int)
+	}
+	if crawler.retriesSpent[startUrl] >= maxTotalRetries {
+		return ErrRetryBudgetExhausted
+	}
+	crawler.retriesSpent[startUrl]++
+	if crawler.retriesSpent[startUrl] == maxTotalRetries {
+		_ = level.Warn(logging.Logger).Log("context", "crawl retry budget exhausted", "start_url", startUrl, "retries", maxTotalRetries)
+	}
+	return nil
+}
+
+// overRetryBudget function checks whether the page's crawl has retried maxTotalRetries times. A maxTotalRetries of 0
+// means there is no budget.
+func (crawler *Crawler) overRetryBudget(currentPage *page.Page, maxTotalRetries int) bool {
+	if maxTotalRetries <= 0 {
+		return false
+	}
+	defer crawler.Unlock()
+	crawler.Lock()
+	return crawler.retriesSpent[currentPage.StartUrl] >= maxTotalRetries
+}
+
+// dbContext function bounds a run of database retries by DbTimeout, if it is set
+func (crawler *Crawler) dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	crawler.settingsMutex.RLock()
+	timeout := crawler.DbTimeout
+	crawler.settingsMutex.RUnlock()
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// overHostBudget function checks whether the pages downloaded from the host of Url in the page's crawl have used up
+// maxBytesPerHost. A maxBytesPerHost of 0 means there is no budget.
+func (crawler *Crawler) overHostBudget(currentPage *page.Page, Url string, maxBytesPerHost int64) bool {
+	if maxBytesPerHost <= 0 {
+		return false
+	}
+	parsedUrl, err := url.Parse(Url)
+	if err != nil {
+		return false
+	}
+	defer crawler.Unlock()
+	crawler.Lock()
+	return crawler.hostBytes[hostBudget{startUrl: currentPage.StartUrl, host: parsedUrl.Host}] >= maxBytesPerHost
+}
+
+// addHostBytes function adds the bytes downloaded for a page to its host's total in the page's crawl
+func (crawler *Crawler) addHostBytes(currentPage *page.Page, host string, bytes int64) {
+	defer crawler.Unlock()
+	crawler.Lock()
+	if crawler.hostBytes == nil {
+		crawler.hostBytes = make(map[hostBudget]int64)
+	}
+	crawler.hostBytes[hostBudget{startUrl: currentPage.StartUrl, host: host}] += bytes
+}
+
+// WarmConnections function opens connections to up to maxWarmHosts of the hosts the page preconnects to which haven't
+// been warmed yet in its crawl. Each host is sent a HEAD request for its root through the shared client, which leaves
+// the connection idle in the transport for the pages fetched from it later. Failures are only logged, as the host is
+// dialled again when it is crawled.
+func (crawler *Crawler) WarmConnections(currentPage *page.Page, maxWarmHosts int) {
+	var origins []string
+	crawler.Lock()
+	if crawler.warmedHosts == nil {
+		crawler.warmedHosts = make(map[hostBudget]struct{})
+	}
+	for _, origin := range currentPage.Preconnects {
+		if len(origins) == maxWarmHosts {
+			break
+		}
+		warmed := hostBudget{startUrl: currentPage.StartUrl, host: origin}
+		if _, isPresent := crawler.warmedHosts[warmed]; !isPresent {
+			crawler.warmedHosts[warmed] = struct{}{}
+			origins = append(origins, origin)
+		}
+	}
+	crawler.Unlock()
+	ctx, cancel := crawler.crawlContext(currentPage)
+	defer cancel()
+	client := crawler.httpClient()
+	var wg sync.WaitGroup
+	for _, origin := range origins {
+		wg.Add(1)
+		go func(origin string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin+"/", nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("User-Agent", "stevenayers/clamber")
+			resp, err := client.Do(req)
+			if err != nil {
+				_ = level.Debug(logging.Logger).Log("context", "warm connection", "url", currentPage.Url, "host", origin, "msg", err.Error())
+				return
+			}
+			_ = resp.Body.Close()
+		}(origin)
+	}
+	wg.Wait()
+}
+
+// Close function closes the body and frees its host slot, once however many times it is called
+func (body *releasingBody) Close() (err error) {
+	err = body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return
+}
+
+// Read function reads from the body, counting the bytes read
+func (body *countingBody) Read(p []byte) (n int, err error) {
+	n, err = body.ReadCloser.Read(p)
+	atomic.AddInt64(&body.bytes, int64(n))
+	return
+}
+
+// Locks crawl, then returns true/false dependent on the page's Url being in map. If false, we store the Url. When a
+// VisitedFilter is set, it is used in place of the map. Pages of a named crawl are kept apart by their CrawlId, so a
+// page one crawl has stored is still stored and linked by another.
+func (crawler *Crawler) hasAlreadyCrawled(currentPage *page.Page) (isPresent bool) {
+	cleanUrl := page.CanonicalUrl(currentPage.Url)
+	if currentPage.CrawlId != "" {
+		cleanUrl = currentPage.CrawlId + " " + cleanUrl
+	}
+	if crawler.VisitedFilter != nil {
+		return crawler.VisitedFilter.CheckAndAdd(cleanUrl)
+	}
 	defer crawler.Unlock()
 	crawler.Lock()
 	_, isPresent = crawler.AlreadyCrawled[cleanUrl]
@@ -4,20 +4,30 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stevenayers/clamber/pkg/config"
 	"github.com/stevenayers/clamber/pkg/crawl"
 	"github.com/stevenayers/clamber/pkg/database/relationship"
 	"github.com/stevenayers/clamber/pkg/logging"
 	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stevenayers/clamber/pkg/schedule"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -34,8 +44,117 @@ type (
 		Msg     string `json:"msg,omitempty"`
 		Context string `json:"context,omitempty"`
 	}
+
+	// failingLinkStore fails every link it is asked to create, either straight away or once the context is done. If
+	// failures is set, it only fails that many times before creating the link.
+	failingLinkStore struct {
+		relationship.Graph
+		err       error
+		block     bool
+		failures  int
+		linkCalls int
+	}
 )
 
+// localFrontier crawls each published page straight away in this process, in place of the SQS queue
+type localFrontier struct {
+	crawler *crawl.Crawler
+}
+
+func (frontier *localFrontier) Publish(p *page.Page) {
+	go frontier.crawler.Crawl(p)
+}
+
+// recordingFrontier keeps each published page in place of the SQS queue, without crawling it
+type recordingFrontier struct {
+	mutex     sync.Mutex
+	published map[string]*page.Page
+}
+
+func (frontier *recordingFrontier) Publish(p *page.Page) {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	frontier.published[p.Url] = p
+}
+
+// stubFetcher returns a canned HTML body for each URL it knows, with any headers set for it, and a 404 for the rest,
+// recording the URLs fetched
+type stubFetcher struct {
+	mutex   sync.Mutex
+	bodies  map[string]string
+	headers map[string]http.Header
+	fetched []string
+}
+
+func (fetcher *stubFetcher) Fetch(ctx context.Context, Url string) (*http.Response, error) {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	fetcher.fetched = append(fetcher.fetched, Url)
+	body, isPresent := fetcher.bodies[Url]
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/html"}}, Body: ioutil.NopCloser(strings.NewReader(body))}
+	for key, values := range fetcher.headers[Url] {
+		resp.Header[key] = values
+	}
+	if !isPresent {
+		resp.StatusCode = http.StatusNotFound
+	}
+	return resp, nil
+}
+
+// timingFetcher records when each request was sent
+type timingFetcher struct {
+	mutex sync.Mutex
+	sent  []time.Time
+}
+
+func (fetcher *timingFetcher) Fetch(ctx context.Context, Url string) (*http.Response, error) {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	fetcher.sent = append(fetcher.sent, time.Now())
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+// countingStore records the most writes it has seen running at once
+type countingStore struct {
+	relationship.Graph
+	active    int32
+	maxActive int32
+}
+
+// write function counts a write as running for long enough that other writes can overlap it
+func (store *countingStore) write() func() {
+	active := atomic.AddInt32(&store.active, 1)
+	for {
+		maxActive := atomic.LoadInt32(&store.maxActive)
+		if active <= maxActive || atomic.CompareAndSwapInt32(&store.maxActive, maxActive, active) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return func() { atomic.AddInt32(&store.active, -1) }
+}
+
+func (store *countingStore) FindOrCreateNode(ctx *context.Context, currentPage *page.Page) (string, error) {
+	defer store.write()()
+	return store.Graph.FindOrCreateNode(ctx, currentPage)
+}
+
+func (store *countingStore) CheckOrCreatePredicate(ctx *context.Context, parentUid string, childUid string, crawlId string) (bool, error) {
+	defer store.write()()
+	return store.Graph.CheckOrCreatePredicate(ctx, parentUid, childUid, crawlId)
+}
+
+func (store *failingLinkStore) CheckOrCreatePredicate(ctx *context.Context, parentUid string, childUid string, crawlId string) (bool, error) {
+	store.linkCalls++
+	if store.failures > 0 && store.linkCalls > store.failures {
+		return true, nil
+	}
+	if store.block {
+		<-(*ctx).Done()
+	}
+	return false, store.err
+}
+
 var (
 	CrawlTests = []CrawlTest{
 		//{"https://golang.org", 2},
@@ -208,7 +327,7 @@ func (s *StoreSuite) TestAllPagesReturned() {
 		var Urls []*page.Page
 		if err != nil {
 			_ = level.Error(logging.Logger).Log("context", "failed to get URL", "url", rootPage.Url, "msg", err.Error())
-			Urls, _ = rootPage.FetchChildPages(resp)
+			Urls, _ = rootPage.FetchChildPages(resp, 0, nil, nil)
 			crawler.Crawl(&rootPage)
 			crawler.DbWaitGroup.Wait()
 			assert.Equal(s.T(), len(Urls), len(rootPage.Links), "page.Links and fetch Urls length expected to match.")
@@ -216,6 +335,526 @@ func (s *StoreSuite) TestAllPagesReturned() {
 	}
 }
 
+func (s *StoreSuite) TestGetInsecureSkipVerify() {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body></body></html>"))
+	}))
+	defer server.Close()
+	verifyingCrawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{})}
+	_, err := verifyingCrawler.Get(context.Background(), &page.Page{Url: server.URL})
+	assert.Equal(s.T(), true, err != nil, "self-signed certificate should be rejected by default")
+	insecureCrawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), InsecureSkipVerify: true}
+	resp, err := insecureCrawler.Get(context.Background(), &page.Page{Url: server.URL})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *StoreSuite) TestReconfigure() {
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{})}
+	crawler.Reconfigure(config.ServiceConfig{
+		Recrawl:         true,
+		PruneStaleLinks: true,
+		MaxLinksPerPage: 50,
+		AcceptLanguage:  "de-DE,de;q=0.9",
+		DbTimeout:       30,
+	})
+	assert.Equal(s.T(), true, crawler.Recrawl)
+	assert.Equal(s.T(), true, crawler.PruneStaleLinks)
+	assert.Equal(s.T(), 50, crawler.MaxLinksPerPage)
+	assert.Equal(s.T(), "de-DE,de;q=0.9", crawler.AcceptLanguage)
+	assert.Equal(s.T(), 30*time.Second, crawler.DbTimeout)
+}
+
+func (s *StoreSuite) TestReconfigureKeepsPatternsOnCompileError() {
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{})}
+	crawler.Reconfigure(config.ServiceConfig{
+		ExcludePatterns: []string{`/private/`},
+		DepthRules:      []config.DepthRule{{Pattern: `/blog/`, DepthDelta: 1}},
+	})
+	if assert.Equal(s.T(), 1, len(crawler.ExcludePatterns)) && assert.Equal(s.T(), 1, len(crawler.DepthRules)) {
+		crawler.Reconfigure(config.ServiceConfig{
+			ExcludePatterns: []string{`[invalid`},
+			DepthRules:      []config.DepthRule{{Pattern: `(invalid`, DepthDelta: 1}},
+		})
+		if assert.Equal(s.T(), 1, len(crawler.ExcludePatterns), "patterns which don't compile should not replace the old ones") {
+			assert.Equal(s.T(), `/private/`, crawler.ExcludePatterns[0].String())
+		}
+		assert.Equal(s.T(), 1, len(crawler.DepthRules), "depth rules which don't compile should not replace the old ones")
+	}
+}
+
+func (s *StoreSuite) TestCrawlMaxDuration() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	crawler := crawl.Crawler{
+		AlreadyCrawled: make(map[string]struct{}),
+		Store:          &s.store,
+		MaxDuration:    200 * time.Millisecond,
+	}
+	rootPage := page.Page{Url: server.URL, Depth: 1}
+	start := time.Now()
+	crawler.Crawl(&rootPage)
+	assert.Equal(s.T(), true, time.Since(start) < time.Second, "crawl should stop near its deadline")
+	assert.NotEqual(s.T(), int64(0), rootPage.Deadline)
+}
+
+func (s *StoreSuite) TestGetConditional() {
+	bodiesServed := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		bodiesServed++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><body><a href="/about">about</a></body></html>`))
+	}))
+	defer server.Close()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{})}
+	p := page.Page{Url: server.URL}
+	resp, err := crawler.Get(context.Background(), &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	p.ETag = resp.Header.Get("ETag")
+	resp, err = crawler.Get(context.Background(), &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(s.T(), http.StatusNotModified, resp.StatusCode)
+	assert.Equal(s.T(), 1, bodiesServed, "unchanged page should not be downloaded again")
+}
+
+func (s *StoreSuite) TestCrawlNotModifiedPublishesStoredLinks() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><body><a href="/about">about</a></body></html>`))
+	}))
+	defer server.Close()
+	store := relationship.NewMemoryStore()
+	ctx := context.Background()
+	first := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store}
+	first.Frontier = &localFrontier{crawler: first}
+	first.Crawl(&page.Page{Url: server.URL + "/", StartUrl: server.URL + "/", Depth: 1})
+	var stored []*page.Page
+	var root *page.Page
+	for start := time.Now(); time.Since(start) < time.Second && (len(stored) == 0 || root == nil || root.ETag == ""); time.Sleep(10 * time.Millisecond) {
+		stored, _ = store.FindChildren(&ctx, server.URL+"/")
+		root, _ = store.FindNode(&ctx, server.URL+"/", 0, "")
+	}
+	if len(stored) == 0 || root == nil || root.ETag == "" {
+		s.T().Fatal("the page and its link to /about were not stored")
+	}
+
+	frontier := &recordingFrontier{published: make(map[string]*page.Page)}
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, Frontier: frontier}
+	crawler.Crawl(&page.Page{Url: server.URL + "/", StartUrl: server.URL + "/", Depth: 2})
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	child, isPresent := frontier.published[server.URL+"/about"]
+	if !isPresent {
+		s.T().Fatal("the stored link of a page which answered 304 should be published")
+	}
+	assert.Equal(s.T(), 1, child.Depth, "the stored link should be crawled to the depth left beneath it")
+	assert.Equal(s.T(), server.URL+"/", child.StartUrl)
+}
+
+func (s *StoreSuite) TestRecordRedirects() {
+	mux := http.NewServeMux()
+	mux.Handle("/old", http.RedirectHandler("/new", http.StatusMovedPermanently))
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body></body></html>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	crawler := crawl.Crawler{
+		AlreadyCrawled:  make(map[string]struct{}),
+		Store:           &s.store,
+		RecordRedirects: true,
+	}
+	p := page.Page{Url: server.URL + "/old", Timestamp: time.Now().Unix()}
+	resp, err := crawler.Get(context.Background(), &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	_ = resp.Body.Close()
+	redirects := crawl.RedirectChain(&p, resp)
+	assert.Equal(s.T(), [][2]string{{server.URL + "/old", server.URL + "/new"}}, redirects)
+	err = crawler.CreateRedirects(&p, redirects)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	ctx := context.Background()
+	targetUrl, err := s.store.FindRedirect(&ctx, server.URL+"/old")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), server.URL+"/new", targetUrl)
+}
+
+func (s *StoreSuite) TestGetAcceptLanguage() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		if strings.HasPrefix(r.Header.Get("Accept-Language"), "fr") {
+			_, _ = w.Write([]byte("bonjour"))
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	for acceptLanguage, expected := range map[string]string{"": "hello", "fr-FR,fr;q=0.9,en;q=0.8": "bonjour"} {
+		crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), AcceptLanguage: acceptLanguage}
+		resp, err := crawler.Get(context.Background(), &page.Page{Url: server.URL})
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(s.T(), expected, string(body), acceptLanguage)
+	}
+}
+
+func (s *StoreSuite) TestGetHeaders() {
+	var received http.Header
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, host = r.Header.Clone(), r.Host
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	crawler := crawl.Crawler{
+		AlreadyCrawled: make(map[string]struct{}),
+		AcceptLanguage: "fr",
+		Headers: map[string]string{
+			"X-Forwarded-For": "203.0.113.7",
+			"x-api-key":       "secret",
+			"User-Agent":      "clamber-test",
+			"Host":            "evil.example.com",
+			"cookie":          "session=stolen",
+			"If-None-Match":   `"forged"`,
+		},
+	}
+	resp, err := crawler.Get(context.Background(), &page.Page{Url: server.URL, ETag: `"v1"`})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(s.T(), "203.0.113.7", received.Get("X-Forwarded-For"))
+	assert.Equal(s.T(), "secret", received.Get("X-Api-Key"))
+	assert.Equal(s.T(), "clamber-test", received.Get("User-Agent"), "configured headers should replace the built-in ones")
+	assert.Equal(s.T(), "fr", received.Get("Accept-Language"))
+	assert.Equal(s.T(), strings.TrimPrefix(server.URL, "http://"), host, "the Host header should not be overridden")
+	assert.Equal(s.T(), "", received.Get("Cookie"), "the Cookie header should not be overridden")
+	assert.Equal(s.T(), `"v1"`, received.Get("If-None-Match"), "conditional headers should not be overridden")
+}
+
+func (s *StoreSuite) TestPruneStaleLinks() {
+	links := []string{"/b", "/c"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		body := "<html><body>"
+		for _, link := range links {
+			body += fmt.Sprintf(`<a href="%s">%s</a>`, link, link)
+		}
+		_, _ = w.Write([]byte(body + "</body></html>"))
+	}))
+	defer server.Close()
+	crawler := crawl.Crawler{
+		AlreadyCrawled:  make(map[string]struct{}),
+		Store:           &s.store,
+		Recrawl:         true,
+		PruneStaleLinks: true,
+	}
+	ctx := context.Background()
+	crawlLinks := func() {
+		rootPage := page.Page{Url: server.URL, Depth: 1, Timestamp: time.Now().Unix()}
+		resp, err := crawler.Get(ctx, &rootPage)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		childPages, err := rootPage.FetchChildPages(resp, 0, nil, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		for _, childPage := range childPages {
+			if err = crawler.Create(childPage); err != nil {
+				s.T().Fatal(err)
+			}
+		}
+		if err = crawler.PruneLinks(&rootPage, childPages); err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	storedLinks := func() (urls []string) {
+		result, err := s.store.FindNode(&ctx, server.URL, 1, "")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		for _, link := range result.Links {
+			urls = append(urls, link.Url)
+		}
+		sort.Strings(urls)
+		return
+	}
+
+	crawlLinks()
+	assert.Equal(s.T(), []string{server.URL + "/b", server.URL + "/c"}, storedLinks())
+	links = []string{"/b", "/d"}
+	crawlLinks()
+	assert.Equal(s.T(), []string{server.URL + "/b", server.URL + "/d"}, storedLinks(), "links should match the page's current links")
+}
+
+func (s *StoreSuite) TestGetLogin() {
+	var logins int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&logins, 1)
+		if r.Method != http.MethodPost || r.PostFormValue("username") != "bob" || r.PostFormValue("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "bob", Path: "/"})
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "bob" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><body><a href="/private">private</a></body></html>`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{})}
+
+	resp, err := crawler.Get(context.Background(), &page.Page{Url: server.URL + "/private", StartUrl: server.URL})
+	assert.Equal(s.T(), true, err != nil && resp.StatusCode == http.StatusUnauthorized, "pages should be gated without a login")
+	_ = resp.Body.Close()
+
+	login := &page.Login{Url: server.URL + "/login", Fields: map[string]string{"username": "bob", "password": "secret"}}
+	for _, Url := range []string{server.URL, server.URL + "/private"} {
+		resp, err = crawler.Get(context.Background(), &page.Page{Url: Url, StartUrl: server.URL, Login: login})
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		_ = resp.Body.Close()
+		assert.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&logins), "pages of a crawl should share its session")
+
+	badLogin := &page.Login{Url: server.URL + "/login", Fields: map[string]string{"username": "bob", "password": "wrong"}}
+	_, err = crawler.Get(context.Background(), &page.Page{Url: server.URL, StartUrl: server.URL, Login: badLogin})
+	assert.Equal(s.T(), true, err != nil && strings.Contains(err.Error(), "login"), err)
+}
+
+func (s *StoreSuite) TestCrawlCookies() {
+	var mutex sync.Mutex
+	received := make(map[string][]string)
+	started := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		site := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[0]
+		if r.URL.Path == "/"+site {
+			// both start pages set their cookie before either crawl fetches its next page
+			http.SetCookie(w, &http.Cookie{Name: site, Value: "1", Path: "/"})
+			started <- struct{}{}
+			for start := time.Now(); len(started) < 2 && time.Since(start) < time.Second; {
+				time.Sleep(time.Millisecond)
+			}
+			_, _ = fmt.Fprintf(w, `<html><body><a href="/%s/next">next</a></body></html>`, site)
+			return
+		}
+		var names []string
+		for _, cookie := range r.Cookies() {
+			names = append(names, cookie.Name)
+		}
+		mutex.Lock()
+		received[r.URL.Path] = names
+		mutex.Unlock()
+		_, _ = w.Write([]byte("<html><body></body></html>"))
+	}))
+	defer server.Close()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: relationship.NewMemoryStore()}
+	crawler.Frontier = &localFrontier{crawler: &crawler}
+	for _, site := range []string{"a", "b"} {
+		go crawler.Crawl(&page.Page{Url: server.URL + "/" + site, StartUrl: server.URL + "/" + site, Depth: 1})
+	}
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		mutex.Lock()
+		done := len(received) == 2
+		mutex.Unlock()
+		if done {
+			break
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(s.T(), []string{"a"}, received["/a/next"], "a crawl should only send its own cookies")
+	assert.Equal(s.T(), []string{"b"}, received["/b/next"], "a crawl should only send its own cookies")
+}
+
+func (s *StoreSuite) TestMaxBytesPerHost() {
+	var fetched int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(strings.Repeat("a", 100)))
+	}))
+	defer server.Close()
+	crawler := crawl.Crawler{
+		AlreadyCrawled:  make(map[string]struct{}),
+		Store:           relationship.NewMemoryStore(),
+		MaxBytesPerHost: 250,
+	}
+	for i := 0; i < 5; i++ {
+		crawler.Crawl(&page.Page{Url: fmt.Sprintf("%s/%d", server.URL, i), StartUrl: server.URL})
+	}
+	assert.Equal(s.T(), int32(3), atomic.LoadInt32(&fetched), "pages should stop being fetched once the budget is used up")
+	crawler.Crawl(&page.Page{Url: server.URL + "/other", StartUrl: "https://golang.org"})
+	assert.Equal(s.T(), int32(4), atomic.LoadInt32(&fetched), "each crawl should have its own budget")
+}
+
+func (s *StoreSuite) TestRecordErrors() {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	store := relationship.NewMemoryStore()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, RecordErrors: true}
+	parent := &page.Page{Url: "https://golang.org", Timestamp: time.Now().Unix()}
+	crawler.Crawl(&page.Page{Url: server.URL + "/missing", Parent: parent, StartUrl: parent.Url})
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	crawler.Crawl(&page.Page{Url: closed.URL, Parent: parent, StartUrl: parent.Url})
+
+	ctx := context.Background()
+	var result *page.Page
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		var err error
+		result, err = store.FindNode(&ctx, parent.Url, 1, "")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		if result != nil && len(result.Links) == 2 {
+			break
+		}
+	}
+	if !assert.Equal(s.T(), true, result != nil && len(result.Links) == 2, "failed pages should be linked from their parent") {
+		return
+	}
+	errorPages := make(map[string]*page.Page)
+	for _, childPage := range result.Links {
+		errorPages[childPage.Url] = childPage
+	}
+	missing := errorPages[server.URL+"/missing"]
+	assert.Equal(s.T(), http.StatusNotFound, missing.StatusCode)
+	assert.Equal(s.T(), "http: received HTTP status 404 Not Found", missing.Error)
+	unreachable := errorPages[closed.URL]
+	assert.Equal(s.T(), 0, unreachable.StatusCode)
+	assert.Equal(s.T(), true, strings.HasPrefix(unreachable.Error, "network: "), unreachable.Error)
+}
+
+func (s *StoreSuite) TestFindOrCreateLinkError() {
+	ctx := context.Background()
+	store := &failingLinkStore{err: errors.New("commit failed: connection reset")}
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store}
+	err := crawler.FindOrCreateLink(&ctx, "0x1", "0x2", "")
+	assert.Equal(s.T(), store.err, err)
+	assert.Equal(s.T(), 1, store.linkCalls, "errors which can't be retried should be returned straight away")
+
+	store = &failingLinkStore{err: errors.New("Transaction has been aborted. Please retry")}
+	crawler.Store = store
+	err = crawler.FindOrCreateLink(&ctx, "0x1", "0x2", "")
+	assert.Equal(s.T(), store.err, err)
+	assert.Equal(s.T(), 10, store.linkCalls)
+}
+
+func (s *StoreSuite) TestFindOrCreateLinkTimeout() {
+	ctx := context.Background()
+	store := &failingLinkStore{err: errors.New("Transaction has been aborted. Please retry"), block: true}
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, DbTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	err := crawler.FindOrCreateLink(&ctx, "0x1", "0x2", "")
+	assert.Equal(s.T(), true, err != nil)
+	assert.Equal(s.T(), true, time.Since(start) < time.Second, "retries should stop at the timeout")
+	assert.Equal(s.T(), 1, store.linkCalls)
+}
+
+func (s *StoreSuite) TestFindOrCreateLinkRetries() {
+	ctx := context.Background()
+	retries := func(outcome string) (count uint64, sum float64) {
+		metric := &dto.Metric{}
+		if err := crawl.DbRetries.WithLabelValues("create link", outcome).(prometheus.Metric).Write(metric); err != nil {
+			s.T().Fatal(err)
+		}
+		return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+	}
+	count, sum := retries("success")
+	store := &failingLinkStore{err: errors.New("Transaction has been aborted. Please retry"), failures: 3}
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store}
+	err := crawler.FindOrCreateLink(&ctx, "0x1", "0x2", "")
+	assert.Equal(s.T(), nil, err)
+	newCount, newSum := retries("success")
+	assert.Equal(s.T(), count+1, newCount)
+	assert.Equal(s.T(), sum+3, newSum, "the three aborted transactions should be recorded as retries")
+
+	count, sum = retries("exhausted")
+	crawler.Store = &failingLinkStore{err: errors.New("Transaction has been aborted. Please retry")}
+	err = crawler.FindOrCreateLink(&ctx, "0x1", "0x2", "")
+	assert.Equal(s.T(), true, err != nil)
+	newCount, newSum = retries("exhausted")
+	assert.Equal(s.T(), count+1, newCount)
+	assert.Equal(s.T(), sum+9, newSum)
+}
+
+func (s *StoreSuite) TestMaxTotalRetries() {
+	config.Update(func(c *config.Config) {
+		c.Service.HttpRetryAttempts = 3
+		c.Service.HttpBackOffDuration = 0
+	})
+	var mutex sync.Mutex
+	fetched := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		fetched[r.URL.Path]++
+		mutex.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: relationship.NewMemoryStore(), MaxTotalRetries: 5}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		crawler.Crawl(&page.Page{Url: server.URL + path, StartUrl: server.URL})
+	}
+	crawler.Crawl(&page.Page{Url: server.URL + "/d", StartUrl: server.URL + "/other"})
+	mutex.Lock()
+	assert.Equal(s.T(), map[string]int{"/a": 4, "/b": 3, "/d": 4}, fetched, "the crawl should stop once its five retries are spent")
+	mutex.Unlock()
+
+	store := &failingLinkStore{Graph: relationship.NewMemoryStore(), err: errors.New("Transaction has been aborted. Please retry")}
+	crawler = crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, MaxTotalRetries: 2}
+	err := crawler.Create(&page.Page{Url: server.URL + "/b", StartUrl: server.URL, Parent: &page.Page{Url: server.URL}})
+	assert.Equal(s.T(), crawl.ErrRetryBudgetExhausted, err)
+	assert.Equal(s.T(), 3, store.linkCalls, "database writes should be charged to the budget too")
+}
+
 func recursivelySearchPages(t *testing.T, p *page.Page, depth int, Url string, counter *int, depths *[]int) func() {
 	return func() {
 		for _, v := range p.Links {
@@ -245,7 +884,7 @@ func (s *StoreSuite) TestCreateAndFindNode() {
 		crawler.Crawl(&expectedPage)
 		crawler.DbWaitGroup.Wait()
 		ctx := context.Background()
-		resultPage, err := s.store.FindNode(&ctx, test.Url, test.Depth)
+		resultPage, err := s.store.FindNode(&ctx, test.Url, test.Depth, "")
 		if err != nil {
 			s.T().Fatal(err)
 		}
@@ -255,6 +894,918 @@ func (s *StoreSuite) TestCreateAndFindNode() {
 
 }
 
+func (s *StoreSuite) TestCrawlTimestamp() {
+	lastModified := time.Date(2019, time.November, 5, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		_, _ = w.Write([]byte("<html><body></body></html>"))
+	}))
+	defer server.Close()
+	store := relationship.NewMemoryStore()
+	storedTimestamp := func(Url string) (timestamp int64) {
+		ctx := context.Background()
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			result, err := store.FindNode(&ctx, Url, 0, "")
+			if err != nil {
+				s.T().Fatal(err)
+			}
+			if result != nil {
+				return result.Timestamp
+			}
+		}
+		s.T().Fatalf("%s was not stored", Url)
+		return
+	}
+
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store}
+	before := time.Now().Unix()
+	crawler.Crawl(&page.Page{Url: server.URL + "/fetched"})
+	timestamp := storedTimestamp(server.URL + "/fetched")
+	assert.Equal(s.T(), true, timestamp >= before && timestamp <= time.Now().Unix(), "the fetch time should be stored")
+
+	crawler = crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, TimestampSource: crawl.TimestampLastModified}
+	crawler.Crawl(&page.Page{Url: server.URL + "/modified"})
+	assert.Equal(s.T(), lastModified.Unix(), storedTimestamp(server.URL+"/modified"))
+}
+
+func (s *StoreSuite) TestFetcher() {
+	fetcher := &stubFetcher{bodies: map[string]string{
+		"https://example.com": `<html><head><title>Example</title></head><body><a href="/a">a</a><a href="/b#top">b</a></body></html>`,
+	}}
+	frontier := &recordingFrontier{published: make(map[string]*page.Page)}
+	store := relationship.NewMemoryStore()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, Frontier: frontier, Fetcher: fetcher}
+	crawler.Crawl(&page.Page{Url: "https://example.com", Depth: 1})
+
+	var published []string
+	for start := time.Now(); time.Since(start) < time.Second && len(published) < 2; time.Sleep(10 * time.Millisecond) {
+		frontier.mutex.Lock()
+		published = nil
+		for Url := range frontier.published {
+			published = append(published, Url)
+		}
+		frontier.mutex.Unlock()
+	}
+	sort.Strings(published)
+	assert.Equal(s.T(), []string{"https://example.com/a", "https://example.com/b"}, published, "links should be extracted from the canned body")
+	assert.Equal(s.T(), []string{"https://example.com"}, fetcher.fetched)
+
+	crawler.Crawl(&page.Page{Url: "https://example.com/missing"})
+	fetcher.mutex.Lock()
+	assert.Equal(s.T(), []string{"https://example.com", "https://example.com/missing"}, fetcher.fetched, "a 404 from the fetcher should not be retried")
+	fetcher.mutex.Unlock()
+}
+
+func (s *StoreSuite) TestPreferHTTPS() {
+	fetcher := &stubFetcher{bodies: map[string]string{
+		"http://example.com":          `<html><body><a href="/secure">secure</a><a href="/insecure">insecure</a></body></html>`,
+		"https://example.com/secure":  `<html><body></body></html>`,
+		"http://example.com/insecure": `<html><body></body></html>`,
+	}}
+	store := relationship.NewMemoryStore()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, Fetcher: fetcher, PreferHTTPS: true}
+	crawler.Frontier = &localFrontier{crawler: &crawler}
+	crawler.Crawl(&page.Page{Url: "http://example.com", Depth: 1})
+
+	ctx := context.Background()
+	var links []string
+	for start := time.Now(); time.Since(start) < time.Second && len(links) < 2; time.Sleep(10 * time.Millisecond) {
+		result, err := store.FindNode(&ctx, "http://example.com", 1, "")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		links = nil
+		if result != nil {
+			for _, link := range result.Links {
+				links = append(links, link.Url)
+			}
+		}
+	}
+	sort.Strings(links)
+	assert.Equal(s.T(), []string{"http://example.com/insecure", "https://example.com/secure"}, links, "links should be stored under https when it succeeds")
+	for _, Url := range []string{"http://example.com/secure", "https://example.com/insecure"} {
+		result, err := store.FindNode(&ctx, Url, 0, "")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Nil(s.T(), result, Url)
+	}
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	sort.Strings(fetcher.fetched)
+	assert.Equal(s.T(), []string{"http://example.com", "http://example.com/insecure", "https://example.com/insecure", "https://example.com/secure"}, fetcher.fetched, "the start page should not be upgraded")
+}
+
+func (s *StoreSuite) TestStats() {
+	bodies := map[string]string{
+		"/":  `<html><body><a href="/a">a</a><a href="/b">b</a><a href="/missing">missing</a></body></html>`,
+		"/a": `<html><body><a href="/">home</a><a href="/b">b</a></body></html>`,
+		"/b": `<html><body></body></html>`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, isPresent := bodies[r.URL.Path]
+		if !isPresent {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+	saveInterval := crawl.StatsSaveInterval
+	crawl.StatsSaveInterval = 20 * time.Millisecond
+	defer func() { crawl.StatsSaveInterval = saveInterval }()
+	recorder := crawl.NewStatsRecorder()
+	store := relationship.NewMemoryStore()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, StatsRecorder: recorder}
+	crawler.Frontier = &localFrontier{crawler: &crawler}
+	crawler.Crawl(&page.Page{Url: server.URL, StartUrl: server.URL, Depth: 2})
+
+	// / is crawled at depth 2, and /a, /b and /missing at depth 1. /a links back to / and to /b, which are fetched
+	// again at depth 0 but skipped as they are already stored.
+	expected := crawl.Stats{
+		PagesFetched: 6,
+		PagesSkipped: 2,
+		EdgesCreated: 3,
+		Bytes:        int64(2*len(bodies["/"]) + len(bodies["/a"]) + 2*len(bodies["/b"])),
+		Errors:       1,
+	}
+	var stats crawl.Stats
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		stats, _ = recorder.Get(server.URL)
+		if stats.PagesFetched >= expected.PagesFetched && stats.EdgesCreated >= expected.EdgesCreated {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	stats, isPresent := recorder.Get(server.URL + "/")
+	assert.Equal(s.T(), true, isPresent, "stats should be found under the normalized start url")
+	assert.Equal(s.T(), true, stats.ElapsedMs >= 0)
+	stats.ElapsedMs = 0
+	assert.Equal(s.T(), expected, stats)
+	_, isPresent = recorder.Get("https://example.com")
+	assert.Equal(s.T(), false, isPresent, "crawls which haven't run should have no stats")
+
+	ctx := context.Background()
+	var stored *crawl.Stats
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		stored, _ = store.FindCrawlStats(&ctx, page.CanonicalUrl(server.URL))
+		if stored != nil {
+			stored.ElapsedMs = 0
+			if *stored == expected {
+				break
+			}
+		}
+	}
+	if assert.NotNil(s.T(), stored, "the stats should be saved to the store for the api to read") {
+		assert.Equal(s.T(), expected, *stored)
+	}
+}
+
+func (s *StoreSuite) TestRunScheduled() {
+	fetcher := &stubFetcher{bodies: map[string]string{
+		"https://scheduled.example.com":   `<html><body><a href="/a">a</a></body></html>`,
+		"https://scheduled.example.com/a": `<html><body></body></html>`,
+	}}
+	recorder := crawl.NewStatsRecorder()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: relationship.NewMemoryStore(), Fetcher: fetcher, StatsRecorder: recorder}
+	crawler.Frontier = &localFrontier{crawler: &crawler}
+	quietPeriod := crawl.ScheduleQuietPeriod
+	crawl.ScheduleQuietPeriod = 50 * time.Millisecond
+	defer func() { crawl.ScheduleQuietPeriod = quietPeriod }()
+
+	err := crawler.RunScheduled(context.Background(), schedule.Job{Url: "https://scheduled.example.com", Depth: 1})
+	assert.Equal(s.T(), nil, err)
+	stats, _ := recorder.Get("https://scheduled.example.com")
+	assert.Equal(s.T(), int64(2), stats.PagesFetched, "the run should only finish once the crawl has stopped")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = crawler.RunScheduled(ctx, schedule.Job{Url: "https://scheduled.example.com", Depth: 1})
+	assert.Equal(s.T(), context.Canceled, err)
+}
+
+func (s *StoreSuite) TestFollowPagination() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		var number int
+		if _, err := fmt.Sscanf(r.URL.Path, "/list/%d", &number); err != nil {
+			_, _ = w.Write([]byte("<html><body></body></html>"))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `<html><head><link rel="prev" href="/list/%d"></head><body><a href="/item/%d">item</a>`, number-1, number)
+		if number < 3 {
+			_, _ = fmt.Fprintf(w, `<a rel="next" href="%d">next</a>`, number+1)
+		}
+		_, _ = w.Write([]byte("</body></html>"))
+	}))
+	defer server.Close()
+	store := relationship.NewMemoryStore()
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, FollowPagination: true}
+	crawler.Frontier = &localFrontier{crawler: crawler}
+	crawler.Crawl(&page.Page{Url: server.URL + "/list/1", StartUrl: server.URL + "/list/1", Depth: 1})
+
+	ctx := context.Background()
+	for number := 1; number <= 3; number++ {
+		Url := fmt.Sprintf("%s/item/%d", server.URL, number)
+		var result *page.Page
+		for start := time.Now(); time.Since(start) < time.Second && result == nil; time.Sleep(10 * time.Millisecond) {
+			var err error
+			result, err = store.FindNode(&ctx, Url, 0, "")
+			if err != nil {
+				s.T().Fatal(err)
+			}
+		}
+		assert.Equal(s.T(), true, result != nil, "%s should be reached through the rel=next chain at depth 1", Url)
+	}
+
+	p := page.Page{Url: "https://golang.org/blog/1", Depth: 2}
+	paginated := page.Page{Url: "https://golang.org/blog/2", Depth: 2, Paginated: true}
+	assert.Equal(s.T(), true, crawl.DefaultScore(&paginated) > crawl.DefaultScore(&p), "pagination should be crawled first")
+}
+
+func (s *StoreSuite) TestRouteHints() {
+	fetcher := &stubFetcher{bodies: map[string]string{
+		"https://app.example.com":            `<html><body><div id="root"></div><a href="/item/1">first</a></body></html>`,
+		"https://app.example.com/item/1":     "<html><body>1</body></html>",
+		"https://app.example.com/item/2":     "<html><body>2</body></html>",
+		"https://app.example.com/item/a%20b": "<html><body>a b</body></html>",
+	}}
+	hints := []config.RouteHint{
+		{Host: "APP.example.com", Template: "/item/{id}", Ids: []string{"1", "2", "a b"}},
+		{Host: "other.example.com", Template: "/other/{id}", Ids: []string{"1"}},
+	}
+	store := relationship.NewMemoryStore()
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, Fetcher: fetcher, RouteHints: hints}
+	crawler.Frontier = &localFrontier{crawler: crawler}
+	crawler.Crawl(&page.Page{Url: "https://app.example.com", StartUrl: "https://app.example.com", Depth: 1})
+
+	ctx := context.Background()
+	for _, Url := range []string{"https://app.example.com/item/1", "https://app.example.com/item/2", "https://app.example.com/item/a%20b"} {
+		var result *page.Page
+		for start := time.Now(); time.Since(start) < time.Second && result == nil; time.Sleep(10 * time.Millisecond) {
+			var err error
+			result, err = store.FindNode(&ctx, Url, 0, "")
+			if err != nil {
+				s.T().Fatal(err)
+			}
+		}
+		assert.Equal(s.T(), true, result != nil, "%s should be crawled from the route hint", Url)
+	}
+	fetched := make(map[string]int)
+	fetcher.mutex.Lock()
+	for _, Url := range fetcher.fetched {
+		fetched[Url]++
+	}
+	fetcher.mutex.Unlock()
+	assert.Equal(s.T(), 1, fetched["https://app.example.com/item/1"], "a hinted page the start page links to should be crawled once")
+	assert.Equal(s.T(), 0, fetched["https://app.example.com/other/1"], "hints for other hosts should be ignored")
+
+	frontier := &recordingFrontier{published: make(map[string]*page.Page)}
+	bounded := crawl.Crawler{
+		AlreadyCrawled:   make(map[string]struct{}),
+		Store:            relationship.NewMemoryStore(),
+		Fetcher:          fetcher,
+		Frontier:         frontier,
+		RouteHints:       hints,
+		MaxRouteHintUrls: 1,
+	}
+	bounded.Crawl(&page.Page{Url: "https://app.example.com", StartUrl: "https://app.example.com", Depth: 1})
+	bounded.Crawl(&page.Page{Url: "https://app.example.com/item/1", Parent: &page.Page{Url: "https://app.example.com"}, StartUrl: "https://app.example.com", Depth: 1})
+	time.Sleep(50 * time.Millisecond)
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	_, isPresent := frontier.published["https://app.example.com/item/2"]
+	assert.Equal(s.T(), true, isPresent, "the first hinted page the start page doesn't link to should be published")
+	assert.Equal(s.T(), 2, len(frontier.published), "no more than MaxRouteHintUrls hinted pages should be added, and only by the start page")
+}
+
+func (s *StoreSuite) TestSelfLinks() {
+	fetcher := &stubFetcher{bodies: map[string]string{
+		"https://self.example.com":     `<html><body><a href="#frag">frag</a><a href="./">here</a><a href="">empty</a><a href="/faq">faq</a></body></html>`,
+		"https://self.example.com/faq": `<html><body><a href="#top">top</a></body></html>`,
+	}}
+	store := relationship.NewMemoryStore()
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, Fetcher: fetcher}
+	crawler.Frontier = &localFrontier{crawler: &crawler}
+	crawler.Crawl(&page.Page{Url: "https://self.example.com", StartUrl: "https://self.example.com", Depth: 1})
+
+	ctx := context.Background()
+	var result *page.Page
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		var err error
+		result, err = store.FindNode(&ctx, "https://self.example.com", 1, "")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		if result != nil && len(result.Links) > 0 {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	result, _ = store.FindNode(&ctx, "https://self.example.com", 1, "")
+	if assert.Equal(s.T(), true, result != nil) {
+		assert.Equal(s.T(), []string{"https://self.example.com", "https://self.example.com/faq"}, result.Urls(),
+			"links back to a page should not be stored as its children")
+		assert.Equal(s.T(), 0, len(result.Links[0].Links))
+	}
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	assert.Equal(s.T(), []string{"https://self.example.com", "https://self.example.com/faq"}, fetcher.fetched,
+		"a page should not be fetched again through its links to itself")
+}
+
+func (s *StoreSuite) TestRobotsDirectives() {
+	for _, honor := range []bool{false, true} {
+		fetcher := &stubFetcher{
+			bodies: map[string]string{
+				"https://robots.example.com":        `<html><body><a href="/meta">meta</a><a href="/header">header</a><a href="/hidden">hidden</a></body></html>`,
+				"https://robots.example.com/meta":   `<html><head><meta name="robots" content="index, nofollow"></head><body><a href="/meta-child">child</a></body></html>`,
+				"https://robots.example.com/header": `<html><body><a href="/header-child">child</a></body></html>`,
+				"https://robots.example.com/hidden": `<html><head><meta name="ROBOTS" content="noindex"></head><body><a href="/hidden-child">child</a></body></html>`,
+			},
+			headers: map[string]http.Header{
+				"https://robots.example.com/header": {"X-Robots-Tag": {"googlebot: noindex", "nofollow"}},
+			},
+		}
+		store := relationship.NewMemoryStore()
+		crawler := crawl.Crawler{
+			AlreadyCrawled:      make(map[string]struct{}),
+			Store:               store,
+			Fetcher:             fetcher,
+			HonorRobotsNoFollow: honor,
+			HonorRobotsNoIndex:  honor,
+		}
+		crawler.Frontier = &localFrontier{crawler: &crawler}
+		crawler.Crawl(&page.Page{Url: "https://robots.example.com", StartUrl: "https://robots.example.com", Depth: 2})
+
+		fetched := []string{
+			"https://robots.example.com",
+			"https://robots.example.com/header",
+			"https://robots.example.com/header-child",
+			"https://robots.example.com/hidden",
+			"https://robots.example.com/hidden-child",
+			"https://robots.example.com/meta",
+			"https://robots.example.com/meta-child",
+		}
+		stored, depth := fetched, 2
+		if honor {
+			fetched = []string{"https://robots.example.com", "https://robots.example.com/header", "https://robots.example.com/hidden", "https://robots.example.com/meta"}
+			stored, depth = []string{"https://robots.example.com", "https://robots.example.com/header", "https://robots.example.com/meta"}, 1
+		}
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			fetcher.mutex.Lock()
+			count := len(fetcher.fetched)
+			fetcher.mutex.Unlock()
+			if count >= len(fetched) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		fetcher.mutex.Lock()
+		sort.Strings(fetcher.fetched)
+		assert.Equal(s.T(), fetched, fetcher.fetched, "the links of nofollow and noindex pages should only be fetched when they aren't honored")
+		fetcher.mutex.Unlock()
+		ctx := context.Background()
+		result, err := store.FindNode(&ctx, "https://robots.example.com", depth, "")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		urls := result.Urls()
+		sort.Strings(urls)
+		assert.Equal(s.T(), stored, urls, "noindex pages should only be stored when it isn't honored")
+	}
+}
+
+func (s *StoreSuite) TestDepthZero() {
+	fetcher := &stubFetcher{bodies: map[string]string{
+		"https://zero.example.com": `<html><head><title>Zero</title>
+			<link rel="alternate" hreflang="de" href="https://zero.example.com/de">
+			<link rel="next" href="https://zero.example.com/page/2">
+		</head><body><a href="/a">a</a><a href="/b">b</a></body></html>`,
+		"https://zero.example.com/a": `<html><body></body></html>`,
+	}}
+	store := relationship.NewMemoryStore()
+	crawler := crawl.Crawler{
+		AlreadyCrawled:   make(map[string]struct{}),
+		Store:            store,
+		Fetcher:          fetcher,
+		RecordAlternates: true,
+		FollowPagination: true,
+	}
+	crawler.Frontier = &localFrontier{crawler: &crawler}
+	crawler.Crawl(&page.Page{Url: "https://zero.example.com", StartUrl: "https://zero.example.com", Depth: 0})
+
+	ctx := context.Background()
+	var nodes, edges int
+	for start := time.Now(); time.Since(start) < time.Second && nodes == 0; time.Sleep(10 * time.Millisecond) {
+		var err error
+		nodes, edges, err = store.Stats(&ctx)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	nodes, edges, _ = store.Stats(&ctx)
+	assert.Equal(s.T(), 1, nodes, "a depth 0 crawl should store only its seed")
+	assert.Equal(s.T(), 0, edges)
+	result, err := store.FindNode(&ctx, "https://zero.example.com", 0, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "Zero", result.Title)
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	assert.Equal(s.T(), []string{"https://zero.example.com"}, fetcher.fetched, "no link of a depth 0 seed should be fetched")
+}
+
+func (s *StoreSuite) TestMaxURLLength() {
+	longPath := "/" + strings.Repeat("a", 100) + "?q=" + strings.Repeat("b", 100)
+	fetcher := &stubFetcher{bodies: map[string]string{
+		"https://long.example.com": `<html><body><a href="/short">short</a><a href="` + longPath + `">long</a></body></html>`,
+	}}
+	frontier := &recordingFrontier{published: make(map[string]*page.Page)}
+	recorder := crawl.NewStatsRecorder()
+	crawler := crawl.Crawler{
+		AlreadyCrawled: make(map[string]struct{}),
+		Store:          relationship.NewMemoryStore(),
+		Fetcher:        fetcher,
+		Frontier:       frontier,
+		StatsRecorder:  recorder,
+		MaxURLLength:   100,
+	}
+	crawler.Crawl(&page.Page{Url: "https://long.example.com", StartUrl: "https://long.example.com", Depth: 1})
+
+	time.Sleep(50 * time.Millisecond)
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	_, isPresent := frontier.published["https://long.example.com"+longPath]
+	assert.Equal(s.T(), false, isPresent, "a link longer than MaxURLLength should not reach the frontier")
+	_, isPresent = frontier.published["https://long.example.com/short"]
+	assert.Equal(s.T(), true, isPresent, "a link within MaxURLLength should be published")
+	stats, _ := recorder.Get("https://long.example.com")
+	assert.Equal(s.T(), int64(1), stats.PagesSkipped)
+}
+
+func (s *StoreSuite) TestCrawlIds() {
+	fetcher := &stubFetcher{bodies: map[string]string{
+		"https://ids.example.com/docs":   `<html><body><a href="/docs/a">a</a><a href="/shared">shared</a></body></html>`,
+		"https://ids.example.com/blog":   `<html><body><a href="/blog/b">b</a><a href="/shared">shared</a></body></html>`,
+		"https://ids.example.com/docs/a": `<html><body></body></html>`,
+		"https://ids.example.com/blog/b": `<html><body></body></html>`,
+		"https://ids.example.com/shared": `<html><body></body></html>`,
+	}}
+	store := relationship.NewMemoryStore()
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, Fetcher: fetcher}
+	crawler.Frontier = &localFrontier{crawler: crawler}
+	ctx := context.Background()
+	for crawlId, seed := range map[string]string{"docs": "https://ids.example.com/docs", "blog": "https://ids.example.com/blog"} {
+		if _, err := crawler.Seed(ctx, []string{seed}, crawl.SeedOptions{Depth: 1, CrawlId: crawlId}); err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	var edges int
+	for start := time.Now(); time.Since(start) < time.Second && edges < 4; time.Sleep(10 * time.Millisecond) {
+		_, edges, _ = store.Stats(&ctx)
+	}
+	assert.Equal(s.T(), 4, edges, "the page both crawls link to should be linked by each")
+
+	for crawlId, expected := range map[string]map[string][]string{
+		"docs": {"https://ids.example.com/docs": {"https://ids.example.com/docs/a", "https://ids.example.com/shared"}},
+		"blog": {"https://ids.example.com/blog": {"https://ids.example.com/blog/b", "https://ids.example.com/shared"}},
+	} {
+		for seed, links := range expected {
+			result, err := store.FindNode(&ctx, seed, 1, crawlId)
+			if err != nil {
+				s.T().Fatal(err)
+			}
+			if assert.Equal(s.T(), true, result != nil, crawlId) {
+				var urls []string
+				for _, link := range result.Links {
+					urls = append(urls, link.Url)
+				}
+				assert.ElementsMatch(s.T(), links, urls, crawlId)
+			}
+		}
+	}
+	result, err := store.FindNode(&ctx, "https://ids.example.com/docs", 1, "blog")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), true, result == nil, "one crawl's pages should not be found under another's id")
+}
+
+func (s *StoreSuite) TestDepthRules() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><body><a href="/blog/post">post</a><a href="/about">about</a></body></html>`))
+	}))
+	defer server.Close()
+	depthRules, err := crawl.CompileDepthRules([]config.DepthRule{{Pattern: `/blog/`, DepthDelta: 2}})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	frontier := &recordingFrontier{published: make(map[string]*page.Page)}
+	crawler := crawl.Crawler{
+		AlreadyCrawled: make(map[string]struct{}),
+		Store:          relationship.NewMemoryStore(),
+		Frontier:       frontier,
+		DepthRules:     depthRules,
+	}
+	crawler.Crawl(&page.Page{Url: server.URL, Depth: 2})
+
+	depths := make(map[string]int)
+	for start := time.Now(); time.Since(start) < time.Second && len(depths) < 2; time.Sleep(10 * time.Millisecond) {
+		frontier.mutex.Lock()
+		for Url, p := range frontier.published {
+			depths[Url] = p.Depth
+		}
+		frontier.mutex.Unlock()
+	}
+	assert.Equal(s.T(), map[string]int{server.URL + "/blog/post": 3, server.URL + "/about": 1}, depths)
+	shallower := []crawl.DepthRule{{Pattern: depthRules[0].Pattern, DepthDelta: -5}}
+	assert.Equal(s.T(), 0, crawl.ChildDepth(2, server.URL+"/blog/post", shallower), "the depth should not drop below 0")
+}
+
+func (s *StoreSuite) TestSeed() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if !strings.HasSuffix(r.URL.Path, "/child") {
+			_, _ = fmt.Fprintf(w, `<html><body><a href="%s/child">child</a></body></html>`, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	store := relationship.NewMemoryStore()
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store}
+	crawler.Frontier = &localFrontier{crawler: crawler}
+	seeds := []string{server.URL + "/a", server.URL + "/b", server.URL + "/c", server.URL + "/a#top"}
+	startPages, err := crawler.Seed(context.Background(), seeds, crawl.SeedOptions{Depth: 1})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 3, len(startPages), "duplicate seeds should be dropped")
+
+	ctx := context.Background()
+	var nodes, edges int
+	for start := time.Now(); time.Since(start) < time.Second && edges < 3; time.Sleep(10 * time.Millisecond) {
+		nodes, edges, err = store.Stats(&ctx)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	assert.Equal(s.T(), 6, nodes)
+	assert.Equal(s.T(), 3, edges)
+	for _, startPage := range startPages {
+		assert.Equal(s.T(), server.URL+"/a", startPage.StartUrl, "every seed should belong to the same crawl")
+		result, err := store.FindNode(&ctx, startPage.Url, 1, "")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		if assert.Equal(s.T(), true, result != nil && len(result.Links) == 1, startPage.Url) {
+			assert.Equal(s.T(), startPage.Url+"/child", result.Links[0].Url)
+		}
+	}
+}
+
+func (s *StoreSuite) TestSkipRecentlyCrawled() {
+	var mutex sync.Mutex
+	fetched := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		fetched[r.URL.Path]++
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" {
+			_, _ = w.Write([]byte(`<html><body><a href="/fresh">fresh</a><a href="/stale">stale</a></body></html>`))
+		}
+	}))
+	defer server.Close()
+	store := relationship.NewMemoryStore()
+	ctx := context.Background()
+	freshTimestamp := time.Now().Add(-time.Minute).Unix()
+	for Url, timestamp := range map[string]int64{
+		server.URL + "/fresh": freshTimestamp,
+		server.URL + "/stale": time.Now().Add(-2 * time.Hour).Unix(),
+	} {
+		_, err := store.FindOrCreateNode(&ctx, &page.Page{Url: Url, Timestamp: timestamp, StatusCode: http.StatusOK})
+		if err != nil {
+			s.T().Fatal(err)
+		}
+	}
+
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, SkipRecentlyCrawled: true, RecentlyCrawled: time.Hour}
+	crawler.Frontier = &localFrontier{crawler: crawler}
+	_, err := crawler.Seed(context.Background(), []string{server.URL}, crawl.SeedOptions{Depth: 1})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var result *page.Page
+	for start := time.Now(); time.Since(start) < time.Second && (result == nil || len(result.Links) < 2); time.Sleep(10 * time.Millisecond) {
+		result, err = store.FindNode(&ctx, server.URL, 1, "")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	if assert.NotNil(s.T(), result) {
+		assert.Equal(s.T(), 2, len(result.Links), "the recently crawled page should still be linked")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(s.T(), 0, fetched["/fresh"], "a page crawled within the window should not be fetched")
+	assert.Equal(s.T(), 1, fetched["/stale"], "a page crawled before the window should be fetched")
+	fresh, _ := store.FindNode(&ctx, server.URL+"/fresh", 0, "")
+	if assert.NotNil(s.T(), fresh) {
+		assert.Equal(s.T(), freshTimestamp, fresh.Timestamp)
+	}
+}
+
+func (s *StoreSuite) TestRecordAlternates() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head>
+			<link rel="alternate" hreflang="fr" href="/fr/">
+			<link rel="alternate" hreflang="de" href="https://golang.org/de">
+			<link rel="alternate" hreflang="en" href="/">
+			<link rel="amphtml" href="/amp">
+			<link rel="stylesheet" href="/style.css">
+		</head><body></body></html>`))
+	}))
+	defer server.Close()
+	store := relationship.NewMemoryStore()
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, RecordAlternates: true}
+	crawler.Crawl(&page.Page{Url: server.URL, Timestamp: time.Now().Unix()})
+	ctx := context.Background()
+	var alternates []page.Alternate
+	for start := time.Now(); time.Since(start) < time.Second && len(alternates) < 3; time.Sleep(10 * time.Millisecond) {
+		var err error
+		alternates, err = store.FindAlternates(&ctx, server.URL)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	assert.ElementsMatch(s.T(), []page.Alternate{
+		{Url: server.URL + "/fr", Rel: page.RelAlternate, Hreflang: "fr"},
+		{Url: "https://golang.org/de", Rel: page.RelAlternate, Hreflang: "de"},
+		{Url: server.URL + "/amp", Rel: page.RelAmp},
+	}, alternates, "the page itself should not be recorded as its own alternate")
+	amp, err := store.FindNode(&ctx, server.URL+"/amp", 0, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), server.URL+"/amp", amp.Url)
+}
+
+func (s *StoreSuite) TestMaxConcurrencyPerHost() {
+	var mutex sync.Mutex
+	inFlight, peak := make(map[string]int), make(map[string]int)
+	totalInFlight, totalPeak := 0, 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight[r.Host]++
+		totalInFlight++
+		if inFlight[r.Host] > peak[r.Host] {
+			peak[r.Host] = inFlight[r.Host]
+		}
+		if totalInFlight > totalPeak {
+			totalPeak = totalInFlight
+		}
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		inFlight[r.Host]--
+		totalInFlight--
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body></body></html>"))
+	})
+	hosts := []*httptest.Server{httptest.NewServer(handler), httptest.NewServer(handler)}
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: relationship.NewMemoryStore(), MaxConcurrencyPerHost: 2}
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		defer host.Close()
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func(Url string) {
+				defer wg.Done()
+				crawler.Crawl(&page.Page{Url: Url, Timestamp: time.Now().Unix()})
+			}(fmt.Sprintf("%s/%d", host.URL, i))
+		}
+	}
+	wg.Wait()
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, host := range hosts {
+		assert.Equal(s.T(), 2, peak[host.Listener.Addr().String()], "requests to a host should be capped at max_concurrency_per_host")
+	}
+	assert.Equal(s.T(), 4, totalPeak, "both hosts should be fetched from at once")
+}
+
+func (s *StoreSuite) TestDelayJitter() {
+	fetcher := &timingFetcher{}
+	crawlDelay, delayJitter := 20*time.Millisecond, 10*time.Millisecond
+	crawler := &crawl.Crawler{Fetcher: fetcher, CrawlDelay: crawlDelay, DelayJitter: delayJitter}
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(Url string) {
+			defer wg.Done()
+			resp, err := crawler.Get(context.Background(), &page.Page{Url: Url})
+			if assert.Equal(s.T(), nil, err) {
+				_ = resp.Body.Close()
+			}
+		}(fmt.Sprintf("https://golang.org/%d", i))
+	}
+	wg.Wait()
+	sort.Slice(fetcher.sent, func(i, j int) bool { return fetcher.sent[i].Before(fetcher.sent[j]) })
+	minGap, maxGap := time.Hour, time.Duration(0)
+	for i := 1; i < len(fetcher.sent); i++ {
+		gap := fetcher.sent[i].Sub(fetcher.sent[i-1])
+		if gap < minGap {
+			minGap = gap
+		}
+		if gap > maxGap {
+			maxGap = gap
+		}
+	}
+	assert.Equal(s.T(), 40, len(fetcher.sent))
+	assert.Equal(s.T(), true, minGap >= crawlDelay-delayJitter-2*time.Millisecond, "requests should be at least the delay less the jitter apart, got %s", minGap)
+	assert.Equal(s.T(), true, maxGap <= crawlDelay+delayJitter+15*time.Millisecond, "requests should be at most the delay plus the jitter apart, got %s", maxGap)
+	assert.Equal(s.T(), true, maxGap-minGap > delayJitter/2, "the gaps between requests should vary, got %s to %s", minGap, maxGap)
+
+	fetcher = &timingFetcher{}
+	crawler = &crawl.Crawler{Fetcher: fetcher}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		resp, err := crawler.Get(context.Background(), &page.Page{Url: "https://golang.org"})
+		if assert.Equal(s.T(), nil, err) {
+			_ = resp.Body.Close()
+		}
+	}
+	assert.Equal(s.T(), true, time.Since(start) < crawlDelay, "requests should not wait without a crawl delay")
+}
+
+func (s *StoreSuite) TestWarmConnections() {
+	var mutex sync.Mutex
+	dialed := make(map[string]int)
+	var hosts []*httptest.Server
+	for i := 0; i < 3; i++ {
+		host := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		host.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				mutex.Lock()
+				dialed[conn.LocalAddr().String()]++
+				mutex.Unlock()
+			}
+		}
+		host.Start()
+		defer host.Close()
+		hosts = append(hosts, host)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprintf(w, `<html><head>
+			<link rel="preconnect" href="%s">
+			<link rel="dns-prefetch" href="%s/fonts">
+			<link rel="preconnect" href="%s">
+			<link rel="preconnect" href="/">
+		</head><body></body></html>`, hosts[0].URL, hosts[1].URL, hosts[2].URL)
+	}))
+	defer server.Close()
+	dialedHost := func(host *httptest.Server) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return dialed[host.Listener.Addr().String()]
+	}
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: relationship.NewMemoryStore()}
+	p := &page.Page{Url: server.URL, StartUrl: server.URL, Timestamp: time.Now().Unix()}
+	crawler.Crawl(p)
+	assert.Equal(s.T(), []string{hosts[0].URL, hosts[1].URL, hosts[2].URL}, p.Preconnects)
+	assert.Equal(s.T(), 0, dialedHost(hosts[0]), "nothing should be warmed unless max_warm_hosts is set")
+
+	crawler = &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: relationship.NewMemoryStore(), MaxWarmHosts: 2}
+	p = &page.Page{Url: server.URL, StartUrl: server.URL, Timestamp: time.Now().Unix()}
+	crawler.Crawl(p)
+	for start := time.Now(); time.Since(start) < time.Second && dialedHost(hosts[0])+dialedHost(hosts[1]) < 2; time.Sleep(10 * time.Millisecond) {
+	}
+	assert.Equal(s.T(), 1, dialedHost(hosts[0]), "preconnect hosts should be dialed")
+	assert.Equal(s.T(), 1, dialedHost(hosts[1]), "dns-prefetch hosts should be dialed")
+	assert.Equal(s.T(), 0, dialedHost(hosts[2]), "no more than max_warm_hosts hosts should be dialed")
+	crawler.WarmConnections(p, 2)
+	assert.Equal(s.T(), 1, dialedHost(hosts[0]), "hosts should be warmed once per crawl")
+	assert.Equal(s.T(), 1, dialedHost(hosts[2]))
+}
+
+func (s *StoreSuite) TestSeedInvalid() {
+	frontier := &localFrontier{}
+	crawler := crawl.Crawler{Frontier: frontier}
+	for _, seeds := range [][]string{nil, {"https://golang.org", "/doc"}, {"golang.org"}, {"ftp://golang.org"}} {
+		startPages, err := crawler.Seed(context.Background(), seeds, crawl.SeedOptions{})
+		assert.Equal(s.T(), true, err != nil, seeds)
+		assert.Equal(s.T(), 0, len(startPages), "nothing should be published when a seed is invalid")
+	}
+}
+
+func (s *StoreSuite) TestSeedFromFile() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body></body></html>"))
+	}))
+	defer server.Close()
+	seedFile, err := ioutil.TempFile("", "seeds")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer os.Remove(seedFile.Name())
+	_, err = fmt.Fprintf(seedFile, "# seeds for the nightly crawl\n%[1]s/a\n\n  %[1]s/b  \nnot a url\n%[1]s/a\nftp://golang.org\n", server.URL)
+	_ = seedFile.Close()
+	if err != nil {
+		s.T().Fatal(err)
+	}
+
+	_, malformed, err := crawl.ReadSeeds(strings.NewReader(fmt.Sprintf("%[1]s/a\nnot a url\n# %[1]s/c\nftp://golang.org\n", server.URL)))
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	if assert.Equal(s.T(), 2, len(malformed)) {
+		assert.Equal(s.T(), true, strings.HasPrefix(malformed[0].Error(), "line 2: "), malformed[0].Error())
+		assert.Equal(s.T(), true, strings.HasPrefix(malformed[1].Error(), "line 4: "), malformed[1].Error())
+	}
+
+	store := relationship.NewMemoryStore()
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, SeedDepth: 1}
+	crawler.Frontier = &localFrontier{crawler: crawler}
+	startPages, err := crawler.SeedFromFile(context.Background(), seedFile.Name())
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var seeds []string
+	for _, startPage := range startPages {
+		seeds = append(seeds, startPage.Url)
+		assert.Equal(s.T(), 1, startPage.Depth)
+	}
+	assert.Equal(s.T(), []string{server.URL + "/a", server.URL + "/b"}, seeds)
+	ctx := context.Background()
+	for _, seed := range seeds {
+		var result *page.Page
+		for start := time.Now(); time.Since(start) < time.Second && result == nil; time.Sleep(10 * time.Millisecond) {
+			result, err = store.FindNode(&ctx, seed, 0, "")
+			if err != nil {
+				s.T().Fatal(err)
+			}
+		}
+		assert.Equal(s.T(), true, result != nil, seed+" should be crawled")
+	}
+
+	_, err = crawler.SeedFromFile(context.Background(), seedFile.Name()+".missing")
+	assert.Equal(s.T(), true, err != nil)
+}
+
+func (s *StoreSuite) TestMaxConcurrentTxns() {
+	store := &countingStore{Graph: relationship.NewMemoryStore()}
+	crawler := crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: relationship.NewLimitedGraph(store, 2)}
+	parent := &page.Page{Url: "https://golang.org"}
+	errs := make(chan error, 20)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- crawler.Create(&page.Page{Url: fmt.Sprintf("https://golang.org/%d", i), Parent: parent})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Equal(s.T(), nil, err, "creates which make several writes should not deadlock")
+	}
+	assert.Equal(s.T(), int32(2), atomic.LoadInt32(&store.maxActive), "no more than two writes should run at once")
+}
+
+func (s *StoreSuite) TestForceHTTP1() {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	for _, forceHTTP1 := range []bool{false, true} {
+		crawler := crawl.Crawler{InsecureSkipVerify: true, ForceAttemptHTTP2: true, ForceHTTP1: forceHTTP1}
+		resp, err := crawler.Get(context.Background(), &page.Page{Url: ts.URL})
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		_ = resp.Body.Close()
+		transport := crawler.Client.Transport.(*http.Transport)
+		if forceHTTP1 {
+			assert.Equal(s.T(), false, transport.ForceAttemptHTTP2)
+			assert.Equal(s.T(), true, transport.TLSNextProto != nil && len(transport.TLSNextProto) == 0)
+			assert.Equal(s.T(), 1, resp.ProtoMajor)
+		} else {
+			assert.Equal(s.T(), true, transport.ForceAttemptHTTP2)
+			assert.Equal(s.T(), 2, resp.ProtoMajor, "HTTP/2 should be negotiated when it is not disabled")
+		}
+	}
+}
+
 func (s *StoreSuite) TestCreateError() {
 	p := page.Page{Url: "https://golang.org"}
 	err := s.store.DeleteAll()
@@ -268,3 +1819,33 @@ func (s *StoreSuite) TestCreateError() {
 	err = s.crawler.Create(&c)
 	assert.Equal(s.T(), true, err != nil)
 }
+
+// BenchmarkGetSameHost compares fetching many pages from one host through the crawler's shared client, which keeps
+// connections alive, against building a new client for every request.
+func BenchmarkGetSameHost(b *testing.B) {
+	logging.InitJsonLogger(log.NewSyncWriter(os.Stdout), "error", "test")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body><a href=\"/next\">next</a></body></html>"))
+	}))
+	defer ts.Close()
+	fetch := func(b *testing.B, crawler *crawl.Crawler) {
+		resp, err := crawler.Get(context.Background(), &page.Page{Url: ts.URL})
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	b.Run("SharedClient", func(b *testing.B) {
+		crawler := &crawl.Crawler{MaxIdleConnsPerHost: 16, IdleConnTimeout: 90 * time.Second}
+		for i := 0; i < b.N; i++ {
+			fetch(b, crawler)
+		}
+	})
+	b.Run("ClientPerRequest", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fetch(b, &crawl.Crawler{})
+		}
+	})
+}
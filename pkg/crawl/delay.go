@@ -0,0 +1,62 @@
+package crawl
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// delayRand picks the jitter of each crawl delay. It is seeded once per process, so services started together don't
+// pick the same delays, and is shared by every crawler behind a mutex, as a rand.Rand isn't safe for concurrent use.
+var delayRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// jitteredDelay function returns a delay picked uniformly between delay - jitter and delay + jitter, never less than 0.
+// Without jitter, delay is returned as it is.
+func jitteredDelay(delay time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return delay
+	}
+	delayRand.Lock()
+	offset := time.Duration(delayRand.Int63n(int64(2*jitter)+1)) - jitter
+	delayRand.Unlock()
+	if delay+offset < 0 {
+		return 0
+	}
+	return delay + offset
+}
+
+// waitForHost function waits until a request may be sent to host, returning the context's error if it is done first.
+// Requests to a host are spaced out by crawlDelay, each by a different amount within delayJitter of it, so workers
+// fetching from one host don't send their requests in bursts. Each call reserves the next time a request may be sent,
+// so concurrent callers are spaced out too. There is no wait without a crawlDelay.
+func (crawler *Crawler) waitForHost(ctx context.Context, host string, crawlDelay time.Duration, delayJitter time.Duration) error {
+	if crawlDelay <= 0 {
+		return nil
+	}
+	crawler.Lock()
+	if crawler.hostNextRequest == nil {
+		crawler.hostNextRequest = make(map[string]time.Time)
+	}
+	sendAt := crawler.hostNextRequest[host]
+	if now := time.Now(); sendAt.Before(now) {
+		sendAt = now
+	}
+	crawler.hostNextRequest[host] = sendAt.Add(jitteredDelay(crawlDelay, delayJitter))
+	crawler.Unlock()
+	wait := time.Until(sendAt)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
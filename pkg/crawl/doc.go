@@ -5,12 +5,12 @@ To initiate a crawl, create a Crawler with an empty sync.WaitGroup and struct ma
 clamber process does not exit before the crawler is done writing to the database. AlreadyCrawled keeps track of the
 URLs which have been crawled already in that crawl process. The rest are self explanatory.
 
-		crawler := app.Crawler{
-			DbWaitGroup: sync.WaitGroup{},
-			AlreadyCrawled: make(map[string]struct{}),
-			Logger: log.Logger,
-			Store: app.DbStore,
-		}
+	crawler := app.Crawler{
+		DbWaitGroup: sync.WaitGroup{},
+		AlreadyCrawled: make(map[string]struct{}),
+		Logger: log.Logger,
+		Store: app.DbStore,
+	}
 
 Create a page object with the starting URL of your crawl.
 
@@ -25,5 +25,45 @@ first, put the line below after this, as your application will hang on Wait() un
 
 	crawler.DbWaitGroup.Wait()
 
+# Crawler settings
+
+Most of the Crawler's settings are read from the service config by New, and changed on reload by Reconfigure. Pages
+already being crawled keep the settings they started with.
+
+Fetching: Get sends each request through the crawler's Fetcher. Only the default HttpFetcher sends the crawler's
+Headers, the conditional and login headers and the crawl's cookies; Headers are set after the User-Agent and
+Accept-Language so they can replace them, except for those config.IsReservedHeader reports. MaxConcurrencyPerHost limits
+the requests in flight to each host, and CrawlDelay, varied by up to DelayJitter either way, spaces them out. Once the
+fetches and database writes of a crawl have retried MaxTotalRetries times between them, operations which would retry
+fail with ErrRetryBudgetExhausted. With PreferHTTPS, pages found through an http link are fetched over https first. With
+MaxWarmHosts, connections are opened to the hosts a page preconnects to before its links are crawled. Each crawl keeps
+its own cookies, starting without any when its start page is crawled.
+
+Limits: the seed page of a crawl sets the deadline every page beneath it shares, so once MaxDuration has passed
+outstanding pages are dropped and the partial tree is left in the database. Once the pages downloaded from a host in a
+crawl add up to MaxBytesPerHost, no more pages are fetched from that host. Pages whose body takes longer than
+MaxReadTime to read, or whose HTML takes longer than MaxParseTime to parse, are stored without their links.
+
+Parsing: with StreamLinks, pages are read with page.StreamChildPages, which finds only their <a> links, title and
+robots meta tags without holding the body in memory, so LinkExtractor, JsonLdLinks, ParseMode and MaxParseTime don't
+apply. With JsonLdLinks, the links in a page's JSON-LD structured data are followed too. With a ParseMode of
+page.ParseStrict, the problems in each page's markup are set as its ParseWarnings. Each page's Timestamp is set from
+TimestampSource. Pages matching the Soft404TitlePatterns or Soft404BodyPatterns are stored with a 404 status and
+without their links.
+
+Following links: links are offered to a bounded PriorityFrontier in turn, so a crawl waits while it is full, and crawls
+the link itself if every crawl is waiting. Links whose normalized URL is longer than MaxURLLength, and links from a page
+back to itself unless FollowSelfLinks is set, are skipped. With FollowPagination, rel="next" and rel="prev" links are
+crawled at the page's own depth, once per crawl. When a crawl's start page is on the host of any of the RouteHints, the
+pages each hint expands to, up to MaxRouteHintUrls, are crawled as its links too. With HonorRobotsNoFollow, none of the
+links of a page which says nofollow are followed; with HonorRobotsNoIndex, a page which says noindex isn't stored, so
+its links aren't followed either. With SkipRecentlyCrawled, a page stored without an error less than RecentlyCrawled ago
+is only linked from its parent, and the pages beneath it aren't crawled.
+
+Storing: in Recrawl mode pages already stored are written again, and PruneStaleLinks removes the links a page no longer
+has. With RecordErrors, pages which fail with an error status code or a network error are stored with the error. With
+RecordAlternates, the alternate-language and AMP versions a page declares are stored as its alternates. Pages with a
+Sink are written to that ResultSink once crawled. The Stats of each crawl are counted in the crawler's StatsRecorder, or
+DefaultStats, and added to those stored in the crawler's Store at most once every StatsSaveInterval.
 */
 package crawl
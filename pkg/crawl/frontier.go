@@ -0,0 +1,245 @@
+package crawl
+
+import (
+	"container/heap"
+	"context"
+	"github.com/stevenayers/clamber/pkg/page"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type (
+	// ScoreFunc scores a page waiting in a PriorityFrontier. Pages with higher scores are crawled first.
+	ScoreFunc func(p *page.Page) float64
+
+	// PriorityFrontier is a Frontier which hands out the waiting page with the highest score first, and pages with equal
+	// scores in the order they were published. With a maxSize, publishing to a full frontier waits for space, so a crawl
+	// finding links faster than they are fetched slows down rather than holding every page in memory. It never holds
+	// more than maxSize pages. It is safe for concurrent use.
+	PriorityFrontier struct {
+		sync.Mutex
+		pages   pageHeap
+		score   ScoreFunc
+		seq     uint64
+		notify  chan struct{}
+		maxSize int
+		peak    int
+		busy    int
+		blocked int
+		freed   chan struct{}
+	}
+
+	// scoredPage holds a waiting page with its score, and the order it was published in to break ties
+	scoredPage struct {
+		page  *page.Page
+		score float64
+		seq   uint64
+	}
+
+	// pageHeap orders scoredPages for container/heap, highest score first
+	pageHeap []scoredPage
+)
+
+// NewPriorityFrontier function creates an empty PriorityFrontier which orders pages by score, or by DefaultScore if
+// score is nil, and holds no more than maxSize waiting pages if maxSize is above 0
+func NewPriorityFrontier(score ScoreFunc, maxSize int) *PriorityFrontier {
+	if score == nil {
+		score = DefaultScore
+	}
+	return &PriorityFrontier{score: score, notify: make(chan struct{}, 1), maxSize: maxSize, freed: make(chan struct{})}
+}
+
+// DefaultScore function scores shallower pages higher, as they have more depth left to crawl beneath them. Between
+// pages at the same depth, Paginated pages score higher, so the rest of a paginated set is reached early, then shorter
+// paths and then fewer query parameters.
+func DefaultScore(p *page.Page) float64 {
+	score := float64(p.Depth) * 1000
+	if p.Paginated {
+		score += 500
+	}
+	pageUrl, err := url.Parse(p.Url)
+	if err != nil {
+		return score
+	}
+	score -= float64(len(strings.FieldsFunc(pageUrl.Path, func(r rune) bool { return r == '/' }))) * 10
+	score -= float64(len(pageUrl.Query()))
+	return score
+}
+
+// Publish function adds a page to the frontier, waiting while it is full
+func (frontier *PriorityFrontier) Publish(p *page.Page) {
+	_ = frontier.PublishWait(context.Background(), p)
+}
+
+// Offer function adds a page found by the crawl of a page handed out by Next, waiting while the frontier is full. If
+// every such crawl is waiting to publish, nothing would free space, so rather than wait forever Offer returns false
+// without adding the page, and the caller should crawl it itself.
+func (frontier *PriorityFrontier) Offer(p *page.Page) bool {
+	frontier.Lock()
+	for frontier.full() {
+		if frontier.blocked+1 >= frontier.busy {
+			frontier.Unlock()
+			return false
+		}
+		frontier.blocked++
+		freed := frontier.freed
+		frontier.Unlock()
+		<-freed
+		frontier.Lock()
+		frontier.blocked--
+	}
+	frontier.push(p)
+	frontier.Unlock()
+	frontier.wake()
+	return true
+}
+
+// PublishWait function adds a page to the frontier, waiting while it is full, for publishers such as the queue which
+// aren't crawling the frontier's pages. It returns the context's error if ctx is done first.
+func (frontier *PriorityFrontier) PublishWait(ctx context.Context, p *page.Page) error {
+	frontier.Lock()
+	for frontier.full() {
+		freed := frontier.freed
+		frontier.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		frontier.Lock()
+	}
+	frontier.push(p)
+	frontier.Unlock()
+	frontier.wake()
+	return nil
+}
+
+// Next function removes and returns the waiting page with the highest score, waiting for one to be published if the
+// frontier is empty. It returns the context's error if ctx is done first. Each page returned should be passed to Done
+// once it has been crawled.
+func (frontier *PriorityFrontier) Next(ctx context.Context) (*page.Page, error) {
+	for {
+		frontier.Lock()
+		if len(frontier.pages) > 0 {
+			next := heap.Pop(&frontier.pages).(scoredPage)
+			remaining := len(frontier.pages)
+			frontier.busy++
+			frontier.free()
+			frontier.Unlock()
+			if remaining > 0 {
+				frontier.wake() // pass the wake up on, as publishes made while nobody was waiting share one
+			}
+			return next.page, nil
+		}
+		frontier.Unlock()
+		select {
+		case <-frontier.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Done function records that a page returned by Next has been crawled, and its links published
+func (frontier *PriorityFrontier) Done() {
+	frontier.Lock()
+	frontier.busy--
+	frontier.free()
+	frontier.Unlock()
+}
+
+// Len function returns the number of pages waiting in the frontier
+func (frontier *PriorityFrontier) Len() int {
+	frontier.Lock()
+	defer frontier.Unlock()
+	return len(frontier.pages)
+}
+
+// Peak function returns the most pages which have waited in the frontier at once
+func (frontier *PriorityFrontier) Peak() int {
+	frontier.Lock()
+	defer frontier.Unlock()
+	return frontier.peak
+}
+
+// Bounded function checks whether the frontier has a maxSize, so publishing to it can wait
+func (frontier *PriorityFrontier) Bounded() bool {
+	return frontier.maxSize > 0
+}
+
+// full function checks whether the frontier is holding maxSize pages. The frontier must be locked.
+func (frontier *PriorityFrontier) full() bool {
+	return frontier.maxSize > 0 && len(frontier.pages) >= frontier.maxSize
+}
+
+// push function adds a page to the heap. The frontier must be locked.
+func (frontier *PriorityFrontier) push(p *page.Page) {
+	frontier.seq++
+	heap.Push(&frontier.pages, scoredPage{page: p, score: frontier.score(p), seq: frontier.seq})
+	if len(frontier.pages) > frontier.peak {
+		frontier.peak = len(frontier.pages)
+	}
+}
+
+// free function wakes every publisher waiting for space, to check again whether they can publish. The frontier must be
+// locked.
+func (frontier *PriorityFrontier) free() {
+	close(frontier.freed)
+	frontier.freed = make(chan struct{})
+}
+
+// wake function wakes one caller waiting in Next, if there is one
+func (frontier *PriorityFrontier) wake() {
+	select {
+	case frontier.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (pages pageHeap) Len() int {
+	return len(pages)
+}
+
+func (pages pageHeap) Less(i, j int) bool {
+	if pages[i].score != pages[j].score {
+		return pages[i].score > pages[j].score
+	}
+	return pages[i].seq < pages[j].seq
+}
+
+func (pages pageHeap) Swap(i, j int) {
+	pages[i], pages[j] = pages[j], pages[i]
+}
+
+func (pages *pageHeap) Push(x interface{}) {
+	*pages = append(*pages, x.(scoredPage))
+}
+
+func (pages *pageHeap) Pop() interface{} {
+	old := *pages
+	last := old[len(old)-1]
+	*pages = old[:len(old)-1]
+	return last
+}
+
+// Work function crawls pages from the frontier with a pool of workers until ctx is done, so no more than workers pages
+// are fetched at once and the highest scored page waiting is always fetched next
+func (crawler *Crawler) Work(ctx context.Context, frontier *PriorityFrontier, workers int) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				next, err := frontier.Next(ctx)
+				if err != nil {
+					return
+				}
+				crawler.Crawl(next)
+				frontier.Done()
+			}
+		}()
+	}
+	wg.Wait()
+}
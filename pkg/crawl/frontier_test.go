@@ -0,0 +1,139 @@
+package crawl_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stevenayers/clamber/pkg/crawl"
+	"github.com/stevenayers/clamber/pkg/database/relationship"
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nextUrls returns the URLs of the next n pages handed out by the frontier
+func nextUrls(frontier *crawl.PriorityFrontier, n int) (urls []string, err error) {
+	for i := 0; i < n; i++ {
+		var next *page.Page
+		next, err = frontier.Next(context.Background())
+		if err != nil {
+			return
+		}
+		urls = append(urls, next.Url)
+	}
+	return
+}
+
+func (s *StoreSuite) TestPriorityFrontier() {
+	frontier := crawl.NewPriorityFrontier(nil, 0)
+	for _, p := range []*page.Page{
+		{Url: "https://golang.org/doc/articles/wiki", Depth: 1},
+		{Url: "https://golang.org/pkg?tab=all&sort=name", Depth: 2},
+		{Url: "https://golang.org/doc/faq", Depth: 1},
+		{Url: "https://golang.org/blog", Depth: 2},
+		{Url: "https://golang.org/doc", Depth: 1},
+		{Url: "https://golang.org/pkg/net/http", Depth: 0},
+	} {
+		frontier.Publish(p)
+	}
+	urls, err := nextUrls(frontier, 6)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), []string{
+		"https://golang.org/blog",
+		"https://golang.org/pkg?tab=all&sort=name",
+		"https://golang.org/doc",
+		"https://golang.org/doc/faq",
+		"https://golang.org/doc/articles/wiki",
+		"https://golang.org/pkg/net/http",
+	}, urls, "shallower pages, then shorter paths, then fewer query parameters should come first")
+	assert.Equal(s.T(), 0, frontier.Len())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = frontier.Next(ctx)
+	assert.Equal(s.T(), context.DeadlineExceeded, err, "Next should stop waiting once the context is done")
+}
+
+func (s *StoreSuite) TestPriorityFrontierScore() {
+	frontier := crawl.NewPriorityFrontier(func(p *page.Page) float64 {
+		return float64(len(p.Url))
+	}, 0)
+	frontier.Publish(&page.Page{Url: "https://golang.org"})
+	frontier.Publish(&page.Page{Url: "https://golang.org/doc/faq"})
+	frontier.Publish(&page.Page{Url: "https://golang.org/doc"})
+	urls, err := nextUrls(frontier, 3)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), []string{"https://golang.org/doc/faq", "https://golang.org/doc", "https://golang.org"}, urls)
+}
+
+func (s *StoreSuite) TestPriorityFrontierConcurrent() {
+	frontier := crawl.NewPriorityFrontier(nil, 0)
+	received := make(chan string, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for len(received) < cap(received) {
+				next, err := frontier.Next(ctx)
+				if err != nil {
+					return
+				}
+				received <- next.Url
+			}
+		}()
+	}
+	for i := 0; i < cap(received); i++ {
+		go frontier.Publish(&page.Page{Url: "https://golang.org/doc"})
+	}
+	for start := time.Now(); len(received) < cap(received) && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+	}
+	cancel()
+	wg.Wait()
+	assert.Equal(s.T(), cap(received), len(received), "every published page should be handed out once")
+}
+
+func (s *StoreSuite) TestMaxFrontierSize() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = io.WriteString(w, "<html><body>")
+		if strings.Count(r.URL.Path, "/") < 3 {
+			for i := 0; i < 10; i++ {
+				_, _ = fmt.Fprintf(w, `<a href="%s/%d">%d</a>`, strings.TrimRight(r.URL.Path, "/"), i, i)
+			}
+		}
+		_, _ = io.WriteString(w, "</body></html>")
+	}))
+	defer server.Close()
+	const maxSize, workers = 5, 3
+	frontier := crawl.NewPriorityFrontier(nil, maxSize)
+	store := relationship.NewMemoryStore()
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: store, Frontier: frontier}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go crawler.Work(ctx, frontier, workers)
+	_, err := crawler.Seed(ctx, []string{server.URL + "/site"}, crawl.SeedOptions{Depth: 2})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	nodes := 0
+	for start := time.Now(); time.Since(start) < 5*time.Second && nodes < 111; time.Sleep(10 * time.Millisecond) {
+		nodes, _, err = store.Stats(&ctx)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	assert.Equal(s.T(), 111, nodes, "the crawl should complete with a small frontier")
+	assert.Equal(s.T(), true, frontier.Peak() <= maxSize,
+		fmt.Sprintf("%d pages waited at once, more than the frontier should hold", frontier.Peak()))
+}
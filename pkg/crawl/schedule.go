@@ -0,0 +1,70 @@
+package crawl
+
+import (
+	"context"
+	"github.com/go-kit/kit/log/level"
+	"github.com/stevenayers/clamber/pkg/config"
+	"github.com/stevenayers/clamber/pkg/logging"
+	"github.com/stevenayers/clamber/pkg/schedule"
+	"time"
+)
+
+// ScheduleQuietPeriod is how long a scheduled crawl has to go without a page of it being counted in the crawler's Stats
+// before its run is finished, and the next run of its schedule can start
+var ScheduleQuietPeriod = 30 * time.Second
+
+// Scheduler function returns a schedule.Scheduler which runs each of the schedules with RunScheduled, logging each run.
+// Schedules whose cron expression doesn't parse are logged and left out, though config.Validate rejects them first.
+func (crawler *Crawler) Scheduler(schedules []config.Schedule) *schedule.Scheduler {
+	scheduler := &schedule.Scheduler{Launch: crawler.RunScheduled, Log: logRun}
+	for _, s := range schedules {
+		spec, err := schedule.Parse(s.Cron)
+		if err != nil {
+			_ = level.Error(logging.Logger).Log("context", "parsing schedule", "url", s.Url, "cron", s.Cron, "msg", err.Error())
+			continue
+		}
+		scheduler.Jobs = append(scheduler.Jobs, schedule.Job{Url: s.Url, Depth: s.Depth, Cron: s.Cron, Spec: spec})
+	}
+	return scheduler
+}
+
+// RunScheduled function seeds a crawl of the job's URL to its depth, and returns once the crawl has finished, which is
+// when no page of it has been counted in the crawler's Stats for ScheduleQuietPeriod. Pages crawled by other services
+// aren't counted here, so a crawl spread across several services may be taken to have finished early.
+func (crawler *Crawler) RunScheduled(ctx context.Context, job schedule.Job) (err error) {
+	started := time.Now()
+	startPages, err := crawler.Seed(ctx, []string{job.Url}, SeedOptions{Depth: job.Depth})
+	if err != nil {
+		return
+	}
+	startUrl := startPages[0].StartUrl
+	ticker := time.NewTicker(ScheduleQuietPeriod/10 + time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		lastActive := crawler.statsRecorder().lastActive(startUrl)
+		if lastActive.Before(started) {
+			lastActive = started
+		}
+		if time.Since(lastActive) >= ScheduleQuietPeriod {
+			return
+		}
+	}
+}
+
+// logRun function logs a run of a schedule
+func logRun(run schedule.Run) {
+	if run.Skipped {
+		_ = level.Warn(logging.Logger).Log("context", "scheduled crawl", "url", run.Url, "cron", run.Cron, "msg", "skipped as the previous run is still running")
+		return
+	}
+	if run.Error != "" {
+		_ = level.Error(logging.Logger).Log("context", "scheduled crawl", "url", run.Url, "cron", run.Cron, "started", run.Started, "msg", run.Error)
+		return
+	}
+	_ = level.Info(logging.Logger).Log("context", "scheduled crawl", "url", run.Url, "cron", run.Cron, "started", run.Started, "finished", run.Finished)
+}
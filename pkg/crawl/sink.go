@@ -0,0 +1,207 @@
+package crawl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log/level"
+	"github.com/stevenayers/clamber/pkg/logging"
+	"github.com/stevenayers/clamber/pkg/page"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type (
+	// ResultSink receives the pages of a crawl as they are crawled, so large results can be written out instead of
+	// being returned in one response. A crawl selects its sink by name with the Sink of its pages.
+	ResultSink interface {
+		Write(p *page.Page) error
+	}
+
+	// FileSink is a ResultSink which appends a SinkRecord for each page to a file, written with its Serializer: as a
+	// line of JSON with JsonSerializer, which is used when it has none, and otherwise prefixed with its length as a
+	// uvarint. ReadSinkRecords reads them back. It is safe for concurrent use.
+	FileSink struct {
+		sync.Mutex
+		Path       string
+		Serializer page.Serializer
+	}
+
+	// SinkRecord is the line of JSON a FileSink writes for a page
+	SinkRecord struct {
+		Url           string   `json:"url"`
+		Parent        string   `json:"parent,omitempty"`
+		StartUrl      string   `json:"start_url,omitempty"`
+		StatusCode    int      `json:"status_code,omitempty"`
+		Title         string   `json:"title,omitempty"`
+		Error         string   `json:"error,omitempty"`
+		Timestamp     int64    `json:"timestamp,omitempty"`
+		ParseWarnings []string `json:"parse_warnings,omitempty"`
+	}
+)
+
+// ErrNoSinkDir is returned when a crawl selects a file sink but the crawler has no SinkDir to write it in
+var ErrNoSinkDir = errors.New("no sink_dir is configured")
+
+// NewFileSink function creates a FileSink writing with serializer, or JsonSerializer if it is nil, to name.ndjson in
+// dir for JSON and to a file named for the serializer otherwise, such as name.gob. Names which would leave dir are
+// rejected.
+func NewFileSink(dir string, name string, serializer page.Serializer) (*FileSink, error) {
+	if dir == "" {
+		return nil, ErrNoSinkDir
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("sink name %q is not a plain file name", name)
+	}
+	if serializer == nil {
+		serializer = page.JsonSerializer{}
+	}
+	extension := ".ndjson"
+	if serializer.Name() != page.SerializerJson {
+		extension = "." + serializer.Name()
+	}
+	return &FileSink{Path: filepath.Join(dir, name+extension), Serializer: serializer}, nil
+}
+
+// Write function appends the page's SinkRecord to the file, creating it if it doesn't exist
+func (sink *FileSink) Write(p *page.Page) error {
+	record := SinkRecord{
+		Url:           p.Url,
+		StartUrl:      p.StartUrl,
+		StatusCode:    p.StatusCode,
+		Title:         p.Title,
+		Error:         p.Error,
+		Timestamp:     p.Timestamp,
+		ParseWarnings: p.ParseWarnings,
+	}
+	if p.Parent != nil {
+		record.Parent = p.Parent.Url
+	}
+	serializer := sink.serializer()
+	data, err := serializer.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if serializer.Name() == page.SerializerJson {
+		data = append(data, '\n')
+	} else {
+		prefix := make([]byte, binary.MaxVarintLen64)
+		data = append(prefix[:binary.PutUvarint(prefix, uint64(len(data)))], data...)
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	file, err := os.OpenFile(sink.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// serializer function returns the sink's Serializer, or JsonSerializer if it has none
+func (sink *FileSink) serializer() page.Serializer {
+	if sink.Serializer == nil {
+		return page.JsonSerializer{}
+	}
+	return sink.Serializer
+}
+
+// ReadSinkRecords function reads the SinkRecords a FileSink wrote with serializer, or JsonSerializer if it is nil, from
+// r, such as the sink's file
+func ReadSinkRecords(r io.Reader, serializer page.Serializer) (records []SinkRecord, err error) {
+	if serializer == nil {
+		serializer = page.JsonSerializer{}
+	}
+	reader := bufio.NewReader(r)
+	for {
+		var data []byte
+		if serializer.Name() == page.SerializerJson {
+			data, err = reader.ReadBytes('\n')
+			if err == io.EOF && len(bytes.TrimSpace(data)) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+		} else {
+			var length uint64
+			length, err = binary.ReadUvarint(reader)
+			if err == nil {
+				data = make([]byte, length)
+				_, err = io.ReadFull(reader, data)
+			}
+		}
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return
+		}
+		var record SinkRecord
+		if err = serializer.Unmarshal(data, &record); err != nil {
+			return
+		}
+		records = append(records, record)
+	}
+}
+
+// writeSink function writes a crawled page to the ResultSink named by its Sink, once for each URL. Pages without a
+// Sink aren't written anywhere, and failures are only logged, so they don't stop the crawl.
+func (crawler *Crawler) writeSink(currentPage *page.Page) {
+	if currentPage.Sink == "" {
+		return
+	}
+	key := currentPage.Sink + " " + page.CanonicalUrl(currentPage.Url)
+	crawler.Lock()
+	if crawler.sunk == nil {
+		crawler.sunk = make(map[string]struct{})
+	}
+	_, isPresent := crawler.sunk[key]
+	crawler.sunk[key] = struct{}{}
+	crawler.Unlock()
+	if isPresent {
+		return
+	}
+	sink, err := crawler.sink(currentPage.Sink)
+	if err == nil {
+		err = sink.Write(currentPage)
+	}
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "writing to result sink", "sink", currentPage.Sink, "url", currentPage.Url, "msg", err.Error())
+	}
+}
+
+// sink function returns the ResultSink with the given name, opening it with OpenSink, or as a FileSink in SinkDir
+// written in SinkFormat if OpenSink isn't set, the first time it is used
+func (crawler *Crawler) sink(name string) (sink ResultSink, err error) {
+	crawler.settingsMutex.RLock()
+	openSink, sinkDir, sinkFormat := crawler.OpenSink, crawler.SinkDir, crawler.SinkFormat
+	crawler.settingsMutex.RUnlock()
+	defer crawler.Unlock()
+	crawler.Lock()
+	if sink, isPresent := crawler.sinks[name]; isPresent {
+		return sink, nil
+	}
+	if openSink != nil {
+		sink, err = openSink(name)
+	} else {
+		var serializer page.Serializer
+		serializer, err = page.NewSerializer(sinkFormat)
+		if err == nil {
+			sink, err = NewFileSink(sinkDir, name, serializer)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if crawler.sinks == nil {
+		crawler.sinks = make(map[string]ResultSink)
+	}
+	crawler.sinks[name] = sink
+	return
+}
@@ -0,0 +1,133 @@
+package crawl_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/stevenayers/clamber/pkg/crawl"
+	"github.com/stevenayers/clamber/pkg/database/relationship"
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// sinkRecords returns the records written to a FileSink's file, once it holds at least n lines or a second has passed
+func sinkRecords(path string, n int) (records []crawl.SinkRecord, err error) {
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		var file *os.File
+		file, err = os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return
+		}
+		records = nil
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record crawl.SinkRecord
+			if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				_ = file.Close()
+				return
+			}
+			records = append(records, record)
+		}
+		_ = file.Close()
+		if len(records) >= n {
+			return
+		}
+	}
+	return
+}
+
+func (s *StoreSuite) TestFileSink() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" {
+			_, _ = w.Write([]byte(`<html><body><a href="/a">a</a><a href="/b">b</a><a href="/a#top">a again</a></body></html>`))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `<html><head><title>%s</title></head><body><a href="/">home</a></body></html>`, r.URL.Path)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crawler := &crawl.Crawler{AlreadyCrawled: make(map[string]struct{}), Store: relationship.NewMemoryStore(), SinkDir: dir}
+	crawler.Frontier = &localFrontier{crawler: crawler}
+	crawler.Crawl(&page.Page{Url: server.URL, StartUrl: server.URL, Depth: 2, Sink: "results"})
+
+	if _, err = sinkRecords(filepath.Join(dir, "results.ndjson"), 3); err != nil {
+		s.T().Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // the pages beneath link back to the start page, which is crawled again
+	records, err := sinkRecords(filepath.Join(dir, "results.ndjson"), 3)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var urls []string
+	for _, record := range records {
+		urls = append(urls, record.Url)
+		assert.Equal(s.T(), server.URL, record.StartUrl)
+		assert.Equal(s.T(), http.StatusOK, record.StatusCode)
+	}
+	sort.Strings(urls)
+	assert.Equal(s.T(), []string{server.URL, server.URL + "/a", server.URL + "/b"}, urls, "each page should be written once")
+
+	_, err = crawl.NewFileSink(dir, "../results", nil)
+	assert.Equal(s.T(), true, err != nil, "sinks should not be written outside the sink directory")
+	_, err = crawl.NewFileSink("", "results", nil)
+	assert.Equal(s.T(), crawl.ErrNoSinkDir, err)
+}
+
+func (s *StoreSuite) TestFileSinkFormats() {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := &page.Page{Url: "https://golang.org", StartUrl: "https://golang.org", StatusCode: 200, Title: "The Go\nProgramming Language", Timestamp: 1575205020}
+	pages := []*page.Page{
+		root,
+		{Url: "https://golang.org/doc", Parent: root, StartUrl: "https://golang.org", StatusCode: 200, ParseWarnings: []string{"line 1: <div> is never closed"}},
+		{Url: "https://golang.org/missing", Parent: root, StartUrl: "https://golang.org", StatusCode: 404, Error: "http: received HTTP status 404 Not Found"},
+	}
+	for _, serializer := range []page.Serializer{nil, page.JsonSerializer{}, page.GobSerializer{}} {
+		sink, err := crawl.NewFileSink(dir, "formats", serializer)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		expectedPath := filepath.Join(dir, "formats.ndjson")
+		if serializer != nil && serializer.Name() == page.SerializerGob {
+			expectedPath = filepath.Join(dir, "formats.gob")
+		}
+		assert.Equal(s.T(), expectedPath, sink.Path)
+		for _, p := range pages {
+			if err := sink.Write(p); err != nil {
+				s.T().Fatal(err)
+			}
+		}
+		file, err := os.Open(sink.Path)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		records, err := crawl.ReadSinkRecords(file, serializer)
+		_ = file.Close()
+		_ = os.Remove(sink.Path)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), []crawl.SinkRecord{
+			{Url: "https://golang.org", StartUrl: "https://golang.org", StatusCode: 200, Title: "The Go\nProgramming Language", Timestamp: 1575205020},
+			{Url: "https://golang.org/doc", Parent: "https://golang.org", StartUrl: "https://golang.org", StatusCode: 200, ParseWarnings: []string{"line 1: <div> is never closed"}},
+			{Url: "https://golang.org/missing", Parent: "https://golang.org", StartUrl: "https://golang.org", StatusCode: 404, Error: "http: received HTTP status 404 Not Found"},
+		}, records, "records should be read back as they were written with %v", serializer)
+	}
+}
@@ -0,0 +1,173 @@
+package crawl
+
+import (
+	"context"
+	"github.com/go-kit/kit/log/level"
+	"github.com/stevenayers/clamber/pkg/database/relationship"
+	"github.com/stevenayers/clamber/pkg/logging"
+	"github.com/stevenayers/clamber/pkg/page"
+	"sync"
+	"time"
+)
+
+type (
+	// Stats summarises a crawl, as described by page.CrawlStats
+	Stats = page.CrawlStats
+
+	// StatsRecorder collects the Stats of each crawl by its StartUrl. It is safe for concurrent use, so every worker
+	// crawling pages of one crawl can count into it.
+	StatsRecorder struct {
+		sync.Mutex
+		crawls map[string]*crawlStats
+	}
+
+	// crawlStats holds the Stats of one crawl with the time it started and the time a page of it was last counted.
+	// Saved holds the Stats already added to those stored in the graph, reset whether the stored Stats are still those
+	// of an earlier crawl from the same URL, and saving whether a save is waiting or running.
+	crawlStats struct {
+		Stats
+		started time.Time
+		updated time.Time
+		saved   Stats
+		reset   bool
+		saving  bool
+	}
+)
+
+// DefaultStats is the StatsRecorder crawlers count into when they have none set
+var DefaultStats = NewStatsRecorder()
+
+// StatsSaveInterval is how long the Stats counted for a crawl wait before they are added to those stored in the graph,
+// so a busy crawl saves them at most once in each interval
+var StatsSaveInterval = time.Second
+
+// NewStatsRecorder function creates an empty StatsRecorder
+func NewStatsRecorder() *StatsRecorder {
+	return &StatsRecorder{crawls: make(map[string]*crawlStats)}
+}
+
+// Get function returns the Stats of the latest crawl from startUrl, and whether any were recorded
+func (recorder *StatsRecorder) Get(startUrl string) (stats Stats, isPresent bool) {
+	recorder.Lock()
+	defer recorder.Unlock()
+	crawl, isPresent := recorder.crawls[page.CanonicalUrl(startUrl)]
+	if isPresent {
+		stats = crawl.Stats
+	}
+	return
+}
+
+// start function begins recording a new crawl from startUrl, replacing the Stats of an earlier crawl from it
+func (recorder *StatsRecorder) start(startUrl string) {
+	recorder.Lock()
+	defer recorder.Unlock()
+	now := time.Now()
+	recorder.crawls[page.CanonicalUrl(startUrl)] = &crawlStats{started: now, updated: now, reset: true}
+}
+
+// add function applies update to the Stats of the crawl from startUrl, and updates how long it has run
+func (recorder *StatsRecorder) add(startUrl string, update func(stats *Stats)) {
+	recorder.Lock()
+	defer recorder.Unlock()
+	key := page.CanonicalUrl(startUrl)
+	crawl, isPresent := recorder.crawls[key]
+	if !isPresent {
+		crawl = &crawlStats{started: time.Now()}
+		recorder.crawls[key] = crawl
+	}
+	update(&crawl.Stats)
+	crawl.updated = time.Now()
+	crawl.ElapsedMs = crawl.updated.Sub(crawl.started).Milliseconds()
+}
+
+// persist function saves the Stats of the crawl from startUrl to the graph once StatsSaveInterval has passed, unless a
+// save of them is already waiting or running
+func (recorder *StatsRecorder) persist(startUrl string, store relationship.Graph) {
+	recorder.Lock()
+	defer recorder.Unlock()
+	key := page.CanonicalUrl(startUrl)
+	crawl, isPresent := recorder.crawls[key]
+	if !isPresent || crawl.saving {
+		return
+	}
+	crawl.saving = true
+	time.AfterFunc(StatsSaveInterval, func() {
+		recorder.save(key, crawl, store)
+	})
+}
+
+// save function adds what has been counted for the crawl since it was last saved to the Stats stored in the graph for
+// it, and schedules another save if more was counted meanwhile. A failed save is logged and left to the next page
+// counted to retry.
+func (recorder *StatsRecorder) save(key string, crawl *crawlStats, store relationship.Graph) {
+	recorder.Lock()
+	stats, unsaved, reset := crawl.Stats, unsavedStats(crawl.Stats, crawl.saved), crawl.reset
+	recorder.Unlock()
+	ctx := context.Background()
+	err := store.AddCrawlStats(&ctx, key, unsaved, reset)
+	recorder.Lock()
+	defer recorder.Unlock()
+	crawl.saving = false
+	if err != nil {
+		_ = level.Warn(logging.Logger).Log("context", "saving crawl stats", "start_url", key, "msg", err.Error())
+		return
+	}
+	crawl.saved, crawl.reset = stats, false
+	if crawl.Stats != stats {
+		crawl.saving = true
+		time.AfterFunc(StatsSaveInterval, func() {
+			recorder.save(key, crawl, store)
+		})
+	}
+}
+
+// unsavedStats function returns the counts of stats which aren't in saved, with the elapsed time of stats
+func unsavedStats(stats Stats, saved Stats) Stats {
+	return Stats{
+		PagesFetched: stats.PagesFetched - saved.PagesFetched,
+		PagesSkipped: stats.PagesSkipped - saved.PagesSkipped,
+		EdgesCreated: stats.EdgesCreated - saved.EdgesCreated,
+		Bytes:        stats.Bytes - saved.Bytes,
+		Errors:       stats.Errors - saved.Errors,
+		ElapsedMs:    stats.ElapsedMs,
+	}
+}
+
+// lastActive function returns when the crawl from startUrl was started or last had a page counted, or the zero time if
+// it hasn't been recorded
+func (recorder *StatsRecorder) lastActive(startUrl string) time.Time {
+	recorder.Lock()
+	defer recorder.Unlock()
+	if crawl, isPresent := recorder.crawls[page.CanonicalUrl(startUrl)]; isPresent {
+		return crawl.updated
+	}
+	return time.Time{}
+}
+
+// skipped function counts a page which was skipped
+func skipped(stats *Stats) {
+	stats.PagesSkipped++
+}
+
+// failed function counts a page which failed
+func failed(stats *Stats) {
+	stats.Errors++
+}
+
+// statsRecorder function returns the crawler's StatsRecorder, or DefaultStats if it has none
+func (crawler *Crawler) statsRecorder() *StatsRecorder {
+	if crawler.StatsRecorder == nil {
+		return DefaultStats
+	}
+	return crawler.StatsRecorder
+}
+
+// count function applies update to the Stats of the page's crawl, and saves them to the crawler's Store, if it has one,
+// so the api can read them from another process
+func (crawler *Crawler) count(currentPage *page.Page, update func(stats *Stats)) {
+	recorder := crawler.statsRecorder()
+	recorder.add(currentPage.StartUrl, update)
+	if crawler.Store != nil {
+		recorder.persist(currentPage.StartUrl, crawler.Store)
+	}
+}
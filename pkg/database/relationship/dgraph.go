@@ -2,6 +2,8 @@ package relationship
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dgraph-io/dgo/v2"
@@ -10,30 +12,124 @@ import (
 	"github.com/stevenayers/clamber/pkg/page"
 	"google.golang.org/grpc"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type (
 
-	// Store holds dgraph client and connections
+	// Store holds dgraph client and connections. NewReadTxn, if set, replaces the factory for the transactions the
+	// read paths use, mainly for tests. A transaction belongs to whoever created it: methods which create their own
+	// discard it before returning, and methods passed one leave it open for the caller to discard.
 	Store struct {
 		DB         *dgo.Dgraph
 		Connection []*grpc.ClientConn
+		Clients    []api.DgraphClient
+		NewReadTxn func() *dgo.Txn
+	}
+
+	// historyNode holds a node with its links and unlinked edges, and their facets, as FindLinkHistory queries them
+	historyNode struct {
+		Uid   string `json:"uid"`
+		Url   string `json:"url"`
+		Links []struct {
+			Uid      string `json:"uid"`
+			Url      string `json:"url"`
+			LinkedAt int64  `json:"links|linked_at"`
+			CrawlId  string `json:"links|crawl_id"`
+		} `json:"links"`
+		Unlinked []struct {
+			Uid        string `json:"uid"`
+			Url        string `json:"url"`
+			LinkedAt   int64  `json:"unlinked|linked_at"`
+			UnlinkedAt int64  `json:"unlinked|unlinked_at"`
+		} `json:"unlinked"`
+	}
+
+	// duplicateNode holds one of the nodes stored for a URL, with its links both ways and their facets, as Dedup
+	// queries them
+	duplicateNode struct {
+		Uid      string   `json:"uid"`
+		CrawlIds []string `json:"crawl_id"`
+		Links    []struct {
+			Uid      string `json:"uid"`
+			LinkedAt int64  `json:"links|linked_at"`
+			CrawlId  string `json:"links|crawl_id"`
+		} `json:"links"`
+		Parents []struct {
+			Uid      string `json:"uid"`
+			LinkedAt int64  `json:"~links|linked_at"`
+			CrawlId  string `json:"~links|crawl_id"`
+		} `json:"~links"`
+	}
+
+	// crawlStatsNode holds the node the stats of a crawl are stored on, with the stats as JSON
+	crawlStatsNode struct {
+		Uid        string `json:"uid"`
+		CrawlStats string `json:"crawl_stats"`
 	}
 )
 
 // Connect function initiates connections to database
 func (store *Store) Connect() {
 	var clients []api.DgraphClient
+	var connections []*grpc.ClientConn
 	for _, connConfig := range config.AppConfig.Database.Connections {
 		var conn *grpc.ClientConn
 		connString := fmt.Sprintf("%s:%d", connConfig.Host, connConfig.Port)
 		conn, _ = grpc.Dial(connString, grpc.WithInsecure())
+		connections = append(connections, conn)
 		clients = append(clients, api.NewDgraphClient(conn))
 	}
+	store.Connection = connections
+	store.Clients = clients
 	store.DB = dgo.NewDgraphClient(clients...)
 	return
 }
 
+// Close function closes the connections opened by Connect
+func (store *Store) Close() {
+	for _, conn := range store.Connection {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
+
+// Version function returns the version of the dgraph server
+func (store *Store) Version(ctx *context.Context) (version string, err error) {
+	if len(store.Clients) == 0 {
+		return "", &Error{Kind: ErrConnUnavailable, Op: "version", Err: errors.New("no dgraph connections configured")}
+	}
+	var v *api.Version
+	v, err = store.Clients[0].CheckVersion(*ctx, &api.Check{})
+	if err != nil {
+		return "", &Error{Kind: ErrConnUnavailable, Op: "version", Err: fmt.Errorf("dgraph server unreachable: %w", err)}
+	}
+	version = v.GetTag()
+	return
+}
+
+// readTxn function returns a read-only transaction for a query which doesn't write. With the database's
+// best_effort_reads set it is best effort too, so Dgraph can answer from a replica's latest state without fetching a
+// timestamp, at the cost of possibly missing the most recent writes.
+func (store *Store) readTxn() *dgo.Txn {
+	if store.NewReadTxn != nil {
+		return store.NewReadTxn()
+	}
+	txn := store.DB.NewReadOnlyTxn()
+	if config.Get().Database.BestEffortReads {
+		txn = txn.BestEffort()
+	}
+	return txn
+}
+
+// pagePredicates holds every predicate a page's node can be stored with
+var pagePredicates = []string{
+	"url", "timestamp", "status_code", "etag", "last_modified", "redirects_to", "alternate", "truncated", "title",
+	"error", "crawl_id", "links", "unlinked",
+}
+
 // SetSchema function sets the schema for dgraph (mainly for tests)
 func (store *Store) SetSchema() (err error) {
 	op := &api.Operation{}
@@ -42,35 +138,241 @@ func (store *Store) SetSchema() (err error) {
 	timestamp: int .
 	deoth: int .
 	status_code: int .
+	etag: string .
+	last_modified: string .
+	redirects_to: uid @reverse .
+	alternate: [uid] @reverse .
+	truncated: bool .
+	title: string .
+	error: string .
+	crawl_id: [string] @index(exact) .
     links: [uid] @count @reverse .
+	unlinked: [uid] .
+	crawl_stats_url: string @index(hash) @upsert .
+	crawl_stats: string .
 	`
-	ctx := context.TODO()
-	err = store.DB.Alter(ctx, op)
-	if err != nil {
-		fmt.Println(err)
-	}
-	return
+	return store.alter("set schema", op)
 }
 
 // DeleteAll function deletes all data in database
 func (store *Store) DeleteAll() (err error) {
-	err = store.DB.Alter(context.Background(), &api.Operation{DropAll: true})
+	return store.alter("delete all", &api.Operation{DropAll: true})
+}
+
+// alter function runs an Alter operation, giving up once the database's alter_timeout has passed so an unresponsive
+// server can't block it indefinitely. A timed out operation returns an error of kind ErrConnUnavailable.
+func (store *Store) alter(op string, operation *api.Operation) (err error) {
+	defer classify(&err, op)
+	ctx := context.Background()
+	if alterTimeout := time.Duration(config.AppConfig.Database.AlterTimeout) * time.Second; alterTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, alterTimeout)
+		defer cancel()
+	}
+	err = store.DB.Alter(ctx, operation)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = &Error{Kind: ErrConnUnavailable, Op: op, Err: fmt.Errorf("dgraph did not respond in time: %w", err)}
+	}
 	return
 }
 
-// FindNode function finds Page by URL and depth
-func (store *Store) FindNode(ctx *context.Context, Url string, depth int) (currentPage *page.Page, err error) {
-	txn := store.DB.NewTxn()
+// FindNode function finds Page by URL and depth. Depth counts the levels of links returned beneath the page: 0 returns
+// just the page, 1 the page and its direct links, 2 also their links, and so on. With a crawlId, the page is only found
+// if that crawl stored it, and only the links to pages it stored are followed and counted.
+func (store *Store) FindNode(ctx *context.Context, Url string, depth int, crawlId string) (currentPage *page.Page, err error) {
+	defer classify(&err, "find node")
+	return store.findCounted(ctx, Url, depth, crawlId, true)
+}
+
+// FindNodeUpTo function finds Page by URL like FindNode, but when fewer than depth levels of links are stored beneath
+// it, returns the levels which are instead of ErrDepthMismatch
+func (store *Store) FindNodeUpTo(ctx *context.Context, Url string, depth int, crawlId string) (currentPage *page.Page, err error) {
+	defer classify(&err, "find node")
+	return store.findCounted(ctx, Url, depth, crawlId, false)
+}
+
+// findCounted function finds the tree beneath Url down to depth and sets the ChildCount of every Page in it. With
+// strict, a tree with fewer than depth levels stored returns ErrDepthMismatch.
+func (store *Store) findCounted(ctx *context.Context, Url string, depth int, crawlId string, strict bool) (currentPage *page.Page, err error) {
+	txn := store.readTxn()
 	defer txn.Discard(*ctx)
+	currentPage, err = store.findTree(ctx, txn, Url, depth, crawlId)
+	if currentPage != nil {
+		if strict && currentPage.MaxDepth() < depth {
+			return nil, ErrDepthMismatch
+		}
+		err = store.countChildren(ctx, txn, currentPage, crawlId)
+	}
+	return
+}
+
+// FindChildren function finds the pages the Page with the given URL links to directly, without their own links, for
+// callers which expand the graph one level at a time. Each child has its ChildCount set, so callers can tell which have
+// links of their own. An error of kind ErrNotFound is returned if the URL isn't stored.
+func (store *Store) FindChildren(ctx *context.Context, Url string) (children []*page.Page, err error) {
+	defer classify(&err, "find children")
+	txn := store.readTxn()
+	defer txn.Discard(*ctx)
+	currentPage, err := store.findTree(ctx, txn, Url, 1, "")
+	if err != nil {
+		return
+	}
+	if currentPage == nil {
+		return nil, &Error{Kind: ErrNotFound, Op: "find children", Err: fmt.Errorf("no page with url %s", Url)}
+	}
+	if len(currentPage.Links) == 0 {
+		return
+	}
+	if err = store.countChildren(ctx, txn, currentPage, ""); err != nil {
+		return
+	}
+	return currentPage.Links, nil
+}
+
+// countChildren function sets ChildCount on every Page in the tree from its stored link count, so the count is
+// accurate however many levels of links were returned. With a crawlId, only the links to pages that crawl stored are
+// counted.
+func (store *Store) countChildren(ctx *context.Context, txn *dgo.Txn, currentPage *page.Page, crawlId string) (err error) {
+	pages := make(map[string][]*page.Page)
+	collectPages(currentPage, pages)
+	var uids []string
+	for uid := range pages {
+		uids = append(uids, uid)
+	}
+	q := `query withvar($crawlId: string){
+			result(func: uid(` + strings.Join(uids, ", ") + `)) {
+				uid
+				childCount: count(links` + crawlFilter(crawlId) + `)
+			}
+		}`
 	var resp *api.Response
-	queryDepth := strconv.Itoa(depth + 1)
-	v := map[string]string{"$url": Url}
-	q := `query withvar($url: string, $depth: int){
-			result(func: eq(url, $url)) @recurse(depth: ` + queryDepth + `, loop: false){
+	resp, err = txn.QueryWithVars(*ctx, q, map[string]string{"$crawlId": crawlId})
+	if err != nil {
+		return
+	}
+	var result page.JsonResult
+	err = json.Unmarshal(resp.Json, &result)
+	if err != nil {
+		return
+	}
+	for _, counted := range result.Result {
+		for _, p := range pages[counted.Uid] {
+			p.ChildCount = counted.ChildCount
+		}
+	}
+	return
+}
+
+// DeleteSubtree function deletes the Page with the given URL and every Page linked beneath it down to depth, with the
+// links, redirects and alternates to them from other pages, returning the number of pages removed. An error of kind
+// ErrNotFound is returned if the URL isn't stored.
+func (store *Store) DeleteSubtree(ctx *context.Context, Url string, depth int) (deleted int, err error) {
+	defer classify(&err, "delete subtree")
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	currentPage, err := store.findTree(ctx, txn, Url, depth, "")
+	if err != nil {
+		return
+	}
+	if currentPage == nil {
+		return 0, &Error{Kind: ErrNotFound, Op: "delete subtree", Err: fmt.Errorf("no page with url %s", Url)}
+	}
+	pages := make(map[string][]*page.Page)
+	collectPages(currentPage, pages)
+	var uids []string
+	var del []*api.NQuad
+	for uid := range pages {
+		uids = append(uids, uid)
+		del = append(del, deleteNodeNQuads(uid)...)
+	}
+	incoming, err := store.incomingNQuads(ctx, txn, uids)
+	if err != nil {
+		return
+	}
+	del = append(del, incoming...)
+	_, err = txn.Mutate(*ctx, &api.Mutation{Del: del, CommitNow: true})
+	if err != nil {
+		return
+	}
+	deleted = len(pages)
+	return
+}
+
+// incomingNQuads function returns the NQuads deleting the links, redirects and alternates from pages outside uids to
+// the nodes in uids, so pages which pointed into a deleted subtree aren't left pointing at empty nodes
+func (store *Store) incomingNQuads(ctx *context.Context, txn *dgo.Txn, uids []string) (del []*api.NQuad, err error) {
+	q := `{
+			result(func: uid(` + strings.Join(uids, ", ") + `)) {
+				uid
+				~links {
+					uid
+				}
+				~redirects_to {
+					uid
+				}
+				~alternate {
+					uid
+				}
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.Query(*ctx, q)
+	if err != nil {
+		return
+	}
+	type source struct {
+		Uid string `json:"uid"`
+	}
+	var result struct {
+		Result []struct {
+			Uid       string   `json:"uid"`
+			Links     []source `json:"~links"`
+			Redirects []source `json:"~redirects_to"`
+			Alternate []source `json:"~alternate"`
+		} `json:"result"`
+	}
+	err = json.Unmarshal(resp.Json, &result)
+	if err != nil {
+		return
+	}
+	deleting := make(map[string]struct{})
+	for _, uid := range uids {
+		deleting[uid] = struct{}{}
+	}
+	for _, node := range result.Result {
+		incoming := map[string][]source{"links": node.Links, "redirects_to": node.Redirects, "alternate": node.Alternate}
+		for predicate, sources := range incoming {
+			for _, from := range sources {
+				if _, isDeleting := deleting[from.Uid]; !isDeleting {
+					del = append(del, &api.NQuad{Subject: from.Uid, Predicate: predicate, ObjectId: node.Uid})
+				}
+			}
+		}
+	}
+	return
+}
+
+// findTree function runs the recursive URL query inside an existing transaction, which is left for the caller to
+// discard. With a crawlId, only the pages that crawl stored are found.
+func (store *Store) findTree(ctx *context.Context, txn *dgo.Txn, Url string, depth int, crawlId string) (currentPage *page.Page, err error) {
+	if depth < 0 {
+		return nil, errors.New("depth must not be negative")
+	}
+	var resp *api.Response
+	queryDepth := recurseDepth(depth)
+	v := map[string]string{"$url": Url, "$crawlId": crawlId}
+	q := `query withvar($url: string, $depth: int, $crawlId: string){
+			result(func: eq(url, $url))` + crawlFilter(crawlId) + ` @recurse(depth: ` + queryDepth + `, loop: false){
  				uid
 				url
 				timestamp
-    			links
+				status_code
+				etag
+				last_modified
+				truncated
+				title
+				error
+    			links` + crawlFilter(crawlId) + `
 			}
 		}`
 
@@ -83,18 +385,97 @@ func (store *Store) FindNode(ctx *context.Context, Url string, depth int) (curre
 		return
 	}
 	currentPage, err = page.DeserializeJsonPage(resp.Json)
-	if currentPage != nil {
-		if currentPage.MaxDepth() < depth {
-			return nil, errors.New("Depth does not match dgraph result.")
-		}
+	return
+}
+
+// crawlFilter function returns the filter which keeps only the pages stored by the crawl in the $crawlId query
+// variable, or nothing when crawlId is empty
+func crawlFilter(crawlId string) string {
+	if crawlId == "" {
+		return ""
 	}
+	return ` @filter(eq(crawl_id, $crawlId))`
+}
+
+// recurseDepth function converts a link depth into a dgraph @recurse depth. @recurse counts the root node as its own
+// level, so returning depth levels of links beneath the root needs depth + 1.
+func recurseDepth(depth int) string {
+	return strconv.Itoa(depth + 1)
+}
+
+// discard function discards a write transaction without the caller's context, so a cancelled crawl still cleans up
+// rather than leaving a half-written transaction open on the server.
+func discard(txn *dgo.Txn) {
+	_ = txn.Discard(context.Background())
+}
+
+// collectPages function groups a Page and its links by uid, as the same node can appear in several branches
+func collectPages(currentPage *page.Page, pages map[string][]*page.Page) {
+	pages[currentPage.Uid] = append(pages[currentPage.Uid], currentPage)
+	for _, childPage := range currentPage.Links {
+		collectPages(childPage, pages)
+	}
+}
+
+// FindNodeShallow function finds the Page with the given URL without expanding its links, for callers which only need
+// the node itself. The query runs in txn, which is left open for the caller to discard, so it can be part of a larger
+// transaction such as FindOrCreateNode's upsert. With a nil txn, a read-only transaction is created from the read
+// transaction factory and discarded before returning.
+func (store *Store) FindNodeShallow(ctx *context.Context, txn *dgo.Txn, Url string) (currentPage *page.Page, err error) {
+	defer classify(&err, "find node")
+	if txn == nil {
+		txn = store.readTxn()
+		defer txn.Discard(*ctx)
+	}
+	v := map[string]string{"$url": Url}
+	q := `query withvar($url: string){
+			result(func: eq(url, $url)) {
+				uid
+				url
+				timestamp
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.QueryWithVars(*ctx, q, v)
+	if err != nil {
+		return
+	}
+	currentPage, err = page.DeserializeJsonPage(resp.Json)
 	return
 }
 
-// FindOrCreateNode function checks for page, creates if doesn't exist.F
+// FindOrCreateNode function checks for page, creates if doesn't exist, and sets the page's Uid. Transactions aborted by a
+// conflicting write return an error for which IsRetryable is true. A page whose Uid is already set, by an earlier lookup
+// in the same crawl, is returned without a query unless it has a CrawlId, in which case the node is checked to still be
+// stored for the page's URL as the crawl is added to it. A Uid which isn't a valid uid, or which that check finds
+// stale, is looked up again. Each call looks the page up and creates it in one transaction of its own, discarded before
+// returning, so callers retrying an aborted call start a fresh one. A page with a CrawlId has it added to the crawls
+// its node was stored by, whether or not it was created.
 func (store *Store) FindOrCreateNode(ctx *context.Context, currentPage *page.Page) (uid string, err error) {
+	defer classify(&err, "find or create node")
+	if _, parseErr := strconv.ParseUint(currentPage.Uid, 0, 64); parseErr == nil {
+		if currentPage.CrawlId == "" {
+			return currentPage.Uid, nil
+		}
+		var stored bool
+		stored, err = store.tagStoredCrawl(ctx, currentPage)
+		if err != nil || stored {
+			return currentPage.Uid, err
+		}
+	}
+	currentPage.Uid = ""
 	txn := store.DB.NewTxn()
-	defer txn.Discard(*ctx)
+	defer discard(txn)
+	existingPage, err := store.FindNodeShallow(ctx, txn, currentPage.Url)
+	if err != nil {
+		return
+	}
+	if existingPage != nil && existingPage.Uid != "" {
+		uid = existingPage.Uid
+		currentPage.Uid = uid
+		err = store.tagCrawl(ctx, txn, uid, currentPage.CrawlId)
+		return
+	}
 	var resp *api.Response
 	v := map[string]string{"$url": currentPage.Url}
 	q := `query withvar($url: string){
@@ -102,8 +483,9 @@ func (store *Store) FindOrCreateNode(ctx *context.Context, currentPage *page.Pag
 				uid
 			}
 		}`
-	currentPage.Uid = "_:cp"
-	p, _ := page.SerializeJsonPage(currentPage)
+	newPage := *currentPage
+	newPage.Uid = "_:cp"
+	p, _ := page.SerializeJsonPage(&newPage)
 	req := &api.Request{
 		Query:     q,
 		Vars:      v,
@@ -123,12 +505,502 @@ func (store *Store) FindOrCreateNode(ctx *context.Context, currentPage *page.Pag
 			uid = resultPage.Uid
 		}
 	}
+	if uid != "" {
+		currentPage.Uid = uid
+	}
+	return
+}
+
+// tagCrawl function adds crawlId to the crawls the node with the given uid was stored by, committing txn. Nothing is
+// written when crawlId is empty.
+func (store *Store) tagCrawl(ctx *context.Context, txn *dgo.Txn, uid string, crawlId string) (err error) {
+	if crawlId == "" {
+		return
+	}
+	pb, err := json.Marshal(page.JsonPage{Uid: uid, CrawlIds: []string{crawlId}})
+	if err != nil {
+		return
+	}
+	_, err = txn.Mutate(*ctx, &api.Mutation{SetJson: pb, CommitNow: true})
+	return
+}
+
+// tagStoredCrawl function adds the page's CrawlId to the crawls its node was stored by, in an upsert which only writes
+// if the node with the page's Uid is still stored for its URL, returning whether it is
+func (store *Store) tagStoredCrawl(ctx *context.Context, currentPage *page.Page) (stored bool, err error) {
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	pb, err := json.Marshal(page.JsonPage{Uid: "uid(node)", CrawlIds: []string{currentPage.CrawlId}})
+	if err != nil {
+		return
+	}
+	v := map[string]string{"$uid": currentPage.Uid, "$url": currentPage.Url}
+	q := `query withvar($uid: string, $url: string){
+			node as result(func: uid($uid)) @filter(eq(url, $url)) {
+				uid
+			}
+		}`
+	req := &api.Request{
+		Query:     q,
+		Vars:      v,
+		Mutations: []*api.Mutation{{SetJson: pb, Cond: `@if(eq(len(node), 1))`}},
+		CommitNow: true,
+	}
+	resp, err := txn.Do(*ctx, req)
+	if err != nil {
+		return
+	}
+	var result page.JsonResult
+	err = json.Unmarshal(resp.Json, &result)
+	stored = err == nil && len(result.Result) == 1
+	return
+}
+
+// Dedup function merges the nodes stored for Url into the one with the lowest uid, which is the node FindNode and
+// FindOrCreateNode settle on, returning how many duplicate nodes were removed. Racing writes can store several nodes
+// for one URL; the links from and to each duplicate, with their facets, and the crawls it was stored by are moved to
+// the kept node unless it already has them, and the duplicates are deleted. Their other edges, such as redirects and
+// alternates, are dropped with them. It is all done in one transaction, so nothing is changed if it fails.
+func (store *Store) Dedup(ctx *context.Context, Url string) (merged int, err error) {
+	defer classify(&err, "dedup")
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	v := map[string]string{"$url": Url}
+	q := `query withvar($url: string){
+			result(func: eq(url, $url)) {
+				uid
+				crawl_id
+				links @facets(linked_at, crawl_id) {
+					uid
+				}
+				~links @facets(linked_at, crawl_id) {
+					uid
+				}
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.QueryWithVars(*ctx, q, v)
+	if err != nil {
+		return
+	}
+	var result struct {
+		Result []duplicateNode `json:"result"`
+	}
+	err = json.Unmarshal(resp.Json, &result)
+	if err != nil || len(result.Result) < 2 {
+		return
+	}
+	kept := result.Result[0]
+	for _, node := range result.Result[1:] {
+		if page.UidLess(node.Uid, kept.Uid) {
+			kept = node
+		}
+	}
+	merging := make(map[string]struct{})
+	for _, node := range result.Result {
+		merging[node.Uid] = struct{}{}
+	}
+	children, parents, crawlIds := make(map[string]struct{}), make(map[string]struct{}), make(map[string]struct{})
+	for _, link := range kept.Links {
+		children[link.Uid] = struct{}{}
+	}
+	for _, link := range kept.Parents {
+		parents[link.Uid] = struct{}{}
+	}
+	for _, crawlId := range kept.CrawlIds {
+		crawlIds[crawlId] = struct{}{}
+	}
+	var set, del []*api.NQuad
+	for _, node := range result.Result {
+		if node.Uid == kept.Uid {
+			continue
+		}
+		for _, crawlId := range node.CrawlIds {
+			if _, isPresent := crawlIds[crawlId]; !isPresent {
+				crawlIds[crawlId] = struct{}{}
+				set = append(set, &api.NQuad{Subject: kept.Uid, Predicate: "crawl_id", ObjectValue: &api.Value{Val: &api.Value_StrVal{StrVal: crawlId}}})
+			}
+		}
+		for _, link := range node.Links {
+			_, isMerging := merging[link.Uid]
+			if _, isPresent := children[link.Uid]; !isPresent && !isMerging {
+				children[link.Uid] = struct{}{}
+				set = append(set, linkNQuad(kept.Uid, link.Uid, link.LinkedAt, link.CrawlId))
+			}
+		}
+		for _, link := range node.Parents {
+			del = append(del, &api.NQuad{Subject: link.Uid, Predicate: "links", ObjectId: node.Uid})
+			_, isMerging := merging[link.Uid]
+			if _, isPresent := parents[link.Uid]; !isPresent && !isMerging {
+				parents[link.Uid] = struct{}{}
+				set = append(set, linkNQuad(link.Uid, kept.Uid, link.LinkedAt, link.CrawlId))
+			}
+		}
+		del = append(del, deleteNodeNQuads(node.Uid)...)
+	}
+	_, err = txn.Mutate(*ctx, &api.Mutation{Set: set, Del: del, CommitNow: true})
+	if err != nil {
+		return
+	}
+	merged = len(result.Result) - 1
+	return
+}
+
+// UpsertErrorNode function finds or creates the node for a page which couldn't be fetched, sets the page's Uid, and
+// records the page's error and status code on the node, replacing those of a page which failed before. Network
+// errors have no status code, so a status code stored earlier is left as it was.
+func (store *Store) UpsertErrorNode(ctx *context.Context, currentPage *page.Page) (uid string, err error) {
+	defer classify(&err, "upsert error node")
+	uid, err = store.FindOrCreateNode(ctx, currentPage)
+	if err != nil || uid == "" {
+		return
+	}
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	pb, err := json.Marshal(page.JsonPage{Uid: uid, Error: currentPage.Error, StatusCode: currentPage.StatusCode, Timestamp: currentPage.Timestamp})
+	if err != nil {
+		return
+	}
+	_, err = txn.Mutate(*ctx, &api.Mutation{SetJson: pb, CommitNow: true})
+	return
+}
+
+// FindRoots function returns up to limit pages which no stored page links to, the entry points of the graph, without
+// their links. Every root is returned when limit isn't positive.
+func (store *Store) FindRoots(ctx *context.Context, limit int) (roots []*page.Page, err error) {
+	defer classify(&err, "find roots")
+	txn := store.readTxn()
+	defer txn.Discard(*ctx)
+	first := ""
+	if limit > 0 {
+		first = ", first: " + strconv.Itoa(limit)
+	}
+	q := `{
+			result(func: has(url)` + first + `) @filter(eq(count(~links), 0)) {
+				uid
+				url
+				timestamp
+				status_code
+				etag
+				last_modified
+				truncated
+				title
+				error
+				childCount: count(links)
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.Query(*ctx, q)
+	if err != nil {
+		return
+	}
+	return page.DeserializeJsonPages(resp.Json)
+}
+
+// Stats function counts the pages and links stored in the graph
+func (store *Store) Stats(ctx *context.Context) (nodes int, edges int, err error) {
+	defer classify(&err, "stats")
+	txn := store.readTxn()
+	defer txn.Discard(*ctx)
+	q := `{
+			var(func: has(links)) {
+				linkCount as count(links)
+			}
+			edges() {
+				total: sum(val(linkCount))
+			}
+			nodes(func: has(url)) {
+				total: count(uid)
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.Query(*ctx, q)
+	if err != nil {
+		return
+	}
+	var result struct {
+		Nodes []struct {
+			Total int `json:"total"`
+		} `json:"nodes"`
+		Edges []struct {
+			Total int `json:"total"`
+		} `json:"edges"`
+	}
+	err = json.Unmarshal(resp.Json, &result)
+	if err != nil {
+		return
+	}
+	if len(result.Nodes) > 0 {
+		nodes = result.Nodes[0].Total
+	}
+	if len(result.Edges) > 0 {
+		edges = result.Edges[0].Total
+	}
+	return
+}
+
+// AddCrawlStats function adds stats to those stored for the crawl from startUrl, keeping the longer elapsed time, or
+// with reset replaces them, as a new crawl from startUrl has started. The stats are stored as JSON on a node of their
+// own, apart from the start page, which may not be stored yet. When several services add stats for one crawl at once,
+// all but one of their transactions are aborted with an error for which IsRetryable is true.
+func (store *Store) AddCrawlStats(ctx *context.Context, startUrl string, stats page.CrawlStats, reset bool) (err error) {
+	defer classify(&err, "add crawl stats")
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	stored, err := store.findCrawlStats(ctx, txn, startUrl)
+	if err != nil {
+		return
+	}
+	uid := "_:stats"
+	var total page.CrawlStats
+	if stored != nil {
+		uid = stored.Uid
+		if !reset && stored.CrawlStats != "" {
+			err = json.Unmarshal([]byte(stored.CrawlStats), &total)
+			if err != nil {
+				return
+			}
+		}
+	}
+	total.Add(stats)
+	encoded, err := json.Marshal(total)
+	if err != nil {
+		return
+	}
+	_, err = txn.Mutate(*ctx, &api.Mutation{
+		Set: []*api.NQuad{
+			{Subject: uid, Predicate: "crawl_stats_url", ObjectValue: &api.Value{Val: &api.Value_StrVal{StrVal: startUrl}}},
+			{Subject: uid, Predicate: "crawl_stats", ObjectValue: &api.Value{Val: &api.Value_StrVal{StrVal: string(encoded)}}},
+		},
+		CommitNow: true,
+	})
+	return
+}
+
+// FindCrawlStats function returns the stats stored for the crawl from startUrl, or nil if none are
+func (store *Store) FindCrawlStats(ctx *context.Context, startUrl string) (stats *page.CrawlStats, err error) {
+	defer classify(&err, "find crawl stats")
+	txn := store.readTxn()
+	defer txn.Discard(*ctx)
+	stored, err := store.findCrawlStats(ctx, txn, startUrl)
+	if err != nil || stored == nil || stored.CrawlStats == "" {
+		return
+	}
+	stats = &page.CrawlStats{}
+	err = json.Unmarshal([]byte(stored.CrawlStats), stats)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// findCrawlStats function returns the node the stats of the crawl from startUrl are stored on, or nil if there is none
+func (store *Store) findCrawlStats(ctx *context.Context, txn *dgo.Txn, startUrl string) (stored *crawlStatsNode, err error) {
+	v := map[string]string{"$url": startUrl}
+	q := `query withvar($url: string){
+			result(func: eq(crawl_stats_url, $url), first: 1) {
+				uid
+				crawl_stats
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.QueryWithVars(*ctx, q, v)
+	if err != nil {
+		return
+	}
+	var result struct {
+		Result []*crawlStatsNode `json:"result"`
+	}
+	err = json.Unmarshal(resp.Json, &result)
+	if err != nil || len(result.Result) == 0 {
+		return
+	}
+	return result.Result[0], nil
+}
+
+// UpdateTimestamp function sets the timestamp of an existing node
+func (store *Store) UpdateTimestamp(ctx *context.Context, uid string, timestamp int64) (err error) {
+	defer classify(&err, "update timestamp")
+	if uid == "" {
+		return errors.New("cannot update timestamp without a uid")
+	}
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	pb, err := json.Marshal(page.JsonPage{Uid: uid, Timestamp: timestamp})
+	if err != nil {
+		return
+	}
+	_, err = txn.Mutate(*ctx, &api.Mutation{SetJson: pb, CommitNow: true})
+	return
+}
+
+// PruneLinks function removes the links from the node with the given uid to any node whose URL isn't in keepUrls,
+// returning how many links were removed. Each removed link is kept as an unlinked edge, with the time it was stored and
+// the time it was removed as facets; Dgraph holds one edge for each pair of nodes, so only the latest removal is kept.
+func (store *Store) PruneLinks(ctx *context.Context, uid string, keepUrls []string) (pruned int, err error) {
+	defer classify(&err, "prune links")
+	if uid == "" {
+		return 0, errors.New("cannot prune links without a uid")
+	}
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	v := map[string]string{"$uid": uid}
+	q := `query withvar($uid: string){
+			result(func: uid($uid)) {
+				links @facets(linked_at) {
+					uid
+					url
+				}
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.QueryWithVars(*ctx, q, v)
+	if err != nil {
+		return
+	}
+	var result struct {
+		Result []historyNode `json:"result"`
+	}
+	err = json.Unmarshal(resp.Json, &result)
+	if err != nil || len(result.Result) == 0 {
+		return
+	}
+	keep := make(map[string]struct{})
+	for _, Url := range keepUrls {
+		keep[Url] = struct{}{}
+	}
+	var stale, unlinked []*api.NQuad
+	now := time.Now().Unix()
+	for _, child := range result.Result[0].Links {
+		if _, isPresent := keep[child.Url]; !isPresent {
+			stale = append(stale, &api.NQuad{Subject: uid, Predicate: "links", ObjectId: child.Uid})
+			unlinked = append(unlinked, &api.NQuad{
+				Subject:   uid,
+				Predicate: "unlinked",
+				ObjectId:  child.Uid,
+				Facets:    []*api.Facet{intFacet("linked_at", child.LinkedAt), intFacet("unlinked_at", now)},
+			})
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	_, err = txn.Mutate(*ctx, &api.Mutation{Set: unlinked, Del: stale, CommitNow: true})
+	if err != nil {
+		return
+	}
+	pruned = len(stale)
+	return
+}
+
+// CreateRedirect function records that the source node redirects to the target node
+func (store *Store) CreateRedirect(ctx *context.Context, sourceUid string, targetUid string) (err error) {
+	defer classify(&err, "create redirect")
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	_, err = txn.Mutate(*ctx, &api.Mutation{
+		Set:       []*api.NQuad{{Subject: sourceUid, Predicate: "redirects_to", ObjectId: targetUid}},
+		CommitNow: true,
+	})
+	return
+}
+
+// FindRedirect function returns the URL the page with the given URL redirects to, or an empty string if it doesn't
+func (store *Store) FindRedirect(ctx *context.Context, Url string) (targetUrl string, err error) {
+	defer classify(&err, "find redirect")
+	txn := store.readTxn()
+	defer txn.Discard(*ctx)
+	v := map[string]string{"$url": Url}
+	q := `query withvar($url: string){
+			result(func: eq(url, $url)) {
+				redirects_to {
+					url
+				}
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.QueryWithVars(*ctx, q, v)
+	if err != nil {
+		return
+	}
+	var result struct {
+		Result []struct {
+			RedirectsTo *page.JsonPage `json:"redirects_to"`
+		} `json:"result"`
+	}
+	err = json.Unmarshal(resp.Json, &result)
+	if err != nil {
+		return
+	}
+	if len(result.Result) > 0 && result.Result[0].RedirectsTo != nil {
+		targetUrl = result.Result[0].RedirectsTo.Url
+	}
+	return
+}
+
+// CreateAlternate function records that the target node is an alternate of the source node, with rel and hreflang
+// as facets of the alternate edge. An existing edge between them has its facets replaced.
+func (store *Store) CreateAlternate(ctx *context.Context, sourceUid string, targetUid string, rel string, hreflang string) (err error) {
+	defer classify(&err, "create alternate")
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	_, err = txn.Mutate(*ctx, &api.Mutation{
+		Set: []*api.NQuad{{
+			Subject:   sourceUid,
+			Predicate: "alternate",
+			ObjectId:  targetUid,
+			Facets: []*api.Facet{
+				{Key: "rel", Value: []byte(rel), ValType: api.Facet_STRING},
+				{Key: "hreflang", Value: []byte(hreflang), ValType: api.Facet_STRING},
+			},
+		}},
+		CommitNow: true,
+	})
+	return
+}
+
+// FindAlternates function returns the alternates recorded for the page with the given URL
+func (store *Store) FindAlternates(ctx *context.Context, Url string) (alternates []page.Alternate, err error) {
+	defer classify(&err, "find alternates")
+	txn := store.readTxn()
+	defer txn.Discard(*ctx)
+	v := map[string]string{"$url": Url}
+	q := `query withvar($url: string){
+			result(func: eq(url, $url)) {
+				alternate @facets(rel, hreflang) {
+					url
+				}
+			}
+		}`
+	var resp *api.Response
+	resp, err = txn.QueryWithVars(*ctx, q, v)
+	if err != nil {
+		return
+	}
+	var result struct {
+		Result []struct {
+			Alternate []struct {
+				Url      string `json:"url"`
+				Rel      string `json:"alternate|rel"`
+				Hreflang string `json:"alternate|hreflang"`
+			} `json:"alternate"`
+		} `json:"result"`
+	}
+	err = json.Unmarshal(resp.Json, &result)
+	if err != nil || len(result.Result) == 0 {
+		return
+	}
+	for _, alternate := range result.Result[0].Alternate {
+		alternates = append(alternates, page.Alternate{Url: alternate.Url, Rel: alternate.Rel, Hreflang: alternate.Hreflang})
+	}
 	return
 }
 
 // CheckPredicate function checks to see if edge exists
 func (store *Store) CheckPredicate(ctx *context.Context, parentUid string, childUid string) (exists bool, err error) {
-	txn := store.DB.NewTxn()
+	defer classify(&err, "check predicate")
+	txn := store.readTxn()
+	defer txn.Discard(*ctx)
 	variables := map[string]string{"$parentUid": parentUid, "$childUid": childUid}
 	q := `query withvar($parentUid: string, $childUid: string){
 			edges(func: uid($parentUid)) {
@@ -144,11 +1016,13 @@ func (store *Store) CheckPredicate(ctx *context.Context, parentUid string, child
 	return
 }
 
-// CheckOrCreatePredicate function checks for edge, creates if doesn't exist.
-func (store *Store) CheckOrCreatePredicate(ctx *context.Context, parentUid string, childUid string) (exists bool, err error) {
+// CheckOrCreatePredicate function checks for edge, creates if doesn't exist. An edge created with a crawlId has it as
+// its crawl_id facet. Transactions aborted by a conflicting write return an error for which IsRetryable is true.
+func (store *Store) CheckOrCreatePredicate(ctx *context.Context, parentUid string, childUid string, crawlId string) (exists bool, err error) {
+	defer classify(&err, "check or create predicate")
 	txn := store.DB.NewTxn()
 	var resp *api.Response
-	defer txn.Discard(*ctx)
+	defer discard(txn)
 	v := map[string]string{"$parentUid": parentUid, "$childUid": childUid}
 	q := `query withvar($parentUid: string, $childUid: string){
 			edge as edges(func: uid($parentUid)) @filter(uid_in(links, $childUid)){
@@ -160,7 +1034,7 @@ func (store *Store) CheckOrCreatePredicate(ctx *context.Context, parentUid strin
 		Vars:  v,
 		Mutations: []*api.Mutation{{
 			Cond: `@if(eq(len(edge), 0))`,
-			Set:  []*api.NQuad{{Subject: parentUid, Predicate: "links", ObjectId: childUid}},
+			Set:  []*api.NQuad{linkNQuad(parentUid, childUid, time.Now().Unix(), crawlId)},
 		}},
 		CommitNow: true,
 	}
@@ -174,3 +1048,158 @@ func (store *Store) CheckOrCreatePredicate(ctx *context.Context, parentUid strin
 	}
 	return
 }
+
+// predicateBatchSize is the number of edges CreatePredicates creates in each transaction
+const predicateBatchSize = 100
+
+// CreatePredicates function creates the edges from the parent to each child which don't already exist, in one upsert
+// transaction for every predicateBatchSize children rather than one for each edge, each with crawlId as its crawl_id
+// facet if it is set. Transactions aborted by a conflicting write return an error for which IsRetryable is true; the
+// batches committed before it keep their edges, so the call can be retried.
+func (store *Store) CreatePredicates(ctx *context.Context, parentUid string, childUids []string, crawlId string) (err error) {
+	defer classify(&err, "create predicates")
+	for start := 0; start < len(childUids); start += predicateBatchSize {
+		end := start + predicateBatchSize
+		if end > len(childUids) {
+			end = len(childUids)
+		}
+		if err = store.createPredicateBatch(ctx, parentUid, childUids[start:end], crawlId); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// createPredicateBatch function creates the missing edges from the parent to each child in a single upsert, with a
+// query block and a conditional mutation for each child
+func (store *Store) createPredicateBatch(ctx *context.Context, parentUid string, childUids []string, crawlId string) (err error) {
+	txn := store.DB.NewTxn()
+	defer discard(txn)
+	v := map[string]string{"$parentUid": parentUid}
+	params := []string{"$parentUid: string"}
+	var blocks []string
+	var mutations []*api.Mutation
+	now := time.Now().Unix()
+	for i, childUid := range childUids {
+		child := fmt.Sprintf("$child%d", i)
+		v[child] = childUid
+		params = append(params, child+": string")
+		blocks = append(blocks, fmt.Sprintf(
+			"edge%d as var(func: uid($parentUid)) @filter(uid_in(links, %s))", i, child,
+		))
+		mutations = append(mutations, &api.Mutation{
+			Cond: fmt.Sprintf("@if(eq(len(edge%d), 0))", i),
+			Set:  []*api.NQuad{linkNQuad(parentUid, childUid, now, crawlId)},
+		})
+	}
+	q := fmt.Sprintf("query withvar(%s){\n%s\n}", strings.Join(params, ", "), strings.Join(blocks, "\n"))
+	_, err = txn.Do(*ctx, &api.Request{Query: q, Vars: v, Mutations: mutations, CommitNow: true})
+	return
+}
+
+// FindLinkHistory function returns the history of every link, stored or pruned, from the pages reachable from the
+// given URL through depth of those links or fewer. Each level of pages is read with one query, inside one read-only
+// transaction. Nothing is returned if the URL isn't stored.
+func (store *Store) FindLinkHistory(ctx *context.Context, Url string, depth int) (history []page.LinkHistory, err error) {
+	defer classify(&err, "find link history")
+	if depth < 0 {
+		return nil, errors.New("depth must not be negative")
+	}
+	txn := store.readTxn()
+	defer txn.Discard(*ctx)
+	stored, err := store.FindNodeShallow(ctx, txn, Url)
+	if err != nil || stored == nil || stored.Uid == "" {
+		return
+	}
+	seen := map[string]struct{}{stored.Uid: {}}
+	level := []string{stored.Uid}
+	for ; depth > 0 && len(level) > 0; depth-- {
+		q := `{
+			result(func: uid(` + strings.Join(level, ", ") + `)) {
+				uid
+				url
+				links @facets(linked_at, crawl_id) {
+					uid
+					url
+				}
+				unlinked @facets(linked_at, unlinked_at) {
+					uid
+					url
+				}
+			}
+		}`
+		var resp *api.Response
+		resp, err = txn.Query(*ctx, q)
+		if err != nil {
+			return
+		}
+		var result struct {
+			Result []historyNode `json:"result"`
+		}
+		if err = json.Unmarshal(resp.Json, &result); err != nil {
+			return
+		}
+		var next []string
+		visit := func(uid string) {
+			if _, isPresent := seen[uid]; !isPresent {
+				seen[uid] = struct{}{}
+				next = append(next, uid)
+			}
+		}
+		for _, node := range result.Result {
+			for _, link := range node.Links {
+				history = append(history, page.LinkHistory{
+					Edge:     page.Edge{From: node.Url, To: link.Url},
+					LinkedAt: link.LinkedAt,
+					CrawlId:  link.CrawlId,
+				})
+				visit(link.Uid)
+			}
+			for _, link := range node.Unlinked {
+				history = append(history, page.LinkHistory{
+					Edge:       page.Edge{From: node.Url, To: link.Url},
+					LinkedAt:   link.LinkedAt,
+					UnlinkedAt: link.UnlinkedAt,
+				})
+				visit(link.Uid)
+			}
+		}
+		level = next
+	}
+	return
+}
+
+// deleteNodeNQuads function returns the NQuads deleting every predicate a page's node can have. Pages have no
+// dgraph.type, so deleting a node as a bare uid, which only removes the predicates of its type, would leave it intact.
+func deleteNodeNQuads(uid string) (del []*api.NQuad) {
+	for _, predicate := range pagePredicates {
+		del = append(del, &api.NQuad{
+			Subject:     uid,
+			Predicate:   predicate,
+			ObjectValue: &api.Value{Val: &api.Value_DefaultVal{DefaultVal: "_STAR_ALL"}},
+		})
+	}
+	return
+}
+
+// linkNQuad function returns the NQuad of a link from the parent to the child, with the time it was stored as its
+// linked_at facet, and the crawl which stored it as its crawl_id facet if crawlId is set
+func linkNQuad(parentUid string, childUid string, linkedAt int64, crawlId string) *api.NQuad {
+	facets := []*api.Facet{intFacet("linked_at", linkedAt)}
+	if crawlId != "" {
+		facets = append(facets, &api.Facet{Key: "crawl_id", Value: []byte(crawlId), ValType: api.Facet_STRING})
+	}
+	return &api.NQuad{
+		Subject:   parentUid,
+		Predicate: "links",
+		ObjectId:  childUid,
+		Facets:    facets,
+	}
+}
+
+// intFacet function returns an int facet, encoded as Dgraph expects
+func intFacet(key string, value int64) *api.Facet {
+	encoded := make([]byte, 8)
+	binary.LittleEndian.PutUint64(encoded, uint64(value))
+	return &api.Facet{Key: key, Value: encoded, ValType: api.Facet_INT}
+}
@@ -2,7 +2,10 @@ package relationship_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/dgraph-io/dgo/v2/protos/api"
 	"github.com/go-kit/kit/log"
 	"github.com/stevenayers/clamber/pkg/config"
 	"github.com/stevenayers/clamber/pkg/crawl"
@@ -11,6 +14,10 @@ import (
 	"github.com/stevenayers/clamber/pkg/page"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
 	"os"
 	"strings"
 	"testing"
@@ -23,8 +30,30 @@ type (
 		store   relationship.Store
 		crawler crawl.Crawler
 	}
+
+	// fakeDgraphClient answers CheckVersion without a dgraph server, and records the requests sent to it
+	fakeDgraphClient struct {
+		api.DgraphClient
+		version  string
+		err      error
+		requests *[]*api.Request
+	}
 )
 
+func (c fakeDgraphClient) Query(ctx context.Context, in *api.Request, opts ...grpc.CallOption) (*api.Response, error) {
+	if c.requests != nil {
+		*c.requests = append(*c.requests, in)
+	}
+	return &api.Response{Json: []byte(`{}`)}, c.err
+}
+
+func (c fakeDgraphClient) CheckVersion(ctx context.Context, in *api.Check, opts ...grpc.CallOption) (*api.Version, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &api.Version{Tag: c.version}, nil
+}
+
 func (s *StoreSuite) SetupSuite() {
 	var err error
 	configFile := "/Users/steven/git/clamber/configs/config.toml"
@@ -89,11 +118,41 @@ func (s *StoreSuite) TestBadConnectionsSetSchema() {
 	}
 }
 
+func (s *StoreSuite) TestAlterTimeout() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	address := listener.Addr().(*net.TCPAddr)
+	db := relationship.Store{}
+	config.AppConfig.Database = config.DatabaseConfig{
+		Connections:  []*config.Connection{{Host: address.IP.String(), Port: address.Port}},
+		AlterTimeout: 1,
+	}
+	db.Connect()
+	for name, alter := range map[string]func() error{"set schema": db.SetSchema, "delete all": db.DeleteAll} {
+		start := time.Now()
+		err = alter()
+		assert.Equal(s.T(), true, errors.Is(err, relationship.ErrConnUnavailable), name)
+		assert.Equal(s.T(), true, time.Since(start) < 5*time.Second, "%s should give up after alter_timeout", name)
+	}
+}
+
 func (s *StoreSuite) TestFindNodeBadTransaction() {
 	txn := s.store.DB.NewTxn()
 	ctx := context.Background()
 	txn.Discard(ctx)
-	_, err := s.store.FindNode(&ctx, "https://golang.org", 0)
+	_, err := s.store.FindNode(&ctx, "https://golang.org", 0, "")
 	assert.Equal(s.T(), true, err != nil)
 }
 
@@ -105,7 +164,7 @@ func (s *StoreSuite) TestFindNodeBadDepth() {
 		s.T().Fatal(err)
 		return
 	}
-	_, err = s.store.FindNode(&ctx, "https://golang.org", 9)
+	_, err = s.store.FindNode(&ctx, "https://golang.org", 9, "")
 	assert.Equal(s.T(), true, strings.Contains(err.Error(), "Depth does not match dgraph result."))
 }
 
@@ -113,7 +172,7 @@ func (s *StoreSuite) TestCheckOrCreatePredicateBadTransaction() {
 	txn := s.store.DB.NewTxn()
 	ctx := context.Background()
 	txn.Discard(ctx)
-	_, err := s.store.CheckOrCreatePredicate(&ctx, "fakeuid1", "fakeuid2")
+	_, err := s.store.CheckOrCreatePredicate(&ctx, "fakeuid1", "fakeuid2", "")
 	assert.Equal(s.T(), true, err != nil)
 }
 
@@ -131,3 +190,307 @@ func (s *StoreSuite) TestDeserializePredicateError() {
 	_, err := page.DeserializePredicate(pb)
 	assert.Equal(s.T(), true, err != nil)
 }
+
+func (s *StoreSuite) TestIsRetryable() {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{dgo.ErrAborted, true},
+		{fmt.Errorf("create page: %w", dgo.ErrAborted), true},
+		{status.Error(codes.Aborted, "conflict"), true},
+		{errors.New("rpc error: code = Unknown desc = Transaction has been aborted. Please retry"), true},
+		{errors.New("rpc error: code = Unknown desc = Transaction is too old"), true},
+		{status.Error(codes.Unavailable, "all SubConns are in TransientFailure"), false},
+		{status.Error(codes.InvalidArgument, "while lexing {"), false},
+		{dgo.ErrFinished, false},
+		{context.DeadlineExceeded, false},
+	} {
+		assert.Equal(s.T(), test.retryable, relationship.IsRetryable(test.err), fmt.Sprint(test.err))
+	}
+}
+
+func (s *StoreSuite) TestStats() {
+	assertStats(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestFindNodeDepth() {
+	assertFindNodeDepth(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestCrawlStats() {
+	assertCrawlStats(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestFindNodeUpTo() {
+	assertFindNodeUpTo(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestFindNodeShallow() {
+	ctx := context.Background()
+	root := page.Page{Url: "https://golang.org", Timestamp: time.Now().Unix()}
+	rootUid, err := s.store.FindOrCreateNode(&ctx, &root)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	child := page.Page{Url: "https://golang.org/doc", Timestamp: time.Now().Unix()}
+	childUid, err := s.store.FindOrCreateNode(&ctx, &child)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	_, err = s.store.CheckOrCreatePredicate(&ctx, rootUid, childUid, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	txn := s.store.DB.NewReadOnlyTxn()
+	defer txn.Discard(ctx)
+	result, err := s.store.FindNodeShallow(&ctx, txn, root.Url)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	if assert.Equal(s.T(), true, result != nil) {
+		assert.Equal(s.T(), rootUid, result.Uid)
+		assert.Equal(s.T(), root.Url, result.Url)
+		assert.Equal(s.T(), root.Timestamp, result.Timestamp)
+		assert.Equal(s.T(), 0, len(result.Links), "the shallow query should not expand links")
+	}
+	uid, err := s.store.FindOrCreateNode(&ctx, &page.Page{Url: root.Url, Timestamp: time.Now().Unix()})
+	assert.Equal(s.T(), nil, err)
+	assert.Equal(s.T(), rootUid, uid, "an existing node should be found rather than created")
+}
+
+func (s *StoreSuite) TestStoreTitle() {
+	assertStoreTitle(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestCheckOrCreatePredicate() {
+	assertCheckOrCreatePredicate(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestCreatePredicates() {
+	assertCreatePredicates(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestCreatePredicatesBatched() {
+	ctx := context.Background()
+	var requests []*api.Request
+	store := relationship.Store{DB: dgo.NewDgraphClient(fakeDgraphClient{requests: &requests})}
+	var childUids []string
+	for i := 0; i < 250; i++ {
+		childUids = append(childUids, fmt.Sprintf("%#x", i+2))
+	}
+	err := store.CreatePredicates(&ctx, "0x1", childUids, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 3, len(requests), "250 edges should be created in 3 transactions rather than 250")
+}
+
+func (s *StoreSuite) TestDeleteSubtree() {
+	assertDeleteSubtree(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestPruneLinks() {
+	assertPruneLinks(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestRedirect() {
+	assertRedirect(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestAlternates() {
+	assertAlternates(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestUpdateTimestamp() {
+	assertUpdateTimestamp(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestUpsertErrorNode() {
+	assertUpsertErrorNode(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestFindRoots() {
+	assertFindRoots(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestFindChildren() {
+	assertFindChildren(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestFindOrCreateNodeStaleUid() {
+	assertFindOrCreateNodeStaleUid(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestCrawlIds() {
+	assertCrawlIds(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestDedup() {
+	ctx := context.Background()
+	var uids []string
+	for i := 0; i < 2; i++ {
+		pb, err := page.SerializeJsonPage(&page.Page{Uid: "_:duplicate", Url: "https://golang.org", Timestamp: time.Now().Unix()})
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		resp, err := s.store.DB.NewTxn().Mutate(ctx, &api.Mutation{SetJson: pb, CommitNow: true})
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		uids = append(uids, resp.Uids["duplicate"])
+	}
+	lowest, highest := uids[0], uids[1]
+	if page.UidLess(highest, lowest) {
+		lowest, highest = highest, lowest
+	}
+	child := &page.Page{Url: "https://golang.org/doc", Timestamp: time.Now().Unix()}
+	parent := &page.Page{Url: "https://go.dev", Timestamp: time.Now().Unix()}
+	for _, p := range []*page.Page{child, parent} {
+		if _, err := s.store.FindOrCreateNode(&ctx, p); err != nil {
+			s.T().Fatal(err)
+		}
+	}
+	if _, err := s.store.CheckOrCreatePredicate(&ctx, highest, child.Uid, ""); err != nil {
+		s.T().Fatal(err)
+	}
+	if _, err := s.store.CheckOrCreatePredicate(&ctx, parent.Uid, highest, ""); err != nil {
+		s.T().Fatal(err)
+	}
+
+	found, err := s.store.FindNode(&ctx, "https://golang.org", 0, "")
+	if assert.Equal(s.T(), nil, err) && assert.Equal(s.T(), true, found != nil) {
+		assert.Equal(s.T(), lowest, found.Uid, "the duplicate with the lowest uid should be found")
+	}
+
+	merged, err := s.store.Dedup(&ctx, "https://golang.org")
+	assert.Equal(s.T(), nil, err)
+	assert.Equal(s.T(), 1, merged)
+	found, err = s.store.FindNode(&ctx, "https://golang.org", 1, "")
+	if assert.Equal(s.T(), nil, err) && assert.Equal(s.T(), true, found != nil) {
+		assert.Equal(s.T(), lowest, found.Uid)
+		if assert.Equal(s.T(), 1, len(found.Links), "the duplicate's links should be moved to the kept node") {
+			assert.Equal(s.T(), "https://golang.org/doc", found.Links[0].Url)
+		}
+	}
+	found, err = s.store.FindNode(&ctx, "https://go.dev", 1, "")
+	if assert.Equal(s.T(), nil, err) && assert.Equal(s.T(), true, found != nil) && assert.Equal(s.T(), 1, len(found.Links)) {
+		assert.Equal(s.T(), lowest, found.Links[0].Uid, "links to the duplicate should point at the kept node")
+	}
+	nodes, _, err := s.store.Stats(&ctx)
+	assert.Equal(s.T(), nil, err)
+	assert.Equal(s.T(), 3, nodes)
+
+	merged, err = s.store.Dedup(&ctx, "https://golang.org")
+	assert.Equal(s.T(), nil, err)
+	assert.Equal(s.T(), 0, merged, "nothing should be merged once there is one node")
+}
+
+func (s *StoreSuite) TestFindNodeChildCount() {
+	assertFindNodeChildCount(s.T(), &s.store)
+}
+
+func (s *StoreSuite) TestVersion() {
+	ctx := context.Background()
+	store := relationship.Store{Clients: []api.DgraphClient{fakeDgraphClient{version: "v1.1.0"}}}
+	version, err := store.Version(&ctx)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "v1.1.0", version)
+}
+
+func (s *StoreSuite) TestFindOrCreateNodeUidSet() {
+	ctx := context.Background()
+	var requests []*api.Request
+	store := relationship.Store{DB: dgo.NewDgraphClient(fakeDgraphClient{requests: &requests})}
+	uid, err := store.FindOrCreateNode(&ctx, &page.Page{Uid: "0x1", Url: "https://golang.org"})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "0x1", uid)
+	assert.Equal(s.T(), 0, len(requests), "no query should be sent for a page whose uid is set")
+}
+
+func (s *StoreSuite) TestReadTxn() {
+	ctx := context.Background()
+	var requests []*api.Request
+	store := relationship.Store{DB: dgo.NewDgraphClient(fakeDgraphClient{requests: &requests})}
+	readTxns := 0
+	store.NewReadTxn = func() *dgo.Txn {
+		readTxns++
+		return store.DB.NewReadOnlyTxn()
+	}
+	_, _ = store.FindNode(&ctx, "https://golang.org", 1, "")
+	_, _ = store.FindRedirect(&ctx, "https://golang.org")
+	_, _ = store.FindAlternates(&ctx, "https://golang.org")
+	_, _ = store.CheckPredicate(&ctx, "0x1", "0x2")
+	_, _, _ = store.Stats(&ctx)
+	assert.Equal(s.T(), 5, readTxns, "every read path should use the read transaction factory")
+	for _, req := range requests {
+		assert.Equal(s.T(), true, req.ReadOnly, "reads should not use a read-write transaction")
+		assert.Equal(s.T(), false, req.BestEffort)
+	}
+
+	config.Update(func(c *config.Config) {
+		c.Database.BestEffortReads = true
+	})
+	defer config.Update(func(c *config.Config) {
+		c.Database.BestEffortReads = false
+	})
+	store.NewReadTxn = nil
+	requests = nil
+	_, _ = store.FindNode(&ctx, "https://golang.org", 0, "")
+	if assert.NotEmpty(s.T(), requests) {
+		assert.Equal(s.T(), true, requests[0].ReadOnly && requests[0].BestEffort, "reads should be best effort when configured")
+	}
+}
+
+func (s *StoreSuite) TestFindNodeShallowTxn() {
+	ctx := context.Background()
+	var requests []*api.Request
+	store := relationship.Store{DB: dgo.NewDgraphClient(fakeDgraphClient{requests: &requests})}
+	var readTxns []*dgo.Txn
+	store.NewReadTxn = func() *dgo.Txn {
+		txn := store.DB.NewReadOnlyTxn()
+		readTxns = append(readTxns, txn)
+		return txn
+	}
+
+	txn := store.DB.NewTxn()
+	defer txn.Discard(ctx)
+	_, err := store.FindNodeShallow(&ctx, txn, "https://golang.org")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 0, len(readTxns), "a caller's transaction should be used instead of a new one")
+	if assert.Equal(s.T(), 1, len(requests)) {
+		assert.Equal(s.T(), false, requests[0].ReadOnly, "the query should run in the caller's read-write transaction")
+	}
+	_, err = txn.Query(ctx, `{}`)
+	assert.Equal(s.T(), nil, err, "a caller's transaction should be left open")
+
+	requests = nil
+	_, err = store.FindNodeShallow(&ctx, nil, "https://golang.org")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	if assert.Equal(s.T(), 1, len(readTxns), "a nil transaction should create a read transaction") {
+		_, err = readTxns[0].Query(ctx, `{}`)
+		assert.Equal(s.T(), dgo.ErrFinished, err, "a transaction created internally should be discarded")
+	}
+	if assert.Equal(s.T(), 1, len(requests)) {
+		assert.Equal(s.T(), true, requests[0].ReadOnly)
+	}
+}
+
+func (s *StoreSuite) TestVersionUnreachable() {
+	ctx := context.Background()
+	store := relationship.Store{Clients: []api.DgraphClient{fakeDgraphClient{err: errors.New("connection refused")}}}
+	_, err := store.Version(&ctx)
+	assert.Equal(s.T(), true, err != nil)
+	assert.Equal(s.T(), true, strings.Contains(err.Error(), "dgraph server unreachable"))
+	_, err = (&relationship.Store{}).Version(&ctx)
+	assert.Equal(s.T(), true, err != nil)
+}
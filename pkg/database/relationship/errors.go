@@ -0,0 +1,95 @@
+package relationship
+
+import (
+	"errors"
+	"github.com/dgraph-io/dgo/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+var (
+	// ErrNotFound is the kind of error returned when the page a write or delete refers to isn't stored
+	ErrNotFound = errors.New("page not found")
+	// ErrTxnAborted is the kind of error returned when a transaction was aborted, such as by a conflicting write, and
+	// can be retried
+	ErrTxnAborted = errors.New("transaction aborted")
+	// ErrConnUnavailable is the kind of error returned when the database can't be reached
+	ErrConnUnavailable = errors.New("database unavailable")
+	// ErrDepthMismatch is returned by FindNode when fewer levels of links are stored beneath the page than asked for
+	ErrDepthMismatch = errors.New("Depth does not match dgraph result.")
+)
+
+type (
+	// Error is a database error classified by Kind, one of ErrNotFound, ErrTxnAborted or ErrConnUnavailable, so
+	// callers can check it with errors.Is. Op names the store method which failed, and Err is the underlying error,
+	// which errors.Is and errors.As can also reach.
+	Error struct {
+		Kind error
+		Op   string
+		Err  error
+	}
+)
+
+// Error function returns the operation and the underlying error's message
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap function returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is function reports whether target is the error's Kind
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// retryableMessages are matched against errors which carry neither dgo's ErrAborted nor an Aborted gRPC status, as
+// some Dgraph versions only report a retryable transaction in the error message
+var retryableMessages = []string{
+	"Transaction has been aborted. Please retry",
+	"Transaction is too old",
+}
+
+// IsRetryable function checks whether a database error came from a transaction which can be retried, such as one
+// aborted by a conflicting write. Errors of kind ErrTxnAborted are, and unclassified errors are checked for dgo's
+// ErrAborted and the gRPC status code, with the error message as a fallback.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrTxnAborted) || errors.Is(err, dgo.ErrAborted) {
+		return true
+	}
+	if hasStatusCode(err, codes.Aborted) {
+		return true
+	}
+	for _, message := range retryableMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// classify function wraps err in an Error of kind ErrTxnAborted or ErrConnUnavailable if it is one, naming op as the
+// operation which failed. Other errors, and errors which are already classified, are returned as they are. It is
+// deferred by the Store methods with a pointer to their error.
+func classify(err *error, op string) {
+	var classified *Error
+	switch {
+	case *err == nil || errors.As(*err, &classified):
+	case IsRetryable(*err):
+		*err = &Error{Kind: ErrTxnAborted, Op: op, Err: *err}
+	case hasStatusCode(*err, codes.Unavailable):
+		*err = &Error{Kind: ErrConnUnavailable, Op: op, Err: *err}
+	}
+}
+
+// hasStatusCode function checks whether err carries a gRPC status with the given code
+func hasStatusCode(err error, code codes.Code) bool {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	return errors.As(err, &grpcErr) && grpcErr.GRPCStatus().Code() == code
+}
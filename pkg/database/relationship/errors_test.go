@@ -0,0 +1,56 @@
+package relationship_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/dgo/v2"
+	"github.com/stevenayers/clamber/pkg/database/relationship"
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *MemorySuite) TestErrorKinds() {
+	kinds := []error{relationship.ErrNotFound, relationship.ErrTxnAborted, relationship.ErrConnUnavailable}
+	for _, test := range []struct {
+		err  error
+		kind error
+	}{
+		{&relationship.Error{Kind: relationship.ErrNotFound, Op: "delete subtree", Err: errors.New("no page")}, relationship.ErrNotFound},
+		{&relationship.Error{Kind: relationship.ErrTxnAborted, Op: "find or create node", Err: dgo.ErrAborted}, relationship.ErrTxnAborted},
+		{&relationship.Error{Kind: relationship.ErrConnUnavailable, Op: "stats", Err: status.Error(codes.Unavailable, "connection refused")}, relationship.ErrConnUnavailable},
+	} {
+		wrapped := fmt.Errorf("crawl: %w", test.err)
+		for _, kind := range kinds {
+			assert.Equal(s.T(), kind == test.kind, errors.Is(wrapped, kind), fmt.Sprintf("%v is %v", test.err, kind))
+		}
+		var classified *relationship.Error
+		if assert.Equal(s.T(), true, errors.As(wrapped, &classified)) {
+			assert.Equal(s.T(), test.kind, classified.Kind)
+		}
+		assert.Equal(s.T(), test.kind == relationship.ErrTxnAborted, relationship.IsRetryable(wrapped))
+	}
+	aborted := &relationship.Error{Kind: relationship.ErrTxnAborted, Op: "find or create node", Err: dgo.ErrAborted}
+	assert.Equal(s.T(), true, errors.Is(aborted, dgo.ErrAborted), "the underlying error should still be reachable")
+	assert.Equal(s.T(), "find or create node: "+dgo.ErrAborted.Error(), aborted.Error())
+}
+
+func (s *MemorySuite) TestStoreErrors() {
+	ctx := context.Background()
+	_, err := s.store.DeleteSubtree(&ctx, "https://golang.org", 0)
+	assert.Equal(s.T(), true, errors.Is(err, relationship.ErrNotFound), fmt.Sprint(err))
+	err = s.store.UpdateTimestamp(&ctx, "0x404", 0)
+	assert.Equal(s.T(), true, errors.Is(err, relationship.ErrNotFound), fmt.Sprint(err))
+
+	_, err = s.store.FindOrCreateNode(&ctx, &page.Page{Url: "https://golang.org"})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	_, err = s.store.FindNode(&ctx, "https://golang.org", 1, "")
+	assert.Equal(s.T(), true, errors.Is(err, relationship.ErrDepthMismatch), fmt.Sprint(err))
+
+	_, err = (&relationship.Store{}).Version(&ctx)
+	assert.Equal(s.T(), true, errors.Is(err, relationship.ErrConnUnavailable), fmt.Sprint(err))
+}
@@ -0,0 +1,66 @@
+package relationship
+
+import (
+	"context"
+	"github.com/stevenayers/clamber/pkg/config"
+	"github.com/stevenayers/clamber/pkg/page"
+)
+
+const (
+	// DriverDgraph selects the Dgraph backed Store, and is used when no driver is configured
+	DriverDgraph = "dgraph"
+	// DriverMemory selects the in-memory MemoryStore, for tests and small single process runs
+	DriverMemory = "memory"
+)
+
+// Graph is the interface the crawler and api use to store pages and the links between them, so backends other than
+// Dgraph can be plugged in. Store implements it on Dgraph and MemoryStore implements it in memory. Writes may fail with
+// errors for which IsRetryable is true, which callers should retry. Errors are classified as *Error where possible, so
+// callers can check for ErrNotFound, ErrTxnAborted and ErrConnUnavailable with errors.Is. Pages and links can be
+// attributed to named crawls, so several crawls can share one graph: a page is tagged with the CrawlId of every crawl
+// which stored it, and a link with the crawl which created it. FindNode given a crawl id only finds pages that crawl
+// stored, and an empty crawl id finds every page. The stats of each crawl are kept by its start URL, so services other
+// than the one counting them can read them.
+type Graph interface {
+	Connect()
+	Close()
+	SetSchema() error
+	DeleteAll() error
+	Version(ctx *context.Context) (string, error)
+	FindNode(ctx *context.Context, Url string, depth int, crawlId string) (*page.Page, error)
+	FindNodeUpTo(ctx *context.Context, Url string, depth int, crawlId string) (*page.Page, error)
+	FindChildren(ctx *context.Context, Url string) ([]*page.Page, error)
+	FindOrCreateNode(ctx *context.Context, currentPage *page.Page) (string, error)
+	UpsertErrorNode(ctx *context.Context, currentPage *page.Page) (string, error)
+	DeleteSubtree(ctx *context.Context, Url string, depth int) (int, error)
+	Stats(ctx *context.Context) (int, int, error)
+	UpdateTimestamp(ctx *context.Context, uid string, timestamp int64) error
+	PruneLinks(ctx *context.Context, uid string, keepUrls []string) (int, error)
+	CreateRedirect(ctx *context.Context, sourceUid string, targetUid string) error
+	FindRedirect(ctx *context.Context, Url string) (string, error)
+	CreateAlternate(ctx *context.Context, sourceUid string, targetUid string, rel string, hreflang string) error
+	FindAlternates(ctx *context.Context, Url string) ([]page.Alternate, error)
+	CheckPredicate(ctx *context.Context, parentUid string, childUid string) (bool, error)
+	CheckOrCreatePredicate(ctx *context.Context, parentUid string, childUid string, crawlId string) (bool, error)
+	CreatePredicates(ctx *context.Context, parentUid string, childUids []string, crawlId string) error
+	FindLinkHistory(ctx *context.Context, Url string, depth int) ([]page.LinkHistory, error)
+	FindRoots(ctx *context.Context, limit int) ([]*page.Page, error)
+	AddCrawlStats(ctx *context.Context, startUrl string, stats page.CrawlStats, reset bool) error
+	FindCrawlStats(ctx *context.Context, startUrl string) (*page.CrawlStats, error)
+}
+
+var sharedMemoryStore = NewMemoryStore()
+
+// NewStore function returns the Graph selected by the database driver in the config, which is checked by
+// config.Validate. Every call with the memory driver returns the same MemoryStore, so the api and crawler share it when
+// they run in one process. When max_concurrent_txns is set, the Dgraph Store is wrapped in a LimitedGraph.
+func NewStore() Graph {
+	databaseConfig := config.Get().Database
+	if databaseConfig.Driver == DriverMemory {
+		return sharedMemoryStore
+	}
+	if databaseConfig.MaxConcurrentTxns > 0 {
+		return NewLimitedGraph(&Store{}, databaseConfig.MaxConcurrentTxns)
+	}
+	return &Store{}
+}
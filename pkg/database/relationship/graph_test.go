@@ -0,0 +1,490 @@
+package relationship_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stevenayers/clamber/pkg/database/relationship"
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+	"time"
+)
+
+// The functions in this file assert behaviour through the Graph interface, so each backend's suite runs the same
+// checks.
+
+// createGraph creates a page for every URL in edges and the links between them, returning the uid of each page
+func createGraph(t *testing.T, store relationship.Graph, edges [][2]string) (uids map[string]string) {
+	ctx := context.Background()
+	uids = make(map[string]string)
+	for _, edge := range edges {
+		for _, Url := range edge {
+			if _, isPresent := uids[Url]; isPresent {
+				continue
+			}
+			p := page.Page{Url: Url, Timestamp: time.Now().Unix()}
+			uid, err := store.FindOrCreateNode(&ctx, &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uids[Url] = uid
+		}
+	}
+	for _, edge := range edges {
+		_, err := store.CheckOrCreatePredicate(&ctx, uids[edge[0]], uids[edge[1]], "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+// linkUrls returns the sorted URLs of the pages a page links to
+func linkUrls(p *page.Page) (urls []string) {
+	for _, link := range p.Links {
+		urls = append(urls, link.Url)
+	}
+	sort.Strings(urls)
+	return
+}
+
+func assertStats(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org", "https://golang.org/pkg"},
+	})
+	nodes, edges, err := store.Stats(&ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, nodes)
+	assert.Equal(t, 2, edges)
+}
+
+func assertFindNodeDepth(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org", "https://golang.org/pkg"},
+		{"https://golang.org/doc", "https://golang.org/doc/faq"},
+	})
+	for depth := 0; depth <= 2; depth++ {
+		result, err := store.FindNode(&ctx, "https://golang.org", depth, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, depth, result.MaxDepth(), "FindNode should return exactly the requested levels")
+	}
+	_, err := store.FindNode(&ctx, "https://golang.org", -1, "")
+	assert.Equal(t, true, err != nil)
+	_, err = store.FindNode(&ctx, "https://golang.org", 9, "")
+	assert.Equal(t, true, err != nil && err.Error() == "Depth does not match dgraph result.")
+}
+
+func assertCrawlStats(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	stats, err := store.FindCrawlStats(&ctx, "https://golang.org")
+	assert.Equal(t, true, err == nil && stats == nil, "a crawl without stats should have none")
+	for _, added := range []page.CrawlStats{
+		{PagesFetched: 2, EdgesCreated: 1, Bytes: 100, ElapsedMs: 50},
+		{PagesFetched: 1, PagesSkipped: 1, Bytes: 20, Errors: 1, ElapsedMs: 30},
+	} {
+		if err = store.AddCrawlStats(&ctx, "https://golang.org", added, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err = store.FindCrawlStats(&ctx, "https://golang.org")
+	if assert.Equal(t, nil, err) && assert.Equal(t, true, stats != nil) {
+		assert.Equal(t, page.CrawlStats{PagesFetched: 3, PagesSkipped: 1, EdgesCreated: 1, Bytes: 120, Errors: 1, ElapsedMs: 50}, *stats)
+	}
+	if err = store.AddCrawlStats(&ctx, "https://golang.org", page.CrawlStats{PagesFetched: 1, ElapsedMs: 10}, true); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = store.FindCrawlStats(&ctx, "https://golang.org")
+	if assert.Equal(t, nil, err) && assert.Equal(t, true, stats != nil) {
+		assert.Equal(t, page.CrawlStats{PagesFetched: 1, ElapsedMs: 10}, *stats, "a reset should replace the stored stats")
+	}
+	stats, err = store.FindCrawlStats(&ctx, "https://golang.org/doc")
+	assert.Equal(t, true, err == nil && stats == nil, "stats should be kept by start URL")
+}
+
+func assertFindNodeUpTo(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org/doc", "https://golang.org/doc/faq"},
+	})
+	result, err := store.FindNodeUpTo(&ctx, "https://golang.org", 9, "")
+	if assert.Equal(t, nil, err) && assert.Equal(t, true, result != nil) {
+		assert.Equal(t, 2, result.MaxDepth(), "the levels which are stored should be returned")
+	}
+	result, err = store.FindNodeUpTo(&ctx, "https://golang.org", 1, "")
+	if assert.Equal(t, nil, err) && assert.Equal(t, true, result != nil) {
+		assert.Equal(t, 1, result.MaxDepth(), "no more than the requested levels should be returned")
+	}
+	result, err = store.FindNodeUpTo(&ctx, "https://golang.org/pkg", 1, "")
+	assert.Equal(t, true, err == nil && result == nil, "a URL which isn't stored should not be found")
+}
+
+func assertFindNodeChildCount(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org", "https://golang.org/pkg"},
+		{"https://golang.org", "https://golang.org/blog"},
+	})
+	result, err := store.FindNode(&ctx, "https://golang.org", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(result.Links))
+	assert.Equal(t, 3, result.ChildCount, "childCount should not depend on how many levels were expanded")
+	result, err = store.FindNode(&ctx, "https://golang.org", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, result.ChildCount)
+	for _, childPage := range result.Links {
+		assert.Equal(t, 0, childPage.ChildCount)
+	}
+}
+
+func assertStoreTitle(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	p := page.Page{Url: "https://golang.org", Timestamp: time.Now().Unix(), Title: "The Go Programming Language"}
+	_, err := store.FindOrCreateNode(&ctx, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.FindNode(&ctx, p.Url, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, p.Title, result.Title)
+}
+
+func assertCheckOrCreatePredicate(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := createGraph(t, store, [][2]string{{"https://golang.org", "https://golang.org/doc"}})
+	exists, err := store.CheckOrCreatePredicate(&ctx, uids["https://golang.org"], uids["https://golang.org/doc"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, true, exists, "the link created by createGraph should already exist")
+	exists, err = store.CheckPredicate(&ctx, uids["https://golang.org/doc"], uids["https://golang.org"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, false, exists, "links should be directed")
+}
+
+func assertCreatePredicates(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	var edges [][2]string
+	for i := 0; i < 3; i++ {
+		edges = append(edges, [2]string{"https://golang.org", fmt.Sprintf("https://golang.org/pkg/%d", i)})
+	}
+	uids := createGraph(t, store, edges)
+	var childUids []string
+	for i := 0; i < 250; i++ {
+		uid, err := store.FindOrCreateNode(&ctx, &page.Page{Url: fmt.Sprintf("https://golang.org/pkg/%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		childUids = append(childUids, uid)
+	}
+	err := store.CreatePredicates(&ctx, uids["https://golang.org"], childUids, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.FindNode(&ctx, "https://golang.org", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 250, len(result.Links), "links which already existed should not be duplicated")
+	for _, childUid := range []string{childUids[0], childUids[249]} {
+		exists, err := store.CheckPredicate(&ctx, uids["https://golang.org"], childUid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, true, exists)
+	}
+}
+
+func assertDeleteSubtree(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org/doc", "https://golang.org/doc/faq"},
+		{"https://golang.org", "https://golang.org/pkg"},
+	})
+	if err := store.CreateRedirect(&ctx, uids["https://golang.org/pkg"], uids["https://golang.org/doc/faq"]); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := store.DeleteSubtree(&ctx, "https://golang.org/doc", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, deleted)
+	result, err := store.FindNode(&ctx, "https://golang.org", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, true, result != nil, "pages outside the subtree should be kept") {
+		assert.Equal(t, []string{"https://golang.org/pkg"}, linkUrls(result), "links into the subtree should be deleted")
+		assert.Equal(t, 1, result.ChildCount)
+	}
+	redirect, err := store.FindRedirect(&ctx, "https://golang.org/pkg")
+	assert.Equal(t, true, err == nil && redirect == "", "redirects into the subtree should be deleted")
+	nodes, edges, err := store.Stats(&ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, nodes)
+	assert.Equal(t, 1, edges)
+	for _, Url := range []string{"https://golang.org/doc", "https://golang.org/doc/faq"} {
+		result, err = store.FindNode(&ctx, Url, 0, "")
+		assert.Equal(t, true, err == nil && result == nil, "pages in the subtree should be deleted")
+	}
+}
+
+func assertPruneLinks(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org", "https://golang.org/pkg"},
+	})
+	pruned, err := store.PruneLinks(&ctx, uids["https://golang.org"], []string{"https://golang.org/doc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, pruned)
+	result, err := store.FindNode(&ctx, "https://golang.org", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"https://golang.org/doc"}, linkUrls(result))
+}
+
+func assertRedirect(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := createGraph(t, store, [][2]string{{"http://golang.org", "https://golang.org"}})
+	err := store.CreateRedirect(&ctx, uids["http://golang.org"], uids["https://golang.org"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetUrl, err := store.FindRedirect(&ctx, "http://golang.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://golang.org", targetUrl)
+	targetUrl, err = store.FindRedirect(&ctx, "https://golang.org")
+	assert.Equal(t, true, err == nil && targetUrl == "")
+}
+
+func assertAlternates(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/fr"},
+		{"https://golang.org", "https://golang.org/amp"},
+	})
+	for _, alternate := range []page.Alternate{
+		{Url: "https://golang.org/fr", Rel: page.RelAlternate, Hreflang: "en"},
+		{Url: "https://golang.org/fr", Rel: page.RelAlternate, Hreflang: "fr"},
+		{Url: "https://golang.org/amp", Rel: page.RelAmp},
+	} {
+		err := store.CreateAlternate(&ctx, uids["https://golang.org"], uids[alternate.Url], alternate.Rel, alternate.Hreflang)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	alternates, err := store.FindAlternates(&ctx, "https://golang.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []page.Alternate{
+		{Url: "https://golang.org/fr", Rel: page.RelAlternate, Hreflang: "fr"},
+		{Url: "https://golang.org/amp", Rel: page.RelAmp},
+	}, alternates, "recording an alternate again should replace its facets")
+	alternates, err = store.FindAlternates(&ctx, "https://golang.org/fr")
+	assert.Equal(t, true, err == nil && len(alternates) == 0)
+}
+
+func assertUpdateTimestamp(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := createGraph(t, store, [][2]string{{"https://golang.org", "https://golang.org/doc"}})
+	timestamp := time.Now().Add(time.Hour).Unix()
+	err := store.UpdateTimestamp(&ctx, uids["https://golang.org"], timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.FindNode(&ctx, "https://golang.org", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, timestamp, result.Timestamp)
+	assert.Equal(t, true, store.UpdateTimestamp(&ctx, "", timestamp) != nil)
+}
+
+func assertUpsertErrorNode(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := createGraph(t, store, [][2]string{{"https://golang.org", "https://golang.org/doc"}})
+	p := page.Page{Url: "https://golang.org/doc", StatusCode: 404, Error: "http: received HTTP status 404 Not Found"}
+	uid, err := store.UpsertErrorNode(&ctx, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uids["https://golang.org/doc"], uid, "a stored page should be updated rather than duplicated")
+	result, err := store.FindNode(&ctx, "https://golang.org", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 1, len(result.Links)) {
+		assert.Equal(t, p.Error, result.Links[0].Error)
+		assert.Equal(t, p.StatusCode, result.Links[0].StatusCode)
+	}
+}
+
+func assertFindRoots(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org", "https://golang.org/pkg"},
+		{"https://golang.org/doc", "https://golang.org/pkg"},
+		{"https://golang.org/pkg", "https://golang.org/doc"},
+	})
+	roots, err := store.FindRoots(&ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 1, len(roots), "only the page nothing links to should be a root, even with a cycle beneath it") {
+		assert.Equal(t, "https://golang.org", roots[0].Url)
+		assert.Equal(t, uids["https://golang.org"], roots[0].Uid)
+		assert.Equal(t, 2, roots[0].ChildCount)
+		assert.Equal(t, 0, len(roots[0].Links))
+	}
+
+	createGraph(t, store, [][2]string{{"https://blog.golang.org", "https://golang.org/doc"}})
+	roots, err = store.FindRoots(&ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(roots), "no more roots than the limit should be returned")
+	roots, err = store.FindRoots(&ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(roots))
+}
+
+func assertFindChildren(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	createGraph(t, store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org", "https://golang.org/pkg"},
+		{"https://golang.org/doc", "https://golang.org/doc/faq"},
+		{"https://golang.org/doc/faq", "https://golang.org/doc/faq/generics"},
+		{"https://golang.org/pkg", "https://golang.org"},
+	})
+	children, err := store.FindChildren(&ctx, "https://golang.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	childCounts := make(map[string]int)
+	for _, child := range children {
+		childCounts[child.Url] = child.ChildCount
+		assert.Equal(t, true, child.Timestamp > 0, "%s should have its timestamp", child.Url)
+		assert.Equal(t, 0, len(child.Links), "%s should be returned without its links", child.Url)
+	}
+	assert.Equal(t, map[string]int{"https://golang.org/doc": 1, "https://golang.org/pkg": 1}, childCounts,
+		"only the direct links should be returned, each with its number of links")
+
+	children, err = store.FindChildren(&ctx, "https://golang.org/doc/faq/generics")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(children))
+	_, err = store.FindChildren(&ctx, "https://golang.org/missing")
+	assert.Equal(t, true, errors.Is(err, relationship.ErrNotFound), "a URL which isn't stored should not be found")
+}
+
+func assertFindOrCreateNodeStaleUid(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	for _, p := range []page.Page{
+		{Uid: "0xfffffff", Url: "https://golang.org", CrawlId: "docs"},
+		{Uid: "not-a-uid", Url: "https://golang.org/doc"},
+	} {
+		p.Timestamp = time.Now().Unix()
+		stale := p.Uid
+		uid, err := store.FindOrCreateNode(&ctx, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NotEqual(t, stale, uid, "a stale uid should not be returned")
+		result, err := store.FindNode(&ctx, p.Url, 0, p.CrawlId)
+		if assert.Equal(t, nil, err) && assert.Equal(t, true, result != nil, "the page should be created") {
+			assert.Equal(t, uid, result.Uid)
+		}
+	}
+}
+
+func assertCrawlIds(t *testing.T, store relationship.Graph) {
+	ctx := context.Background()
+	uids := make(map[string]string)
+	for _, p := range []page.Page{
+		{Url: "https://golang.org", CrawlId: "docs"},
+		{Url: "https://golang.org", CrawlId: "packages"},
+		{Url: "https://golang.org/doc", CrawlId: "docs"},
+		{Url: "https://golang.org/pkg", CrawlId: "packages"},
+		{Url: "https://golang.org/help"},
+	} {
+		p.Timestamp = time.Now().Unix()
+		uid, err := store.FindOrCreateNode(&ctx, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids[p.Url] = uid
+	}
+	for child, crawlId := range map[string]string{
+		"https://golang.org/doc":  "docs",
+		"https://golang.org/pkg":  "packages",
+		"https://golang.org/help": "",
+	} {
+		if _, err := store.CheckOrCreatePredicate(&ctx, uids["https://golang.org"], uids[child], crawlId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for crawlId, expected := range map[string][]string{
+		"docs":     {"https://golang.org/doc"},
+		"packages": {"https://golang.org/pkg"},
+		"":         {"https://golang.org/doc", "https://golang.org/help", "https://golang.org/pkg"},
+	} {
+		result, err := store.FindNode(&ctx, "https://golang.org", 1, crawlId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Equal(t, true, result != nil, crawlId) {
+			assert.Equal(t, expected, linkUrls(result), "only the pages the crawl stored should be found: %q", crawlId)
+			assert.Equal(t, len(expected), result.ChildCount, crawlId)
+		}
+	}
+	result, err := store.FindNode(&ctx, "https://golang.org/pkg", 0, "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, true, result == nil, "a page another crawl stored should not be found")
+
+	history, err := store.FindLinkHistory(&ctx, "https://golang.org", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkedBy := make(map[string]string)
+	for _, link := range history {
+		linkedBy[link.To] = link.CrawlId
+	}
+	assert.Equal(t, map[string]string{
+		"https://golang.org/doc":  "docs",
+		"https://golang.org/pkg":  "packages",
+		"https://golang.org/help": "",
+	}, linkedBy, "each link should be attributed to the crawl which stored it")
+}
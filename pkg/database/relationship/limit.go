@@ -0,0 +1,125 @@
+package relationship
+
+import (
+	"context"
+	"github.com/stevenayers/clamber/pkg/page"
+)
+
+// LimitedGraph wraps a Graph so that at most a fixed number of writes run at once, with the rest waiting for a slot
+// or until their context is done. Each write holds its slot only for the one call, so callers which make several
+// writes in a row, like the crawler creating a page, its parent and the link between them, can't deadlock on it.
+// Reads aren't limited.
+type LimitedGraph struct {
+	Graph
+	txns chan struct{}
+}
+
+// NewLimitedGraph function wraps graph so no more than maxConcurrentTxns writes run at once
+func NewLimitedGraph(graph Graph, maxConcurrentTxns int) *LimitedGraph {
+	return &LimitedGraph{Graph: graph, txns: make(chan struct{}, maxConcurrentTxns)}
+}
+
+// acquire function waits for a free write slot, returning the context's error if it is done first
+func (graph *LimitedGraph) acquire(ctx *context.Context) error {
+	select {
+	case graph.txns <- struct{}{}:
+		return nil
+	case <-(*ctx).Done():
+		return (*ctx).Err()
+	}
+}
+
+// release function frees the write slot taken by acquire
+func (graph *LimitedGraph) release() {
+	<-graph.txns
+}
+
+// FindOrCreateNode function calls the wrapped Graph's FindOrCreateNode once a write slot is free
+func (graph *LimitedGraph) FindOrCreateNode(ctx *context.Context, currentPage *page.Page) (uid string, err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.FindOrCreateNode(ctx, currentPage)
+}
+
+// UpsertErrorNode function calls the wrapped Graph's UpsertErrorNode once a write slot is free
+func (graph *LimitedGraph) UpsertErrorNode(ctx *context.Context, currentPage *page.Page) (uid string, err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.UpsertErrorNode(ctx, currentPage)
+}
+
+// DeleteSubtree function calls the wrapped Graph's DeleteSubtree once a write slot is free
+func (graph *LimitedGraph) DeleteSubtree(ctx *context.Context, Url string, depth int) (deleted int, err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.DeleteSubtree(ctx, Url, depth)
+}
+
+// UpdateTimestamp function calls the wrapped Graph's UpdateTimestamp once a write slot is free
+func (graph *LimitedGraph) UpdateTimestamp(ctx *context.Context, uid string, timestamp int64) (err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.UpdateTimestamp(ctx, uid, timestamp)
+}
+
+// PruneLinks function calls the wrapped Graph's PruneLinks once a write slot is free
+func (graph *LimitedGraph) PruneLinks(ctx *context.Context, uid string, keepUrls []string) (pruned int, err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.PruneLinks(ctx, uid, keepUrls)
+}
+
+// CreateRedirect function calls the wrapped Graph's CreateRedirect once a write slot is free
+func (graph *LimitedGraph) CreateRedirect(ctx *context.Context, sourceUid string, targetUid string) (err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.CreateRedirect(ctx, sourceUid, targetUid)
+}
+
+// CreateAlternate function calls the wrapped Graph's CreateAlternate once a write slot is free
+func (graph *LimitedGraph) CreateAlternate(ctx *context.Context, sourceUid string, targetUid string, rel string, hreflang string) (err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.CreateAlternate(ctx, sourceUid, targetUid, rel, hreflang)
+}
+
+// CheckOrCreatePredicate function calls the wrapped Graph's CheckOrCreatePredicate once a write slot is free
+func (graph *LimitedGraph) CheckOrCreatePredicate(ctx *context.Context, parentUid string, childUid string, crawlId string) (exists bool, err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.CheckOrCreatePredicate(ctx, parentUid, childUid, crawlId)
+}
+
+// CreatePredicates function calls the wrapped Graph's CreatePredicates once a write slot is free
+func (graph *LimitedGraph) CreatePredicates(ctx *context.Context, parentUid string, childUids []string, crawlId string) (err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.CreatePredicates(ctx, parentUid, childUids, crawlId)
+}
+
+// AddCrawlStats function calls the wrapped Graph's AddCrawlStats once a write slot is free
+func (graph *LimitedGraph) AddCrawlStats(ctx *context.Context, startUrl string, stats page.CrawlStats, reset bool) (err error) {
+	if err = graph.acquire(ctx); err != nil {
+		return
+	}
+	defer graph.release()
+	return graph.Graph.AddCrawlStats(ctx, startUrl, stats, reset)
+}
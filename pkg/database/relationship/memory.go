@@ -0,0 +1,571 @@
+package relationship
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stevenayers/clamber/pkg/page"
+	"sync"
+	"time"
+)
+
+type (
+	// MemoryStore holds the page graph in memory. It is safe for concurrent use.
+	MemoryStore struct {
+		sync.RWMutex
+		nodes      map[string]*memoryNode
+		uids       map[string]string
+		lastUid    uint64
+		crawlStats map[string]page.CrawlStats
+	}
+
+	// memoryNode holds a stored page with the crawls which stored it, the uids it links to in the order they were added
+	// with the time each link was stored and the crawl which stored it, the links pruned from it, the uid it redirects
+	// to and its alternates
+	memoryNode struct {
+		page        page.Page
+		crawlIds    map[string]struct{}
+		links       []string
+		linkedAt    map[string]int64
+		linkedBy    map[string]string
+		unlinked    []memoryUnlink
+		redirectsTo string
+		alternates  []memoryAlternate
+	}
+
+	// memoryUnlink holds the uid a page linked to until the link was pruned, with when it was stored and pruned
+	memoryUnlink struct {
+		uid        string
+		linkedAt   int64
+		unlinkedAt int64
+	}
+
+	// memoryAlternate holds the uid of a page's alternate and the facets of the edge to it
+	memoryAlternate struct {
+		uid      string
+		rel      string
+		hreflang string
+	}
+)
+
+// NewMemoryStore function creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nodes:      make(map[string]*memoryNode),
+		uids:       make(map[string]string),
+		crawlStats: make(map[string]page.CrawlStats),
+	}
+}
+
+// Connect function does nothing, as there is nothing to connect to
+func (store *MemoryStore) Connect() {}
+
+// Close function does nothing, as the memory store has no connections
+func (store *MemoryStore) Close() {}
+
+// SetSchema function does nothing, as the memory store has no schema
+func (store *MemoryStore) SetSchema() (err error) {
+	return
+}
+
+// DeleteAll function deletes every page and link, and the stats of every crawl
+func (store *MemoryStore) DeleteAll() (err error) {
+	store.Lock()
+	defer store.Unlock()
+	store.nodes = make(map[string]*memoryNode)
+	store.uids = make(map[string]string)
+	store.crawlStats = make(map[string]page.CrawlStats)
+	return
+}
+
+// Version function returns "memory", as there is no server
+func (store *MemoryStore) Version(ctx *context.Context) (version string, err error) {
+	return DriverMemory, nil
+}
+
+// FindNode function finds Page by URL and depth, with the same depth and crawlId semantics as Store.FindNode
+func (store *MemoryStore) FindNode(ctx *context.Context, Url string, depth int, crawlId string) (currentPage *page.Page, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	currentPage, err = store.findTree(Url, depth, crawlId)
+	if currentPage != nil && currentPage.MaxDepth() < depth {
+		return nil, ErrDepthMismatch
+	}
+	return
+}
+
+// FindNodeUpTo function finds Page by URL like FindNode, but returns the levels of links which are stored when fewer
+// than depth are, as Store.FindNodeUpTo does
+func (store *MemoryStore) FindNodeUpTo(ctx *context.Context, Url string, depth int, crawlId string) (currentPage *page.Page, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	return store.findTree(Url, depth, crawlId)
+}
+
+// FindChildren function finds the pages the Page with the given URL links to directly, with the same semantics as
+// Store.FindChildren
+func (store *MemoryStore) FindChildren(ctx *context.Context, Url string) (children []*page.Page, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	uid, isPresent := store.uids[Url]
+	if !isPresent {
+		return nil, &Error{Kind: ErrNotFound, Op: "find children", Err: fmt.Errorf("no page with url %s", Url)}
+	}
+	for _, childUid := range store.nodes[uid].links {
+		if childUid != uid {
+			children = append(children, store.buildPage(nil, childUid, 0, "", nil))
+		}
+	}
+	return
+}
+
+// FindOrCreateNode function checks for page, creates if doesn't exist, and sets the page's Uid. The page is always
+// looked up by URL, so a Uid already set which is stale is replaced. Like Store.FindOrCreateNode, a page with a CrawlId
+// has it added to the crawls its node was stored by.
+func (store *MemoryStore) FindOrCreateNode(ctx *context.Context, currentPage *page.Page) (uid string, err error) {
+	store.Lock()
+	defer store.Unlock()
+	uid, isPresent := store.uids[currentPage.Url]
+	if !isPresent {
+		store.lastUid++
+		uid = fmt.Sprintf("%#x", store.lastUid)
+		stored := *currentPage
+		stored.Uid = uid
+		stored.Links = nil
+		stored.Parent = nil
+		stored.CrawlId = ""
+		store.nodes[uid] = &memoryNode{page: stored, crawlIds: make(map[string]struct{})}
+		store.uids[currentPage.Url] = uid
+	}
+	if currentPage.CrawlId != "" {
+		store.nodes[uid].crawlIds[currentPage.CrawlId] = struct{}{}
+	}
+	currentPage.Uid = uid
+	return
+}
+
+// UpsertErrorNode function finds or creates the node for a page which couldn't be fetched, with the same semantics as
+// Store.UpsertErrorNode
+func (store *MemoryStore) UpsertErrorNode(ctx *context.Context, currentPage *page.Page) (uid string, err error) {
+	uid, err = store.FindOrCreateNode(ctx, currentPage)
+	if err != nil {
+		return
+	}
+	store.Lock()
+	defer store.Unlock()
+	node, err := store.node(uid)
+	if err != nil {
+		return
+	}
+	node.page.Error = currentPage.Error
+	if currentPage.StatusCode != 0 {
+		node.page.StatusCode = currentPage.StatusCode
+	}
+	if currentPage.Timestamp != 0 {
+		node.page.Timestamp = currentPage.Timestamp
+	}
+	return
+}
+
+// DeleteSubtree function deletes the Page with the given URL and every Page linked beneath it down to depth, with the
+// links, redirects and alternates to them from other pages, returning the number of pages removed. An error of kind
+// ErrNotFound is returned if the URL isn't stored.
+func (store *MemoryStore) DeleteSubtree(ctx *context.Context, Url string, depth int) (deleted int, err error) {
+	store.Lock()
+	defer store.Unlock()
+	currentPage, err := store.findTree(Url, depth, "")
+	if err != nil {
+		return
+	}
+	if currentPage == nil {
+		return 0, &Error{Kind: ErrNotFound, Op: "delete subtree", Err: fmt.Errorf("no page with url %s", Url)}
+	}
+	pages := make(map[string][]*page.Page)
+	collectPages(currentPage, pages)
+	removed := make(map[string]struct{})
+	for uid := range pages {
+		removed[uid] = struct{}{}
+		delete(store.uids, store.nodes[uid].page.Url)
+		delete(store.nodes, uid)
+	}
+	for _, node := range store.nodes {
+		node.links = removeUids(node.links, removed)
+		var unlinked []memoryUnlink
+		for _, unlink := range node.unlinked {
+			if _, isPresent := removed[unlink.uid]; !isPresent {
+				unlinked = append(unlinked, unlink)
+			}
+		}
+		node.unlinked = unlinked
+		if _, isPresent := removed[node.redirectsTo]; isPresent {
+			node.redirectsTo = ""
+		}
+		var alternates []memoryAlternate
+		for _, alternate := range node.alternates {
+			if _, isPresent := removed[alternate.uid]; !isPresent {
+				alternates = append(alternates, alternate)
+			}
+		}
+		node.alternates = alternates
+	}
+	deleted = len(removed)
+	return
+}
+
+// Stats function counts the pages and links stored in the graph
+func (store *MemoryStore) Stats(ctx *context.Context) (nodes int, edges int, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	nodes = len(store.nodes)
+	for _, node := range store.nodes {
+		edges += len(node.links)
+	}
+	return
+}
+
+// FindRoots function returns up to limit pages which no stored page links to, in the order they were created, without
+// their links. Every root is returned when limit isn't positive.
+func (store *MemoryStore) FindRoots(ctx *context.Context, limit int) (roots []*page.Page, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	linked := make(map[string]struct{})
+	for _, node := range store.nodes {
+		for _, uid := range node.links {
+			linked[uid] = struct{}{}
+		}
+	}
+	for i := uint64(1); i <= store.lastUid && (limit <= 0 || len(roots) < limit); i++ {
+		uid := fmt.Sprintf("%#x", i)
+		if _, isPresent := store.nodes[uid]; !isPresent {
+			continue
+		}
+		if _, isPresent := linked[uid]; isPresent {
+			continue
+		}
+		roots = append(roots, store.buildPage(nil, uid, 0, "", nil))
+	}
+	return
+}
+
+// AddCrawlStats function adds stats to those kept for the crawl from startUrl, like Store.AddCrawlStats
+func (store *MemoryStore) AddCrawlStats(ctx *context.Context, startUrl string, stats page.CrawlStats, reset bool) (err error) {
+	store.Lock()
+	defer store.Unlock()
+	stored := store.crawlStats[startUrl]
+	if reset {
+		stored = page.CrawlStats{}
+	}
+	stored.Add(stats)
+	store.crawlStats[startUrl] = stored
+	return
+}
+
+// FindCrawlStats function returns the stats kept for the crawl from startUrl, or nil if none are
+func (store *MemoryStore) FindCrawlStats(ctx *context.Context, startUrl string) (stats *page.CrawlStats, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	if stored, isPresent := store.crawlStats[startUrl]; isPresent {
+		stats = &stored
+	}
+	return
+}
+
+// UpdateTimestamp function sets the timestamp of an existing node
+func (store *MemoryStore) UpdateTimestamp(ctx *context.Context, uid string, timestamp int64) (err error) {
+	store.Lock()
+	defer store.Unlock()
+	node, err := store.node(uid)
+	if err != nil {
+		return
+	}
+	node.page.Timestamp = timestamp
+	return
+}
+
+// PruneLinks function removes the links from the node with the given uid to any node whose URL isn't in keepUrls,
+// returning how many links were removed. Each removed link is kept in the node's history with the time it was removed.
+func (store *MemoryStore) PruneLinks(ctx *context.Context, uid string, keepUrls []string) (pruned int, err error) {
+	store.Lock()
+	defer store.Unlock()
+	node, err := store.node(uid)
+	if err != nil {
+		return
+	}
+	keep := make(map[string]struct{})
+	for _, Url := range keepUrls {
+		keep[Url] = struct{}{}
+	}
+	stale := make(map[string]struct{})
+	now := time.Now().Unix()
+	for _, childUid := range node.links {
+		if _, isPresent := keep[store.nodes[childUid].page.Url]; !isPresent {
+			stale[childUid] = struct{}{}
+			node.unlinked = append(node.unlinked, memoryUnlink{uid: childUid, linkedAt: node.linkedAt[childUid], unlinkedAt: now})
+			delete(node.linkedAt, childUid)
+			delete(node.linkedBy, childUid)
+		}
+	}
+	node.links = removeUids(node.links, stale)
+	pruned = len(stale)
+	return
+}
+
+// CreateRedirect function records that the source node redirects to the target node
+func (store *MemoryStore) CreateRedirect(ctx *context.Context, sourceUid string, targetUid string) (err error) {
+	store.Lock()
+	defer store.Unlock()
+	source, err := store.node(sourceUid)
+	if err != nil {
+		return
+	}
+	if _, err = store.node(targetUid); err != nil {
+		return
+	}
+	source.redirectsTo = targetUid
+	return
+}
+
+// FindRedirect function returns the URL the page with the given URL redirects to, or an empty string if it doesn't
+func (store *MemoryStore) FindRedirect(ctx *context.Context, Url string) (targetUrl string, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	uid, isPresent := store.uids[Url]
+	if !isPresent {
+		return
+	}
+	if target, isPresent := store.nodes[store.nodes[uid].redirectsTo]; isPresent {
+		targetUrl = target.page.Url
+	}
+	return
+}
+
+// CreateAlternate function records that the target node is an alternate of the source node, replacing the rel and
+// hreflang of an existing edge between them
+func (store *MemoryStore) CreateAlternate(ctx *context.Context, sourceUid string, targetUid string, rel string, hreflang string) (err error) {
+	store.Lock()
+	defer store.Unlock()
+	source, err := store.node(sourceUid)
+	if err != nil {
+		return
+	}
+	if _, err = store.node(targetUid); err != nil {
+		return
+	}
+	alternate := memoryAlternate{uid: targetUid, rel: rel, hreflang: hreflang}
+	for i, existing := range source.alternates {
+		if existing.uid == targetUid {
+			source.alternates[i] = alternate
+			return
+		}
+	}
+	source.alternates = append(source.alternates, alternate)
+	return
+}
+
+// FindAlternates function returns the alternates recorded for the page with the given URL
+func (store *MemoryStore) FindAlternates(ctx *context.Context, Url string) (alternates []page.Alternate, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	uid, isPresent := store.uids[Url]
+	if !isPresent {
+		return
+	}
+	for _, alternate := range store.nodes[uid].alternates {
+		if target, isPresent := store.nodes[alternate.uid]; isPresent {
+			alternates = append(alternates, page.Alternate{Url: target.page.Url, Rel: alternate.rel, Hreflang: alternate.hreflang})
+		}
+	}
+	return
+}
+
+// CheckPredicate function checks to see if edge exists
+func (store *MemoryStore) CheckPredicate(ctx *context.Context, parentUid string, childUid string) (exists bool, err error) {
+	store.RLock()
+	defer store.RUnlock()
+	parent, err := store.node(parentUid)
+	if err != nil {
+		return
+	}
+	exists = hasUid(parent.links, childUid)
+	return
+}
+
+// CheckOrCreatePredicate function checks for edge, creates if doesn't exist, recording crawlId as the crawl which
+// created it. Like Store.CheckOrCreatePredicate, it returns whether the edge existed before the call.
+func (store *MemoryStore) CheckOrCreatePredicate(ctx *context.Context, parentUid string, childUid string, crawlId string) (exists bool, err error) {
+	store.Lock()
+	defer store.Unlock()
+	parent, err := store.node(parentUid)
+	if err != nil {
+		return
+	}
+	if _, err = store.node(childUid); err != nil {
+		return
+	}
+	exists = hasUid(parent.links, childUid)
+	if !exists {
+		parent.link(childUid, time.Now().Unix(), crawlId)
+	}
+	return
+}
+
+// CreatePredicates function creates the edges from the parent to each child which don't already exist, recording
+// crawlId as the crawl which created them. Nothing is created if the parent or any child isn't stored.
+func (store *MemoryStore) CreatePredicates(ctx *context.Context, parentUid string, childUids []string, crawlId string) (err error) {
+	store.Lock()
+	defer store.Unlock()
+	parent, err := store.node(parentUid)
+	if err != nil {
+		return
+	}
+	for _, childUid := range childUids {
+		if _, err = store.node(childUid); err != nil {
+			return
+		}
+	}
+	now := time.Now().Unix()
+	for _, childUid := range childUids {
+		if !hasUid(parent.links, childUid) {
+			parent.link(childUid, now, crawlId)
+		}
+	}
+	return
+}
+
+// FindLinkHistory function returns the history of every link, stored or pruned, from the pages reachable from the
+// given URL through depth of those links or fewer. Nothing is returned if the URL isn't stored.
+func (store *MemoryStore) FindLinkHistory(ctx *context.Context, Url string, depth int) (history []page.LinkHistory, err error) {
+	if depth < 0 {
+		return nil, errors.New("depth must not be negative")
+	}
+	store.RLock()
+	defer store.RUnlock()
+	uid, isPresent := store.uids[Url]
+	if !isPresent {
+		return
+	}
+	seen := map[string]struct{}{uid: {}}
+	level := []string{uid}
+	for ; depth > 0 && len(level) > 0; depth-- {
+		var next []string
+		for _, fromUid := range level {
+			node := store.nodes[fromUid]
+			visit := func(toUid string, linkedAt int64, unlinkedAt int64, crawlId string) {
+				to, isPresent := store.nodes[toUid]
+				if !isPresent {
+					return
+				}
+				history = append(history, page.LinkHistory{
+					Edge:       page.Edge{From: node.page.Url, To: to.page.Url},
+					LinkedAt:   linkedAt,
+					UnlinkedAt: unlinkedAt,
+					CrawlId:    crawlId,
+				})
+				if _, isPresent := seen[toUid]; !isPresent {
+					seen[toUid] = struct{}{}
+					next = append(next, toUid)
+				}
+			}
+			for _, toUid := range node.links {
+				visit(toUid, node.linkedAt[toUid], 0, node.linkedBy[toUid])
+			}
+			for _, unlink := range node.unlinked {
+				visit(unlink.uid, unlink.linkedAt, unlink.unlinkedAt, "")
+			}
+		}
+		level = next
+	}
+	return
+}
+
+// findTree function builds the page tree beneath the given URL down to depth. A page is not expanded again beneath
+// itself, so cycles end where they loop back. With a crawlId, only the pages that crawl stored are found.
+func (store *MemoryStore) findTree(Url string, depth int, crawlId string) (currentPage *page.Page, err error) {
+	if depth < 0 {
+		return nil, errors.New("depth must not be negative")
+	}
+	uid, isPresent := store.uids[Url]
+	if !isPresent || !store.nodes[uid].storedBy(crawlId) {
+		return
+	}
+	currentPage = store.buildPage(nil, uid, depth, crawlId, make(map[string]struct{}))
+	return
+}
+
+// buildPage function copies a stored node into a Page with its links expanded down to depth, leaving out the links to
+// pages which crawlId didn't store
+func (store *MemoryStore) buildPage(parentPage *page.Page, uid string, depth int, crawlId string, ancestors map[string]struct{}) *page.Page {
+	node := store.nodes[uid]
+	currentPage := node.page
+	currentPage.Parent = parentPage
+	currentPage.Links = nil
+	var childUids []string
+	for _, childUid := range node.links {
+		if store.nodes[childUid].storedBy(crawlId) {
+			childUids = append(childUids, childUid)
+		}
+	}
+	currentPage.ChildCount = len(childUids)
+	if depth == 0 {
+		return &currentPage
+	}
+	ancestors[uid] = struct{}{}
+	defer delete(ancestors, uid)
+	for _, childUid := range childUids {
+		if _, isPresent := ancestors[childUid]; isPresent {
+			continue
+		}
+		currentPage.Links = append(currentPage.Links, store.buildPage(&currentPage, childUid, depth-1, crawlId, ancestors))
+	}
+	return &currentPage
+}
+
+// storedBy function checks whether the crawl with the given id stored the node, which every node is taken to be by an
+// empty id
+func (node *memoryNode) storedBy(crawlId string) bool {
+	if crawlId == "" {
+		return true
+	}
+	_, isPresent := node.crawlIds[crawlId]
+	return isPresent
+}
+
+// link function adds a link to the uid, stored at the given time by the crawl with the given id
+func (node *memoryNode) link(uid string, linkedAt int64, crawlId string) {
+	if node.linkedAt == nil {
+		node.linkedAt = make(map[string]int64)
+		node.linkedBy = make(map[string]string)
+	}
+	node.links = append(node.links, uid)
+	node.linkedAt[uid] = linkedAt
+	node.linkedBy[uid] = crawlId
+}
+
+// node function returns the node with the given uid, or an error if there isn't one
+func (store *MemoryStore) node(uid string) (node *memoryNode, err error) {
+	node, isPresent := store.nodes[uid]
+	if !isPresent {
+		return nil, &Error{Kind: ErrNotFound, Op: "find node", Err: fmt.Errorf("no page with uid %s", uid)}
+	}
+	return
+}
+
+// hasUid function checks whether uids contains uid
+func hasUid(uids []string, uid string) bool {
+	for _, u := range uids {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// removeUids function returns uids without any of the uids in remove
+func removeUids(uids []string, remove map[string]struct{}) (kept []string) {
+	for _, uid := range uids {
+		if _, isPresent := remove[uid]; !isPresent {
+			kept = append(kept, uid)
+		}
+	}
+	return
+}
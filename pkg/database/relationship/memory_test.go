@@ -0,0 +1,190 @@
+package relationship_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stevenayers/clamber/pkg/config"
+	"github.com/stevenayers/clamber/pkg/database/relationship"
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+)
+
+type MemorySuite struct {
+	suite.Suite
+	store *relationship.MemoryStore
+}
+
+func (s *MemorySuite) SetupTest() {
+	s.store = relationship.NewMemoryStore()
+}
+
+func TestMemorySuite(t *testing.T) {
+	s := new(MemorySuite)
+	suite.Run(t, s)
+}
+
+func (s *MemorySuite) TestStats() {
+	assertStats(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestFindNodeDepth() {
+	assertFindNodeDepth(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestCrawlStats() {
+	assertCrawlStats(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestFindNodeUpTo() {
+	assertFindNodeUpTo(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestFindNodeChildCount() {
+	assertFindNodeChildCount(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestStoreTitle() {
+	assertStoreTitle(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestCheckOrCreatePredicate() {
+	assertCheckOrCreatePredicate(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestCreatePredicates() {
+	assertCreatePredicates(s.T(), s.store)
+	ctx := context.Background()
+	uids := createGraph(s.T(), s.store, [][2]string{{"https://golang.org", "https://golang.org/doc"}})
+	err := s.store.CreatePredicates(&ctx, uids["https://golang.org/doc"], []string{uids["https://golang.org"], "0xffff"}, "")
+	assert.Equal(s.T(), true, errors.Is(err, relationship.ErrNotFound))
+	exists, _ := s.store.CheckPredicate(&ctx, uids["https://golang.org/doc"], uids["https://golang.org"])
+	assert.Equal(s.T(), false, exists, "nothing should be created when a child isn't stored")
+}
+
+func (s *MemorySuite) TestDeleteSubtree() {
+	assertDeleteSubtree(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestPruneLinks() {
+	assertPruneLinks(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestRedirect() {
+	assertRedirect(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestAlternates() {
+	assertAlternates(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestUpdateTimestamp() {
+	assertUpdateTimestamp(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestUpsertErrorNode() {
+	assertUpsertErrorNode(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestFindRoots() {
+	assertFindRoots(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestFindChildren() {
+	assertFindChildren(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestFindOrCreateNodeStaleUid() {
+	assertFindOrCreateNodeStaleUid(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestCrawlIds() {
+	assertCrawlIds(s.T(), s.store)
+}
+
+func (s *MemorySuite) TestFindNodeCycle() {
+	ctx := context.Background()
+	createGraph(s.T(), s.store, [][2]string{
+		{"https://golang.org", "https://golang.org/doc"},
+		{"https://golang.org/doc", "https://golang.org"},
+	})
+	result, err := s.store.FindNode(&ctx, "https://golang.org", 1, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 1, result.MaxDepth())
+	_, err = s.store.FindNode(&ctx, "https://golang.org", 2, "")
+	assert.Equal(s.T(), true, err != nil, "a page should not be expanded again beneath itself")
+}
+
+func (s *MemorySuite) TestFindOrCreateNodeUidSet() {
+	ctx := context.Background()
+	uids := createGraph(s.T(), s.store, [][2]string{{"https://golang.org", "https://golang.org/doc"}})
+	p := page.Page{Uid: uids["https://golang.org"], Url: "https://golang.org"}
+	uid, err := s.store.FindOrCreateNode(&ctx, &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), uids["https://golang.org"], uid)
+
+	p = page.Page{Uid: uids["https://golang.org"], Url: "https://golang.org/pkg"}
+	uid, err = s.store.FindOrCreateNode(&ctx, &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), true, uid != uids["https://golang.org"], "a uid stored for another URL should not be trusted")
+	assert.Equal(s.T(), uid, p.Uid)
+	_, err = s.store.DeleteSubtree(&ctx, "https://golang.org/pkg", 0)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	uid, err = s.store.FindOrCreateNode(&ctx, &p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	result, err := s.store.FindNode(&ctx, "https://golang.org/pkg", 0, "")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	if assert.NotNil(s.T(), result) {
+		assert.Equal(s.T(), uid, result.Uid, "a page whose uid was deleted should be created again")
+	}
+}
+
+func (s *MemorySuite) TestFindOrCreateNodeConcurrent() {
+	ctx := context.Background()
+	uids := make(chan string, 50)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(uids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uid, err := s.store.FindOrCreateNode(&ctx, &page.Page{Url: "https://golang.org"})
+			if err == nil {
+				uids <- uid
+			}
+		}()
+	}
+	wg.Wait()
+	close(uids)
+	first := <-uids
+	for uid := range uids {
+		assert.Equal(s.T(), first, uid, "concurrent creates of one URL should share a uid")
+	}
+	nodes, _, _ := s.store.Stats(&ctx)
+	assert.Equal(s.T(), 1, nodes)
+}
+
+func (s *MemorySuite) TestNewStore() {
+	config.Update(func(c *config.Config) { c.Database.Driver = relationship.DriverMemory })
+	defer config.Update(func(c *config.Config) { c.Database.Driver = "" })
+	store := relationship.NewStore()
+	_, isMemory := store.(*relationship.MemoryStore)
+	assert.Equal(s.T(), true, isMemory)
+	assert.Equal(s.T(), store, relationship.NewStore(), "the memory store should be shared")
+	config.Update(func(c *config.Config) { c.Database.Driver = relationship.DriverDgraph })
+	_, isDgraph := relationship.NewStore().(*relationship.Store)
+	assert.Equal(s.T(), true, isDgraph)
+}
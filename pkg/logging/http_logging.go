@@ -1,9 +1,12 @@
 package logging
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"github.com/go-kit/kit/log/level"
 	"github.com/google/uuid"
+	"net"
 	"net/http"
 	"time"
 )
@@ -22,6 +25,23 @@ func (w *RichResponseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Flush function sends any buffered data to the client, so streamed responses work through the logger
+func (w *RichResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack function hands the connection over to the handler, so WebSocket upgrades work through the logger
+func (w *RichResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	w.StatusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
 // NewRichResponseWriter function creates a new RichResponseWriter
 func NewRichResponseWriter(w http.ResponseWriter) *RichResponseWriter {
 	return &RichResponseWriter{w, http.StatusOK}
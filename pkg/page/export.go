@@ -0,0 +1,113 @@
+package page
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type (
+	// GraphML is the root element of a GraphML document holding one graph
+	GraphML struct {
+		XMLName xml.Name     `xml:"graphml"`
+		Xmlns   string       `xml:"xmlns,attr"`
+		Keys    []GraphMLKey `xml:"key"`
+		Graph   GraphMLGraph `xml:"graph"`
+	}
+
+	// GraphMLKey declares an attribute the nodes or edges of a GraphML graph carry
+	GraphMLKey struct {
+		Id       string `xml:"id,attr"`
+		For      string `xml:"for,attr"`
+		AttrName string `xml:"attr.name,attr"`
+		AttrType string `xml:"attr.type,attr"`
+	}
+
+	// GraphMLGraph holds the nodes and edges of a GraphML graph
+	GraphMLGraph struct {
+		Id          string        `xml:"id,attr"`
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []GraphMLNode `xml:"node"`
+		Edges       []GraphMLEdge `xml:"edge"`
+	}
+
+	// GraphMLNode is a page in a GraphML graph, with its URL held in a url data element
+	GraphMLNode struct {
+		Id   string        `xml:"id,attr"`
+		Data []GraphMLData `xml:"data"`
+	}
+
+	// GraphMLData is the value of one attribute declared by a GraphMLKey
+	GraphMLData struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	}
+
+	// GraphMLEdge is a link from the source page to the target page in a GraphML graph
+	GraphMLEdge struct {
+		Id     string `xml:"id,attr"`
+		Source string `xml:"source,attr"`
+		Target string `xml:"target,attr"`
+	}
+)
+
+// dotEscaper escapes the characters which end or break a double quoted DOT string
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+// WriteGraphML function writes the unique pages in the recursive page structure and the links between them to w as a
+// directed GraphML graph. Each node is labelled with its page's URL.
+func (page *Page) WriteGraphML(w io.Writer) error {
+	adjacencyList := page.AdjacencyList()
+	ids := nodeIds(adjacencyList)
+	document := GraphML{
+		Xmlns: "http://graphml.graphdrawing.org/xmlns",
+		Keys:  []GraphMLKey{{Id: "url", For: "node", AttrName: "url", AttrType: "string"}},
+		Graph: GraphMLGraph{Id: "clamber", EdgeDefault: "directed"},
+	}
+	for _, node := range adjacencyList.Nodes {
+		document.Graph.Nodes = append(document.Graph.Nodes, GraphMLNode{
+			Id:   ids[node.Url],
+			Data: []GraphMLData{{Key: "url", Value: node.Url}},
+		})
+	}
+	for i, edge := range adjacencyList.Edges {
+		document.Graph.Edges = append(document.Graph.Edges, GraphMLEdge{
+			Id:     fmt.Sprintf("e%d", i),
+			Source: ids[edge.From],
+			Target: ids[edge.To],
+		})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(document)
+}
+
+// WriteDot function writes the unique pages in the recursive page structure and the links between them to w as a
+// Graphviz DOT digraph. Each node is labelled with its page's URL.
+func (page *Page) WriteDot(w io.Writer) (err error) {
+	adjacencyList := page.AdjacencyList()
+	ids := nodeIds(adjacencyList)
+	lines := []string{"digraph clamber {"}
+	for _, node := range adjacencyList.Nodes {
+		lines = append(lines, fmt.Sprintf(`  %s [label="%s"];`, ids[node.Url], dotEscaper.Replace(node.Url)))
+	}
+	for _, edge := range adjacencyList.Edges {
+		lines = append(lines, fmt.Sprintf("  %s -> %s;", ids[edge.From], ids[edge.To]))
+	}
+	lines = append(lines, "}")
+	_, err = io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return
+}
+
+// nodeIds function gives each unique page in the adjacency list an id, n0, n1 and so on in the order they were reached
+func nodeIds(adjacencyList *AdjacencyList) map[string]string {
+	ids := make(map[string]string)
+	for i, node := range adjacencyList.Nodes {
+		ids[node.Url] = fmt.Sprintf("n%d", i)
+	}
+	return ids
+}
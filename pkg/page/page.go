@@ -1,43 +1,127 @@
 package page
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/go-kit/kit/log/level"
+	"github.com/stevenayers/clamber/pkg/config"
 	"github.com/stevenayers/clamber/pkg/logging"
+	"golang.org/x/net/idna"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
-	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 type (
 
 	// Page holds page data
 	Page struct {
-		Uid        string  `json:"-"`
-		Url        string  `json:"url,omitempty"`
-		Links      []*Page `json:"links,omitempty"`
-		Parent     *Page   `json:"-"`
-		Depth      int     `json:"-"`
-		Timestamp  int64   `json:"timestamp,omitempty"`
-		StartUrl   string  `json:"-"`
-		StatusCode int     `json:"status_code,omitempty"`
+		Uid           string      `json:"-"`
+		Url           string      `json:"url,omitempty"`
+		Links         []*Page     `json:"links,omitempty"`
+		Parent        *Page       `json:"-"`
+		Depth         int         `json:"-"`
+		Timestamp     int64       `json:"timestamp,omitempty"`
+		StartUrl      string      `json:"-"`
+		StatusCode    int         `json:"status_code,omitempty"`
+		ChildCount    int         `json:"childCount"`
+		ETag          string      `json:"-"`
+		LastModified  string      `json:"-"`
+		Deadline      int64       `json:"-"`
+		Truncated     bool        `json:"truncated,omitempty"`
+		Title         string      `json:"title,omitempty"`
+		Error         string      `json:"error,omitempty"`
+		Login         *Login      `json:"-"`
+		Sink          string      `json:"-"`
+		CrawlId       string      `json:"-"`
+		Alternates    []Alternate `json:"-"`
+		Preconnects   []string    `json:"-"`
+		Pagination    []string    `json:"-"`
+		Paginated     bool        `json:"-"`
+		Soft404       bool        `json:"-"`
+		NoIndex       bool        `json:"-"`
+		NoFollow      bool        `json:"-"`
+		ParseWarnings []string    `json:"-"`
 	}
 
-	// JsonPage is used to turn Page into a dgraph compatible struct
+	// Alternate is a variant of a page declared in its HTML: a translation with <link rel="alternate" hreflang>, or an
+	// AMP version with <link rel="amphtml">
+	Alternate struct {
+		Url      string `json:"url"`
+		Rel      string `json:"rel"`
+		Hreflang string `json:"hreflang,omitempty"`
+	}
+
+	// Login holds the request a crawl sends to log in to a site before fetching its pages. Fields are sent form encoded,
+	// in the body of a POST or the query string of a GET.
+	Login struct {
+		Url    string            `json:"url"`
+		Method string            `json:"method,omitempty"`
+		Fields map[string]string `json:"fields,omitempty"`
+	}
+
+	// LinkScope decides which of the links found on a page are followed. A nil LinkScope follows every link except
+	// those back to the page itself, which are only followed with FollowSelf. Pages whose title matches a Soft404Title
+	// pattern, or whose body text matches a Soft404Body pattern, are error pages served as a success, and none of their
+	// links are followed.
+	LinkScope struct {
+		Include      []*regexp.Regexp
+		Exclude      []*regexp.Regexp
+		Soft404Title []*regexp.Regexp
+		Soft404Body  []*regexp.Regexp
+		FollowSelf   bool
+	}
+
+	// LinkExtractor finds the URLs a parsed page links to, resolved against the page's URL as base
+	LinkExtractor interface {
+		Extract(doc *goquery.Document, base *url.URL) []string
+	}
+
+	// AnchorLinkExtractor is the default LinkExtractor. It finds the href of each <a> which links to another HTML page
+	// on the same site.
+	AnchorLinkExtractor struct{}
+
+	// JsonLdLinkExtractor finds the URLs in a page's <script type="application/ld+json"> structured data, held in url,
+	// @id and sameAs fields at any depth, which link to another HTML page on the same site. Blocks which aren't valid
+	// JSON are skipped.
+	JsonLdLinkExtractor struct{}
+
+	// LinkExtractors is a LinkExtractor which returns the links found by each of its extractors in turn
+	LinkExtractors []LinkExtractor
+
+	// JsonPage is used to turn Page into a dgraph compatible struct, and into XML with the same fields the api returns
+	// as JSON
 	JsonPage struct {
-		Uid        string      `json:"uid,omitempty"`
-		Url        string      `json:"url,omitempty"`
-		Depth      int         `json:"depth,omitempty"`
-		Timestamp  int64       `json:"timestamp,omitempty"`
-		Children   []*JsonPage `json:"links,omitempty"`
-		StatusCode int         `json:"status_code,omitempty"`
+		XMLName      xml.Name    `json:"-" xml:"page"`
+		Uid          string      `json:"uid,omitempty" xml:"-"`
+		Url          string      `json:"url,omitempty" xml:"url,omitempty"`
+		Depth        int         `json:"depth,omitempty" xml:"-"`
+		Timestamp    int64       `json:"timestamp,omitempty" xml:"timestamp,omitempty"`
+		Children     []*JsonPage `json:"links,omitempty" xml:"links>page,omitempty"`
+		StatusCode   int         `json:"status_code,omitempty" xml:"status_code,omitempty"`
+		ChildCount   int         `json:"childCount,omitempty" xml:"childCount"`
+		ETag         string      `json:"etag,omitempty" xml:"-"`
+		LastModified string      `json:"last_modified,omitempty" xml:"-"`
+		Truncated    bool        `json:"truncated,omitempty" xml:"truncated,omitempty"`
+		Title        string      `json:"title,omitempty" xml:"title,omitempty"`
+		Error        string      `json:"error,omitempty" xml:"error,omitempty"`
+		CrawlIds     []string    `json:"crawl_id,omitempty" xml:"-"`
 	}
 
 	JsonResult struct {
@@ -50,6 +134,51 @@ type (
 		Matching int `json:"matching"`
 	}
 
+	// AdjacencyList holds the unique pages of a recursive page structure and the links between them
+	AdjacencyList struct {
+		Nodes []*Page `json:"nodes"`
+		Edges []*Edge `json:"edges"`
+	}
+
+	// Edge holds a link from one page URL to another
+	Edge struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+
+	// LinkHistory holds a link from one page URL to another with the unix time it was stored, and the unix time it was
+	// removed, or 0 if it is still stored. Links stored before their time was recorded have a LinkedAt of 0. CrawlId
+	// names the crawl which stored a link that is still stored, if it was named.
+	LinkHistory struct {
+		Edge
+		LinkedAt   int64  `json:"linked_at"`
+		UnlinkedAt int64  `json:"unlinked_at,omitempty"`
+		CrawlId    string `json:"crawl_id,omitempty"`
+	}
+
+	// GraphDiff holds the page URLs and links added to and removed from a subtree between two times
+	GraphDiff struct {
+		AddedNodes   []string `json:"addedNodes"`
+		RemovedNodes []string `json:"removedNodes"`
+		AddedEdges   []*Edge  `json:"addedEdges"`
+		RemovedEdges []*Edge  `json:"removedEdges"`
+	}
+
+	// CrawlStats summarises a crawl. PagesFetched counts the pages a response was received for, and Errors those which
+	// failed with an error status, a network error or as a soft 404. PagesSkipped counts the pages which weren't
+	// fetched, because their URL was too long, they were past the crawl's deadline, over a host's byte budget or the
+	// crawl's retry budget, or crawled recently, and those which were fetched again but not stored as the crawl had
+	// already crawled them. EdgesCreated counts the links stored between pages, Bytes the bytes of the bodies read, and
+	// ElapsedMs the time from the start page being crawled to the last page being counted.
+	CrawlStats struct {
+		PagesFetched int64 `json:"pages_fetched"`
+		PagesSkipped int64 `json:"pages_skipped"`
+		EdgesCreated int64 `json:"edges_created"`
+		Bytes        int64 `json:"bytes"`
+		Errors       int64 `json:"errors"`
+		ElapsedMs    int64 `json:"elapsed_ms"`
+	}
+
 	// Page holds page data
 	SQSPage struct {
 		Url       string   `json:"url,omitempty"`
@@ -57,39 +186,562 @@ type (
 		Depth     int      `json:"depth,omitempty"`
 		Timestamp int64    `json:"timestamp,omitempty"`
 		StartUrl  string   `json:"start_url,omitempty"`
+		Deadline  int64    `json:"deadline,omitempty"`
+		Login     *Login   `json:"login,omitempty"`
+		Sink      string   `json:"sink,omitempty"`
+		CrawlId   string   `json:"crawl_id,omitempty"`
+	}
+
+	// parsedHtml holds what was found in a page's HTML, so it can be parsed apart from the page
+	parsedHtml struct {
+		title       string
+		links       []string
+		alternates  []Alternate
+		preconnects []string
+		pagination  []string
+		soft404     bool
+		noIndex     bool
+		noFollow    bool
+		warnings    []string
+		err         error
 	}
 )
 
-// FetchChildPages function converts http response into child page objects
-func (page *Page) FetchChildPages(resp *http.Response) (childPages []*Page, err error) {
-	doc, err := goquery.NewDocumentFromResponse(resp)
+var (
+	// ErrParseTimeout is returned by FetchChildPagesWithin when a page's HTML takes longer than allowed to parse
+	ErrParseTimeout = errors.New("parsing HTML timed out")
+	// ErrReadTimeout is returned by ReadBody when a response body takes longer than allowed to read
+	ErrReadTimeout = errors.New("reading response body timed out")
+	// ErrNotHtml is returned by FetchChildPagesWithin when a page's body is binary, whatever its Content-Type says
+	ErrNotHtml = errors.New("response body is not HTML")
+)
+
+// FetchChildPages function converts http response into child page objects, and sets the page's Title. Links are found
+// by extractor, or AnchorLinkExtractor if it is nil, and links outside scope are skipped, as are links which resolve
+// to the page itself, such as #section, unless scope follows them. If maxLinks is above 0, only the first maxLinks
+// child pages are returned and the page is marked as Truncated. The HTML is parsed with ParseLenient.
+func (page *Page) FetchChildPages(resp *http.Response, maxLinks int, scope *LinkScope, extractor LinkExtractor) (childPages []*Page, err error) {
+	return page.FetchChildPagesWithin(resp, 0, 0, maxLinks, scope, extractor, ParseLenient)
+}
+
+// FetchChildPagesWithin function is FetchChildPages with limits on how long the page's body may take to read and its
+// HTML to parse, so a slow server or a malformed or gigantic document can't hold up the caller. The body is read with
+// ReadBody, bounded by maxReadTime and the context of the request which fetched it, then parsed in a goroutine; if
+// that takes longer than maxParseTime, ErrParseTimeout is returned and the parse is left to finish in the background
+// without changing the page. A maxReadTime or maxParseTime of 0 or less never times out. Bodies which IsText doesn't
+// recognise as text aren't parsed, and return ErrNotHtml. With parseMode ParseStrict, the problems found in the page's
+// markup are set as its ParseWarnings. The page's NoIndex and NoFollow are set from its robots meta tags and the
+// response's X-Robots-Tag headers, but its links are returned either way.
+func (page *Page) FetchChildPagesWithin(resp *http.Response, maxReadTime time.Duration, maxParseTime time.Duration, maxLinks int, scope *LinkScope, extractor LinkExtractor, parseMode string) (childPages []*Page, err error) {
+	if resp == nil {
+		err = errors.New("Response is nil")
+		_ = level.Error(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", err.Error())
+		return
+	}
+	page.ParseRobotsHeader(resp.Header)
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+	}
+	body, err := ReadBody(ctx, resp.Body, maxReadTime)
 	if err != nil {
 		_ = level.Error(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", err.Error())
 		return
 	}
-	defer resp.Body.Close()
-	localProcessed := make(map[string]struct{})
+	if !IsText(body) {
+		_ = level.Warn(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", ErrNotHtml.Error())
+		return nil, ErrNotHtml
+	}
+	if extractor == nil {
+		extractor = AnchorLinkExtractor{}
+	}
+	var parsed parsedHtml
+	if maxParseTime <= 0 {
+		parsed = parseHtml(page.Url, body, extractor, scope, parseMode)
+	} else {
+		parsedChan := make(chan parsedHtml, 1)
+		go func(Url string) {
+			parsedChan <- parseHtml(Url, body, extractor, scope, parseMode)
+		}(page.Url)
+		timer := time.NewTimer(maxParseTime)
+		defer timer.Stop()
+		select {
+		case parsed = <-parsedChan:
+		case <-timer.C:
+			_ = level.Warn(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", ErrParseTimeout.Error())
+			return nil, ErrParseTimeout
+		}
+	}
+	if parsed.err != nil {
+		err = parsed.err
+		_ = level.Error(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", err.Error())
+		return
+	}
+	page.Title = parsed.title
+	page.ParseWarnings = parsed.warnings
+	page.NoIndex = page.NoIndex || parsed.noIndex
+	page.NoFollow = page.NoFollow || parsed.noFollow
+	if parsed.soft404 {
+		page.Soft404 = true
+		_ = level.Debug(logging.Logger).Log("context", "soft 404", "url", page.Url, "title", page.Title)
+		return
+	}
+	page.Alternates = parsed.alternates
+	page.Preconnects = parsed.preconnects
+	page.Pagination = parsed.pagination
+	children := newChildLinks(page, scope, maxLinks)
+	for _, link := range parsed.links {
+		if !children.add(link) {
+			break
+		}
+	}
+	page.Truncated = page.Truncated || children.truncated
+	childPages = children.pages
+	return
+}
+
+// childLinks collects the child pages of a page from its links as they are found, skipping links outside scope, links
+// which resolve to the page itself unless scope follows them, and links to a path already collected. It doesn't change
+// the page, so it can collect in the background while the page is read.
+type childLinks struct {
+	page      *Page
+	scope     *LinkScope
+	maxLinks  int
+	selfUrl   string
+	processed map[string]struct{}
+	pages     []*Page
+	truncated bool
+}
+
+// newChildLinks function creates a childLinks collecting up to maxLinks child pages of page, or every one if maxLinks
+// is 0 or less
+func newChildLinks(page *Page, scope *LinkScope, maxLinks int) *childLinks {
+	return &childLinks{
+		page:      page,
+		scope:     scope,
+		maxLinks:  maxLinks,
+		selfUrl:   CanonicalUrl(page.Url),
+		processed: make(map[string]struct{}),
+	}
+}
+
+// add function adds a child page for link unless it is skipped, and returns false once a link is found past maxLinks,
+// which marks the links as truncated, as no more are collected
+func (children *childLinks) add(link string) bool {
+	absoluteUrl, err := url.Parse(link)
+	if err == nil {
+		absoluteUrl.Fragment = ""
+		err = NormalizeUrl(absoluteUrl)
+	}
+	if err != nil {
+		logSkippedLink(children.page.Url, link, "invalid URL: "+err.Error())
+		return true
+	}
+	childUrl := absoluteUrl.String()
+	if !children.scope.Allows(childUrl) {
+		logSkippedLink(children.page.Url, link, "excluded by patterns")
+		return true
+	}
+	if childUrl == children.selfUrl && !children.scope.followsSelf() {
+		logSkippedLink(children.page.Url, link, "link to itself")
+		return true
+	}
+	if _, isPresent := children.processed[absoluteUrl.Host+absoluteUrl.Path]; isPresent {
+		return true
+	}
+	if children.maxLinks > 0 && len(children.pages) >= children.maxLinks {
+		children.truncated = true
+		return false
+	}
+	children.processed[absoluteUrl.Host+absoluteUrl.Path] = struct{}{}
+	children.pages = append(children.pages, &Page{
+		Url:       childUrl,
+		Parent:    children.page,
+		StartUrl:  children.page.StartUrl,
+		Timestamp: time.Now().Unix(),
+		Login:     children.page.Login,
+		Sink:      children.page.Sink,
+		CrawlId:   children.page.CrawlId,
+	})
+	return true
+}
+
+// ReadBody function reads all of body unless ctx is done or maxReadDuration passes first, so a server which sends its
+// body slowly can't hold up the caller. The body is closed either way, which frees the connection and ends a read left
+// waiting on it. ErrReadTimeout is returned when either deadline passes, and ctx's error if it is cancelled. A
+// maxReadDuration of 0 or less only waits on ctx.
+func ReadBody(ctx context.Context, body io.ReadCloser, maxReadDuration time.Duration) (data []byte, err error) {
+	defer body.Close()
+	type readResult struct {
+		data []byte
+		err  error
+	}
+	readChan := make(chan readResult, 1)
+	go func() {
+		data, err := ioutil.ReadAll(body)
+		readChan <- readResult{data: data, err: err}
+	}()
+	var timeout <-chan time.Time
+	if maxReadDuration > 0 {
+		timer := time.NewTimer(maxReadDuration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case read := <-readChan:
+		if read.err == nil || ctx.Err() == nil {
+			return read.data, read.err
+		}
+	case <-timeout:
+		return nil, ErrReadTimeout
+	case <-ctx.Done():
+	}
+	if err = ctx.Err(); err == context.DeadlineExceeded {
+		err = ErrReadTimeout
+	}
+	return
+}
+
+// IsText function sniffs the first 512 bytes of a body with http.DetectContentType, and reports whether they are HTML or
+// other text rather than binary content such as an image or archive. Text in an encoding other than UTF-8 still counts.
+func IsText(body []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(body), "text/")
+}
+
+// parseHtml function parses a page's HTML, returning its title, its alternates, the hosts it preconnects to, its
+// pagination links and the links extractor finds, resolved against Url, or only its title if scope finds it is a soft
+// 404. With parseMode ParseStrict, the problems in its markup are returned as warnings too.
+func parseHtml(Url string, body []byte, extractor LinkExtractor, scope *LinkScope, parseMode string) (parsed parsedHtml) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		parsed.err = err
+		return
+	}
+	if parseMode == ParseStrict {
+		parsed.warnings = htmlWarnings(body)
+	}
+	parsed.title = strings.Join(strings.Fields(doc.Find("title").First().Text()), " ")
+	doc.Find("meta[name][content]").Each(func(index int, item *goquery.Selection) {
+		if name, _ := item.Attr("name"); strings.EqualFold(strings.TrimSpace(name), "robots") {
+			content, _ := item.Attr("content")
+			noIndex, noFollow := robotsDirectives(content)
+			parsed.noIndex = parsed.noIndex || noIndex
+			parsed.noFollow = parsed.noFollow || noFollow
+		}
+	})
+	if parsed.soft404 = scope.isSoft404(doc, parsed.title); parsed.soft404 {
+		return
+	}
+	base, err := url.Parse(Url)
+	if err != nil {
+		parsed.err = err
+		return
+	}
+	parsed.links = extractor.Extract(doc, base)
+	parsed.alternates = extractAlternates(doc, Url)
+	parsed.preconnects = extractPreconnects(doc, base)
+	parsed.pagination = extractPagination(doc, base)
+	return
+}
+
+// extractPagination function returns the URLs of the next and previous pages a page declares with rel="next" or
+// rel="prev" on a <link> or <a>. Relative hrefs are resolved against base like links, and absolute hrefs are only kept
+// on base's host.
+func extractPagination(doc *goquery.Document, base *url.URL) (links []string) {
+	basePage := Page{Url: base.String()}
+	seen := map[string]struct{}{CanonicalUrl(base.String()): {}}
+	doc.Find("link[href], a[href]").Each(func(index int, item *goquery.Selection) {
+		isPagination := false
+		for _, rel := range strings.Fields(strings.ToLower(item.AttrOr("rel", ""))) {
+			isPagination = isPagination || rel == "next" || rel == "prev" || rel == "previous"
+		}
+		if !isPagination {
+			return
+		}
+		href := strings.TrimSpace(item.AttrOr("href", ""))
+		var linkUrl *url.URL
+		var err error
+		if basePage.IsRelativeUrl(href) {
+			linkUrl, err = basePage.ParseRelativeUrl(href)
+		} else {
+			linkUrl, err = base.Parse(href)
+			if err == nil && !sameHost(linkUrl, base) {
+				err = fmt.Errorf("%s is not on the page's host", href)
+			}
+			if err == nil {
+				linkUrl.Fragment = ""
+				err = NormalizeUrl(linkUrl)
+			}
+		}
+		if err != nil || (linkUrl.Scheme != "http" && linkUrl.Scheme != "https") {
+			return
+		}
+		if _, isPresent := seen[linkUrl.String()]; !isPresent {
+			seen[linkUrl.String()] = struct{}{}
+			links = append(links, linkUrl.String())
+		}
+	})
+	return
+}
+
+// ParseRobotsHeader function sets the page's NoIndex and NoFollow from the X-Robots-Tag headers of its response.
+// Directives given for a named user agent, such as "googlebot: noindex", are ignored, as they aren't meant for every
+// robot.
+func (page *Page) ParseRobotsHeader(header http.Header) {
+	for _, value := range header[http.CanonicalHeaderKey("X-Robots-Tag")] {
+		if i := strings.Index(value, ":"); i >= 0 && !strings.ContainsAny(value[:i], ",") &&
+			!robotsValueDirectives[strings.ToLower(strings.TrimSpace(value[:i]))] {
+			continue
+		}
+		noIndex, noFollow := robotsDirectives(value)
+		page.NoIndex = page.NoIndex || noIndex
+		page.NoFollow = page.NoFollow || noFollow
+	}
+}
+
+// robotsValueDirectives are the robots directives which take a value after a colon, so aren't taken for a user agent
+var robotsValueDirectives = map[string]bool{
+	"unavailable_after": true, "max-snippet": true, "max-image-preview": true, "max-video-preview": true,
+}
+
+// robotsDirectives function reads a comma separated list of robots directives, such as "noindex, nofollow", returning
+// whether it has noindex and nofollow. The directive none has both.
+func robotsDirectives(content string) (noIndex bool, noFollow bool) {
+	for _, directive := range strings.Split(content, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "noindex":
+			noIndex = true
+		case "nofollow":
+			noFollow = true
+		case "none":
+			noIndex, noFollow = true, true
+		}
+	}
+	return
+}
+
+// extractPreconnects function returns the origins, such as https://fonts.gstatic.com, of the other hosts a page
+// declares with <link rel="preconnect"> or <link rel="dns-prefetch">. Hrefs are resolved against base, so protocol
+// relative hrefs take its scheme, and only http and https origins are kept.
+func extractPreconnects(doc *goquery.Document, base *url.URL) (origins []string) {
+	seen := make(map[string]struct{})
+	doc.Find("link[href]").Each(func(index int, item *goquery.Selection) {
+		isPreconnect := false
+		for _, rel := range strings.Fields(strings.ToLower(item.AttrOr("rel", ""))) {
+			isPreconnect = isPreconnect || rel == "preconnect" || rel == "dns-prefetch"
+		}
+		if !isPreconnect {
+			return
+		}
+		hostUrl, err := base.Parse(strings.TrimSpace(item.AttrOr("href", "")))
+		if err != nil || (hostUrl.Scheme != "http" && hostUrl.Scheme != "https") || hostUrl.Host == "" ||
+			strings.EqualFold(hostUrl.Host, base.Host) {
+			return
+		}
+		origin := strings.ToLower(hostUrl.Scheme + "://" + hostUrl.Host)
+		if _, isPresent := seen[origin]; !isPresent {
+			seen[origin] = struct{}{}
+			origins = append(origins, origin)
+		}
+	})
+	return
+}
+
+const (
+	// RelAlternate is the Rel of an Alternate declared with <link rel="alternate" hreflang>
+	RelAlternate = "alternate"
+	// RelAmp is the Rel of an Alternate declared with <link rel="amphtml">
+	RelAmp = "amphtml"
+)
+
+// extractAlternates function returns the alternates declared by <link> elements in a page's HTML. Relative hrefs are
+// resolved against Url like links, absolute http and https hrefs are kept whatever their host, and a page listing
+// itself among its translations is skipped.
+func extractAlternates(doc *goquery.Document, Url string) (alternates []Alternate) {
+	basePage := Page{Url: Url}
+	seen := make(map[Alternate]struct{})
+	doc.Find("link[href]").Each(func(index int, item *goquery.Selection) {
+		rel := strings.ToLower(strings.TrimSpace(item.AttrOr("rel", "")))
+		hreflang := strings.TrimSpace(item.AttrOr("hreflang", ""))
+		if !(rel == RelAlternate && hreflang != "") && rel != RelAmp {
+			return
+		}
+		href := strings.TrimSpace(item.AttrOr("href", ""))
+		var alternateUrl *url.URL
+		var err error
+		if basePage.IsRelativeUrl(href) {
+			alternateUrl, err = basePage.ParseRelativeUrl(href)
+		} else {
+			alternateUrl, err = url.Parse(Url)
+			if err == nil {
+				alternateUrl, err = alternateUrl.Parse(href)
+			}
+			if err == nil && alternateUrl.Scheme != "http" && alternateUrl.Scheme != "https" {
+				err = fmt.Errorf("%s is not an http or https URL", href)
+			}
+			if err == nil {
+				alternateUrl.Fragment = ""
+				err = NormalizeUrl(alternateUrl)
+			}
+		}
+		if err != nil {
+			return
+		}
+		alternate := Alternate{Url: alternateUrl.String(), Rel: rel, Hreflang: hreflang}
+		if _, isPresent := seen[alternate]; isPresent || alternate.Url == CanonicalUrl(Url) {
+			return
+		}
+		seen[alternate] = struct{}{}
+		alternates = append(alternates, alternate)
+	})
+	return
+}
+
+// Extract function returns the absolute URL of each relative <a> href which points to an HTML page
+func (extractor AnchorLinkExtractor) Extract(doc *goquery.Document, base *url.URL) (links []string) {
+	basePage := Page{Url: base.String()}
 	doc.Find("a").Each(func(index int, item *goquery.Selection) {
-		href, ok := item.Attr("href")
-		if ok && page.IsRelativeUrl(href) && page.IsRelativeHtml(href) && href != "" {
-			absoluteUrl, _ := page.ParseRelativeUrl(href)
-			_, isPresent := localProcessed[absoluteUrl.Path]
-			if !isPresent {
-				localProcessed[absoluteUrl.Path] = struct{}{}
-				childPage := Page{
-					Url:       strings.TrimRight(absoluteUrl.String(), "/"),
-					Parent:    page,
-					StartUrl:  page.StartUrl,
-					Timestamp: time.Now().Unix(),
-				}
-				childPages = append(childPages, &childPage)
+		href, hasHref := item.Attr("href")
+		link, skipReason := basePage.anchorLink(href, hasHref)
+		if skipReason != "" {
+			logSkippedLink(basePage.Url, href, skipReason)
+			return
+		}
+		links = append(links, link)
+	})
+	return
+}
+
+// anchorLink function resolves the href of an <a> on the page to the absolute URL AnchorLinkExtractor follows, or
+// returns the reason it is skipped: it is missing or empty, isn't relative, doesn't point to an HTML page, or can't be
+// parsed
+func (page *Page) anchorLink(href string, hasHref bool) (link string, skipReason string) {
+	switch {
+	case !hasHref:
+		return "", "missing href"
+	case href == "":
+		return "", "empty href"
+	case !page.IsRelativeUrl(href):
+		return "", "not a relative URL"
+	case !page.IsRelativeHtml(href):
+		return "", "not an HTML page"
+	}
+	absoluteUrl, err := page.ParseRelativeUrl(href)
+	if err != nil {
+		return "", "invalid URL: " + err.Error()
+	}
+	return absoluteUrl.String(), ""
+}
+
+// logSkippedLink function logs why a link on the page at Url isn't followed. It is logged at debug level, so it is
+// only shown with the --verbose flag or a log_level of debug, as a page can have many links.
+func logSkippedLink(Url string, href string, skipReason string) {
+	_ = level.Debug(logging.Logger).Log("context", "skipping link", "url", Url, "href", href, "reason", skipReason)
+}
+
+// jsonLdLinkFields are the JSON-LD fields JsonLdLinkExtractor reads URLs from
+var jsonLdLinkFields = map[string]struct{}{"url": {}, "@id": {}, "sameAs": {}}
+
+// Extract function returns the absolute URLs in the page's JSON-LD blocks which point to HTML pages on the base's host
+func (extractor JsonLdLinkExtractor) Extract(doc *goquery.Document, base *url.URL) (links []string) {
+	basePage := Page{Url: base.String()}
+	doc.Find(`script[type="application/ld+json"]`).Each(func(index int, item *goquery.Selection) {
+		var data interface{}
+		if err := json.Unmarshal([]byte(item.Text()), &data); err != nil {
+			_ = level.Debug(logging.Logger).Log("context", "skipping malformed JSON-LD", "url", base.String(), "msg", err.Error())
+			return
+		}
+		for _, link := range jsonLdUrls(data, false) {
+			linkUrl, err := base.Parse(link)
+			if err != nil || !sameHost(linkUrl, base) || (linkUrl.Scheme != "http" && linkUrl.Scheme != "https") {
+				continue
+			}
+			if basePage.IsRelativeHtml(linkUrl.Path) {
+				links = append(links, linkUrl.String())
 			}
 		}
 	})
 	return
 }
 
-// MaxDepth function gets the max depth of the recursive page structure
+// jsonLdUrls function walks decoded JSON-LD, returning the strings held in url, @id and sameAs fields. isLinkField
+// is set while walking the value of one of those fields, whose strings are links.
+func jsonLdUrls(data interface{}, isLinkField bool) (urls []string) {
+	switch value := data.(type) {
+	case string:
+		if isLinkField {
+			urls = append(urls, value)
+		}
+	case []interface{}:
+		for _, item := range value {
+			urls = append(urls, jsonLdUrls(item, isLinkField)...)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys) // so links are found in the same order every time
+		for _, key := range keys {
+			_, isLink := jsonLdLinkFields[key]
+			urls = append(urls, jsonLdUrls(value[key], isLink)...)
+		}
+	}
+	return
+}
+
+// Extract function returns the links found by each extractor, in order
+func (extractors LinkExtractors) Extract(doc *goquery.Document, base *url.URL) (links []string) {
+	for _, extractor := range extractors {
+		links = append(links, extractor.Extract(doc, base)...)
+	}
+	return
+}
+
+// followsSelf function checks whether a page's links back to itself should be followed
+func (scope *LinkScope) followsSelf() bool {
+	return scope != nil && scope.FollowSelf
+}
+
+// Allows function checks whether a link to Url should be followed. Links matching an Exclude pattern never are; when
+// there are Include patterns, only links matching one of them are.
+func (scope *LinkScope) Allows(Url string) bool {
+	if scope == nil {
+		return true
+	}
+	if matchesAny(Url, scope.Exclude) {
+		return false
+	}
+	return len(scope.Include) == 0 || matchesAny(Url, scope.Include)
+}
+
+// isSoft404 function checks whether a page is a soft 404: an error page, such as "Not Found", served with a success
+// status. Its title is checked against the Soft404Title patterns, and its body text, with runs of whitespace collapsed
+// to a space, against the Soft404Body patterns.
+func (scope *LinkScope) isSoft404(doc *goquery.Document, title string) bool {
+	if scope == nil {
+		return false
+	}
+	if matchesAny(title, scope.Soft404Title) {
+		return true
+	}
+	if len(scope.Soft404Body) == 0 {
+		return false
+	}
+	return matchesAny(strings.Join(strings.Fields(doc.Find("body").Text()), " "), scope.Soft404Body)
+}
+
+// matchesAny function checks Url against each pattern
+func matchesAny(Url string, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(Url) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxDepth function gets the max depth of the recursive page structure, where a page without links has a depth of 0
 func (page *Page) MaxDepth() (countDepth int) {
 	if page.Links != nil {
 		var childDepths []int
@@ -101,20 +753,373 @@ func (page *Page) MaxDepth() (countDepth int) {
 	return
 }
 
-// ParseRelativeUrl function parses a relative URL string into a URL object
+// NewestTimestamp function returns the newest Timestamp in the recursive page structure
+func (page *Page) NewestTimestamp() (newest int64) {
+	newest = page.Timestamp
+	for _, childPage := range page.Links {
+		if timestamp := childPage.NewestTimestamp(); timestamp > newest {
+			newest = timestamp
+		}
+	}
+	return
+}
+
+// AdjacencyList function flattens the recursive page structure into its unique pages and links, so pages reached
+// through several branches only appear once
+func (page *Page) AdjacencyList() (adjacencyList *AdjacencyList) {
+	adjacencyList = &AdjacencyList{Nodes: []*Page{}, Edges: []*Edge{}}
+	seenNodes := make(map[string]struct{})
+	seenEdges := make(map[Edge]struct{})
+	page.collectAdjacencyList(adjacencyList, seenNodes, seenEdges)
+	return
+}
+
+func (page *Page) collectAdjacencyList(adjacencyList *AdjacencyList, seenNodes map[string]struct{}, seenEdges map[Edge]struct{}) {
+	if _, isPresent := seenNodes[page.Url]; !isPresent {
+		seenNodes[page.Url] = struct{}{}
+		node := *page
+		node.Links = nil
+		node.Parent = nil
+		adjacencyList.Nodes = append(adjacencyList.Nodes, &node)
+	}
+	for _, childPage := range page.Links {
+		edge := Edge{From: page.Url, To: childPage.Url}
+		if _, isPresent := seenEdges[edge]; !isPresent {
+			seenEdges[edge] = struct{}{}
+			adjacencyList.Edges = append(adjacencyList.Edges, &edge)
+		}
+		childPage.collectAdjacencyList(adjacencyList, seenNodes, seenEdges)
+	}
+}
+
+// DiffLinks function compares the subtree beneath Url down to depth as it is now with the subtree as it was at since, a
+// unix time, using the history of the links between its pages. A page is in a subtree when it is reachable from Url
+// through depth links or fewer, and a link when it is from a page reachable through fewer than depth. Url is taken to be
+// in both, as the history only records links. The URLs and links of the diff are sorted.
+func DiffLinks(Url string, depth int, history []LinkHistory, since int64) *GraphDiff {
+	then := linkSubtree(Url, depth, history, func(link LinkHistory) bool {
+		return link.LinkedAt <= since && (link.UnlinkedAt == 0 || link.UnlinkedAt > since)
+	})
+	now := linkSubtree(Url, depth, history, func(link LinkHistory) bool {
+		return link.UnlinkedAt == 0
+	})
+	diff := &GraphDiff{AddedNodes: []string{}, RemovedNodes: []string{}, AddedEdges: []*Edge{}, RemovedEdges: []*Edge{}}
+	diff.AddedNodes, diff.AddedEdges = now.difference(then, diff.AddedNodes, diff.AddedEdges)
+	diff.RemovedNodes, diff.RemovedEdges = then.difference(now, diff.RemovedNodes, diff.RemovedEdges)
+	return diff
+}
+
+// subtree holds the page URLs and links of a subtree built by linkSubtree
+type subtree struct {
+	nodes map[string]struct{}
+	edges map[Edge]struct{}
+}
+
+// linkSubtree function walks the links in history for which present is true from Url, down to depth
+func linkSubtree(Url string, depth int, history []LinkHistory, present func(link LinkHistory) bool) subtree {
+	links := make(map[string][]string)
+	for _, link := range history {
+		if present(link) {
+			links[link.From] = append(links[link.From], link.To)
+		}
+	}
+	tree := subtree{nodes: map[string]struct{}{Url: {}}, edges: make(map[Edge]struct{})}
+	level := []string{Url}
+	for ; depth > 0 && len(level) > 0; depth-- {
+		var next []string
+		for _, from := range level {
+			for _, to := range links[from] {
+				tree.edges[Edge{From: from, To: to}] = struct{}{}
+				if _, isPresent := tree.nodes[to]; !isPresent {
+					tree.nodes[to] = struct{}{}
+					next = append(next, to)
+				}
+			}
+		}
+		level = next
+	}
+	return tree
+}
+
+// difference function appends the URLs and links of the subtree which aren't in other to nodes and edges, sorted
+func (tree subtree) difference(other subtree, nodes []string, edges []*Edge) ([]string, []*Edge) {
+	for Url := range tree.nodes {
+		if _, isPresent := other.nodes[Url]; !isPresent {
+			nodes = append(nodes, Url)
+		}
+	}
+	for edge := range tree.edges {
+		if _, isPresent := other.edges[edge]; !isPresent {
+			edge := edge
+			edges = append(edges, &edge)
+		}
+	}
+	sort.Strings(nodes)
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	return nodes, edges
+}
+
+// Add function adds the counts of other to the stats, keeping the longer of their elapsed times, so the stats of a crawl
+// counted by several services can be combined
+func (stats *CrawlStats) Add(other CrawlStats) {
+	stats.PagesFetched += other.PagesFetched
+	stats.PagesSkipped += other.PagesSkipped
+	stats.EdgesCreated += other.EdgesCreated
+	stats.Bytes += other.Bytes
+	stats.Errors += other.Errors
+	if other.ElapsedMs > stats.ElapsedMs {
+		stats.ElapsedMs = other.ElapsedMs
+	}
+}
+
+// WriteEdgeCsv function writes the unique links in the recursive page structure to w as CSV, with a from,to header
+func (page *Page) WriteEdgeCsv(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	_ = csvWriter.Write([]string{"from", "to"})
+	for _, edge := range page.AdjacencyList().Edges {
+		_ = csvWriter.Write([]string{edge.From, edge.To})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// Urls function returns the unique URLs in the recursive page structure, in the order they are first reached
+func (page *Page) Urls() (urls []string) {
+	for _, node := range page.AdjacencyList().Nodes {
+		urls = append(urls, node.Url)
+	}
+	return
+}
+
+// Failed function checks whether the page couldn't be fetched, either with an error status code or with an Error
+// recorded by the crawler
+func (page *Page) Failed() bool {
+	return page.StatusCode >= http.StatusBadRequest || page.Error != ""
+}
+
+// FailedPages function returns up to limit unique pages in the recursive page structure which couldn't be fetched
+func (page *Page) FailedPages(limit int) (failedPages []*Page) {
+	seen := make(map[string]struct{})
+	page.collectFailedPages(limit, seen, &failedPages)
+	return
+}
+
+func (page *Page) collectFailedPages(limit int, seen map[string]struct{}, failedPages *[]*Page) {
+	if len(*failedPages) >= limit {
+		return
+	}
+	if _, isPresent := seen[page.Url]; !isPresent {
+		seen[page.Url] = struct{}{}
+		if page.Failed() {
+			*failedPages = append(*failedPages, page)
+		}
+	}
+	for _, childPage := range page.Links {
+		childPage.collectFailedPages(limit, seen, failedPages)
+	}
+}
+
+// ParseRelativeUrl function parses a relative URL string into a URL object on the page's host. Root-relative hrefs
+// replace the page's path, and other hrefs are resolved against the page's directory. The resulting path has its dot
+// segments resolved, including percent-encoded ones, duplicate slashes collapsed unless the config keeps them, and its
+// trailing slash handled by NormalizeUrl. As the URL always stays on the page's host, an href starting with // is read as a path, and
+// one with a scheme, such as mailto:, is an error.
 func (page *Page) ParseRelativeUrl(relativeUrl string) (absoluteUrl *url.URL, err error) {
 	parsedRootUrl, err := url.Parse(page.Url)
 	if err != nil {
 		return nil, err
 	}
-	absoluteUrl, err = url.Parse(parsedRootUrl.Scheme + "://" + parsedRootUrl.Host + path.Clean("/"+relativeUrl))
+	if strings.HasPrefix(relativeUrl, "//") {
+		relativeUrl = "/" + strings.TrimLeft(relativeUrl, "/")
+	}
+	reference, err := url.Parse(relativeUrl)
 	if err != nil {
 		return nil, err
 	}
+	if reference.Scheme != "" {
+		return nil, fmt.Errorf("%s is not a relative URL", relativeUrl)
+	}
+	absoluteUrl = parsedRootUrl.ResolveReference(reference)
+	cleanedPath := cleanPath(encodedDot.ReplaceAllString(absoluteUrl.EscapedPath(), "."), config.Get().Url.KeepDuplicateSlashes)
+	absoluteUrl.Path, err = url.PathUnescape(cleanedPath)
+	if err != nil {
+		return nil, err
+	}
+	absoluteUrl.RawPath = cleanedPath
 	absoluteUrl.Fragment = "" // Removes '#' identifiers from Url
+	if err = NormalizeUrl(absoluteUrl); err != nil {
+		return nil, err
+	}
 	return
 }
 
+// encodedDot matches a percent-encoded '.', which is decoded before dot segments are resolved so %2e%2e can't climb
+// past them
+var encodedDot = regexp.MustCompile(`%2[eE]`)
+
+// cleanPath function resolves the . and .. segments of an escaped path, so the result has a single leading slash and
+// keeps a trailing slash if the path had one. Empty segments left by duplicate slashes are dropped unless
+// keepDuplicateSlashes is set.
+func cleanPath(escapedPath string, keepDuplicateSlashes bool) string {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(escapedPath, "/"), "/") {
+		switch {
+		case segment == ".":
+		case segment == "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		case segment == "" && !keepDuplicateSlashes:
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	cleaned := "/" + strings.Join(segments, "/")
+	if len(segments) > 0 && strings.HasSuffix(escapedPath, "/") {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// DefaultTrackingParams are the query parameters stripped from URLs when the config doesn't list any. A trailing '*'
+// matches any parameter with that prefix.
+var DefaultTrackingParams = []string{"utm_*", "fbclid", "gclid", "mc_cid", "mc_eid"}
+
+const (
+	// TrailingSlashStrip removes the trailing slash from every path, so the root URL has no path at all. It is used
+	// when no trailing slash policy is configured.
+	TrailingSlashStrip = "strip"
+	// TrailingSlashKeep leaves paths as they are, except that the root URL always has the path /
+	TrailingSlashKeep = "keep"
+	// TrailingSlashKeepRoot removes the trailing slash from every path except the root URL's, which is always /
+	TrailingSlashKeepRoot = "keep_root"
+)
+
+// NormalizeUrl function lowercases the scheme and host, converts an internationalized host to punycode, removes
+// default ports and tracking query parameters, sorts the remaining query parameters, and applies the config's trailing
+// slash policy to the path, so that different forms of the same URL map to a single page. A URL whose host isn't a
+// valid internationalized domain name is left as it is, and the error returned.
+func NormalizeUrl(u *url.URL) error {
+	host, err := NormalizeHost(u.Hostname())
+	if err != nil {
+		return err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	switch {
+	case port != "":
+		u.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+	if u.Host != "" {
+		u.Path = trailingSlash(u.Path, config.Get().Url.TrailingSlash)
+		if u.RawPath != "" {
+			u.RawPath = trailingSlash(u.RawPath, config.Get().Url.TrailingSlash)
+		}
+	}
+	if u.RawQuery == "" {
+		return nil
+	}
+	trackingParams := config.Get().Url.TrackingParams
+	if trackingParams == nil {
+		trackingParams = DefaultTrackingParams
+	}
+	values := u.Query()
+	for key := range values {
+		if isTrackingParam(key, trackingParams) {
+			values.Del(key)
+		}
+	}
+	u.RawQuery = values.Encode() // Encode sorts by key
+	return nil
+}
+
+// trailingSlash function applies a trailing slash policy to a path
+func trailingSlash(path string, policy string) string {
+	switch policy {
+	case TrailingSlashKeep:
+		if path == "" {
+			return "/"
+		}
+		return path
+	case TrailingSlashKeepRoot:
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			return trimmed
+		}
+		return "/"
+	default:
+		return strings.TrimRight(path, "/")
+	}
+}
+
+// CanonicalUrl function returns Url normalized by NormalizeUrl without its fragment, the form pages are stored under,
+// so it can be used as a key for the page. A Url which can't be parsed is returned as it is.
+func CanonicalUrl(Url string) string {
+	u, err := url.Parse(Url)
+	if err != nil {
+		return Url
+	}
+	u.Fragment = ""
+	if NormalizeUrl(u) != nil {
+		return Url
+	}
+	return u.String()
+}
+
+// hostProfile converts internationalized hosts to punycode as they are looked up, but without the STD3 rules, so
+// hosts with underscores are still allowed
+var hostProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.BidiRule())
+
+// NormalizeHost function lowercases host, converting it to punycode if it has any non-ASCII characters, so a host
+// written in Unicode and in punycode is stored and compared under one name. Hosts which are already ASCII are only
+// lowercased. It returns an error for a host which isn't a valid internationalized domain name.
+func NormalizeHost(host string) (string, error) {
+	for i := 0; i < len(host); i++ {
+		if host[i] >= utf8.RuneSelf {
+			ascii, err := hostProfile.ToASCII(host)
+			if err != nil {
+				return "", err
+			}
+			return ascii, nil
+		}
+	}
+	return strings.ToLower(host), nil
+}
+
+// sameHost function checks whether two URLs have the same host and port, comparing internationalized hosts in their
+// punycode form
+func sameHost(a *url.URL, b *url.URL) bool {
+	aHost, aErr := NormalizeHost(a.Hostname())
+	bHost, bErr := NormalizeHost(b.Hostname())
+	return aErr == nil && bErr == nil && aHost == bHost && a.Port() == b.Port()
+}
+
+// isTrackingParam function checks a query parameter name against the tracking parameter patterns
+func isTrackingParam(key string, trackingParams []string) bool {
+	key = strings.ToLower(key)
+	for _, param := range trackingParams {
+		param = strings.ToLower(param)
+		if strings.HasSuffix(param, "*") && strings.HasPrefix(key, strings.TrimSuffix(param, "*")) {
+			return true
+		}
+		if key == param {
+			return true
+		}
+	}
+	return false
+}
+
 // IsRelativeUrl function checks for relative URL path
 func (page *Page) IsRelativeUrl(href string) bool {
 	match, _ := regexp.MatchString("^(?:[a-zA-Z]+:)?//", href)
@@ -135,9 +1140,16 @@ func (page *Page) IsRelativeHtml(href string) bool {
 // Converts JSONPage into a Page
 func convertJsonPageToPage(parentPage *Page, jsonPage *JsonPage) (currentPage *Page) {
 	currentPage = &Page{
-		Uid:       jsonPage.Uid,
-		Url:       jsonPage.Url,
-		Timestamp: jsonPage.Timestamp,
+		Uid:          jsonPage.Uid,
+		Url:          jsonPage.Url,
+		Timestamp:    jsonPage.Timestamp,
+		StatusCode:   jsonPage.StatusCode,
+		ChildCount:   jsonPage.ChildCount,
+		ETag:         jsonPage.ETag,
+		LastModified: jsonPage.LastModified,
+		Truncated:    jsonPage.Truncated,
+		Title:        jsonPage.Title,
+		Error:        jsonPage.Error,
 	}
 	if parentPage != nil {
 		currentPage.Parent = parentPage
@@ -165,29 +1177,59 @@ func convertJsonPageToPage(parentPage *Page, jsonPage *JsonPage) (currentPage *P
 
 // Converts a Page to a JSONPage
 func convertPageToJsonPage(currentPage *Page) (jsonPage JsonPage) {
-	return JsonPage{
-		Uid:        currentPage.Uid,
-		Url:        currentPage.Url,
-		Timestamp:  currentPage.Timestamp,
-		StatusCode: currentPage.StatusCode,
+	jsonPage = JsonPage{
+		Uid:          currentPage.Uid,
+		Url:          currentPage.Url,
+		Timestamp:    currentPage.Timestamp,
+		StatusCode:   currentPage.StatusCode,
+		ETag:         currentPage.ETag,
+		LastModified: currentPage.LastModified,
+		Truncated:    currentPage.Truncated,
+		Title:        currentPage.Title,
+		Error:        currentPage.Error,
+	}
+	if currentPage.CrawlId != "" {
+		jsonPage.CrawlIds = []string{currentPage.CrawlId}
 	}
+	return
+}
+
+// ConvertPageToJsonTree function converts a Page and the pages linked beneath it into JsonPages, keeping each page's
+// ChildCount
+func ConvertPageToJsonTree(currentPage *Page) *JsonPage {
+	jsonPage := convertPageToJsonPage(currentPage)
+	jsonPage.ChildCount = currentPage.ChildCount
+	for _, childPage := range currentPage.Links {
+		jsonPage.Children = append(jsonPage.Children, ConvertPageToJsonTree(childPage))
+	}
+	return &jsonPage
 }
 
 // Converts SQSPage into a Page
 func convertSOSPageToPage(sqsPage *SQSPage) *Page {
 	return &Page{
-		Url:      sqsPage.Url,
-		Depth:    sqsPage.Depth,
-		StartUrl: sqsPage.StartUrl,
+		Url:       sqsPage.Url,
+		Depth:     sqsPage.Depth,
+		Timestamp: sqsPage.Timestamp,
+		StartUrl:  sqsPage.StartUrl,
+		Deadline:  sqsPage.Deadline,
+		Login:     sqsPage.Login,
+		Sink:      sqsPage.Sink,
+		CrawlId:   sqsPage.CrawlId,
 	}
 }
 
 // Converts a Page to a SQSPage
 func ConvertPageToSQSPage(currentPage *Page) *SQSPage {
 	return &SQSPage{
-		Url:      currentPage.Url,
-		Depth:    currentPage.Depth,
-		StartUrl: currentPage.StartUrl,
+		Url:       currentPage.Url,
+		Depth:     currentPage.Depth,
+		Timestamp: currentPage.Timestamp,
+		StartUrl:  currentPage.StartUrl,
+		Deadline:  currentPage.Deadline,
+		Login:     currentPage.Login,
+		Sink:      currentPage.Sink,
+		CrawlId:   currentPage.CrawlId,
 	}
 }
 
@@ -198,12 +1240,57 @@ func SerializeJsonPage(currentPage *Page) (pb []byte, err error) {
 	return
 }
 
-// Turns JSON dgraph result into a Page
+// Turns JSON dgraph result into a Page. A result without any pages returns a nil Page and no error; JSON which can't
+// be parsed returns a nil Page and the error. A result with several pages, as when racing writes stored duplicate
+// nodes for one URL, logs a warning with their uids and returns the page with the lowest uid, so every lookup settles
+// on the same node.
 func DeserializeJsonPage(pb []byte) (currentPage *Page, err error) {
 	var jsonPages JsonResult
 	err = json.Unmarshal(pb, &jsonPages)
-	if len(jsonPages.Result) > 0 {
-		currentPage = convertJsonPageToPage(nil, jsonPages.Result[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(jsonPages.Result) == 0 {
+		return
+	}
+	chosen := jsonPages.Result[0]
+	if len(jsonPages.Result) > 1 {
+		uids := make([]string, len(jsonPages.Result))
+		for i, jsonPage := range jsonPages.Result {
+			uids[i] = jsonPage.Uid
+			if UidLess(jsonPage.Uid, chosen.Uid) {
+				chosen = jsonPage
+			}
+		}
+		_ = level.Warn(logging.Logger).Log("context", "deserializing page", "url", chosen.Url, "uids", strings.Join(uids, ","), "msg", "several nodes found, using the lowest uid")
+	}
+	currentPage = convertJsonPageToPage(nil, chosen)
+	return
+}
+
+// UidLess function checks whether dgraph uid a comes before uid b, comparing them as the hex numbers they are. Uids
+// which don't parse come after those which do, in string order.
+func UidLess(a string, b string) bool {
+	aValue, aErr := strconv.ParseUint(a, 0, 64)
+	bValue, bErr := strconv.ParseUint(b, 0, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return aValue < bValue
+	case aErr == nil || bErr == nil:
+		return aErr == nil
+	}
+	return a < b
+}
+
+// Turns JSON dgraph result into a Page for each page in it, without their links
+func DeserializeJsonPages(pb []byte) (pages []*Page, err error) {
+	var jsonPages JsonResult
+	err = json.Unmarshal(pb, &jsonPages)
+	if err != nil {
+		return nil, err
+	}
+	for _, jsonPage := range jsonPages.Result {
+		pages = append(pages, convertJsonPageToPage(nil, jsonPage))
 	}
 	return
 }
@@ -225,14 +1312,25 @@ func DeserializeSQSPage(msg *sqs.Message) (currentPage *Page, err error) {
 	return
 }
 
-// Checks JSON dgraph edge result to see if edge exists
+// DeserializePredicate function checks a JSON dgraph edge result to see if the edge exists. The matching counts of every
+// edges entry are added up, so a result split across several entries isn't missed, and a result with no entries means
+// the edge doesn't exist.
 func DeserializePredicate(pb []byte) (exists bool, err error) {
 	var jsonPredicates JsonResult
 	err = json.Unmarshal(pb, &jsonPredicates)
-	if len(jsonPredicates.Edges) > 0 {
-		exists = jsonPredicates.Edges[0].Matching > 0
+	if err != nil {
+		return false, err
 	}
-	return
+	if len(jsonPredicates.Edges) == 0 {
+		return false, nil
+	}
+	matching := 0
+	for _, predicate := range jsonPredicates.Edges {
+		if predicate != nil {
+			matching += predicate.Matching
+		}
+	}
+	return matching > 0, nil
 }
 
 // Return max int in slice
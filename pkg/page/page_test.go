@@ -1,7 +1,11 @@
 package page_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/PuerkitoBio/goquery"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/stevenayers/clamber/pkg/config"
@@ -11,10 +15,15 @@ import (
 	"github.com/stevenayers/clamber/pkg/page"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 type (
@@ -33,11 +42,27 @@ type (
 		ExpectedUrl string
 	}
 
+	CleanPathTest struct {
+		Name        string
+		BaseUrl     string
+		Url         string
+		ExpectedUrl string
+	}
+
+	NormalizeUrlTest struct {
+		Name        string
+		Url         string
+		ExpectedUrl string
+	}
+
 	StoreSuite struct {
 		suite.Suite
 		store   relationship.Store
 		crawler crawl.Crawler
 	}
+
+	// dataHrefExtractor finds links in data-href attributes rather than anchors
+	dataHrefExtractor struct{}
 )
 
 func (s *StoreSuite) SetupSuite() {
@@ -82,6 +107,16 @@ func (s *StoreSuite) TearDownSuite() {
 	}
 }
 
+func (extractor dataHrefExtractor) Extract(doc *goquery.Document, base *url.URL) (links []string) {
+	doc.Find("[data-href]").Each(func(index int, item *goquery.Selection) {
+		href, _ := item.Attr("data-href")
+		if link, err := base.Parse(href); err == nil {
+			links = append(links, link.String())
+		}
+	})
+	return
+}
+
 func TestSuite(t *testing.T) {
 	s := new(StoreSuite)
 	suite.Run(t, s)
@@ -112,6 +147,75 @@ var ParseUrlTests = []ParseUrlTest{
 	{"test", "http://example.edu/test"},
 	{"test/", "http://example.edu/test"},
 	{"test#jg380gj39v", "http://example.edu/test"},
+	{"test?utm_campaign=launch&q=go", "http://example.edu/test?q=go"},
+}
+
+var CleanPathTests = []CleanPathTest{
+	{"collapse duplicate slashes", "http://example.edu", "/a//b", "http://example.edu/a/b"},
+	{"leading duplicate slashes", "http://example.edu", "//double//slash", "http://example.edu/double/slash"},
+	{"parent segment", "http://example.edu", "/a/../b", "http://example.edu/b"},
+	{"current segment", "http://example.edu", "/a/./b", "http://example.edu/a/b"},
+	{"encoded parent segment", "http://example.edu/docs/intro", "%2e%2e/x", "http://example.edu/x"},
+	{"uppercase encoded parent segment", "http://example.edu/docs/a/intro", "%2E%2E/x", "http://example.edu/docs/x"},
+	{"parent above root", "http://example.edu", "/../../a", "http://example.edu/a"},
+	{"root-relative href", "http://example.edu/docs/intro", "/already/absolute", "http://example.edu/already/absolute"},
+	{"relative href", "http://example.edu/docs/intro", "faq", "http://example.edu/docs/faq"},
+	{"keep query", "http://example.edu/docs/", "./a/../b?q=go", "http://example.edu/docs/b?q=go"},
+}
+
+var NormalizeUrlTests = []NormalizeUrlTest{
+	{"lowercase host", "https://EXAMPLE.edu/About", "https://example.edu/About"},
+	{"lowercase scheme", "HTTPS://example.edu", "https://example.edu"},
+	{"strip http default port", "http://example.edu:80/a", "http://example.edu/a"},
+	{"strip https default port", "https://example.edu:443/a", "https://example.edu/a"},
+	{"keep other ports", "http://example.edu:8080/a", "http://example.edu:8080/a"},
+	{"keep ipv6 host", "http://[::1]:80/a", "http://[::1]/a"},
+	{"strip utm params", "http://example.edu/a?utm_source=x&utm_medium=y", "http://example.edu/a"},
+	{"strip fbclid", "http://example.edu/a?id=1&fbclid=abc", "http://example.edu/a?id=1"},
+	{"sort params", "http://example.edu/a?b=2&a=1", "http://example.edu/a?a=1&b=2"},
+	{"keep path case", "http://example.edu/CaseSensitive", "http://example.edu/CaseSensitive"},
+	{"punycode unicode host", "http://MÜNCHEN.de/a", "http://xn--mnchen-3ya.de/a"},
+	{"keep punycode host", "http://XN--MNCHEN-3YA.de:8080/a", "http://xn--mnchen-3ya.de:8080/a"},
+}
+
+func (s *StoreSuite) TestNormalizeUrl() {
+	for _, test := range NormalizeUrlTests {
+		u, err := url.Parse(test.Url)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		page.NormalizeUrl(u)
+		assert.Equal(s.T(), test.ExpectedUrl, u.String(), test.Name)
+	}
+}
+
+func (s *StoreSuite) TestInternationalizedHosts() {
+	assert.Equal(s.T(), page.CanonicalUrl("https://xn--mnchen-3ya.de/a"), page.CanonicalUrl("https://münchen.de/a/"))
+	_, err := page.NormalizeHost("bad\ufffd.de")
+	assert.Equal(s.T(), true, err != nil, "a host with a disallowed character should be rejected")
+	u, _ := url.Parse("https://bad\ufffd.de/a")
+	assert.Equal(s.T(), true, page.NormalizeUrl(u) != nil)
+	assert.Equal(s.T(), "bad\ufffd.de", u.Host, "a host which can't be converted should be left as it is")
+
+	req, _ := http.NewRequest("GET", "https://münchen.de", nil)
+	body := `<html><body><a href="/about">about</a><script type="application/ld+json">
+		{"sameAs": ["https://münchen.de/a", "https://xn--mnchen-3ya.de/a", "https://bad\ufffd.de/b"]}
+	</script></body></html>`
+	p := page.Page{Url: "https://münchen.de"}
+	extractor := page.LinkExtractors{page.AnchorLinkExtractor{}, page.JsonLdLinkExtractor{}}
+	childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, nil, extractor)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var childUrls []string
+	for _, childPage := range childPages {
+		childUrls = append(childUrls, childPage.Url)
+	}
+	assert.Equal(s.T(), []string{"https://xn--mnchen-3ya.de/about", "https://xn--mnchen-3ya.de/a"}, childUrls,
+		"both forms of the host should be one page, and invalid hosts skipped")
+
+	_, err = (&page.Page{Url: "https://bad\ufffd.de"}).ParseRelativeUrl("/a")
+	assert.Equal(s.T(), true, err != nil, "links on a page with an invalid host should be skipped")
 }
 
 func (s *StoreSuite) TestFetchUrlsHttpError() {
@@ -132,14 +236,14 @@ func (s *StoreSuite) TestFetchUrlsHttpError() {
 func (s *StoreSuite) TestParseHtml() {
 	testUrl := "https://golang.org"
 	p := page.Page{Url: testUrl}
-	_, err := p.FetchChildPages(nil)
+	_, err := p.FetchChildPages(nil, 0, nil, nil)
 	assert.Equal(s.T(), true, err != nil, "nil")
 	p = page.Page{Url: testUrl}
 	resp, err := http.Get(testUrl)
 	if err != nil {
 		s.T().Fatal(err)
 	}
-	_, err = p.FetchChildPages(resp)
+	_, err = p.FetchChildPages(resp, 0, nil, nil)
 	assert.Equal(s.T(), false, err != nil, testUrl)
 
 }
@@ -163,6 +267,90 @@ func (s *StoreSuite) TestParseRelativeUrl() {
 	}
 }
 
+func (s *StoreSuite) TestParseRelativeUrlCleanPath() {
+	for _, test := range CleanPathTests {
+		p := &page.Page{Url: test.BaseUrl}
+		absoluteUrl, err := p.ParseRelativeUrl(test.Url)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), test.ExpectedUrl, absoluteUrl.String(), test.Name)
+	}
+	config.Update(func(c *config.Config) {
+		c.Url.KeepDuplicateSlashes = true
+	})
+	defer config.Update(func(c *config.Config) {
+		c.Url.KeepDuplicateSlashes = false
+	})
+	p := &page.Page{Url: "http://example.edu"}
+	absoluteUrl, err := p.ParseRelativeUrl("/a//b/../c")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "http://example.edu/a//c", absoluteUrl.String())
+	_, err = p.ParseRelativeUrl("mailto:gopher@example.edu")
+	assert.Equal(s.T(), true, err != nil, "hrefs with a scheme should not be resolved on the page's host")
+}
+
+func (s *StoreSuite) TestTrailingSlash() {
+	tests := []struct {
+		policy   string
+		expected map[string]string
+	}{
+		{page.TrailingSlashStrip, map[string]string{
+			"http://example.edu":          "http://example.edu",
+			"http://example.edu/":         "http://example.edu",
+			"http://example.edu/docs/":    "http://example.edu/docs",
+			"http://example.edu/docs":     "http://example.edu/docs",
+			"http://example.edu/a.html/":  "http://example.edu/a.html",
+			"http://example.edu/?q=go":    "http://example.edu?q=go",
+			"http://example.edu/docs/#go": "http://example.edu/docs",
+		}},
+		{page.TrailingSlashKeep, map[string]string{
+			"http://example.edu":          "http://example.edu/",
+			"http://example.edu/":         "http://example.edu/",
+			"http://example.edu/docs/":    "http://example.edu/docs/",
+			"http://example.edu/docs":     "http://example.edu/docs",
+			"http://example.edu/a.html":   "http://example.edu/a.html",
+			"http://example.edu?q=go":     "http://example.edu/?q=go",
+			"http://example.edu/docs/#go": "http://example.edu/docs/",
+		}},
+		{page.TrailingSlashKeepRoot, map[string]string{
+			"http://example.edu":          "http://example.edu/",
+			"http://example.edu/":         "http://example.edu/",
+			"http://example.edu/docs/":    "http://example.edu/docs",
+			"http://example.edu/docs":     "http://example.edu/docs",
+			"http://example.edu/a.html/":  "http://example.edu/a.html",
+			"http://example.edu?q=go":     "http://example.edu/?q=go",
+			"http://example.edu/docs/#go": "http://example.edu/docs",
+		}},
+	}
+	defer config.Update(func(c *config.Config) {
+		c.Url.TrailingSlash = ""
+	})
+	for _, test := range tests {
+		config.Update(func(c *config.Config) {
+			c.Url.TrailingSlash = test.policy
+		})
+		for Url, expected := range test.expected {
+			assert.Equal(s.T(), expected, page.CanonicalUrl(Url), "%s with %s", Url, test.policy)
+		}
+		p := &page.Page{Url: page.CanonicalUrl("http://example.edu/docs/")}
+		childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(
+			`<a href="/">root</a><a href="/docs/intro/">intro</a><a href="/a.html">a</a>`))}, 0, nil, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		var childUrls []string
+		for _, childPage := range childPages {
+			childUrls = append(childUrls, childPage.Url)
+			assert.Equal(s.T(), page.CanonicalUrl(childPage.Url), childPage.Url, "links should be stored canonically with %s", test.policy)
+		}
+		assert.Contains(s.T(), childUrls, page.CanonicalUrl("http://example.edu/"), test.policy)
+		assert.Contains(s.T(), childUrls, page.CanonicalUrl("http://example.edu/docs/intro/"), test.policy)
+	}
+}
+
 func (s *StoreSuite) TestParseRelativeRootError() {
 	rootUrl := "£$@£%"
 	for _, test := range ParseUrlTests {
@@ -179,3 +367,743 @@ func (s *StoreSuite) TestParseRelativeError() {
 	assert.Equal(s.T(), true, err != nil)
 
 }
+
+func (s *StoreSuite) TestFailedPages() {
+	rootPage := &page.Page{Url: "http://example.edu", StatusCode: http.StatusOK}
+	missingPage := &page.Page{Url: "http://example.edu/missing", StatusCode: http.StatusNotFound, Parent: rootPage}
+	brokenPage := &page.Page{Url: "http://example.edu/broken", StatusCode: http.StatusInternalServerError, Parent: rootPage}
+	okPage := &page.Page{Url: "http://example.edu/about", StatusCode: http.StatusOK, Parent: rootPage}
+	okPage.Links = []*page.Page{{Url: missingPage.Url, StatusCode: http.StatusNotFound, Parent: okPage}}
+	rootPage.Links = []*page.Page{missingPage, brokenPage, okPage}
+	failedPages := rootPage.FailedPages(10)
+	assert.Equal(s.T(), 2, len(failedPages), "failed pages should be unique")
+	assert.Equal(s.T(), missingPage.Url, failedPages[0].Url)
+	assert.Equal(s.T(), brokenPage.Url, failedPages[1].Url)
+	assert.Equal(s.T(), 1, len(rootPage.FailedPages(1)), "failed pages should be capped")
+}
+
+func (s *StoreSuite) TestAdjacencyList() {
+	// a -> b -> d and a -> c -> d, so d appears in both branches of the tree
+	rootPage := &page.Page{Url: "http://example.edu/a"}
+	leftPage := &page.Page{Url: "http://example.edu/b", Parent: rootPage}
+	rightPage := &page.Page{Url: "http://example.edu/c", Parent: rootPage}
+	leftPage.Links = []*page.Page{{Url: "http://example.edu/d", Parent: leftPage}}
+	rightPage.Links = []*page.Page{{Url: "http://example.edu/d", Parent: rightPage}}
+	rootPage.Links = []*page.Page{leftPage, rightPage}
+	adjacencyList := rootPage.AdjacencyList()
+
+	var nodeUrls []string
+	for _, node := range adjacencyList.Nodes {
+		nodeUrls = append(nodeUrls, node.Url)
+		assert.Equal(s.T(), 0, len(node.Links), "nodes should not be nested")
+	}
+	assert.Equal(s.T(), []string{
+		"http://example.edu/a",
+		"http://example.edu/b",
+		"http://example.edu/d",
+		"http://example.edu/c",
+	}, nodeUrls)
+
+	expectedEdges := []page.Edge{
+		{From: "http://example.edu/a", To: "http://example.edu/b"},
+		{From: "http://example.edu/b", To: "http://example.edu/d"},
+		{From: "http://example.edu/a", To: "http://example.edu/c"},
+		{From: "http://example.edu/c", To: "http://example.edu/d"},
+	}
+	assert.Equal(s.T(), len(expectedEdges), len(adjacencyList.Edges))
+	for _, edge := range expectedEdges {
+		assert.Contains(s.T(), adjacencyList.Edges, &page.Edge{From: edge.From, To: edge.To})
+	}
+}
+
+func (s *StoreSuite) TestFetchChildPagesMaxLinks() {
+	body := "<html><body>"
+	for i := 0; i < 10; i++ {
+		body += fmt.Sprintf(`<a href="/page/%d">page %d</a>`, i, i)
+	}
+	body += "</body></html>"
+	newResponse := func() *http.Response {
+		req, _ := http.NewRequest("GET", "http://example.edu", nil)
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}
+	}
+
+	p := page.Page{Url: "http://example.edu"}
+	childPages, err := p.FetchChildPages(newResponse(), 3, nil, nil)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 3, len(childPages))
+	assert.Equal(s.T(), "http://example.edu/page/0", childPages[0].Url)
+	assert.Equal(s.T(), "http://example.edu/page/2", childPages[2].Url)
+	assert.Equal(s.T(), true, p.Truncated)
+
+	p = page.Page{Url: "http://example.edu"}
+	childPages, err = p.FetchChildPages(newResponse(), 0, nil, nil)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 10, len(childPages))
+	assert.Equal(s.T(), false, p.Truncated)
+}
+
+func (s *StoreSuite) TestFetchChildPagesExclude() {
+	body := `<html><body>
+		<a href="/doc">doc</a>
+		<a href="/logout">logout</a>
+		<a href="/admin/users">users</a>
+		<a href="/pkg">pkg</a>
+		<a href="/blog">blog</a>
+	</body></html>`
+	req, _ := http.NewRequest("GET", "http://example.edu", nil)
+	p := page.Page{Url: "http://example.edu"}
+	scope := &page.LinkScope{Exclude: []*regexp.Regexp{regexp.MustCompile(`/logout$`), regexp.MustCompile(`/admin(/|$)`)}}
+	childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 2, scope, nil)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var urls []string
+	for _, childPage := range childPages {
+		urls = append(urls, childPage.Url)
+	}
+	assert.Equal(s.T(), []string{"http://example.edu/doc", "http://example.edu/pkg"}, urls, "excluded links should not count towards maxLinks")
+}
+
+func (s *StoreSuite) TestSkippedLinksLogged() {
+	body := `<html><body>
+		<a href="/doc">doc</a>
+		<a name="top">top</a>
+		<a href="">empty</a>
+		<a href="https://golang.org/pkg">external</a>
+		<a href="/report.pdf">report</a>
+		<a href="/logout">logout</a>
+		<a href="/">home</a>
+	</body></html>`
+	scope := &page.LinkScope{Exclude: []*regexp.Regexp{regexp.MustCompile(`/logout$`)}}
+	fetchChildPages := func(logLevel string) (reasons map[string]string, childPages []*page.Page) {
+		var buf bytes.Buffer
+		logging.InitJsonLogger(log.NewSyncWriter(&buf), logLevel, "test")
+		defer logging.InitJsonLogger(log.NewSyncWriter(os.Stdout), config.AppConfig.Service.LogLevel, "test")
+		req, _ := http.NewRequest("GET", "http://example.edu", nil)
+		p := page.Page{Url: "http://example.edu"}
+		childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, scope, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		reasons = make(map[string]string)
+		decoder := json.NewDecoder(&buf)
+		for decoder.More() {
+			var line map[string]interface{}
+			if err := decoder.Decode(&line); err != nil {
+				s.T().Fatal(err)
+			}
+			if line["context"] == "skipping link" {
+				assert.Equal(s.T(), "debug", line["level"])
+				reasons[fmt.Sprint(line["reason"])] = fmt.Sprint(line["href"])
+			}
+		}
+		return
+	}
+
+	reasons, childPages := fetchChildPages("debug")
+	assert.Equal(s.T(), map[string]string{
+		"missing href":         "",
+		"empty href":           "",
+		"not a relative URL":   "https://golang.org/pkg",
+		"not an HTML page":     "/report.pdf",
+		"excluded by patterns": "http://example.edu/logout",
+		"link to itself":       "http://example.edu",
+	}, reasons, "each skipped anchor should be logged with the reason it was skipped")
+	assert.Equal(s.T(), 1, len(childPages))
+
+	reasons, childPages = fetchChildPages("info")
+	assert.Equal(s.T(), 0, len(reasons), "skipped links should only be logged at debug level")
+	assert.Equal(s.T(), 1, len(childPages))
+}
+
+func (s *StoreSuite) TestFetchChildPagesSoft404() {
+	scope := &page.LinkScope{
+		Soft404Title: []*regexp.Regexp{regexp.MustCompile(`(?i)^(page )?not found`)},
+		Soft404Body:  []*regexp.Regexp{regexp.MustCompile(`(?i)the page you requested (does not|doesn't) exist`)},
+	}
+	for body, soft404 := range map[string]bool{
+		`<html><head><title>Not Found | Go</title></head><body><a href="/doc">doc</a></body></html>`: true,
+		`<html><head><title>Go</title></head><body><p>Sorry, the page you
+			requested does not exist.</p><a href="/doc">doc</a></body></html>`: true,
+		`<html><head><title>Go</title></head><body><p>Pages which are not found return 404.</p><a href="/doc">doc</a></body></html>`: false,
+	} {
+		req, _ := http.NewRequest("GET", "https://golang.org/missing", nil)
+		p := page.Page{Url: "https://golang.org/missing"}
+		childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, scope, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), soft404, p.Soft404, body)
+		if soft404 {
+			assert.Equal(s.T(), 0, len(childPages), "the links of a soft 404 should not be followed")
+		} else {
+			assert.Equal(s.T(), 1, len(childPages), body)
+		}
+	}
+}
+
+func (s *StoreSuite) TestFetchChildPagesExtractor() {
+	body := `<html><body>
+		<a href="/doc">doc</a>
+		<div data-href="/blog"></div>
+		<button data-href="https://golang.org/pkg#top"></button>
+	</body></html>`
+	req, _ := http.NewRequest("GET", "https://golang.org", nil)
+	p := page.Page{Url: "https://golang.org"}
+	childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, nil, dataHrefExtractor{})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var urls []string
+	for _, childPage := range childPages {
+		urls = append(urls, childPage.Url)
+	}
+	assert.Equal(s.T(), []string{"https://golang.org/blog", "https://golang.org/pkg"}, urls)
+}
+
+func (s *StoreSuite) TestFetchChildPagesSelfLinks() {
+	body := `<html><body>
+		<a href="#frag">frag</a>
+		<a href="./">here</a>
+		<a href="">empty</a>
+		<a href="/doc/#top">top</a>
+		<a href="/doc/faq">faq</a>
+	</body></html>`
+	for _, test := range []struct {
+		scope    *page.LinkScope
+		expected []string
+	}{
+		{nil, []string{"https://golang.org/doc/faq"}},
+		{&page.LinkScope{}, []string{"https://golang.org/doc/faq"}},
+		{&page.LinkScope{FollowSelf: true}, []string{"https://golang.org/doc", "https://golang.org/doc/faq"}},
+	} {
+		req, _ := http.NewRequest("GET", "https://golang.org/doc/", nil)
+		p := page.Page{Url: "https://golang.org/doc/"}
+		childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, test.scope, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		var urls []string
+		for _, childPage := range childPages {
+			urls = append(urls, childPage.Url)
+		}
+		assert.Equal(s.T(), test.expected, urls, "%+v", test.scope)
+	}
+}
+
+func (s *StoreSuite) TestFetchChildPagesParseMode() {
+	body := `<html><head><title>Docs</title></head><body>
+		<div class="a" class="b"><b><i>bold italic</b></i>
+		<p>first<li>item
+		</span>
+		<span/>
+		<svg><path d="M0 0"/></svg>
+		<a href="/doc/faq">faq</a>
+		<img src="gopher.png"><br>
+	</body></html>`
+	for _, mode := range []string{page.ParseLenient, page.ParseStrict} {
+		req, _ := http.NewRequest("GET", "https://golang.org/doc/", nil)
+		p := page.Page{Url: "https://golang.org/doc/"}
+		childPages, err := p.FetchChildPagesWithin(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, 0, 0, nil, nil, mode)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), 1, len(childPages), "malformed markup should be parsed the same way in %s mode", mode)
+		assert.Equal(s.T(), "Docs", p.Title)
+		if mode == page.ParseLenient {
+			assert.Equal(s.T(), 0, len(p.ParseWarnings), "lenient mode should not report warnings")
+			continue
+		}
+		assert.Equal(s.T(), []string{
+			"line 2: <div> repeats the class attribute",
+			"line 2: </b> closes <i>, which is still open",
+			"line 2: </i> has no open <i> to close",
+			"line 4: </span> has no open <span> to close",
+			"line 5: <span/> is not a void element, so it is left open",
+			"line 9: </body> closes <span>, which is still open",
+			"line 9: </body> closes <div>, which is still open",
+		}, p.ParseWarnings)
+	}
+}
+
+func (s *StoreSuite) TestFetchChildPagesRobots() {
+	for _, test := range []struct {
+		meta     string
+		header   []string
+		noIndex  bool
+		noFollow bool
+	}{
+		{"", nil, false, false},
+		{`<meta name="robots" content="noindex,nofollow">`, nil, true, true},
+		{`<meta name="Robots" content=" NOFOLLOW ">`, nil, false, true},
+		{`<meta name="robots" content="none">`, nil, true, true},
+		{`<meta name="googlebot" content="noindex">`, nil, false, false},
+		{"", []string{"noindex"}, true, false},
+		{"", []string{"googlebot: nofollow", "unavailable_after: 25 Jun 2010 15:00:00 PST, nofollow"}, false, true},
+		{`<meta name="robots" content="noindex">`, []string{"nofollow"}, true, true},
+	} {
+		body := `<html><head>` + test.meta + `</head><body><a href="/doc/faq">faq</a></body></html>`
+		req, _ := http.NewRequest("GET", "https://golang.org/doc/", nil)
+		resp := &http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Header: http.Header{"X-Robots-Tag": test.header}, Request: req}
+		p := page.Page{Url: "https://golang.org/doc/"}
+		childPages, err := p.FetchChildPages(resp, 0, nil, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), 1, len(childPages), "links should be returned whatever the directives say")
+		assert.Equal(s.T(), test.noIndex, p.NoIndex, "%s %v", test.meta, test.header)
+		assert.Equal(s.T(), test.noFollow, p.NoFollow, "%s %v", test.meta, test.header)
+	}
+}
+
+func (s *StoreSuite) TestFetchChildPagesJsonLd() {
+	body := `<html><head>
+		<script type="application/ld+json">
+		{
+			"@context": "https://schema.org",
+			"@id": "https://golang.org/#organization",
+			"url": "https://golang.org/about",
+			"sameAs": ["https://twitter.com/golang", "/community"],
+			"hasPart": [{"@type": "WebPage", "url": "https://golang.org/doc"}, {"name": "logo", "url": "/logo.png"}]
+		}
+		</script>
+		<script type="application/ld+json">{"url": "https://golang.org/broken",</script>
+		<script type="application/json">{"url": "https://golang.org/ignored"}</script>
+	</head><body><a href="/doc">doc</a><a href="/pkg">pkg</a></body></html>`
+	req, _ := http.NewRequest("GET", "https://golang.org", nil)
+	p := page.Page{Url: "https://golang.org"}
+	extractor := page.LinkExtractors{page.AnchorLinkExtractor{}, page.JsonLdLinkExtractor{}}
+	childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, nil, extractor)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var urls []string
+	for _, childPage := range childPages {
+		urls = append(urls, childPage.Url)
+	}
+	assert.Equal(s.T(), []string{
+		"https://golang.org/doc",
+		"https://golang.org/pkg",
+		"https://golang.org/community",
+		"https://golang.org/about",
+	}, urls, "JSON-LD links should be found after anchors, skipping other hosts, files, malformed blocks and the page itself")
+}
+
+func (s *StoreSuite) TestLinkScope() {
+	blog := regexp.MustCompile(`/blog/.*`)
+	drafts := regexp.MustCompile(`/blog/drafts/`)
+	urls := []string{"https://golang.org/doc", "https://golang.org/blog/go1.13", "https://golang.org/blog/drafts/go2"}
+	for _, test := range []struct {
+		name     string
+		scope    *page.LinkScope
+		expected []bool
+	}{
+		{"no scope", nil, []bool{true, true, true}},
+		{"empty include", &page.LinkScope{}, []bool{true, true, true}},
+		{"include only", &page.LinkScope{Include: []*regexp.Regexp{blog}}, []bool{false, true, true}},
+		{"include and exclude", &page.LinkScope{Include: []*regexp.Regexp{blog}, Exclude: []*regexp.Regexp{drafts}}, []bool{false, true, false}},
+	} {
+		for i, Url := range urls {
+			assert.Equal(s.T(), test.expected[i], test.scope.Allows(Url), test.name+" "+Url)
+		}
+	}
+}
+
+func (s *StoreSuite) TestFetchChildPagesWithin() {
+	req, _ := http.NewRequest("GET", "https://golang.org", nil)
+	huge := strings.Repeat(`<div><table><a href="/doc">doc</a>`, 200000)
+	p := page.Page{Url: "https://golang.org"}
+	childPages, err := p.FetchChildPagesWithin(&http.Response{Body: ioutil.NopCloser(strings.NewReader(huge)), Request: req}, 0, time.Millisecond, 0, nil, nil, page.ParseLenient)
+	assert.Equal(s.T(), page.ErrParseTimeout, err)
+	assert.Equal(s.T(), 0, len(childPages))
+
+	body := `<html><head><title>Go</title></head><body><a href="/doc">doc</a></body></html>`
+	p = page.Page{Url: "https://golang.org"}
+	childPages, err = p.FetchChildPagesWithin(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, 10*time.Second, 0, nil, nil, page.ParseLenient)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "Go", p.Title)
+	if assert.Equal(s.T(), 1, len(childPages)) {
+		assert.Equal(s.T(), "https://golang.org/doc", childPages[0].Url)
+	}
+}
+
+func (s *StoreSuite) TestFetchChildPagesBinary() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write(append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), `<a href="/doc">doc</a><title>Go</title>`...))
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	p := page.Page{Url: server.URL}
+	childPages, err := p.FetchChildPages(resp, 0, nil, nil)
+	assert.Equal(s.T(), page.ErrNotHtml, err)
+	assert.Equal(s.T(), 0, len(childPages), "no links should be extracted from a binary body")
+	assert.Equal(s.T(), "", p.Title)
+
+	assert.Equal(s.T(), true, page.IsText([]byte("<html><body>caf\xe9</body></html>")), "latin-1 HTML should still be parsed")
+	assert.Equal(s.T(), true, page.IsText(nil))
+}
+
+func (s *StoreSuite) TestFetchChildPagesUnfetched() {
+	req, _ := http.NewRequest("GET", "https://golang.org", nil)
+	body := `<html><head><title>Go</title></head><body><a href="/doc">doc</a><a href="/pkg">pkg</a></body></html>`
+	p := page.Page{Url: "https://golang.org", StartUrl: "https://golang.org", StatusCode: http.StatusOK, ETag: `"v1"`, LastModified: "Tue, 05 Nov 2019 12:00:00 GMT"}
+	childPages, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, nil, nil)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "Go", p.Title)
+	assert.Equal(s.T(), 2, len(childPages))
+	for _, childPage := range childPages {
+		fetched := page.Page{Title: childPage.Title, StatusCode: childPage.StatusCode, ETag: childPage.ETag, LastModified: childPage.LastModified, Links: childPage.Links}
+		assert.Equal(s.T(), page.Page{}, fetched, "a child should carry nothing fetched from its parent: "+childPage.Url)
+		assert.Equal(s.T(), &p, childPage.Parent)
+		assert.Equal(s.T(), p.StartUrl, childPage.StartUrl)
+	}
+}
+
+func (s *StoreSuite) TestReadBody() {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	start := time.Now()
+	_, err = page.ReadBody(req.Context(), resp.Body, 0)
+	assert.Equal(s.T(), page.ErrReadTimeout, err, "the read should stop at the request's deadline")
+	assert.Equal(s.T(), true, time.Since(start) < 5*time.Second)
+
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	start = time.Now()
+	p := page.Page{Url: server.URL}
+	childPages, err := p.FetchChildPagesWithin(resp, 100*time.Millisecond, 0, 0, nil, nil, page.ParseLenient)
+	assert.Equal(s.T(), page.ErrReadTimeout, err, "the read should stop after maxReadTime")
+	assert.Equal(s.T(), 0, len(childPages))
+	assert.Equal(s.T(), true, time.Since(start) < 5*time.Second)
+}
+
+func (s *StoreSuite) TestStreamChildPages() {
+	body := `<html><head>
+		<title>
+		  The Go &amp; Programming Language </title>
+		<meta name="Robots" content="nofollow">
+		<script>document.write('<a href="/scripted">scripted</a>')</script>
+		</head><body>
+		<a href="/doc/">doc</a>
+		<a href="/doc/#install">install</a>
+		<a href="/pkg/?q=a&amp;b=c">pkg</a>
+		<a href="https://golang.org/blog">absolute</a>
+		<a href="/logo.png">logo</a>
+		<a>no href</a>
+		<A HREF="/help" href="/ignored">help</A>
+		<noscript><a href="/noscript">noscript</a></noscript>
+		<textarea><a href="/textarea">textarea</a></textarea>
+		<p><a href="../talks/">talks</a><a href="/project">project
+	</body></html>`
+	newResponse := func() *http.Response {
+		req, _ := http.NewRequest("GET", "https://golang.org/doc/", nil)
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}
+	}
+	urls := func(childPages []*page.Page) (urls []string) {
+		for _, childPage := range childPages {
+			urls = append(urls, childPage.Url)
+		}
+		return
+	}
+	for _, maxLinks := range []int{0, 2} {
+		parsed := page.Page{Url: "https://golang.org/doc/"}
+		parsedPages, err := parsed.FetchChildPages(newResponse(), maxLinks, nil, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		streamed := page.Page{Url: "https://golang.org/doc/"}
+		streamedPages, err := streamed.StreamChildPages(newResponse(), 0, maxLinks, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), urls(parsedPages), urls(streamedPages), "both paths should find the same links")
+		assert.Equal(s.T(), parsed.Truncated, streamed.Truncated)
+		assert.Equal(s.T(), parsed.Title, streamed.Title)
+		assert.Equal(s.T(), parsed.NoFollow, streamed.NoFollow)
+		for _, childPage := range streamedPages {
+			assert.Equal(s.T(), &streamed, childPage.Parent)
+		}
+	}
+	streamed := page.Page{Url: "https://golang.org/doc/"}
+	childPages, _ := streamed.StreamChildPages(newResponse(), 0, 0, nil)
+	assert.Equal(s.T(), []string{"https://golang.org/pkg?b=c&q=a", "https://golang.org/help", "https://golang.org/talks", "https://golang.org/project"}, urls(childPages))
+	assert.Equal(s.T(), "The Go & Programming Language", streamed.Title)
+	assert.Equal(s.T(), true, streamed.NoFollow)
+
+	base, _ := url.Parse("https://golang.org/doc/")
+	links, err := page.StreamLinks(strings.NewReader(body), base)
+	assert.Equal(s.T(), nil, err)
+	doc, _ := goquery.NewDocumentFromReader(strings.NewReader(body))
+	assert.Equal(s.T(), page.AnchorLinkExtractor{}.Extract(doc, base), links, "StreamLinks should find what AnchorLinkExtractor finds")
+
+	req, _ := http.NewRequest("GET", "https://golang.org/logo.png", nil)
+	binary := &http.Response{Body: ioutil.NopCloser(strings.NewReader("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")), Request: req}
+	p := page.Page{Url: "https://golang.org/logo.png"}
+	childPages, err = p.StreamChildPages(binary, 0, 0, nil)
+	assert.Equal(s.T(), page.ErrNotHtml, err)
+	assert.Equal(s.T(), 0, len(childPages))
+}
+
+func (s *StoreSuite) TestWriteDot() {
+	shared := &page.Page{Url: `https://golang.org/say"hi"\`}
+	root := &page.Page{Url: "https://golang.org", Links: []*page.Page{
+		{Url: "https://golang.org/doc", Links: []*page.Page{shared}},
+		{Url: "https://golang.org/pkg", Links: []*page.Page{shared}},
+	}}
+	var dot strings.Builder
+	err := root.WriteDot(&dot)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), `digraph clamber {
+  n0 [label="https://golang.org"];
+  n1 [label="https://golang.org/doc"];
+  n2 [label="https://golang.org/say\"hi\"\\"];
+  n3 [label="https://golang.org/pkg"];
+  n0 -> n1;
+  n1 -> n2;
+  n0 -> n3;
+  n3 -> n2;
+}
+`, dot.String(), "pages reached through several branches should only be written once")
+}
+
+func (s *StoreSuite) TestFetchChildPagesTitle() {
+	for body, expectedTitle := range map[string]string{
+		"<html><head><title>\n  The Go\n Programming Language  </title></head></html>": "The Go Programming Language",
+		"<html><head><title></title></head></html>":                                    "",
+		"<html><body><a href=\"/doc\">doc</a></body></html>":                           "",
+	} {
+		req, _ := http.NewRequest("GET", "https://golang.org", nil)
+		p := page.Page{Url: "https://golang.org"}
+		_, err := p.FetchChildPages(&http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, 0, nil, nil)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), expectedTitle, p.Title, body)
+	}
+
+	p := page.Page{Url: "https://golang.org", Title: "The Go Programming Language"}
+	pb, err := page.SerializeJsonPage(&p)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	result, err := page.DeserializeJsonPage([]byte(fmt.Sprintf(`{"result": [%s]}`, pb)))
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), p.Title, result.Title)
+}
+
+func (s *StoreSuite) TestDeserializeJsonPageMalformed() {
+	for _, pb := range []string{`{"result": [{"url": "https://golang.org"`, `not json`, `{"result": "https://golang.org"}`} {
+		p, err := page.DeserializeJsonPage([]byte(pb))
+		assert.Equal(s.T(), true, err != nil, pb)
+		assert.Equal(s.T(), true, p == nil, pb)
+	}
+}
+
+func (s *StoreSuite) TestDeserializePredicate() {
+	for pb, expected := range map[string]bool{
+		`{}`:                           false,
+		`{"edges": []}`:                false,
+		`{"edges": [{"matching": 0}]}`: false,
+		`{"edges": [{"matching": 1}]}`: true,
+		`{"edges": [{"matching": 0}, {"matching": 0}]}`:       false,
+		`{"edges": [{"matching": 0}, {"matching": 2}]}`:       true,
+		`{"edges": [null, {"matching": 1}, {"matching": 0}]}`: true,
+	} {
+		exists, err := page.DeserializePredicate([]byte(pb))
+		assert.Equal(s.T(), nil, err, pb)
+		assert.Equal(s.T(), expected, exists, pb)
+	}
+}
+
+func (s *StoreSuite) TestSerializers() {
+	root := &page.Page{Uid: "0x1", Url: "https://golang.org", Timestamp: 1575205020, StatusCode: 200, ChildCount: 2, Title: "The Go Programming Language", ETag: `"abc"`}
+	doc := &page.Page{Uid: "0x2", Url: "https://golang.org/doc", Parent: root, Timestamp: 1575205021, StatusCode: 200, Truncated: true}
+	missing := &page.Page{Uid: "0x3", Url: "https://golang.org/missing", Parent: root, StatusCode: 404, Error: "http: received HTTP status 404 Not Found"}
+	faq := &page.Page{Uid: "0x4", Url: "https://golang.org/doc/faq", Parent: doc, LastModified: "Sun, 01 Dec 2019 13:00:00 GMT"}
+	root.Links = []*page.Page{doc, missing}
+	doc.Links = []*page.Page{faq}
+
+	sizes := make(map[string]int)
+	for _, name := range []string{"", page.SerializerJson, page.SerializerGob} {
+		serializer, err := page.NewSerializer(name)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		data, err := page.SerializePage(serializer, root)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		sizes[serializer.Name()] = len(data)
+		result, err := page.DeserializePage(serializer, data)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.ElementsMatch(s.T(), root.AdjacencyList().Edges, result.AdjacencyList().Edges, "%s should keep every link", serializer.Name())
+		pages := map[string]*page.Page{result.Url: result}
+		for _, link := range result.Links {
+			pages[link.Url] = link
+			assert.Equal(s.T(), result, link.Parent)
+			for _, grandchild := range link.Links {
+				pages[grandchild.Url] = grandchild
+				assert.Equal(s.T(), link, grandchild.Parent)
+			}
+		}
+		for _, expected := range []*page.Page{root, doc, missing, faq} {
+			actual, isPresent := pages[expected.Url]
+			if !assert.Equal(s.T(), true, isPresent, expected.Url) {
+				continue
+			}
+			assert.Equal(s.T(), expected.Uid, actual.Uid)
+			assert.Equal(s.T(), expected.Timestamp, actual.Timestamp)
+			assert.Equal(s.T(), expected.StatusCode, actual.StatusCode)
+			assert.Equal(s.T(), expected.ChildCount, actual.ChildCount)
+			assert.Equal(s.T(), expected.Title, actual.Title)
+			assert.Equal(s.T(), expected.Error, actual.Error)
+			assert.Equal(s.T(), expected.ETag, actual.ETag)
+			assert.Equal(s.T(), expected.LastModified, actual.LastModified)
+			assert.Equal(s.T(), expected.Truncated, actual.Truncated)
+		}
+		_, err = page.DeserializePage(serializer, data[:len(data)/2])
+		assert.Equal(s.T(), true, err != nil, "%s should reject truncated data", serializer.Name())
+	}
+	assert.Equal(s.T(), true, sizes[page.SerializerGob] < sizes[page.SerializerJson], "gob should be more compact than JSON: %v", sizes)
+
+	_, err := page.SerializePage(page.GobSerializer{}, nil)
+	assert.Equal(s.T(), page.ErrNilPage, err)
+	_, err = page.NewSerializer("msgpack")
+	assert.Equal(s.T(), true, err != nil)
+}
+
+func (s *StoreSuite) TestDiffLinks() {
+	link := func(from string, to string, linkedAt int64, unlinkedAt int64) page.LinkHistory {
+		return page.LinkHistory{Edge: page.Edge{From: "https://golang.org" + from, To: "https://golang.org" + to}, LinkedAt: linkedAt, UnlinkedAt: unlinkedAt}
+	}
+	history := []page.LinkHistory{
+		link("", "/doc", 0, 0),
+		// pruned after since, then linked again
+		link("", "/pkg", 10, 30),
+		link("", "/pkg", 40, 0),
+		// pruned after since
+		link("", "/blog", 10, 25),
+		link("/blog", "/blog/post", 10, 0),
+		// linked after since
+		link("/doc", "/doc/faq", 30, 0),
+		// beneath depth
+		link("/doc/faq", "/doc/faq/more", 30, 0),
+		// pruned before since
+		link("", "/old", 5, 10),
+	}
+	diff := page.DiffLinks("https://golang.org", 2, history, 20)
+	assert.Equal(s.T(), []string{"https://golang.org/doc/faq"}, diff.AddedNodes)
+	assert.Equal(s.T(), []string{"https://golang.org/blog", "https://golang.org/blog/post"}, diff.RemovedNodes)
+	assert.Equal(s.T(), []*page.Edge{{From: "https://golang.org/doc", To: "https://golang.org/doc/faq"}}, diff.AddedEdges)
+	assert.Equal(s.T(), []*page.Edge{
+		{From: "https://golang.org", To: "https://golang.org/blog"},
+		{From: "https://golang.org/blog", To: "https://golang.org/blog/post"},
+	}, diff.RemovedEdges)
+
+	diff = page.DiffLinks("https://golang.org", 2, history, 50)
+	assert.Equal(s.T(), &page.GraphDiff{AddedNodes: []string{}, RemovedNodes: []string{}, AddedEdges: []*page.Edge{}, RemovedEdges: []*page.Edge{}}, diff)
+}
+
+func (s *StoreSuite) TestDeserializeJsonPageDuplicates() {
+	for _, pb := range []string{
+		`{"result": [{"uid": "0x1a", "url": "https://golang.org", "title": "second"}, {"uid": "0x9", "url": "https://golang.org", "title": "first"}]}`,
+		`{"result": [{"uid": "0x9", "url": "https://golang.org", "title": "first"}, {"uid": "0x1a", "url": "https://golang.org", "title": "second"}]}`,
+	} {
+		p, err := page.DeserializeJsonPage([]byte(pb))
+		assert.Equal(s.T(), nil, err, pb)
+		if assert.Equal(s.T(), true, p != nil, pb) {
+			assert.Equal(s.T(), "0x9", p.Uid, "the lowest uid should be chosen whatever the order")
+			assert.Equal(s.T(), "first", p.Title)
+		}
+	}
+	assert.Equal(s.T(), true, page.UidLess("0x9", "0x1a"))
+	assert.Equal(s.T(), false, page.UidLess("0x1a", "0x9"))
+	assert.Equal(s.T(), true, page.UidLess("0x1", "_:cp"))
+}
+
+func (s *StoreSuite) TestDeserializeJsonPageNoResult() {
+	for _, pb := range []string{`{"result": []}`, `{}`} {
+		p, err := page.DeserializeJsonPage([]byte(pb))
+		assert.Equal(s.T(), nil, err, pb)
+		assert.Equal(s.T(), true, p == nil, pb)
+	}
+	p, err := page.DeserializeJsonPage([]byte(`{"result": [{"uid": "0x1", "url": "https://golang.org"}]}`))
+	assert.Equal(s.T(), nil, err)
+	if assert.Equal(s.T(), true, p != nil) {
+		assert.Equal(s.T(), "https://golang.org", p.Url)
+	}
+}
+
+// BenchmarkFetchChildPages compares the memory used finding the links of a large page by parsing it into a document
+// with FetchChildPages, and by streaming it through a tokenizer with StreamChildPages
+func BenchmarkFetchChildPages(b *testing.B) {
+	var builder strings.Builder
+	builder.WriteString("<html><head><title>Packages</title></head><body>")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&builder, `<div class="package"><h2 id="package-%d">package %d</h2><p>%s</p>`, i, i, strings.Repeat("text ", 20))
+		if i%100 == 0 {
+			fmt.Fprintf(&builder, `<a href="/pkg/%d/">package %d</a>`, i, i)
+		}
+		builder.WriteString("</div>")
+	}
+	builder.WriteString("</body></html>")
+	body := builder.String()
+	for name, fetch := range map[string]func(p *page.Page, resp *http.Response) ([]*page.Page, error){
+		"Parse": func(p *page.Page, resp *http.Response) ([]*page.Page, error) {
+			return p.FetchChildPages(resp, 0, nil, nil)
+		},
+		"Stream": func(p *page.Page, resp *http.Response) ([]*page.Page, error) {
+			return p.StreamChildPages(resp, 0, 0, nil)
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				req, _ := http.NewRequest("GET", "https://golang.org", nil)
+				p := page.Page{Url: "https://golang.org"}
+				if _, err := fetch(&p, &http.Response{Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package page
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+type (
+	// Serializer turns values into bytes and back in one format, so what is written internally, such as the records of a
+	// result sink, isn't tied to JSON. JsonSerializer is used when no format is chosen. What is sent to and read from
+	// Dgraph is always JSON, with SerializeJsonPage and DeserializeJsonPage.
+	Serializer interface {
+		// Name returns the name the format is chosen by
+		Name() string
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	// JsonSerializer is the default Serializer, writing values as JSON
+	JsonSerializer struct{}
+
+	// GobSerializer writes values with encoding/gob, which is more compact and quicker to read than JSON, though only
+	// Go can read it. Each value is written by its own encoder, so it can be read without the values before it, but
+	// the encoder has already sent the value's type, so the type isn't written with every value. Values can only be
+	// read into the type they were written from.
+	GobSerializer struct{}
+)
+
+const (
+	// SerializerJson chooses JsonSerializer
+	SerializerJson = "json"
+	// SerializerGob chooses GobSerializer
+	SerializerGob = "gob"
+)
+
+// ErrNilPage is returned by SerializePage when there is no page to serialize
+var ErrNilPage = errors.New("page is nil")
+
+// NewSerializer function returns the Serializer with the given name, or JsonSerializer if name is empty
+func NewSerializer(name string) (Serializer, error) {
+	switch name {
+	case "", SerializerJson:
+		return JsonSerializer{}, nil
+	case SerializerGob:
+		return GobSerializer{}, nil
+	}
+	return nil, fmt.Errorf("unknown serializer %q, expected json or gob", name)
+}
+
+// SerializePage function writes a page and the pages linked beneath it with serializer, keeping the same fields as
+// ConvertPageToJsonTree
+func SerializePage(serializer Serializer, currentPage *Page) ([]byte, error) {
+	if currentPage == nil {
+		return nil, ErrNilPage
+	}
+	return serializer.Marshal(ConvertPageToJsonTree(currentPage))
+}
+
+// DeserializePage function reads a page written by SerializePage with the same serializer, setting the Parent of each
+// page linked beneath it
+func DeserializePage(serializer Serializer, data []byte) (*Page, error) {
+	var jsonPage JsonPage
+	if err := serializer.Unmarshal(data, &jsonPage); err != nil {
+		return nil, err
+	}
+	currentPage := convertJsonPageToPage(nil, &jsonPage)
+	currentPage.ChildCount = jsonPage.ChildCount
+	return currentPage, nil
+}
+
+// Name function returns SerializerJson
+func (serializer JsonSerializer) Name() string {
+	return SerializerJson
+}
+
+// Marshal function writes v as JSON
+func (serializer JsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal function reads JSON into v
+func (serializer JsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Name function returns SerializerGob
+func (serializer GobSerializer) Name() string {
+	return SerializerGob
+}
+
+// Marshal function writes v with a new gob encoder which has already sent v's type
+func (serializer GobSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := primeGob(encoder, v); err != nil {
+		return nil, err
+	}
+	buffer.Reset()
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Unmarshal function reads a value written by Marshal into v, which must point to the type it was written from
+func (serializer GobSerializer) Unmarshal(data []byte, v interface{}) error {
+	var prefix bytes.Buffer
+	if err := primeGob(gob.NewEncoder(&prefix), v); err != nil {
+		return err
+	}
+	decoder := gob.NewDecoder(io.MultiReader(&prefix, bytes.NewReader(data)))
+	if err := decoder.Decode(reflect.New(gobType(v)).Interface()); err != nil {
+		return err
+	}
+	return decoder.Decode(v)
+}
+
+// primeGob function sends the type of the value v holds or points to through encoder, with the zero value of the type
+func primeGob(encoder *gob.Encoder, v interface{}) error {
+	if v == nil {
+		return errors.New("gob: cannot encode nil value")
+	}
+	return encoder.Encode(reflect.New(gobType(v)).Interface())
+}
+
+// gobType function returns the type v holds, or the type it points to
+func gobType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,172 @@
+package page
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log/level"
+	"github.com/stevenayers/clamber/pkg/logging"
+	"golang.org/x/net/html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// streamedHtml holds what streamHtml finds in a page's HTML
+type streamedHtml struct {
+	title    string
+	noIndex  bool
+	noFollow bool
+	err      error
+}
+
+// StreamChildPages function is FetchChildPagesWithin for pages too large to hold in memory. Rather than being read
+// whole and parsed into a document, the body is read through an HTML tokenizer as it arrives, finding the <a> links
+// AnchorLinkExtractor finds, the page's title and its robots meta tags, and reading stops once a link is found past
+// maxLinks. The page's alternates, preconnects and pagination aren't found, other link extractors, soft 404 patterns
+// and ParseStrict aren't supported, and no parse time limit applies beyond maxReadTime, which bounds the whole read
+// like the request's context does. Bodies which IsText doesn't recognise as text return ErrNotHtml.
+func (page *Page) StreamChildPages(resp *http.Response, maxReadTime time.Duration, maxLinks int, scope *LinkScope) (childPages []*Page, err error) {
+	if resp == nil {
+		err = errors.New("Response is nil")
+		_ = level.Error(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	page.ParseRobotsHeader(resp.Header)
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+	}
+	base, err := url.Parse(page.Url)
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", err.Error())
+		return
+	}
+	children := newChildLinks(page, scope, maxLinks)
+	streamedChan := make(chan streamedHtml, 1)
+	go func() {
+		streamedChan <- streamHtml(resp.Body, base, children.add)
+	}()
+	var timeout <-chan time.Time
+	if maxReadTime > 0 {
+		timer := time.NewTimer(maxReadTime)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var streamed streamedHtml
+	select {
+	case streamed = <-streamedChan:
+		err = streamed.err
+	case <-timeout:
+		err = ErrReadTimeout
+	case <-ctx.Done():
+		if err = ctx.Err(); err == context.DeadlineExceeded {
+			err = ErrReadTimeout
+		}
+	}
+	if err == ErrNotHtml {
+		_ = level.Warn(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", err.Error())
+		return
+	}
+	if err != nil {
+		_ = level.Error(logging.Logger).Log("context", "failed to parse HTML", "url", page.Url, "msg", err.Error())
+		return
+	}
+	page.Title = streamed.title
+	page.NoIndex = page.NoIndex || streamed.noIndex
+	page.NoFollow = page.NoFollow || streamed.noFollow
+	page.Truncated = page.Truncated || children.truncated
+	childPages = children.pages
+	return
+}
+
+// StreamLinks function reads HTML from r with a tokenizer, returning the absolute URL of each relative <a> href which
+// points to an HTML page, resolved against base, as AnchorLinkExtractor finds them in the parsed document
+func StreamLinks(r io.Reader, base *url.URL) (links []string, err error) {
+	streamed := streamHtml(r, base, func(link string) bool {
+		links = append(links, link)
+		return true
+	})
+	return links, streamed.err
+}
+
+// streamHtml function reads HTML from r with a tokenizer, calling visit with each link AnchorLinkExtractor would find,
+// and returning the first title and whether a robots meta tag says noindex or nofollow. Reading stops when visit
+// returns false, or with ErrNotHtml if the first 512 bytes aren't text.
+func streamHtml(r io.Reader, base *url.URL, visit func(link string) bool) (streamed streamedHtml) {
+	reader := bufio.NewReader(r)
+	sniffed, err := reader.Peek(512)
+	if err != nil && err != io.EOF {
+		streamed.err = err
+		return
+	}
+	if !IsText(sniffed) {
+		streamed.err = ErrNotHtml
+		return
+	}
+	basePage := Page{Url: base.String()}
+	tokenizer := html.NewTokenizer(reader)
+	var title strings.Builder
+	defer func() {
+		streamed.title = strings.Join(strings.Fields(title.String()), " ")
+	}()
+	inTitle, titleFound := false, false
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				streamed.err = err
+			}
+			return
+		case html.TextToken:
+			if inTitle {
+				title.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); inTitle && string(name) == "title" {
+				inTitle, titleFound = false, true
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = !titleFound && tokenType == html.StartTagToken
+			case "a":
+				href, hasHref := tagAttrs(tokenizer, hasAttr)["href"]
+				link, skipReason := basePage.anchorLink(href, hasHref)
+				if skipReason != "" {
+					logSkippedLink(basePage.Url, href, skipReason)
+				} else if !visit(link) {
+					return
+				}
+			case "meta":
+				attrs := tagAttrs(tokenizer, hasAttr)
+				metaName, hasName := attrs["name"]
+				content, hasContent := attrs["content"]
+				if hasName && hasContent && strings.EqualFold(strings.TrimSpace(metaName), "robots") {
+					noIndex, noFollow := robotsDirectives(content)
+					streamed.noIndex = streamed.noIndex || noIndex
+					streamed.noFollow = streamed.noFollow || noFollow
+				}
+			}
+		}
+	}
+}
+
+// tagAttrs function reads the attributes of the tag the tokenizer is on, keeping the first value of any repeated one
+// as the parsed document does
+func tagAttrs(tokenizer *html.Tokenizer, hasAttr bool) map[string]string {
+	attrs := make(map[string]string)
+	for hasAttr {
+		var key, value []byte
+		key, value, hasAttr = tokenizer.TagAttr()
+		if _, isPresent := attrs[string(key)]; !isPresent {
+			attrs[string(key)] = string(value)
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,118 @@
+package page
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+)
+
+const (
+	// ParseLenient parses HTML the way browsers do, silently repairing malformed markup. It is used when no parse mode
+	// is configured.
+	ParseLenient = "lenient"
+	// ParseStrict parses HTML like ParseLenient, and records the structural problems the markup was repaired from in the
+	// page's ParseWarnings
+	ParseStrict = "strict"
+)
+
+// MaxParseWarnings is the number of parse warnings kept for a page, so badly broken markup can't grow them without bound
+const MaxParseWarnings = 50
+
+var (
+	// voidElements never have an end tag
+	voidElements = map[string]bool{
+		"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true,
+		"keygen": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+	}
+
+	// optionalEndTags are the elements whose end tag may be left out, as the next element or their parent's end tag
+	// closes them
+	optionalEndTags = map[string]bool{
+		"html": true, "head": true, "body": true, "p": true, "li": true, "dt": true, "dd": true, "option": true,
+		"optgroup": true, "colgroup": true, "caption": true, "thead": true, "tbody": true, "tfoot": true, "tr": true,
+		"td": true, "th": true, "rb": true, "rt": true, "rtc": true, "rp": true,
+	}
+)
+
+// htmlWarnings function tokenizes body and returns the structural problems in its markup which a lenient parse
+// repairs without saying so: end tags with no open element to close, elements closed by the end tag of an element
+// they are inside, elements never closed, self-closing syntax on HTML elements which aren't void, repeated attributes
+// and markup the tokenizer can't read. Elements whose end tag is optional aren't expected to be closed. Each warning
+// starts with the line it was found on, and only the first MaxParseWarnings are returned.
+func htmlWarnings(body []byte) (warnings []string) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	var open []string
+	line := 1
+	warn := func(format string, args ...interface{}) {
+		if len(warnings) < MaxParseWarnings {
+			warnings = append(warnings, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+		}
+	}
+	for {
+		tokenType := tokenizer.Next()
+		newlines := bytes.Count(tokenizer.Raw(), []byte("\n"))
+		switch tokenType {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				warn("unreadable markup: %v", err)
+			}
+			for i := len(open) - 1; i >= 0; i-- {
+				if !optionalEndTags[open[i]] {
+					warn("<%s> is never closed", open[i])
+				}
+			}
+			return
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			seen := make(map[string]bool)
+			for _, attr := range token.Attr {
+				if seen[attr.Key] {
+					warn("<%s> repeats the %s attribute", token.Data, attr.Key)
+				}
+				seen[attr.Key] = true
+			}
+			switch {
+			case voidElements[token.Data]:
+			case tokenType == html.StartTagToken:
+				open = append(open, token.Data)
+			case !inForeignContent(open):
+				warn("<%s/> is not a void element, so it is left open", token.Data)
+				open = append(open, token.Data)
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			closes := -1
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == string(name) {
+					closes = i
+					break
+				}
+			}
+			if closes < 0 {
+				if !voidElements[string(name)] || string(name) == "br" {
+					warn("</%s> has no open <%s> to close", name, name)
+				}
+				break
+			}
+			for i := len(open) - 1; i > closes; i-- {
+				if !optionalEndTags[open[i]] {
+					warn("</%s> closes <%s>, which is still open", name, open[i])
+				}
+			}
+			open = open[:closes]
+		}
+		line += newlines
+	}
+}
+
+// inForeignContent function checks whether any of the open elements is an <svg> or <math>, inside which self-closing
+// tags close the element
+func inForeignContent(open []string) bool {
+	for _, name := range open {
+		if name == "svg" || name == "math" {
+			return true
+		}
+	}
+	return false
+}
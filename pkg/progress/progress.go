@@ -0,0 +1,125 @@
+package progress
+
+import (
+	"github.com/stevenayers/clamber/pkg/page"
+	"sync"
+)
+
+type (
+	// Event holds a snapshot of how far an in-flight crawl has got
+	Event struct {
+		Id           string `json:"id"`
+		PagesFetched int    `json:"pages_fetched"`
+		QueueDepth   int64  `json:"queue_depth"`
+		Errors       int    `json:"errors"`
+		Done         bool   `json:"done"`
+	}
+
+	// Tracker holds the latest progress of each in-flight crawl and the subscribers waiting for updates
+	Tracker struct {
+		sync.Mutex
+		crawls map[string]*crawlProgress
+	}
+
+	crawlProgress struct {
+		latest      Event
+		subscribers map[chan Event]struct{}
+	}
+)
+
+// DefaultTracker is the tracker shared by the api handlers
+var DefaultTracker = NewTracker()
+
+// NewTracker function creates an empty Tracker
+func NewTracker() *Tracker {
+	return &Tracker{crawls: make(map[string]*crawlProgress)}
+}
+
+// NewEvent function counts the unique pages in a crawl result and how many of them failed to fetch
+func NewEvent(id string, result *page.Page) (event Event) {
+	event.Id = id
+	if result == nil {
+		return
+	}
+	for _, node := range result.AdjacencyList().Nodes {
+		event.PagesFetched++
+		if node.Failed() {
+			event.Errors++
+		}
+	}
+	return
+}
+
+// Start function begins tracking the crawl with the given id
+func (tracker *Tracker) Start(id string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	if _, isPresent := tracker.crawls[id]; isPresent {
+		return
+	}
+	tracker.crawls[id] = &crawlProgress{
+		latest:      Event{Id: id},
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Update function records the latest progress of a crawl and passes it on to subscribers if anything changed
+func (tracker *Tracker) Update(event Event) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	event.Done = false
+	crawl, isPresent := tracker.crawls[event.Id]
+	if !isPresent || crawl.latest == event {
+		return
+	}
+	crawl.latest = event
+	for subscriber := range crawl.subscribers {
+		send(subscriber, event)
+	}
+}
+
+// Finish function sends subscribers a final event for the crawl, then stops tracking it
+func (tracker *Tracker) Finish(id string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	crawl, isPresent := tracker.crawls[id]
+	if !isPresent {
+		return
+	}
+	delete(tracker.crawls, id)
+	crawl.latest.Done = true
+	for subscriber := range crawl.subscribers {
+		send(subscriber, crawl.latest)
+		close(subscriber)
+	}
+}
+
+// Subscribe function returns a channel receiving the latest progress of a crawl, starting with its current progress.
+// Slow subscribers only see the most recent event. The channel is closed after the final event. ok is false if the
+// crawl isn't being tracked.
+func (tracker *Tracker) Subscribe(id string) (events <-chan Event, unsubscribe func(), ok bool) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	crawl, isPresent := tracker.crawls[id]
+	if !isPresent {
+		return nil, func() {}, false
+	}
+	subscriber := make(chan Event, 1)
+	subscriber <- crawl.latest
+	crawl.subscribers[subscriber] = struct{}{}
+	unsubscribe = func() {
+		tracker.Lock()
+		defer tracker.Unlock()
+		delete(crawl.subscribers, subscriber)
+	}
+	return subscriber, unsubscribe, true
+}
+
+// send function replaces any event the subscriber hasn't read yet with the given one
+func send(subscriber chan Event, event Event) {
+	select {
+	case <-subscriber:
+	default:
+	}
+	subscriber <- event
+}
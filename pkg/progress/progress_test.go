@@ -0,0 +1,52 @@
+package progress_test
+
+import (
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stevenayers/clamber/pkg/progress"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"testing"
+)
+
+type StoreSuite struct {
+	suite.Suite
+}
+
+func TestSuite(t *testing.T) {
+	s := new(StoreSuite)
+	suite.Run(t, s)
+}
+
+func (s *StoreSuite) TestNewEvent() {
+	root := &page.Page{Url: "https://golang.org", StatusCode: http.StatusOK}
+	doc := &page.Page{Url: "https://golang.org/doc", StatusCode: http.StatusOK}
+	doc.Links = []*page.Page{{Url: "https://golang.org/missing", StatusCode: http.StatusNotFound}}
+	root.Links = []*page.Page{doc, {Url: "https://golang.org/missing", StatusCode: http.StatusNotFound}}
+	event := progress.NewEvent("crawl", root)
+	assert.Equal(s.T(), 3, event.PagesFetched, "pages in several branches should be counted once")
+	assert.Equal(s.T(), 1, event.Errors)
+}
+
+func (s *StoreSuite) TestTracker() {
+	tracker := progress.NewTracker()
+	_, _, ok := tracker.Subscribe("crawl")
+	assert.Equal(s.T(), false, ok)
+
+	tracker.Start("crawl")
+	events, unsubscribe, ok := tracker.Subscribe("crawl")
+	defer unsubscribe()
+	assert.Equal(s.T(), true, ok)
+	assert.Equal(s.T(), progress.Event{Id: "crawl"}, <-events)
+
+	tracker.Update(progress.Event{Id: "crawl", PagesFetched: 1})
+	tracker.Update(progress.Event{Id: "crawl", PagesFetched: 2})
+	assert.Equal(s.T(), 2, (<-events).PagesFetched, "unread events should be replaced by the latest")
+
+	tracker.Finish("crawl")
+	final := <-events
+	assert.Equal(s.T(), true, final.Done)
+	assert.Equal(s.T(), 2, final.PagesFetched)
+	_, open := <-events
+	assert.Equal(s.T(), false, open, "the channel should be closed after the final event")
+}
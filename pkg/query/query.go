@@ -3,12 +3,21 @@ package query
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-kit/kit/log/level"
+	"github.com/stevenayers/clamber/pkg/config"
+	"github.com/stevenayers/clamber/pkg/crawl"
 	"github.com/stevenayers/clamber/pkg/database/relationship"
 	"github.com/stevenayers/clamber/pkg/logging"
 	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stevenayers/clamber/pkg/route"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -17,27 +26,289 @@ import (
 type (
 	// Query contains queried URL, depth and the resulting page data
 	Query struct {
-		Url          string     `json:"url"`
-		Depth        int        `json:"depth"`
-		DisplayDepth int        `json:"display_depth"`
-		StatusCode   int        `json:"statusCode"`
-		Results      *page.Page `json:"results"`
+		Id           string              `json:"id,omitempty"`
+		Url          string              `json:"url"`
+		Seeds        []string            `json:"seeds,omitempty"`
+		Depth        int                 `json:"depth"`
+		DisplayDepth int                 `json:"display_depth"`
+		MaxDuration  int                 `json:"max_duration,omitempty"`
+		Format       string              `json:"format"`
+		Fields       string              `json:"fields,omitempty"`
+		Sink         string              `json:"sink,omitempty"`
+		CrawlId      string              `json:"crawlId,omitempty"`
+		Login        *page.Login         `json:"-"`
+		NoCache      bool                `json:"-"`
+		StatusCode   int                 `json:"statusCode"`
+		Results      *page.Page          `json:"results,omitempty"`
+		Graph        *page.AdjacencyList `json:"graph,omitempty"`
+		Urls         []string            `json:"urls,omitempty"`
+		Errors       []CrawlError        `json:"errors,omitempty"`
+		Stats        *crawl.Stats        `json:"stats,omitempty"`
 	}
+
+	// Body is the JSON body of a POST /search, holding the same fields as the query parameters. Url and Depth are
+	// required, and Seeds are crawled along with Url as if url were given more than once.
+	Body struct {
+		Url          *string           `json:"url"`
+		Seeds        []string          `json:"seeds"`
+		Depth        *int              `json:"depth"`
+		DisplayDepth *int              `json:"display_depth"`
+		MaxDuration  *int              `json:"max_duration"`
+		Format       string            `json:"format"`
+		Fields       string            `json:"fields"`
+		Sink         string            `json:"sink"`
+		CrawlId      string            `json:"crawlId"`
+		NoCache      bool              `json:"nocache"`
+		LoginUrl     string            `json:"login_url"`
+		LoginMethod  string            `json:"login_method"`
+		LoginFields  map[string]string `json:"login_fields"`
+	}
+
+	// ValidationError is returned by New for a JSON body which doesn't match Body, with an error for each field at
+	// fault
+	ValidationError struct {
+		Fields []route.FieldError
+	}
+
+	// CrawlError contains a URL which could not be crawled and why
+	CrawlError struct {
+		Url   string `json:"url"`
+		Error string `json:"error"`
+	}
+)
+
+const (
+	// FormatNested returns results as a tree of pages and their links
+	FormatNested = "nested"
+	// FormatAdjacency returns results as a flat list of unique pages and a list of links between them
+	FormatAdjacency = "adjacency"
+	// FieldsUrl returns only the unique URLs found by the crawl, in place of the results in any format
+	FieldsUrl = "url"
 )
 
+// sinkName matches the names a crawl can give its result sink, which are used as file names, and the ids it can be
+// attributed to in the graph with crawlId
+var sinkName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// sinkNameMessage describes the names sinkName matches
+const sinkNameMessage = "must be 1 to 64 letters, digits, '-' or '_'"
+
+// DefaultMaxReportedErrors is the number of crawl errors reported when the API config doesn't set one
+const DefaultMaxReportedErrors = 100
+
+// New function parses a Query from the request's query parameters, and from its body when it is a form POST. A POST
+// with an application/json body is decoded strictly into a Body instead, returning a ValidationError for unknown
+// fields, fields of the wrong type and missing or invalid values. Depth and max_duration override the crawl defaults
+// for this request only, and are clamped to the api's max_depth and max_crawl_duration when those are set.
 func New(r *http.Request) (query Query, err error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method == http.MethodPost && mediaType == "application/json" {
+		var params url.Values
+		params, err = DecodeBody(r.Body)
+		if err != nil {
+			return
+		}
+		return Parse(params)
+	}
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+	return Parse(r.Form)
+}
+
+// DecodeBody function decodes a JSON Body, rejecting unknown fields, and validates it, returning its fields as the
+// query parameters Parse reads. A body which doesn't match Body returns a ValidationError; one which isn't JSON at all
+// returns a plain error.
+func DecodeBody(r io.Reader) (params url.Values, err error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var body Body
+	if err = decoder.Decode(&body); err != nil {
+		return nil, decodeError(err)
+	}
+	if fields := body.Validate(); len(fields) > 0 {
+		return nil, &ValidationError{Fields: fields}
+	}
+	return body.Params(), nil
+}
+
+// decodeError function returns a ValidationError naming the field when the body failed to decode because of an
+// unknown field or a field of the wrong type
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &ValidationError{Fields: []route.FieldError{
+			{Field: typeErr.Field, Message: fmt.Sprintf("must be %s, got %s", jsonType(typeErr.Type), typeErr.Value)},
+		}}
+	}
+	if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+		if unquoted, unquoteErr := strconv.Unquote(field); unquoteErr == nil {
+			field = unquoted
+		}
+		return &ValidationError{Fields: []route.FieldError{{Field: field, Message: "is not a known field"}}}
+	}
+	return fmt.Errorf("body must be a JSON object: %v", err)
+}
+
+// jsonType function describes the JSON value a Go type is decoded from
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return t.String()
+}
+
+// Validate function returns an error for each field of the body which is missing or has an invalid value
+func (body *Body) Validate() (fields []route.FieldError) {
+	invalid := func(field string, message string) {
+		fields = append(fields, route.FieldError{Field: field, Message: message})
+	}
+	if body.Url == nil {
+		invalid("url", "is required")
+	} else if !isHttpUrl(*body.Url) {
+		invalid("url", "must be an absolute http or https URL")
+	}
+	for i, seed := range body.Seeds {
+		if !isHttpUrl(seed) {
+			invalid(fmt.Sprintf("seeds[%d]", i), "must be an absolute http or https URL")
+		}
+	}
+	if body.Depth == nil {
+		invalid("depth", "is required")
+	} else if *body.Depth < -1 {
+		invalid("depth", "must be -1 (infinite) or more")
+	}
+	if body.DisplayDepth != nil && *body.DisplayDepth < 0 {
+		invalid("display_depth", "must not be negative")
+	}
+	if body.MaxDuration != nil && *body.MaxDuration < 0 {
+		invalid("max_duration", "must not be negative")
+	}
+	switch body.Format {
+	case "", FormatNested, FormatAdjacency:
+	default:
+		invalid("format", fmt.Sprintf("must be %s or %s", FormatNested, FormatAdjacency))
+	}
+	if body.Fields != "" && body.Fields != FieldsUrl {
+		invalid("fields", fmt.Sprintf("must be %s", FieldsUrl))
+	}
+	if body.Sink != "" && !sinkName.MatchString(body.Sink) {
+		invalid("sink", sinkNameMessage)
+	}
+	if body.CrawlId != "" && !sinkName.MatchString(body.CrawlId) {
+		invalid("crawlId", sinkNameMessage)
+	}
+	if body.LoginUrl != "" && !isHttpUrl(body.LoginUrl) {
+		invalid("login_url", "must be an http or https URL")
+	}
+	switch strings.ToUpper(body.LoginMethod) {
+	case "", http.MethodPost, http.MethodGet:
+	default:
+		invalid("login_method", fmt.Sprintf("must be %s or %s", http.MethodPost, http.MethodGet))
+	}
+	return
+}
+
+// Params function returns the body's fields as the query parameters Parse reads
+func (body *Body) Params() url.Values {
+	params := url.Values{}
+	if body.Url != nil {
+		params.Add("url", *body.Url)
+	}
+	for _, seed := range body.Seeds {
+		params.Add("url", seed)
+	}
+	if body.Depth != nil {
+		params.Set("depth", strconv.Itoa(*body.Depth))
+	}
+	if body.DisplayDepth != nil {
+		params.Set("display_depth", strconv.Itoa(*body.DisplayDepth))
+	}
+	if body.MaxDuration != nil {
+		params.Set("max_duration", strconv.Itoa(*body.MaxDuration))
+	}
+	params.Set("format", body.Format)
+	params.Set("fields", body.Fields)
+	params.Set("sink", body.Sink)
+	params.Set("crawlId", body.CrawlId)
+	if body.NoCache {
+		params.Set("nocache", "true")
+	}
+	if body.LoginUrl != "" {
+		params.Set("login_url", body.LoginUrl)
+		params.Set("login_method", body.LoginMethod)
+		loginFields := url.Values{}
+		for name, value := range body.LoginFields {
+			loginFields.Set(name, value)
+		}
+		params.Set("login_fields", loginFields.Encode())
+	}
+	return params
+}
+
+// isHttpUrl function checks whether Url is an absolute http or https URL
+func isHttpUrl(Url string) bool {
+	parsedUrl, err := url.Parse(Url)
+	return err == nil && (parsedUrl.Scheme == "http" || parsedUrl.Scheme == "https") && parsedUrl.Host != ""
+}
+
+// Error function lists each field at fault and what is wrong with it
+func (e *ValidationError) Error() string {
+	var messages []string
+	for _, field := range e.Fields {
+		messages = append(messages, field.Field+" "+field.Message)
+	}
+	return "invalid request body: " + strings.Join(messages, ", ")
+}
+
+// Parse function parses a Query from parameters named the same as the query parameters New reads. When url is given
+// more than once, every value is kept in Seeds and Url holds the first.
+func Parse(params url.Values) (query Query, err error) {
 	var start *url.URL
 	var depth int
 	var displayDepth int
-	start, err = url.Parse(r.URL.Query().Get("url"))
+	start, err = url.Parse(params.Get("url"))
 	if err != nil {
 		return
 	}
-	depth, err = strconv.Atoi(r.URL.Query().Get("depth"))
+	if err = page.NormalizeUrl(start); err != nil {
+		return
+	}
+	depth, err = strconv.Atoi(params.Get("depth"))
 	if err != nil {
 		return
 	}
-	if dDepth := r.URL.Query().Get("display_depth"); dDepth != "" {
+	if depth < -1 {
+		err = errors.New("depth must be -1 (infinite) or more")
+		return
+	}
+	if maxDepth := config.Get().Api.MaxDepth; maxDepth > 0 && (depth == -1 || depth > maxDepth) {
+		depth = maxDepth
+	}
+	var maxDuration int
+	if duration := params.Get("max_duration"); duration != "" {
+		maxDuration, err = strconv.Atoi(duration)
+		if err != nil {
+			return
+		}
+		if maxDuration < 0 {
+			err = errors.New("max_duration must not be negative")
+			return
+		}
+		if limit := config.Get().Api.MaxCrawlDuration; limit > 0 && maxDuration > limit {
+			maxDuration = limit
+		}
+	}
+	if dDepth := params.Get("display_depth"); dDepth != "" {
 		displayDepth, err = strconv.Atoi(dDepth)
 		if err != nil {
 			return
@@ -50,35 +321,178 @@ func New(r *http.Request) (query Query, err error) {
 	if depth != -1 && displayDepth > depth {
 		displayDepth = depth
 	}
-	query = Query{Url: start.String(), Depth: depth, DisplayDepth: displayDepth}
+	format := params.Get("format")
+	switch format {
+	case "":
+		format = FormatNested
+	case FormatNested, FormatAdjacency:
+	default:
+		err = fmt.Errorf("format must be %s or %s", FormatNested, FormatAdjacency)
+		return
+	}
+	fields := params.Get("fields")
+	if fields != "" && fields != FieldsUrl {
+		err = fmt.Errorf("fields must be %s", FieldsUrl)
+		return
+	}
+	sink := params.Get("sink")
+	if sink != "" && !sinkName.MatchString(sink) {
+		err = errors.New("sink " + sinkNameMessage)
+		return
+	}
+	crawlId := params.Get("crawlId")
+	if crawlId != "" && !sinkName.MatchString(crawlId) {
+		err = errors.New("crawlId " + sinkNameMessage)
+		return
+	}
+	var noCache bool
+	if nocache := params.Get("nocache"); nocache != "" {
+		noCache, err = strconv.ParseBool(nocache)
+		if err != nil {
+			return
+		}
+	}
+	var login *page.Login
+	login, err = parseLogin(params)
+	if err != nil {
+		return
+	}
+	query = Query{
+		Url:          start.String(),
+		Depth:        depth,
+		DisplayDepth: displayDepth,
+		MaxDuration:  maxDuration,
+		Format:       format,
+		Fields:       fields,
+		Sink:         sink,
+		CrawlId:      crawlId,
+		Login:        login,
+		NoCache:      noCache,
+	}
+	if len(params["url"]) > 1 {
+		query.Seeds = params["url"]
+	}
+	return
+}
+
+// parseLogin function parses the login request a crawl sends before fetching its pages, if login_url is set.
+// login_fields holds the form fields url encoded, and login_method defaults to POST.
+func parseLogin(params url.Values) (login *page.Login, err error) {
+	loginUrl := params.Get("login_url")
+	if loginUrl == "" {
+		return
+	}
+	parsedUrl, err := url.Parse(loginUrl)
+	if err != nil {
+		return
+	}
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return nil, errors.New("login_url must be an http or https URL")
+	}
+	method := strings.ToUpper(params.Get("login_method"))
+	switch method {
+	case "":
+		method = http.MethodPost
+	case http.MethodPost, http.MethodGet:
+	default:
+		return nil, fmt.Errorf("login_method must be %s or %s", http.MethodPost, http.MethodGet)
+	}
+	fields, err := url.ParseQuery(params.Get("login_fields"))
+	if err != nil {
+		return nil, fmt.Errorf("login_fields must be url encoded: %v", err)
+	}
+	login = &page.Login{Url: loginUrl, Method: method, Fields: make(map[string]string)}
+	for name := range fields {
+		login.Fields[name] = fields.Get(name)
+	}
 	return
 }
 
-func (query *Query) PollForFinishedCrawl(store relationship.Store) (result *page.Page, err error) {
-	ctx := context.Background()
+// CollectErrors function fills Errors with the pages in the results which failed to fetch, up to limit
+func (query *Query) CollectErrors(limit int) {
+	if query.Results == nil {
+		return
+	}
+	if limit <= 0 {
+		limit = DefaultMaxReportedErrors
+	}
+	for _, failedPage := range query.Results.FailedPages(limit) {
+		crawlError := CrawlError{Url: failedPage.Url, Error: failedPage.Error}
+		if crawlError.Error == "" {
+			crawlError.Error = fmt.Sprintf("received HTTP status %d %s", failedPage.StatusCode, http.StatusText(failedPage.StatusCode))
+		}
+		query.Errors = append(query.Errors, crawlError)
+	}
+}
+
+// FormatResults function converts the nested results into the requested format, or into just their URLs if the
+// query asks for the url field only
+func (query *Query) FormatResults() {
+	if query.Results == nil {
+		return
+	}
+	switch {
+	case query.Fields == FieldsUrl:
+		query.Urls = query.Results.Urls()
+	case query.Format == FormatAdjacency:
+		query.Graph = query.Results.AdjacencyList()
+	default:
+		return
+	}
+	query.Results = nil
+}
+
+// Deadline function returns the crawl deadline requested by max_duration, or 0 to use the service's default
+func (query *Query) Deadline() int64 {
+	if query.MaxDuration == 0 {
+		return 0
+	}
+	return time.Now().Add(time.Duration(query.MaxDuration) * time.Second).UnixNano()
+}
+
+// PollForFinishedCrawl function polls the database until the crawl's results stop changing or ctx is done. With a
+// CrawlId, only the pages of that crawl are found. report, if not nil, is called with the results found on each poll.
+func (query *Query) PollForFinishedCrawl(ctx context.Context, store relationship.Graph, report func(result *page.Page)) (result *page.Page, err error) {
 	var prevResult *page.Page
 	for {
 		var r []byte
 		var pr []byte
 		_ = level.Info(logging.Logger).Log("msg", "Polling for crawl...")
-		result, err = store.FindNode(&ctx, query.Url, query.Depth)
+		result, err = store.FindNode(&ctx, query.Url, query.Depth, query.CrawlId)
+		if report != nil && result != nil {
+			report(result)
+		}
 		if err == nil {
 			r, err = json.Marshal(result)
 			pr, err = json.Marshal(prevResult)
 		}
 		switch {
-		case err != nil && !strings.Contains(err.Error(), "Depth does not match dgraph result."):
+		case err != nil && !errors.Is(err, relationship.ErrDepthMismatch):
 			return
 		case prevResult == nil || result == nil:
 			prevResult = result
-			time.Sleep(time.Millisecond * 100)
+			if err = pollWait(ctx); err != nil {
+				return nil, err
+			}
 			continue
 		case prevResult != nil && len(pr) != len(r):
 			prevResult = result
-			time.Sleep(time.Millisecond * 100)
+			if err = pollWait(ctx); err != nil {
+				return nil, err
+			}
 			continue
 		default:
 			return
 		}
 	}
 }
+
+// pollWait function waits between polls, returning early with the context's error if it is done
+func pollWait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Millisecond * 100):
+		return nil
+	}
+}
@@ -0,0 +1,220 @@
+package query_test
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/stevenayers/clamber/pkg/config"
+	"github.com/stevenayers/clamber/pkg/logging"
+	"github.com/stevenayers/clamber/pkg/page"
+	"github.com/stevenayers/clamber/pkg/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type (
+	OverrideTest struct {
+		Depth               string
+		MaxDuration         string
+		ExpectedDepth       int
+		ExpectedMaxDuration int
+		Error               bool
+	}
+
+	StoreSuite struct {
+		suite.Suite
+	}
+)
+
+var OverrideTests = []OverrideTest{
+	{"3", "", 3, 0, false},
+	{"5", "", 4, 0, false},
+	{"-1", "", 4, 0, false},
+	{"2", "30", 2, 30, false},
+	{"2", "600", 2, 60, false},
+	{"-5", "", 0, 0, true},
+	{"2", "-1", 0, 0, true},
+	{"2", "soon", 0, 0, true},
+}
+
+func (s *StoreSuite) SetupSuite() {
+	configFile := "/Users/steven/git/clamber/configs/config.toml"
+	err := config.InitConfig(configFile)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	logging.InitJsonLogger(log.NewSyncWriter(os.Stdout), config.AppConfig.Api.LogLevel, "test")
+}
+
+func (s *StoreSuite) SetupTest() {
+	configFile := "/Users/steven/git/clamber/configs/config.toml"
+	err := config.InitConfig(configFile)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+}
+
+func TestSuite(t *testing.T) {
+	s := new(StoreSuite)
+	suite.Run(t, s)
+}
+
+func (s *StoreSuite) TestNewOverrides() {
+	config.AppConfig.Api.MaxDepth = 4
+	config.AppConfig.Api.MaxCrawlDuration = 60
+	for _, test := range OverrideTests {
+		req, _ := http.NewRequest("GET", "/search", nil)
+		q := req.URL.Query()
+		q.Add("url", "https://golang.org")
+		q.Add("depth", test.Depth)
+		if test.MaxDuration != "" {
+			q.Add("max_duration", test.MaxDuration)
+		}
+		req.URL.RawQuery = q.Encode()
+		result, err := query.New(req)
+		assert.Equal(s.T(), test.Error, err != nil, test)
+		if err != nil {
+			continue
+		}
+		assert.Equal(s.T(), test.ExpectedDepth, result.Depth, test)
+		assert.Equal(s.T(), test.ExpectedMaxDuration, result.MaxDuration, test)
+	}
+}
+
+func (s *StoreSuite) TestDeadline() {
+	q := query.Query{}
+	assert.Equal(s.T(), int64(0), q.Deadline(), "no override should leave the service default")
+	q.MaxDuration = 30
+	deadline := time.Unix(0, q.Deadline())
+	assert.Equal(s.T(), true, deadline.After(time.Now().Add(29*time.Second)))
+	assert.Equal(s.T(), true, deadline.Before(time.Now().Add(31*time.Second)))
+}
+
+func (s *StoreSuite) TestNewFormat() {
+	for format, expected := range map[string]string{"": query.FormatNested, "nested": query.FormatNested, "adjacency": query.FormatAdjacency} {
+		req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=1&format="+format, nil)
+		result, err := query.New(req)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), expected, result.Format)
+	}
+	req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=1&format=flat", nil)
+	_, err := query.New(req)
+	assert.Equal(s.T(), true, err != nil)
+}
+
+func (s *StoreSuite) TestNewFields() {
+	req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=1&fields=url", nil)
+	result, err := query.New(req)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), query.FieldsUrl, result.Fields)
+	req, _ = http.NewRequest("GET", "/search?url=https://golang.org&depth=1&fields=title", nil)
+	_, err = query.New(req)
+	assert.Equal(s.T(), true, err != nil)
+}
+
+func (s *StoreSuite) TestNewSink() {
+	req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=1&sink=golang-2019_11", nil)
+	result, err := query.New(req)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "golang-2019_11", result.Sink)
+	for _, sink := range []string{"../etc/passwd", ".hidden", strings.Repeat("a", 65)} {
+		req, _ = http.NewRequest("GET", "/search?url=https://golang.org&depth=1&sink="+url.QueryEscape(sink), nil)
+		_, err = query.New(req)
+		assert.Equal(s.T(), true, err != nil, sink)
+	}
+}
+
+func (s *StoreSuite) TestNewSeeds() {
+	req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=1", nil)
+	result, err := query.New(req)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), 0, len(result.Seeds), "a single url should not be a list of seeds")
+
+	body := url.Values{"url": {"https://golang.org", "https://go.dev"}, "depth": {"1"}}
+	req, _ = http.NewRequest("POST", "/search", strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	result, err = query.New(req)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), "https://golang.org", result.Url)
+	assert.Equal(s.T(), []string{"https://golang.org", "https://go.dev"}, result.Seeds)
+}
+
+func (s *StoreSuite) TestNewLogin() {
+	req, _ := http.NewRequest("GET", "/search?url=https://golang.org&depth=1", nil)
+	result, err := query.New(req)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), true, result.Login == nil)
+
+	params := url.Values{
+		"url":          {"https://golang.org"},
+		"depth":        {"1"},
+		"login_url":    {"https://golang.org/login"},
+		"login_fields": {"username=bob&password=secret"},
+	}
+	result, err = query.Parse(params)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), &page.Login{
+		Url:    "https://golang.org/login",
+		Method: http.MethodPost,
+		Fields: map[string]string{"username": "bob", "password": "secret"},
+	}, result.Login)
+
+	for name, value := range map[string]string{"login_method": "DELETE", "login_fields": "%zz", "login_url": "ftp://golang.org"} {
+		badParams := url.Values{"url": {"https://golang.org"}, "depth": {"1"}, "login_url": {"https://golang.org/login"}}
+		badParams.Set(name, value)
+		_, err = query.Parse(badParams)
+		assert.Equal(s.T(), true, err != nil, name)
+	}
+}
+
+func (s *StoreSuite) TestFormatResultsUrls() {
+	rootPage := &page.Page{Url: "https://golang.org", Timestamp: time.Now().Unix()}
+	doc := &page.Page{Url: "https://golang.org/doc", Parent: rootPage, Timestamp: time.Now().Unix()}
+	pkg := &page.Page{Url: "https://golang.org/pkg", Parent: rootPage, Timestamp: time.Now().Unix()}
+	doc.Links = []*page.Page{{Url: "https://golang.org/pkg", Parent: doc}}
+	rootPage.Links = []*page.Page{doc, pkg}
+	var fullUrls []string
+	for _, node := range rootPage.AdjacencyList().Nodes {
+		fullUrls = append(fullUrls, node.Url)
+	}
+
+	q := query.Query{Format: query.FormatAdjacency, Fields: query.FieldsUrl, Results: rootPage}
+	q.FormatResults()
+	assert.Equal(s.T(), true, q.Results == nil && q.Graph == nil, "only the URLs should be returned")
+	assert.Equal(s.T(), []string{"https://golang.org", "https://golang.org/doc", "https://golang.org/pkg"}, q.Urls)
+	assert.Subset(s.T(), fullUrls, q.Urls)
+	body, err := json.Marshal(q)
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	assert.Equal(s.T(), false, strings.Contains(string(body), "timestamp"))
+}
+
+func (s *StoreSuite) TestFormatResults() {
+	rootPage := &page.Page{Url: "https://golang.org"}
+	rootPage.Links = []*page.Page{{Url: "https://golang.org/doc", Parent: rootPage}}
+	q := query.Query{Format: query.FormatAdjacency, Results: rootPage}
+	q.FormatResults()
+	assert.Equal(s.T(), true, q.Results == nil)
+	assert.Equal(s.T(), 2, len(q.Graph.Nodes))
+	assert.Equal(s.T(), 1, len(q.Graph.Edges))
+}
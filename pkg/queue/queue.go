@@ -11,6 +11,7 @@ import (
 	"github.com/stevenayers/clamber/pkg/config"
 	"github.com/stevenayers/clamber/pkg/logging"
 	"github.com/stevenayers/clamber/pkg/page"
+	"strconv"
 	"time"
 )
 
@@ -114,3 +115,18 @@ func (q *Queue) Publish(p *page.Page) {
 	}
 	_ = level.Info(logging.Logger).Log("msg", "Successfully sent message", "messageId", *result.MessageId, "url", p.Url, "start_url", p.StartUrl)
 }
+
+// ApproximateDepth function returns roughly how many messages are waiting in the queue, across every crawl
+func (q *Queue) ApproximateDepth() (depth int64, err error) {
+	output, err := q.Svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+		QueueUrl:       &config.AppConfig.Queue.QueueURL,
+	})
+	if err != nil {
+		return
+	}
+	if value, isPresent := output.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]; isPresent && value != nil {
+		depth, err = strconv.ParseInt(*value, 10, 64)
+	}
+	return
+}
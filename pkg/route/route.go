@@ -1,20 +1,58 @@
 package route
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stevenayers/clamber/pkg/config"
 	"github.com/stevenayers/clamber/pkg/logging"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MediaJson is the media type responses are written in unless the client asks for another
+	MediaJson = "application/json"
+	// MediaXml is the media type of responses written as XML
+	MediaXml = "application/xml"
+	// MediaCsv is the media type of responses written as CSV
+	MediaCsv = "text/csv"
 )
 
 type (
-	// Route contains all route data
+	// Route contains all route data. Authenticated routes are only served to requests bearing the api's admin_token.
+	// AuthenticatedIfEnabled routes need it too once an admin_token is set, but are open to every request until then.
 	Route struct {
-		Name        string
-		Method      string
-		Pattern     string
-		HandlerFunc http.HandlerFunc
-		Params      []string
+		Name                   string
+		Method                 string
+		Pattern                string
+		HandlerFunc            http.HandlerFunc
+		Params                 []string
+		Authenticated          bool
+		AuthenticatedIfEnabled bool
+	}
+
+	// ErrorResponse is the JSON envelope written when a request fails
+	ErrorResponse struct {
+		Error ErrorDetail `json:"error"`
+	}
+
+	// ErrorDetail holds the status code and message of a failed request, and the fields at fault when it was rejected
+	// for an invalid body
+	ErrorDetail struct {
+		Code    int          `json:"code"`
+		Message string       `json:"message"`
+		Fields  []FieldError `json:"fields,omitempty"`
+	}
+
+	// FieldError names a field of a request body and what is wrong with it
+	FieldError struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
 	}
 )
 
@@ -22,7 +60,13 @@ type (
 func NewRouter(definedRoutes []Route) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range definedRoutes {
-		handler := logging.HttpResponseLogger(route.HandlerFunc)
+		var handler http.Handler = route.HandlerFunc
+		if route.Authenticated {
+			handler = RequireAdminToken(handler)
+		} else if route.AuthenticatedIfEnabled {
+			handler = RequireAdminTokenIfSet(handler)
+		}
+		handler = logging.HttpResponseLogger(handler)
 		router.
 			Methods(route.Method).
 			Path(route.Pattern).
@@ -33,3 +77,98 @@ func NewRouter(definedRoutes []Route) *mux.Router {
 
 	return router
 }
+
+// WriteError function writes the status code and a JSON error envelope to the response.
+func WriteError(w http.ResponseWriter, statusCode int, message string) {
+	WriteFieldErrors(w, statusCode, message, nil)
+}
+
+// WriteFieldErrors function writes the status code and a JSON error envelope listing the fields at fault to the
+// response.
+func WriteFieldErrors(w http.ResponseWriter, statusCode int, message string, fields []FieldError) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetail{Code: statusCode, Message: message, Fields: fields}})
+}
+
+// RequireAdminToken function wraps handler so it is only called for requests with an "Authorization: Bearer" header
+// holding the api's admin_token. Other requests get a 401, or a 403 while no admin_token is set, so admin routes are
+// disabled until one is configured. The token is read from the config on each request, so it can be changed on reload.
+func RequireAdminToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := config.Get().Api.AdminToken
+		if token == "" {
+			WriteError(w, http.StatusForbidden, "admin routes are disabled until api.admin_token is set")
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		bearer := strings.TrimPrefix(authorization, "Bearer ")
+		if bearer == authorization || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			WriteError(w, http.StatusUnauthorized, "a valid admin token is required")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdminTokenIfSet function wraps handler like RequireAdminToken while the api's admin_token is set, and calls it
+// for every request while it isn't
+func RequireAdminTokenIfSet(handler http.Handler) http.Handler {
+	required := RequireAdminToken(handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.Get().Api.AdminToken == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		required.ServeHTTP(w, r)
+	})
+}
+
+// NotModified function sets the Cache-Control, ETag and Last-Modified headers of a response whose body has the given
+// etag and was last modified at lastModified, and writes 304 Not Modified if the request's If-None-Match, or failing
+// that its If-Modified-Since, shows the client already has it. Responses may be cached for maxAge seconds, or must be
+// revalidated each time when maxAge is 0. A zero lastModified sets no Last-Modified. It returns whether 304 was
+// written, in which case the caller should write nothing more.
+func NotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time, maxAge int) bool {
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	notModified := false
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			notModified = notModified || tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/")
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.IsZero() {
+		notModified = !lastModified.Truncate(time.Second).After(since)
+	}
+	if notModified {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// Negotiate function returns the first media type in the request's Accept header which is one of offers, or the first
+// offer if none of them are accepted. Accepted types are taken in the order the client lists them, ignoring q values.
+func Negotiate(r *http.Request, offers ...string) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		for _, offer := range offers {
+			if mediaType == offer {
+				return offer
+			}
+		}
+	}
+	return offers[0]
+}
@@ -0,0 +1,282 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Spec decides when a Job is due
+	Spec interface {
+		// Next returns the first time the Job is due after after
+		Next(after time.Time) time.Time
+	}
+
+	// Job is a crawl of Url to Depth, launched each time its Spec is due
+	Job struct {
+		Url   string
+		Depth int
+		Cron  string
+		Spec  Spec
+	}
+
+	// Run records one time a Job was due. A run is Skipped if the Job's previous run was still running, and Error holds
+	// the reason a run failed.
+	Run struct {
+		Url      string    `json:"url"`
+		Cron     string    `json:"cron"`
+		Started  time.Time `json:"started"`
+		Finished time.Time `json:"finished,omitempty"`
+		Skipped  bool      `json:"skipped,omitempty"`
+		Error    string    `json:"error,omitempty"`
+	}
+
+	// Scheduler launches each of its Jobs with Launch when their Spec is due, recording each Run. A Job is never run
+	// twice at once: a Job due while its previous run hasn't returned from Launch is skipped. It is safe for concurrent
+	// use.
+	Scheduler struct {
+		sync.Mutex
+		Jobs   []Job
+		Launch func(ctx context.Context, job Job) error
+		Log    func(run Run)
+		runs   []Run
+	}
+
+	// every is the Spec of "@every <duration>"
+	every struct {
+		interval time.Duration
+	}
+
+	// cronSpec is the Spec of a five field cron expression. Each field is a bit set of the values it matches.
+	cronSpec struct {
+		minute uint64
+		hour   uint64
+		dom    uint64
+		month  uint64
+		dow    uint64
+		anyDom bool
+		anyDow bool
+	}
+
+	// field holds the range of values one field of a cron expression accepts
+	field struct {
+		name string
+		min  int
+		max  int
+	}
+)
+
+// MaxRuns is the number of the latest runs a Scheduler keeps
+const MaxRuns = 100
+
+var (
+	fields = []field{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day of month", 1, 31},
+		{"month", 1, 12},
+		{"day of week", 0, 7},
+	}
+
+	descriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// Parse function parses a cron expression: five fields for the minute, hour, day of month, month and day of week, each
+// a *, a number, a range like 1-5, or a list of them separated by commas, optionally with a step like */15. Sunday is
+// 0 or 7. The descriptors @yearly, @monthly, @weekly, @daily and @hourly are accepted too, as is "@every <duration>"
+// with a duration like 30m, which is due that long after each run was due.
+func Parse(expr string) (Spec, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid @every duration: %v", err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("@every duration must be positive, got %s", interval)
+		}
+		return every{interval: interval}, nil
+	}
+	if descriptor, isPresent := descriptors[expr]; isPresent {
+		expr = descriptor
+	}
+	values := strings.Fields(expr)
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("expected %d fields, got %d in %q", len(fields), len(values), expr)
+	}
+	sets := make([]uint64, len(fields))
+	for i, value := range values {
+		set, err := parseField(value, fields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	spec := cronSpec{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDom: strings.HasPrefix(values[2], "*"),
+		anyDow: strings.HasPrefix(values[4], "*"),
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	return spec, nil
+}
+
+// parseField function parses one comma separated field of a cron expression into the set of values it matches
+func parseField(value string, f field) (set uint64, err error) {
+	for _, part := range strings.Split(value, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+			}
+		}
+		start, end := f.min, f.max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			start, err = strconv.Atoi(bounds[0])
+			if err == nil {
+				end, err = strconv.Atoi(bounds[1])
+			}
+			if err != nil {
+				return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+			}
+		default:
+			start, err = strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %s field %q", f.name, part)
+			}
+			end = start
+			if step > 1 {
+				end = f.max
+			}
+		}
+		if start < f.min || end > f.max || start > end {
+			return 0, fmt.Errorf("%s field %q must be within %d-%d", f.name, part, f.min, f.max)
+		}
+		for v := start; v <= end; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return
+}
+
+// Next function returns after plus the interval
+func (spec every) Next(after time.Time) time.Time {
+	return after.Add(spec.interval)
+}
+
+// Next function returns the first minute after after which matches the expression, in after's location. As in cron,
+// when both the day of month and day of week are restricted, a day matching either is due. The zero time is returned
+// if no time in the next five years matches, such as for the 31st of February.
+func (spec cronSpec) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case spec.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !spec.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case spec.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case spec.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches function checks t's day of month and day of week against the expression
+func (spec cronSpec) dayMatches(t time.Time) bool {
+	dom := spec.dom&(1<<uint(t.Day())) != 0
+	dow := spec.dow&(1<<uint(t.Weekday())) != 0
+	if spec.anyDom || spec.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Start function runs each Job on its Spec until ctx is done
+func (scheduler *Scheduler) Start(ctx context.Context) {
+	for _, job := range scheduler.Jobs {
+		go scheduler.loop(ctx, job)
+	}
+}
+
+// Runs function returns the latest runs of every Job, oldest first, up to MaxRuns
+func (scheduler *Scheduler) Runs() []Run {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	return append([]Run(nil), scheduler.runs...)
+}
+
+// loop function launches job each time it is due until ctx is done, skipping the times its previous run is still
+// running. Times missed while the scheduler was held up, such as by the machine sleeping, are not made up.
+func (scheduler *Scheduler) loop(ctx context.Context, job Job) {
+	running := make(chan struct{}, 1)
+	due := job.Spec.Next(time.Now())
+	for !due.IsZero() {
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		select {
+		case running <- struct{}{}:
+			go func(started time.Time) {
+				defer func() { <-running }()
+				run := Run{Url: job.Url, Cron: job.Cron, Started: started}
+				if err := scheduler.Launch(ctx, job); err != nil {
+					run.Error = err.Error()
+				}
+				run.Finished = time.Now()
+				scheduler.record(run)
+			}(time.Now())
+		default:
+			scheduler.record(Run{Url: job.Url, Cron: job.Cron, Started: time.Now(), Skipped: true})
+		}
+		due = job.Spec.Next(due)
+		if now := time.Now(); due.Before(now) {
+			due = job.Spec.Next(now)
+		}
+	}
+}
+
+// record function keeps a run, dropping the oldest once there are more than MaxRuns, and passes it to Log
+func (scheduler *Scheduler) record(run Run) {
+	scheduler.Lock()
+	scheduler.runs = append(scheduler.runs, run)
+	if len(scheduler.runs) > MaxRuns {
+		scheduler.runs = scheduler.runs[len(scheduler.runs)-MaxRuns:]
+	}
+	scheduler.Unlock()
+	if scheduler.Log != nil {
+		scheduler.Log(run)
+	}
+}
@@ -0,0 +1,131 @@
+package schedule_test
+
+import (
+	"context"
+	"github.com/stevenayers/clamber/pkg/schedule"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type StoreSuite struct {
+	suite.Suite
+}
+
+func TestSuite(t *testing.T) {
+	s := new(StoreSuite)
+	suite.Run(t, s)
+}
+
+func (s *StoreSuite) TestParse() {
+	// a Sunday
+	after := time.Date(2019, time.December, 1, 10, 17, 0, 0, time.UTC)
+	for expr, expected := range map[string]time.Time{
+		"*/15 * * * *":    time.Date(2019, time.December, 1, 10, 30, 0, 0, time.UTC),
+		"0 3 * * *":       time.Date(2019, time.December, 2, 3, 0, 0, 0, time.UTC),
+		"@daily":          time.Date(2019, time.December, 2, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 1":       time.Date(2019, time.December, 2, 0, 0, 0, 0, time.UTC),
+		"30 9 * * 7":      time.Date(2019, time.December, 8, 9, 30, 0, 0, time.UTC),
+		"0 0 1,15 * 5":    time.Date(2019, time.December, 6, 0, 0, 0, 0, time.UTC),
+		"0 12 1 1-3 *":    time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC),
+		"5-10/5 10 * * *": time.Date(2019, time.December, 2, 10, 5, 0, 0, time.UTC),
+		"@every 90s":      time.Date(2019, time.December, 1, 10, 18, 30, 0, time.UTC),
+		"0 0 31 2 *":      {},
+	} {
+		spec, err := schedule.Parse(expr)
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		assert.Equal(s.T(), expected, spec.Next(after), expr)
+	}
+
+	for _, expr := range []string{"61 * * * *", "* * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *", "@every -1s", "@every often"} {
+		_, err := schedule.Parse(expr)
+		assert.Equal(s.T(), true, err != nil, expr)
+	}
+}
+
+func (s *StoreSuite) TestNextHalfHourOffset() {
+	kolkata := time.FixedZone("IST", 5*60*60+30*60)
+	spec, err := schedule.Parse("0 11 * * *")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	after := time.Date(2019, time.December, 1, 9, 17, 0, 0, kolkata)
+	assert.Equal(s.T(), time.Date(2019, time.December, 1, 11, 0, 0, 0, kolkata), spec.Next(after), "hours should step by wall clock")
+}
+
+func (s *StoreSuite) TestScheduler() {
+	spec, err := schedule.Parse("@every 20ms")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var launched int32
+	scheduler := &schedule.Scheduler{
+		Jobs: []schedule.Job{{Url: "https://golang.org", Depth: 1, Cron: "@every 20ms", Spec: spec}},
+		Launch: func(ctx context.Context, job schedule.Job) error {
+			atomic.AddInt32(&launched, 1)
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduler.Start(ctx)
+	time.Sleep(110 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.InDelta(s.T(), 5, atomic.LoadInt32(&launched), 1, "the job should run every 20ms")
+	runs := scheduler.Runs()
+	assert.Equal(s.T(), int(atomic.LoadInt32(&launched)), len(runs), "each run should be recorded")
+	for _, run := range runs {
+		assert.Equal(s.T(), "https://golang.org", run.Url)
+		assert.Equal(s.T(), false, run.Skipped)
+		assert.Equal(s.T(), false, run.Finished.Before(run.Started))
+	}
+}
+
+func (s *StoreSuite) TestSchedulerOverlap() {
+	spec, err := schedule.Parse("@every 20ms")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	var mutex sync.Mutex
+	running, maxRunning, launched := 0, 0, 0
+	scheduler := &schedule.Scheduler{
+		Jobs: []schedule.Job{{Url: "https://golang.org", Cron: "@every 20ms", Spec: spec}},
+		Launch: func(ctx context.Context, job schedule.Job) error {
+			mutex.Lock()
+			running++
+			launched++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduler.Start(ctx)
+	time.Sleep(110 * time.Millisecond)
+	cancel()
+	time.Sleep(60 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(s.T(), 1, maxRunning, "a job should not run while its previous run is still running")
+	skipped := 0
+	for _, run := range scheduler.Runs() {
+		if run.Skipped {
+			skipped++
+		}
+	}
+	assert.Equal(s.T(), true, skipped > 0, "runs due while the previous run is still running should be skipped")
+	assert.Equal(s.T(), true, launched < 4, "only runs which don't overlap should be launched")
+}